@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// advisoryRecognizers identify well-known vendor advisory IDs in reference
+// URLs and names.
+var advisoryRecognizers = []struct {
+	vendor  string
+	pattern *regexp.Regexp
+}{
+	{"redhat", regexp.MustCompile(`RH[SBE]A-\d{4}:\d+`)},
+	{"debian", regexp.MustCompile(`D[SL]A-\d+(-\d+)?`)},
+	{"ubuntu", regexp.MustCompile(`USN-\d+-\d+`)},
+	{"microsoft", regexp.MustCompile(`MS\d{2}-\d{3}`)},
+}
+
+// recognizeAdvisory returns the vendor and advisory ID of a vendor advisory
+// reference. Unrecognized formats get the URL's host as vendor and no ID.
+func recognizeAdvisory(ref Reference) (vendor, advisoryID string) {
+	for _, r := range advisoryRecognizers {
+		for _, s := range []string{ref.Name, ref.URL} {
+			if id := r.pattern.FindString(strings.ToUpper(s)); id != "" {
+				return r.vendor, id
+			}
+		}
+	}
+	if u, err := url.Parse(ref.URL); err == nil {
+		return strings.TrimPrefix(u.Hostname(), "www."), ""
+	}
+	return "", ""
+}
+
+// insertAdvisories replaces the advisories of a CVE with those built from its
+// references tagged "Vendor Advisory".
+func insertAdvisories(tx *sql.Tx, cveID string, refs []Reference) error {
+	if _, err := tx.Exec(`DELETE FROM advisories WHERE cve_id = $1`, cveID); err != nil {
+		return fmt.Errorf("failed to delete advisories for CVE ID %s: %v", cveID, err)
+	}
+
+	for _, ref := range refs {
+		if !slices.Contains(ref.Tags, "Vendor Advisory") {
+			continue
+		}
+		vendor, advisoryID := recognizeAdvisory(ref)
+		_, err := tx.Exec(`INSERT INTO advisories (cve_id, vendor, advisory_id, url)
+						   VALUES ($1, $2, $3, $4)
+						   ON CONFLICT (cve_id, url) DO NOTHING;`,
+			cveID, vendor, advisoryID, ref.URL)
+		if err != nil {
+			return fmt.Errorf("failed to insert advisory %s for CVE ID %s: %v", ref.URL, cveID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v3"
+)
+
+// advisoryFile is the schema of a hand-written advisory file, in YAML or
+// JSON:
+//
+//	id: ACME-2025-0042            # defaults to the file name without extension
+//	title: Portal session fixation
+//	description: Session IDs are not rotated on login.
+//	severity: HIGH                # LOW, MEDIUM, HIGH or CRITICAL
+//	base_score: 8.1               # optional
+//	published: 2025-03-01         # optional, a date or an RFC 3339 time
+//	products:
+//	  - cpe: cpe:2.3:a:acme:portal:*:*:*:*:*:*:*:*
+//	    version_start: "4.0"      # optional, inclusive
+//	    version_end: "4.2.3"      # optional, exclusive
+type advisoryFile struct {
+	ID          string   `yaml:"id"`
+	Title       string   `yaml:"title"`
+	Description string   `yaml:"description"`
+	Severity    string   `yaml:"severity"`
+	BaseScore   *float64 `yaml:"base_score"`
+	Published   string   `yaml:"published"`
+	Products    []struct {
+		CPE          string `yaml:"cpe"`
+		VersionStart string `yaml:"version_start"`
+		VersionEnd   string `yaml:"version_end"`
+	} `yaml:"products"`
+}
+
+var advisoryFileExts = []string{".yaml", ".yml", ".json"}
+
+// readAdvisoryFile parses an advisory file. Unknown fields are an error, so
+// a misspelled field does not silently go missing.
+func readAdvisoryFile(path string) (InternalAdvisory, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return InternalAdvisory{}, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var f advisoryFile
+	if err := dec.Decode(&f); err != nil && err != io.EOF {
+		return InternalAdvisory{}, err
+	}
+
+	a := InternalAdvisory{ID: f.ID, Title: f.Title, Description: f.Description, Severity: f.Severity, BaseScore: f.BaseScore, Source: internalSourceFiles}
+	if a.ID == "" {
+		a.ID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if f.Published != "" {
+		if a.PublishedAt, err = time.Parse(time.DateOnly, f.Published); err != nil {
+			if a.PublishedAt, err = time.Parse(time.RFC3339, f.Published); err != nil {
+				return InternalAdvisory{}, fmt.Errorf("invalid published %q: want a date or an RFC 3339 time", f.Published)
+			}
+		}
+	}
+	for _, p := range f.Products {
+		a.Products = append(a.Products, InternalAdvisoryProduct{CPE: p.CPE, VersionStart: p.VersionStart, VersionEnd: p.VersionEnd})
+	}
+	if err := normalizeInternalAdvisory(&a); err != nil {
+		return InternalAdvisory{}, err
+	}
+	return a, nil
+}
+
+// advisoryFilesIn returns the advisory files directly in dir, sorted.
+func advisoryFilesIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && slices.Contains(advisoryFileExts, strings.ToLower(filepath.Ext(e.Name()))) {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return paths, nil
+}
+
+// importAdvisoryFiles makes the tenant's file-sourced internal advisories
+// match the files in dir: every file is upserted and advisories imported
+// from files that are gone are deleted. Nothing changes unless every file is
+// valid, so a broken file cannot delete its advisory.
+func importAdvisoryFiles(db *sql.DB, tenant, dir string) error {
+	paths, err := advisoryFilesIn(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list advisory files: %v", err)
+	}
+	var advisories []InternalAdvisory
+	var problems []error
+	seen := map[string]string{}
+	for _, path := range paths {
+		a, err := readAdvisoryFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", path, err))
+			continue
+		}
+		if other, ok := seen[a.ID]; ok {
+			problems = append(problems, fmt.Errorf("%s: %s is also defined in %s", path, a.ID, other))
+			continue
+		}
+		seen[a.ID] = path
+		advisories = append(advisories, a)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid advisory files, nothing imported:\n%v", errors.Join(problems...))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	ids := make([]string, 0, len(advisories))
+	created := 0
+	for i := range advisories {
+		isNew, err := storeInternalAdvisory(tx, tenant, &advisories[i])
+		if err != nil {
+			return err
+		}
+		if isNew {
+			created++
+		}
+		ids = append(ids, advisories[i].ID)
+	}
+	res, err := tx.Exec(`DELETE FROM internal_advisories WHERE tenant = $1 AND source = $2 AND NOT id = ANY($3)`,
+		tenant, internalSourceFiles, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to delete removed internal advisories: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	removed, _ := res.RowsAffected()
+	log.Printf("Imported %d advisory files from %s for tenant %s (%d new, %d removed)\n", len(advisories), dir, tenant, created, removed)
+	return nil
+}
+
+// advisoryDirFingerprint hashes the names, sizes and modification times of
+// the advisory files in dir, to notice edits without reading every file.
+func advisoryDirFingerprint(dir string) (string, error) {
+	paths, err := advisoryFilesIn(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", filepath.Base(path), info.Size(), info.ModTime().UnixNano())
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// runImportAdvisories implements "import advisories", which loads a directory
+// of advisory files (see advisoryFile) as the tenant's internal advisories.
+// With -watch it keeps running and imports again whenever a file is added,
+// changed or removed, e.g. after a git pull.
+func runImportAdvisories(args []string) error {
+	fs := flag.NewFlagSet("import advisories", flag.ExitOnError)
+	tenant := fs.String("tenant", defaultTenant, "tenant the advisories belong to")
+	watch := fs.Bool("watch", false, "keep running and import again when the directory changes")
+	interval := fs.Duration("interval", 30*time.Second, "how often -watch checks the directory")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import advisories [-tenant name] [-watch] <dir>")
+	}
+	dir := fs.Arg(0)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
+
+	fingerprint, err := advisoryDirFingerprint(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read advisory directory: %v", err)
+	}
+	if err := importAdvisoryFiles(db, *tenant, dir); err != nil {
+		if !*watch {
+			return err
+		}
+		log.Printf("Error importing advisories: %v\n", err)
+	}
+	if !*watch {
+		return nil
+	}
+
+	log.Printf("Watching %s for advisory changes every %s\n", dir, *interval)
+	for range time.Tick(*interval) {
+		current, err := advisoryDirFingerprint(dir)
+		if err != nil {
+			log.Printf("Error reading advisory directory: %v\n", err)
+			continue
+		}
+		if current == fingerprint {
+			continue
+		}
+		fingerprint = current
+		if err := importAdvisoryFiles(db, *tenant, dir); err != nil {
+			log.Printf("Error importing advisories: %v\n", err)
+		}
+	}
+	return nil
+}
+
+// runImport dispatches the import subcommands.
+func runImport(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: import advisories|csv")
+	}
+	switch args[0] {
+	case "advisories":
+		return runImportAdvisories(args[1:])
+	case "csv":
+		return runImportCSV(args[1:])
+	}
+	return fmt.Errorf("unknown import %q: want advisories or csv", args[0])
+}
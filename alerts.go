@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// Alert states. An alert opens when a CVE first matches a paging rule and is
+// never opened again for the same CVE, so repeat matches across syncs do not
+// notify twice; only an explicit reopen pages again.
+const (
+	alertOpen         = "open"
+	alertAcknowledged = "acknowledged"
+	alertResolved     = "resolved"
+	alertSuppressed   = "suppressed"
+)
+
+// alertTransitions lists the states each state may move to.
+var alertTransitions = map[string][]string{
+	alertOpen:         {alertAcknowledged, alertResolved, alertSuppressed},
+	alertAcknowledged: {alertResolved, alertSuppressed},
+	alertResolved:     {alertOpen},
+	alertSuppressed:   {alertOpen},
+}
+
+var (
+	errAlertNotFound     = errors.New("alert not found")
+	errInvalidTransition = errors.New("invalid alert transition")
+)
+
+// Alert is the lifecycle of the page raised for a CVE within a tenant.
+type Alert struct {
+	Tenant      string            `json:"tenant"`
+	CVEID       string            `json:"cve_id"`
+	Rule        string            `json:"rule"`
+	Status      string            `json:"status"`
+	TriggeredAt time.Time         `json:"triggered_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Transitions []AlertTransition `json:"transitions,omitempty"`
+}
+
+// AlertTransition is one recorded state change of an alert.
+type AlertTransition struct {
+	From  string    `json:"from,omitempty"`
+	To    string    `json:"to"`
+	Actor string    `json:"actor"`
+	Note  string    `json:"note,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// openAlert records a new open alert for a CVE and pages on-call before
+// committing, so a failed page is retried on the next sync.
+func openAlert(db *sql.DB, m pageMatch) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO alerts (tenant, cve_id, rule, status) VALUES ($1, $2, $3, $4) ON CONFLICT (tenant, cve_id) DO NOTHING`,
+		m.Tenant, m.CVEID, m.Rule, alertOpen)
+	if err != nil {
+		return fmt.Errorf("failed to record alert for %s: %v", m.CVEID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	if err := recordAlertTransition(tx, m.Tenant, m.CVEID, "", alertOpen, "sync", "matched rule "+m.Rule); err != nil {
+		return err
+	}
+	if err := sendPage("trigger", m); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Paged on-call for %s (tenant %s, rule %s)\n", m.CVEID, m.Tenant, m.Rule)
+	return nil
+}
+
+// transitionAlert moves a CVE's alert to a new state and then mirrors the
+// change to the pager: acknowledging acknowledges the incident, resolving or
+// suppressing resolves it and reopening triggers it again. A failed page is
+// logged; the transition stands.
+func transitionAlert(db *sql.DB, tenant, cveID, to, actor, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var from, rule string
+	err = tx.QueryRow(`SELECT status, rule FROM alerts WHERE tenant = $1 AND cve_id = $2 FOR UPDATE`, tenant, cveID).Scan(&from, &rule)
+	if err == sql.ErrNoRows {
+		return errAlertNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load alert for %s: %v", cveID, err)
+	}
+	if !slices.Contains(alertTransitions[from], to) {
+		return fmt.Errorf("%w: %s to %s", errInvalidTransition, from, to)
+	}
+
+	if _, err := tx.Exec(`UPDATE alerts SET status = $3, updated_at = now() WHERE tenant = $1 AND cve_id = $2`, tenant, cveID, to); err != nil {
+		return fmt.Errorf("failed to update alert for %s: %v", cveID, err)
+	}
+	if err := recordAlertTransition(tx, tenant, cveID, from, to, actor, note); err != nil {
+		return err
+	}
+
+	var m pageMatch
+	if pagerEnabled() {
+		if m, err = loadPageMatch(tx, tenant, cveID, rule); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+
+	// The pager is called once the transition is committed, so a slow pager
+	// does not hold the alert locked and a failed commit pages nothing.
+	if pagerEnabled() {
+		action := map[string]string{
+			alertOpen:         "trigger",
+			alertAcknowledged: "acknowledge",
+			alertResolved:     "resolve",
+			alertSuppressed:   "resolve",
+		}[to]
+		if err := sendPage(action, m); err != nil {
+			log.Printf("Failed to mirror the %s transition of %s to the pager: %v\n", to, cveID, err)
+		}
+	}
+	return nil
+}
+
+func recordAlertTransition(tx *sql.Tx, tenant, cveID, from, to, actor, note string) error {
+	_, err := tx.Exec(`INSERT INTO alert_transitions (tenant, cve_id, from_status, to_status, actor, note) VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)`,
+		tenant, cveID, from, to, actor, note)
+	if err != nil {
+		return fmt.Errorf("failed to record alert transition for %s: %v", cveID, err)
+	}
+	return enqueueEvent(tx, eventAlertTransitioned, alertTransitionedEvent{
+		Tenant: tenant, CVEID: cveID, From: from, To: to, Actor: actor, Note: note,
+	})
+}
+
+// listAlerts returns a tenant's alerts in the given state, or all of them if
+// status is empty, most recently updated first.
+func listAlerts(db *sql.DB, tenant, status string) ([]Alert, error) {
+	rows, err := db.Query(`SELECT tenant, cve_id, rule, status, triggered_at, updated_at FROM alerts
+						   WHERE tenant = $1 AND ($2 = '' OR status = $2)
+						   ORDER BY updated_at DESC`, tenant, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list alerts: %v", err)
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		var a Alert
+		if err := rows.Scan(&a.Tenant, &a.CVEID, &a.Rule, &a.Status, &a.TriggeredAt, &a.UpdatedAt); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// getAlert returns a CVE's alert with its transition history.
+func getAlert(db *sql.DB, tenant, cveID string) (*Alert, error) {
+	a := Alert{Tenant: tenant, CVEID: cveID}
+	err := db.QueryRow(`SELECT rule, status, triggered_at, updated_at FROM alerts WHERE tenant = $1 AND cve_id = $2`, tenant, cveID).
+		Scan(&a.Rule, &a.Status, &a.TriggeredAt, &a.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errAlertNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alert for %s: %v", cveID, err)
+	}
+
+	rows, err := db.Query(`SELECT COALESCE(from_status, ''), to_status, actor, note, at FROM alert_transitions
+						   WHERE tenant = $1 AND cve_id = $2 ORDER BY id`, tenant, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alert transitions for %s: %v", cveID, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t AlertTransition
+		if err := rows.Scan(&t.From, &t.To, &t.Actor, &t.Note, &t.At); err != nil {
+			return nil, err
+		}
+		a.Transitions = append(a.Transitions, t)
+	}
+	return &a, rows.Err()
+}
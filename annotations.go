@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Annotation is an analyst note on a CVE. Text is Markdown and is stored and
+// returned as written.
+type Annotation struct {
+	ID        int       `json:"id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// addAnnotation stores a tenant's note on a CVE. It returns sql.ErrNoRows if
+// the CVE is unknown.
+func addAnnotation(db *sql.DB, tenant, cveID, author, text string) (*Annotation, error) {
+	a := Annotation{Author: author, Text: text}
+	err := db.QueryRow(`INSERT INTO annotations (tenant, cve_id, author, text)
+						SELECT $4, cve_id, $2, $3 FROM cve_data1 WHERE cve_id = $1
+						RETURNING id, created_at`, cveID, author, text, tenant).Scan(&a.ID, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to annotate %s: %v", cveID, err)
+	}
+	return &a, nil
+}
+
+// getAnnotations lists the tenant's notes on a CVE, oldest first.
+func getAnnotations(db *sql.DB, tenant, cveID string) ([]Annotation, error) {
+	rows, err := db.Query(`SELECT id, author, text, created_at FROM annotations WHERE tenant = $1 AND cve_id = $2 ORDER BY created_at, id`, tenant, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load annotations: %v", err)
+	}
+	defer rows.Close()
+
+	annotations := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(&a.ID, &a.Author, &a.Text, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
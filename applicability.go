@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// inventoryCPE is a parsed inventory item: the part, vendor and product of
+// its CPE name and the version it runs.
+type inventoryCPE struct {
+	part, vendor, product, version string
+}
+
+// parseMatchItem extracts the product and version of an inventory item.
+func parseMatchItem(item MatchItem) (inventoryCPE, error) {
+	parts := strings.Split(normalizeCPEURI(strings.ToLower(strings.TrimSpace(item.CPE))), ":")
+	if len(parts) < 6 || parts[0] != "cpe" || parts[1] != "2.3" {
+		return inventoryCPE{}, errInvalidCPE
+	}
+	version := item.Version
+	if version == "" {
+		version = parts[5]
+	}
+	if version == "" || version == "*" || version == "-" {
+		return inventoryCPE{}, errVersionRequired
+	}
+	return inventoryCPE{part: parts[2], vendor: parts[3], product: parts[4], version: version}, nil
+}
+
+// covers reports whether the item falls into a CPE match of a configuration,
+// with the match's start and end bounds inclusive or exclusive as published.
+func (c inventoryCPE) covers(m CPEMatch) bool {
+	parts := strings.Split(m.CPE23URI, ":")
+	if len(parts) < 6 || parts[2] != c.part || parts[3] != c.vendor || parts[4] != c.product {
+		return false
+	}
+	return cpeCoversVersion(m.CPE23URI, m.versionRange(), c.version)
+}
+
+// inventory is every item of one match request. Configurations are
+// evaluated against all of it, so an application only matches a CVE whose
+// configuration requires a platform if the platform is in the inventory too.
+type inventory []inventoryCPE
+
+func (inv inventory) covers(m CPEMatch) bool {
+	for _, c := range inv {
+		if c.covers(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// satisfies evaluates a configuration node against the inventory. With
+// anyPlatform, the non-vulnerable CPE matches of a node (the platforms a
+// product must run on) count as present, for inventories that do not list
+// operating systems or hardware.
+func (inv inventory) satisfies(n ConfigNode, anyPlatform bool) bool {
+	var results []bool
+	for _, m := range n.CPEMatch {
+		results = append(results, (anyPlatform && !m.Vulnerable) || inv.covers(m))
+	}
+	for _, child := range n.Children {
+		results = append(results, inv.satisfies(child, anyPlatform))
+	}
+	v := false
+	if strings.EqualFold(n.Operator, "AND") {
+		v = len(results) > 0
+		for _, r := range results {
+			v = v && r
+		}
+	} else {
+		for _, r := range results {
+			v = v || r
+		}
+	}
+	return v != n.Negate
+}
+
+// vulnerableIn reports whether the item falls into a vulnerable CPE match of
+// the node or its children.
+func (c inventoryCPE) vulnerableIn(n ConfigNode) bool {
+	for _, m := range n.CPEMatch {
+		if m.Vulnerable && c.covers(m) {
+			return true
+		}
+	}
+	for _, child := range n.Children {
+		if c.vulnerableIn(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// applicableHits keeps the hits of item whose CVE has a configuration that
+// the inventory satisfies and in which the item is vulnerable. CVEs stored
+// before their configurations were kept are matched by their CPE rows alone.
+func applicableHits(db *sql.DB, hits []CPEMatchHit, item inventoryCPE, inv inventory, anyPlatform bool) ([]CPEMatchHit, error) {
+	if len(hits) == 0 {
+		return hits, nil
+	}
+	ids := make([]string, len(hits))
+	for i, h := range hits {
+		ids[i] = h.CVEID
+	}
+	rows, err := db.Query(`SELECT cve_id, node FROM cve_configurations WHERE cve_id = ANY($1) ORDER BY cve_id, config`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configurations: %v", err)
+	}
+	defer rows.Close()
+	configs := map[string][]ConfigNode{}
+	for rows.Next() {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var node ConfigNode
+		if err := json.Unmarshal(data, &node); err != nil {
+			return nil, fmt.Errorf("invalid configuration of %s: %v", id, err)
+		}
+		configs[id] = append(configs[id], node)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load configurations: %v", err)
+	}
+
+	kept := hits[:0]
+	for _, h := range hits {
+		nodes, ok := configs[h.CVEID]
+		applies := !ok
+		for _, n := range nodes {
+			if item.vulnerableIn(n) && inv.satisfies(n, anyPlatform) {
+				applies = true
+				break
+			}
+		}
+		if applies {
+			kept = append(kept, h)
+		}
+	}
+	return kept, nil
+}
+
+// normalizeConfigNode returns a copy of n with its CPE names normalized as
+// they are in cpe_data. Version bounds are kept as published.
+func normalizeConfigNode(n ConfigNode) ConfigNode {
+	out := ConfigNode{Operator: strings.ToUpper(n.Operator), Negate: n.Negate}
+	for _, m := range n.CPEMatch {
+		m.CPE23URI = normalizeCPEURI(m.CPE23URI)
+		out.CPEMatch = append(out.CPEMatch, m)
+	}
+	for _, child := range n.Children {
+		out.Children = append(out.Children, normalizeConfigNode(child))
+	}
+	return out
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const backupFormat = "cve-download-update-backup"
+
+// backupTables are the tables the tool owns, parents before children so a
+// restore satisfies foreign keys.
+var backupTables = []string{
+	"cve_data1", "cpe_data", "cve_configurations", "impact_data", "cve_quarantine",
+	"match_criteria", "match_criteria_names", "cpe_name_lookup", "advisories",
+	"exploits", "metasploit_modules", "kev", "epss", "cve_cwe", "cve_tags", "cve_comments", "cvss_metrics",
+	"capec_patterns", "cwe_capec", "capec_attack", "cwe_entries", "cwe_relations",
+	"watchlist", "jira_issues", "alerts", "alert_transitions", "tags",
+	"annotations", "suppressions", "api_tokens", "cve_history", "parse_errors", "cvss_environmental",
+	"cve_nvd_history", "misp_events", "cve_enrichments", "epss_history", "change_consumers",
+	"internal_advisories", "internal_advisory_products", "sync_runs", "sync_checkpoints", "score_history",
+	"tenant_risk_scores",
+}
+
+// stateTables hold data that cannot be downloaded again: what users entered,
+// what the integrations have already done, and superseded CVE versions.
+var stateTables = []string{
+	"watchlist", "jira_issues", "alerts", "alert_transitions", "tags",
+	"annotations", "suppressions", "api_tokens", "cve_history", "cvss_environmental", "misp_events",
+	"change_consumers", "internal_advisories", "internal_advisory_products", "score_history",
+}
+
+// stateFiles are the sync state files kept next to the binary.
+var stateFiles = []string{lastModifiedFile, cpeMatchLastModifiedFile, cveHistoryLastModifiedFile, feedHashesFile}
+
+// A backup is a gzipped stream of JSON lines: a header, then one line per
+// state file and one line per table row. Rows are encoded with row_to_json
+// and restored with json_populate_record, so backups do not depend on the
+// PostgreSQL version or pg_dump.
+type backupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Tables    []string  `json:"tables"`
+}
+
+type backupLine struct {
+	File    string          `json:"file,omitempty"`
+	Content string          `json:"content,omitempty"`
+	Table   string          `json:"table,omitempty"`
+	Row     json.RawMessage `json:"row,omitempty"`
+}
+
+func writeBackup(db *sql.DB, w io.Writer, tables []string) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+
+	header := backupHeader{Format: backupFormat, Version: 1, CreatedAt: time.Now().UTC(), Tables: tables}
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	for _, name := range stateFiles {
+		data, err := os.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		if err := enc.Encode(backupLine{File: name, Content: string(data)}); err != nil {
+			return err
+		}
+	}
+
+	// Read every table in one snapshot so the backup is consistent.
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY`); err != nil {
+		return fmt.Errorf("failed to start snapshot: %v", err)
+	}
+
+	for _, table := range tables {
+		rows, err := tx.Query(`SELECT row_to_json(t)::text FROM ` + pq.QuoteIdentifier(table) + ` t`)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", table, err)
+		}
+		n := 0
+		for rows.Next() {
+			var row string
+			if err := rows.Scan(&row); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := enc.Encode(backupLine{Table: table, Row: json.RawMessage(row)}); err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read %s: %v", table, err)
+		}
+		rows.Close()
+		log.Printf("Backed up %d rows from %s\n", n, table)
+	}
+
+	return gz.Close()
+}
+
+// readBackup restores a backup written by writeBackup. The tables listed in
+// its header are emptied and reloaded in one transaction; state files are
+// rewritten after the transaction commits.
+func readBackup(db *sql.DB, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %v", err)
+	}
+	dec := json.NewDecoder(bufio.NewReader(gz))
+
+	var header backupHeader
+	if err := dec.Decode(&header); err != nil || header.Format != backupFormat {
+		return fmt.Errorf("not a %s file", backupFormat)
+	}
+	if header.Version != 1 {
+		return fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+	for _, table := range header.Tables {
+		if !slices.Contains(backupTables, table) {
+			return fmt.Errorf("backup contains unknown table %s", table)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := stashChangeSeqs(tx); err != nil {
+		return err
+	}
+	quoted := make([]string, len(header.Tables))
+	for i, table := range header.Tables {
+		quoted[i] = pq.QuoteIdentifier(table)
+	}
+	if len(quoted) > 0 {
+		if _, err := tx.Exec(`TRUNCATE ` + strings.Join(quoted, ", ")); err != nil {
+			return fmt.Errorf("failed to clear tables: %v", err)
+		}
+	}
+
+	files := map[string]string{}
+	counts := map[string]int{}
+	for {
+		var line backupLine
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read backup: %v", err)
+		}
+
+		switch {
+		case line.File == retiredCheckpointFile:
+			// Superseded by sync_checkpoints; a stale checkpoint only costs a restart.
+		case line.File != "":
+			if !slices.Contains(stateFiles, line.File) {
+				return fmt.Errorf("backup contains unknown file %s", line.File)
+			}
+			files[line.File] = line.Content
+		case slices.Contains(header.Tables, line.Table):
+			table := pq.QuoteIdentifier(line.Table)
+			if _, err := tx.Exec(`INSERT INTO `+table+` SELECT * FROM json_populate_record(NULL::`+table+`, $1)`, string(line.Row)); err != nil {
+				return fmt.Errorf("failed to restore row of %s: %v", line.Table, err)
+			}
+			counts[line.Table]++
+		default:
+			return fmt.Errorf("backup row for undeclared table %q", line.Table)
+		}
+	}
+
+	if err := resetIDSequences(tx, header.Tables); err != nil {
+		return err
+	}
+	if err := restoreChangeSeqs(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	for _, table := range header.Tables {
+		log.Printf("Restored %d rows into %s\n", counts[table], table)
+	}
+
+	for name, content := range files {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// resetIDSequences makes the SERIAL id columns of the tables continue after
+// the ids loaded into them.
+func resetIDSequences(tx *sql.Tx, tables []string) error {
+	for _, table := range tables {
+		var seq sql.NullString
+		err := tx.QueryRow(`SELECT pg_get_serial_sequence($1, a.attname)
+							FROM pg_attribute a WHERE a.attrelid = $1::regclass AND a.attname = 'id'`, tableName(table)).Scan(&seq)
+		if err == sql.ErrNoRows || (err == nil && !seq.Valid) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find id sequence of %s: %v", table, err)
+		}
+		_, err = tx.Exec(`SELECT setval($1, COALESCE((SELECT max(id) FROM `+pq.QuoteIdentifier(table)+`), 0) + 1, false)`, seq.String)
+		if err != nil {
+			return fmt.Errorf("failed to reset id sequence of %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// runBackup implements the backup subcommand.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "cve-backup.jsonl.gz", "file to write the backup to")
+	stateOnly := fs.Bool("state-only", false, "only back up user and integration state, not data that can be downloaded again")
+	fs.Parse(args)
+
+	tables := backupTables
+	if *stateOnly {
+		tables = stateTables
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tmp := *out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := writeBackup(db, f, tables); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("backup failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, *out); err != nil {
+		return err
+	}
+	log.Printf("Wrote backup to %s\n", *out)
+	return nil
+}
+
+// runRestore implements the restore subcommand.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("i", "cve-backup.jsonl.gz", "backup file to restore")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := readBackup(db, f); err != nil {
+		return fmt.Errorf("restore failed: %v", err)
+	}
+	log.Printf("Restored backup from %s\n", *in)
+	return nil
+}
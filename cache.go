@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+var cacheTTL = flag.Duration("cache-ttl", time.Minute, "how long the query API caches search and report responses; a sync or a change made through the API clears the cache (0 disables)")
+
+// responseCacheSize bounds the number of cached responses. When it is
+// reached, expired entries are dropped, and if none were expired the cache
+// starts over.
+const responseCacheSize = 1000
+
+type cachedResponse struct {
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// responseCache holds rendered responses keyed by tenant and request URI.
+var responseCache = struct {
+	sync.Mutex
+	entries map[string]cachedResponse
+}{entries: map[string]cachedResponse{}}
+
+// invalidateResponseCache drops every cached response, after the data they
+// were computed from changed.
+func invalidateResponseCache() {
+	responseCache.Lock()
+	clear(responseCache.entries)
+	responseCache.Unlock()
+}
+
+// responseRecorder captures a response so it can be cached.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header         { return r.header }
+func (r *responseRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *responseRecorder) WriteHeader(status int)      { r.status = status }
+
+// cached serves repeated requests for the same URI from the cache for
+// -cache-ttl. Only successful responses are cached.
+func cached(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *cacheTTL <= 0 {
+			h(w, r)
+			return
+		}
+		key := tenantOf(r) + " " + r.URL.RequestURI()
+		now := time.Now()
+
+		responseCache.Lock()
+		entry, ok := responseCache.entries[key]
+		responseCache.Unlock()
+		if ok && now.Before(entry.expires) {
+			w.Header().Set("Content-Type", entry.contentType)
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+		h(rec, r)
+		if rec.status == http.StatusOK {
+			responseCache.Lock()
+			if len(responseCache.entries) >= responseCacheSize {
+				for k, e := range responseCache.entries {
+					if !now.Before(e.expires) {
+						delete(responseCache.entries, k)
+					}
+				}
+				if len(responseCache.entries) >= responseCacheSize {
+					clear(responseCache.entries)
+				}
+			}
+			responseCache.entries[key] = cachedResponse{
+				status:      rec.status,
+				contentType: rec.header.Get("Content-Type"),
+				body:        rec.body.Bytes(),
+				expires:     now.Add(*cacheTTL),
+			}
+			responseCache.Unlock()
+		}
+
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("X-Cache", "MISS")
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+	}
+}
+
+// queryPOSTs are the POST endpoints that only read data; their request
+// bodies are too large for a query string.
+var queryPOSTs = []string{"/match", "/scan/packages"}
+
+// invalidateOnWrite clears the response cache after every request that may
+// have changed data, such as adding a tag or a suppression.
+func invalidateOnWrite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !slices.Contains(queryPOSTs, r.URL.Path) {
+			invalidateResponseCache()
+		}
+	})
+}
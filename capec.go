@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const capecURL = "https://capec.mitre.org/data/xml/capec_latest.xml"
+
+var syncCAPECCatalog = flag.Bool("capec", false, "sync the CAPEC catalog daily to map CWEs to attack patterns and ATT&CK techniques")
+
+type capecCatalog struct {
+	AttackPatterns []capecAttackPattern `xml:"Attack_Patterns>Attack_Pattern"`
+}
+
+type capecAttackPattern struct {
+	ID                string `xml:"ID,attr"`
+	Name              string `xml:"Name,attr"`
+	Abstraction       string `xml:"Abstraction,attr"`
+	Status            string `xml:"Status,attr"`
+	Description       string `xml:"Description"`
+	Likelihood        string `xml:"Likelihood_Of_Attack"`
+	Severity          string `xml:"Typical_Severity"`
+	RelatedWeaknesses []struct {
+		CWEID string `xml:"CWE_ID,attr"`
+	} `xml:"Related_Weaknesses>Related_Weakness"`
+	TaxonomyMappings []struct {
+		TaxonomyName string `xml:"Taxonomy_Name,attr"`
+		EntryID      string `xml:"Entry_ID"`
+		EntryName    string `xml:"Entry_Name"`
+	} `xml:"Taxonomy_Mappings>Taxonomy_Mapping"`
+}
+
+func downloadCAPEC() (*capecCatalog, error) {
+	resp, err := http.Get(capecURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download CAPEC catalog: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download CAPEC catalog: %s", resp.Status)
+	}
+
+	var catalog capecCatalog
+	if err := xml.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return nil, fmt.Errorf("failed to decode CAPEC catalog: %v", err)
+	}
+	return &catalog, nil
+}
+
+// syncCAPEC replaces the attack pattern catalog and the CWE -> CAPEC ->
+// ATT&CK mapping tables from the CAPEC catalog. Deprecated attack patterns
+// are skipped.
+func syncCAPEC(db *sql.DB) error {
+	catalog, err := downloadCAPEC()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"capec_patterns", "cwe_capec", "capec_attack"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return fmt.Errorf("failed to clear %s: %v", table, err)
+		}
+	}
+
+	patterns := 0
+	for _, ap := range catalog.AttackPatterns {
+		if ap.Status == "Deprecated" {
+			continue
+		}
+		patterns++
+		capecID := "CAPEC-" + ap.ID
+
+		_, err := tx.Exec(`INSERT INTO capec_patterns (capec_id, name, description, abstraction, likelihood, severity, status)
+						   VALUES ($1, $2, $3, $4, $5, $6, $7)
+						   ON CONFLICT DO NOTHING;`,
+			capecID, ap.Name, strings.TrimSpace(ap.Description), ap.Abstraction, ap.Likelihood, ap.Severity, ap.Status)
+		if err != nil {
+			return fmt.Errorf("failed to insert %s: %v", capecID, err)
+		}
+
+		for _, w := range ap.RelatedWeaknesses {
+			_, err := tx.Exec(`INSERT INTO cwe_capec (cwe_id, capec_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+				"CWE-"+w.CWEID, capecID)
+			if err != nil {
+				return fmt.Errorf("failed to insert CWE mapping for %s: %v", capecID, err)
+			}
+		}
+
+		for _, m := range ap.TaxonomyMappings {
+			if m.TaxonomyName != "ATTACK" || m.EntryID == "" {
+				continue
+			}
+			_, err := tx.Exec(`INSERT INTO capec_attack (capec_id, technique_id, technique_name) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+				capecID, "T"+strings.TrimPrefix(m.EntryID, "T"), m.EntryName)
+			if err != nil {
+				return fmt.Errorf("failed to insert ATT&CK mapping for %s: %v", capecID, err)
+			}
+		}
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Synced %d CAPEC attack patterns\n", patterns)
+	return nil
+}
+
+// AttackTechnique is an ATT&CK technique a CVE is likely exposed to, with the
+// weakness and attack pattern that link them.
+type AttackTechnique struct {
+	TechniqueID   string `json:"technique_id"`
+	TechniqueName string `json:"technique_name"`
+	CAPECID       string `json:"capec_id"`
+	CWEID         string `json:"cwe_id"`
+}
+
+// getAttackTechniques follows a CVE's CWEs through CAPEC to ATT&CK.
+func getAttackTechniques(db *sql.DB, cveID string) ([]AttackTechnique, error) {
+	rows, err := db.Query(`SELECT a.technique_id, a.technique_name, a.capec_id, w.cwe_id
+						   FROM cve_cwe w
+						   JOIN cwe_capec c ON c.cwe_id = w.cwe_id
+						   JOIN capec_attack a ON a.capec_id = c.capec_id
+						   WHERE w.cve_id = $1
+						   ORDER BY a.technique_id, a.capec_id`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load attack techniques: %v", err)
+	}
+	defer rows.Close()
+
+	techniques := []AttackTechnique{}
+	for rows.Next() {
+		var t AttackTechnique
+		if err := rows.Scan(&t.TechniqueID, &t.TechniqueName, &t.CAPECID, &t.CWEID); err != nil {
+			return nil, err
+		}
+		techniques = append(techniques, t)
+	}
+	return techniques, rows.Err()
+}
+
+// AttackPattern is a CAPEC attack pattern that applies to one of a CVE's CWEs.
+type AttackPattern struct {
+	CAPECID     string `json:"capec_id"`
+	Name        string `json:"name"`
+	Abstraction string `json:"abstraction,omitempty"`
+	Likelihood  string `json:"likelihood,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	CWEID       string `json:"cwe_id"`
+}
+
+// getAttackPatterns lists the attack patterns related to a CVE's CWEs.
+func getAttackPatterns(db *sql.DB, cveID string) ([]AttackPattern, error) {
+	rows, err := db.Query(`SELECT p.capec_id, p.name, p.abstraction, p.likelihood, p.severity, w.cwe_id
+						   FROM cve_cwe w
+						   JOIN cwe_capec c ON c.cwe_id = w.cwe_id
+						   JOIN capec_patterns p ON p.capec_id = c.capec_id
+						   WHERE w.cve_id = $1
+						   ORDER BY p.capec_id, w.cwe_id`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load attack patterns: %v", err)
+	}
+	defer rows.Close()
+
+	patterns := []AttackPattern{}
+	for rows.Next() {
+		var p AttackPattern
+		if err := rows.Scan(&p.CAPECID, &p.Name, &p.Abstraction, &p.Likelihood, &p.Severity, &p.CWEID); err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, rows.Err()
+}
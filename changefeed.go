@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// The change feed orders CVE versions by change_seq: every write that changes
+// a CVE's content hash moves the CVE to the next number, so a consumer that
+// has processed everything up to a cursor only needs the CVEs above it, and a
+// re-sync storing the same content leaves the CVE where it was. Writers hold
+// changeFeedLock until they commit, so numbers become visible in order and a
+// cursor never skips a CVE whose transaction committed late.
+const changeFeedLock = 0x6376655f63686773
+
+// notifyChannel carries a NOTIFY for every CVE moved to the end of the feed.
+// The payload is the cve.changed event; Postgres delivers it to listeners when
+// the writing transaction commits and drops it if it rolls back.
+const notifyChannel = "cve_changes"
+
+var notifyChanges = flag.Bool("notify-changes", false, "NOTIFY the cve_changes channel for every CVE whose content changed, for services listening on the same database")
+
+var errCursorOutOfRange = errors.New("cursor is past the end of the change feed")
+
+// advanceChangeSeq moves a CVE whose content changed to the end of the feed,
+// and of the TAXII collection by its ingest time, and enqueues its
+// cve.changed event.
+func advanceChangeSeq(tx *sql.Tx, cveID string) error {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, changeFeedLock); err != nil {
+		return fmt.Errorf("failed to lock the change feed: %v", err)
+	}
+	e := cveChangedEvent{CVEID: cveID}
+	err := tx.QueryRow(`UPDATE cve_data1 SET change_seq = nextval('cve_change_seq'::regclass), ingested_at = now() WHERE cve_id = $1
+						RETURNING change_seq, COALESCE(`+utcTimestampSQL("last_modified_date")+`, '')`, cveID).Scan(&e.ChangeSeq, &e.LastModifiedDate)
+	if err != nil {
+		return fmt.Errorf("failed to advance change_seq of CVE ID %s: %v", cveID, err)
+	}
+	if *notifyChanges {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`SELECT pg_notify($1, $2)`, notifyChannel, string(payload)); err != nil {
+			return fmt.Errorf("failed to notify %s: %v", notifyChannel, err)
+		}
+	}
+	return enqueueEvent(tx, eventCVEChanged, e)
+}
+
+// stashChangeSeqs remembers every CVE's position and content hash before
+// cve_data1 is replaced wholesale by a snapshot import or a restore.
+func stashChangeSeqs(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TEMP TABLE stashed_change_seqs ON COMMIT DROP AS
+					   SELECT cve_id, content_hash, change_seq, ingested_at FROM cve_data1`)
+	if err != nil {
+		return fmt.Errorf("failed to stash change positions: %v", err)
+	}
+	return nil
+}
+
+// restoreChangeSeqs gives the CVEs whose content is unchanged since
+// stashChangeSeqs their previous position and ingest time, and moves the
+// others to the end of the feed, as ingested now, with a cve.changed event and
+// notification each. Positions loaded from elsewhere are never kept.
+func restoreChangeSeqs(tx *sql.Tx) error {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, changeFeedLock); err != nil {
+		return fmt.Errorf("failed to lock the change feed: %v", err)
+	}
+	_, err := tx.Exec(`WITH moved AS (
+						   UPDATE cve_data1 c SET change_seq = CASE
+							   WHEN s.cve_id IS NOT NULL THEN s.change_seq
+							   ELSE nextval('cve_change_seq'::regclass)
+						   END,
+						   ingested_at = CASE WHEN s.cve_id IS NOT NULL THEN s.ingested_at ELSE now() END
+						   FROM cve_data1 c2
+						   LEFT JOIN stashed_change_seqs s ON s.cve_id = c2.cve_id AND s.content_hash = c2.content_hash
+						   WHERE c2.cve_id = c.cve_id
+						   RETURNING c.cve_id, c.change_seq, s.cve_id IS NULL AS changed,
+									 jsonb_build_object('cve_id', c.cve_id, 'change_seq', c.change_seq,
+														'last_modified_date', COALESCE(`+utcTimestampSQL("c.last_modified_date")+`, '')) AS payload
+					   ), queued AS (
+						   INSERT INTO event_outbox (event_type, payload)
+						   SELECT $1, payload FROM moved WHERE changed AND $2
+						   ORDER BY change_seq
+					   )
+					   SELECT count(*) FROM (
+						   SELECT pg_notify($4, payload::text) FROM moved WHERE changed AND $3 ORDER BY change_seq
+					   ) n`, eventCVEChanged, eventsEnabled(), *notifyChanges, notifyChannel)
+	if err != nil {
+		return fmt.Errorf("failed to restore change positions: %v", err)
+	}
+	return nil
+}
+
+// ChangeConsumer is the position a downstream consumer acknowledged, and how
+// many changed CVEs it has not seen yet.
+type ChangeConsumer struct {
+	Name      string    `json:"name"`
+	Cursor    string    `json:"cursor"`
+	Pending   int       `json:"pending"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// consumerCursor returns the acknowledged position of a tenant's consumer, 0
+// for a new consumer.
+func consumerCursor(db *sql.DB, tenant, name string) (int64, error) {
+	var cursor int64
+	err := db.QueryRow(`SELECT cursor FROM change_consumers WHERE tenant = $1 AND name = $2`, tenant, name).Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to load consumer %s: %v", name, err)
+	}
+	return cursor, nil
+}
+
+// getChangeConsumer returns a tenant's consumer, or sql.ErrNoRows if it never
+// acknowledged a position.
+func getChangeConsumer(db *sql.DB, tenant, name string) (*ChangeConsumer, error) {
+	c := &ChangeConsumer{Name: name}
+	var cursor int64
+	err := db.QueryRow(`SELECT cursor, updated_at, (SELECT count(*) FROM cve_data1 WHERE change_seq > cursor)
+						FROM change_consumers WHERE tenant = $1 AND name = $2`, tenant, name).Scan(&cursor, &c.UpdatedAt, &c.Pending)
+	if err != nil {
+		return nil, err
+	}
+	c.Cursor = fmt.Sprint(cursor)
+	return c, nil
+}
+
+// ackChangeConsumer stores the position up to which a tenant's consumer has
+// processed the feed. Positions past the end of the feed are rejected.
+func ackChangeConsumer(db *sql.DB, tenant, name string, cursor int64) error {
+	var end int64
+	if err := db.QueryRow(`SELECT COALESCE(max(change_seq), 0) FROM cve_data1`).Scan(&end); err != nil {
+		return fmt.Errorf("failed to read the end of the change feed: %v", err)
+	}
+	if cursor < 0 || cursor > end {
+		return errCursorOutOfRange
+	}
+	_, err := db.Exec(`INSERT INTO change_consumers (tenant, name, cursor, updated_at) VALUES ($1, $2, $3, now())
+					   ON CONFLICT (tenant, name) DO UPDATE SET cursor = EXCLUDED.cursor, updated_at = EXCLUDED.updated_at`,
+		tenant, name, cursor)
+	if err != nil {
+		return fmt.Errorf("failed to store consumer %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxChangesPage bounds the number of CVEs of one GET /changes page.
+const maxChangesPage = 5000
+
+// CVEChange is a CVE as stored, with its impact and CPE rows, for downstream
+// systems mirroring the database.
+type CVEChange struct {
+	ID               string       `json:"cve_id"`
+	Assigner         string       `json:"assigner,omitempty"`
+	Description      string       `json:"description"`
+	PublishedDate    string       `json:"published_date"`
+	LastModifiedDate string       `json:"last_modified_date"`
+	ChangeSeq        int64        `json:"change_seq"`
+	Impact           *ImpactRow   `json:"impact,omitempty"`
+	CPEs             []CPEDataRow `json:"cpes"`
+}
+
+// ImpactRow is a CVE's impact_data row.
+type ImpactRow struct {
+	CVSSVersion      string   `json:"cvss_version"`
+	CVSSVectorString string   `json:"cvss_vector_string"`
+	CVSSBaseScore    *float64 `json:"cvss_base_score"`
+	CVSSBaseSeverity string   `json:"cvss_base_severity"`
+}
+
+// CPEDataRow is one of a CVE's cpe_data rows.
+type CPEDataRow struct {
+	CPEURI                string `json:"cpe_uri"`
+	Vulnerable            bool   `json:"vulnerable"`
+	VersionStart          string `json:"version_start,omitempty"`
+	VersionStartExcluding bool   `json:"version_start_excluding,omitempty"`
+	VersionEnd            string `json:"version_end,omitempty"`
+	VersionEndIncluding   bool   `json:"version_end_including,omitempty"`
+	Config                *int   `json:"config,omitempty"`
+	NodeID                *int   `json:"node_id,omitempty"`
+	ParentNodeID          *int   `json:"parent_node_id,omitempty"`
+	MatchCriteriaID       string `json:"match_criteria_id,omitempty"`
+}
+
+// ChangesPage is a page of GET /changes. When More is set, the next page
+// starts after NextSince and NextAfter, or after Cursor when the feed is read
+// by change position.
+type ChangesPage struct {
+	Changes   []CVEChange `json:"changes"`
+	More      bool        `json:"more"`
+	NextSince string      `json:"next_since,omitempty"`
+	NextAfter string      `json:"next_after,omitempty"`
+	Cursor    string      `json:"cursor,omitempty"`
+}
+
+// getChanges returns up to limit CVEs last modified after since, oldest
+// first. afterID continues a page that ended within CVEs of the same last
+// modified time: CVEs modified exactly at since are returned if their ID
+// sorts after it.
+func getChanges(db *sql.DB, since time.Time, afterID string, limit int) (*ChangesPage, error) {
+	page, last, err := loadChanges(db, `last_modified_date > $1 OR ($2 <> '' AND last_modified_date = $1 AND cve_id > $2)
+										ORDER BY last_modified_date, cve_id LIMIT $3`, since, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(page.Changes); n == limit {
+		page.More = true
+		page.NextSince = last.UTC().Format(time.RFC3339Nano)
+		page.NextAfter = page.Changes[n-1].ID
+	}
+	return page, nil
+}
+
+// getChangesAfter returns up to limit CVEs whose current version comes after
+// cursor in the change feed, in feed order. The page's Cursor is the position
+// to continue from, or to acknowledge once the page is processed.
+func getChangesAfter(db *sql.DB, cursor int64, limit int) (*ChangesPage, error) {
+	page, _, err := loadChanges(db, `change_seq > $1 ORDER BY change_seq LIMIT $2`, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	if n := len(page.Changes); n > 0 {
+		cursor = page.Changes[n-1].ChangeSeq
+		page.More = n == limit
+	}
+	page.Cursor = fmt.Sprint(cursor)
+	return page, nil
+}
+
+// loadChanges reads the cve_data1 rows selected by where, which also orders
+// and limits them, together with their impact and CPE rows. It returns the
+// last modified time of the last row.
+func loadChanges(db *sql.DB, where string, args ...any) (*ChangesPage, time.Time, error) {
+	var last time.Time
+	rows, err := db.Query(`SELECT cve_id, COALESCE(assigner, ''), COALESCE(description, ''),
+								  COALESCE(`+utcTimestampSQL("published_date")+`, ''), `+utcTimestampSQL("last_modified_date")+`,
+								  last_modified_date, COALESCE(change_seq, 0)
+						   FROM cve_data1
+						   WHERE `+where, args...)
+	if err != nil {
+		return nil, last, fmt.Errorf("failed to read changed CVEs: %v", err)
+	}
+	page := &ChangesPage{Changes: []CVEChange{}}
+	index := map[string]int{}
+	var ids []string
+	for rows.Next() {
+		c := CVEChange{CPEs: []CPEDataRow{}}
+		if err := rows.Scan(&c.ID, &c.Assigner, &c.Description, &c.PublishedDate, &c.LastModifiedDate, &last, &c.ChangeSeq); err != nil {
+			rows.Close()
+			return nil, last, err
+		}
+		index[c.ID] = len(page.Changes)
+		ids = append(ids, c.ID)
+		page.Changes = append(page.Changes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, last, fmt.Errorf("failed to read changed CVEs: %v", err)
+	}
+	if len(ids) == 0 {
+		return page, last, nil
+	}
+
+	rows, err = db.Query(`SELECT cve_id, COALESCE(cvss_version, ''), COALESCE(cvss_vector_string, ''), cvss_base_score, COALESCE(cvss_base_severity, '')
+						  FROM impact_data WHERE cve_id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, last, fmt.Errorf("failed to read impact_data: %v", err)
+	}
+	for rows.Next() {
+		var id string
+		var impact ImpactRow
+		if err := rows.Scan(&id, &impact.CVSSVersion, &impact.CVSSVectorString, &impact.CVSSBaseScore, &impact.CVSSBaseSeverity); err != nil {
+			rows.Close()
+			return nil, last, err
+		}
+		page.Changes[index[id]].Impact = &impact
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, last, fmt.Errorf("failed to read impact_data: %v", err)
+	}
+
+	rows, err = db.Query(`SELECT cve_id, cpe_uri, COALESCE(vulnerable, false), COALESCE(version_start, ''), version_start_excluding,
+								 COALESCE(version_end, ''), version_end_including, config, node_id, parent_node_id, COALESCE(match_criteria_id, '')
+						  FROM cpe_data WHERE cve_id = ANY($1)
+						  ORDER BY cve_id, config, node_id, cpe_uri`, pq.Array(ids))
+	if err != nil {
+		return nil, last, fmt.Errorf("failed to read cpe_data: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var cpe CPEDataRow
+		if err := rows.Scan(&id, &cpe.CPEURI, &cpe.Vulnerable, &cpe.VersionStart, &cpe.VersionStartExcluding, &cpe.VersionEnd, &cpe.VersionEndIncluding,
+			&cpe.Config, &cpe.NodeID, &cpe.ParentNodeID, &cpe.MatchCriteriaID); err != nil {
+			return nil, last, err
+		}
+		c := &page.Changes[index[id]]
+		c.CPEs = append(c.CPEs, cpe)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, last, fmt.Errorf("failed to read cpe_data: %v", err)
+	}
+	return page, last, nil
+}
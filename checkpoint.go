@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// batchSize is the number of CVEs committed per transaction; a checkpoint is
+// written with every batch.
+const batchSize = 1000
+
+// retiredCheckpointFile is where checkpoints were kept before they moved to
+// the sync_checkpoints table. Backups may still contain it.
+const retiredCheckpointFile = "checkpoint.json"
+
+// checkpoint records how far ingestion from a source got, so a crash in the
+// middle of a large year feed or API sweep resumes there instead of starting
+// over. Position identifies what was being paged through (a feed URL or an
+// API query) and Offset is the number of its records committed.
+type checkpoint struct {
+	Source    string
+	Position  string
+	Offset    int
+	LastCVEID string
+}
+
+// readCheckpoint returns the checkpoint of source, if one is recorded.
+func readCheckpoint(db *sql.DB, source string) (checkpoint, bool, error) {
+	cp := checkpoint{Source: source}
+	err := db.QueryRow(`SELECT position, batch_offset, last_cve_id FROM sync_checkpoints WHERE source = $1`, source).
+		Scan(&cp.Position, &cp.Offset, &cp.LastCVEID)
+	if err == sql.ErrNoRows {
+		return cp, false, nil
+	}
+	if err != nil {
+		return cp, false, fmt.Errorf("failed to read the %s checkpoint: %v", source, err)
+	}
+	return cp, true, nil
+}
+
+// saveCheckpoint records cp in tx, the transaction of the batch it follows.
+func saveCheckpoint(tx *sql.Tx, cp checkpoint) error {
+	_, err := tx.Exec(`INSERT INTO sync_checkpoints (source, position, batch_offset, last_cve_id, updated_at)
+					   VALUES ($1, $2, $3, $4, now())
+					   ON CONFLICT (source) DO UPDATE
+					   SET position = EXCLUDED.position, batch_offset = EXCLUDED.batch_offset,
+						   last_cve_id = EXCLUDED.last_cve_id, updated_at = EXCLUDED.updated_at`,
+		cp.Source, cp.Position, cp.Offset, cp.LastCVEID)
+	if err != nil {
+		return fmt.Errorf("failed to save the %s checkpoint: %v", cp.Source, err)
+	}
+	return nil
+}
+
+// clearCheckpoint forgets the checkpoint of source once its ingest is done.
+func clearCheckpoint(db *sql.DB, source string) error {
+	if _, err := db.Exec(`DELETE FROM sync_checkpoints WHERE source = $1`, source); err != nil {
+		return fmt.Errorf("failed to clear the %s checkpoint: %v", source, err)
+	}
+	return nil
+}
+
+// resumeOffset returns the index of the first item of the feed at url that
+// still needs to be inserted. The checkpoint is only trusted if it belongs to
+// the same feed and the item before the offset is still the last committed
+// CVE; otherwise the feed is processed from the start.
+func resumeOffset(db *sql.DB, source, url string, items []CVEItem) int {
+	cp, ok, err := readCheckpoint(db, source)
+	if err != nil {
+		log.Printf("Ignoring unreadable checkpoint: %v\n", err)
+		return 0
+	}
+	if !ok || cp.Position != url || cp.Offset <= 0 || cp.Offset > len(items) {
+		return 0
+	}
+	if items[cp.Offset-1].CVE.CVEDataMeta.ID != cp.LastCVEID {
+		log.Printf("Feed %s changed since checkpoint at %s, starting over\n", url, cp.LastCVEID)
+		return 0
+	}
+	return cp.Offset
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Kinds of cve_comments rows.
+const (
+	commentVendor            = "vendor"
+	commentEvaluator         = "evaluator_comment"
+	commentEvaluatorSolution = "evaluator_solution"
+	commentEvaluatorImpact   = "evaluator_impact"
+)
+
+// VendorComment is a statement a vendor made about a CVE, e.g. which versions
+// are affected or how to mitigate it.
+type VendorComment struct {
+	Organization string `json:"organization"`
+	Comment      string `json:"comment"`
+	LastModified string `json:"lastModified"`
+}
+
+// CommentRecord is a vendor or evaluator comment as returned by the API.
+type CommentRecord struct {
+	Kind         string `json:"kind"`
+	Organization string `json:"organization,omitempty"`
+	Comment      string `json:"comment"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// comments returns the vendor and evaluator comments of the CVE.
+func (item CVEItem) comments() []CommentRecord {
+	var comments []CommentRecord
+	for _, c := range item.VendorComments {
+		comments = append(comments, CommentRecord{Kind: commentVendor, Organization: c.Organization, Comment: c.Comment, LastModified: c.LastModified})
+	}
+	for _, e := range []struct{ kind, text string }{
+		{commentEvaluator, item.EvaluatorComment},
+		{commentEvaluatorImpact, item.EvaluatorImpact},
+		{commentEvaluatorSolution, item.EvaluatorSolution},
+	} {
+		if e.text != "" {
+			comments = append(comments, CommentRecord{Kind: e.kind, Comment: e.text})
+		}
+	}
+	return comments
+}
+
+// insertComments replaces the vendor and evaluator comments stored for a CVE.
+func insertComments(tx *sql.Tx, cveID string, comments []CommentRecord) error {
+	if _, err := tx.Exec(`DELETE FROM cve_comments WHERE cve_id = $1`, cveID); err != nil {
+		return fmt.Errorf("failed to delete comments for CVE ID %s: %v", cveID, err)
+	}
+	for _, c := range comments {
+		var lastModified sql.NullTime
+		if t, err := parseNVDTime(c.LastModified); err == nil {
+			lastModified = sql.NullTime{Time: t, Valid: true}
+		}
+		_, err := tx.Exec(`INSERT INTO cve_comments (cve_id, kind, organization, comment, last_modified)
+						   VALUES ($1, $2, NULLIF($3, ''), $4, $5)`,
+			cveID, c.Kind, c.Organization, c.Comment, lastModified)
+		if err != nil {
+			return fmt.Errorf("failed to insert %s comment for CVE ID %s: %v", c.Kind, cveID, err)
+		}
+	}
+	return nil
+}
+
+// getComments loads the stored comments of a CVE, vendor comments first.
+func getComments(db *sql.DB, cveID string) ([]CommentRecord, error) {
+	rows, err := db.Query(`SELECT kind, COALESCE(organization, ''), comment, COALESCE(to_char(last_modified, 'YYYY-MM-DD"T"HH24:MI:SS'), '')
+						   FROM cve_comments WHERE cve_id = $1
+						   ORDER BY kind = 'vendor' DESC, kind, id`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load comments: %v", err)
+	}
+	defer rows.Close()
+	var comments []CommentRecord
+	for rows.Next() {
+		var c CommentRecord
+		if err := rows.Scan(&c.Kind, &c.Organization, &c.Comment, &c.LastModified); err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Conflict strategies decide what an ingested CVE does to rows already stored
+// for it in a table.
+const (
+	// conflictUpdate replaces the stored rows with NVD's current data.
+	conflictUpdate = "update"
+	// conflictSkip keeps the stored rows, e.g. for locally curated data in an
+	// append-only archive.
+	conflictSkip = "skip"
+	// conflictFail aborts the insert so the conflict can be reviewed.
+	conflictFail = "fail"
+)
+
+// conflictTables are the per-CVE tables whose strategy can be configured.
+var conflictTables = []string{"cve_data1", "impact_data", "cpe_data", "cve_cwe", "advisories"}
+
+var conflictStrategySpec = flag.String("conflict-strategy", "", "per-table conflict strategy for ingested CVEs, e.g. cve_data1=skip,cpe_data=fail (update, skip or fail; default update)")
+
+// conflictStrategies is parsed from -conflict-strategy at startup.
+var conflictStrategies = map[string]string{}
+
+func parseConflictStrategies(spec string) (map[string]string, error) {
+	strategies := map[string]string{}
+	if spec == "" {
+		return strategies, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		table, strategy, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid conflict strategy %q: want table=strategy", entry)
+		}
+		if !slices.Contains(conflictTables, table) {
+			return nil, fmt.Errorf("conflict strategy for unknown table %q: must be one of %s", table, strings.Join(conflictTables, ", "))
+		}
+		if strategy != conflictUpdate && strategy != conflictSkip && strategy != conflictFail {
+			return nil, fmt.Errorf("invalid conflict strategy %q for %s: must be update, skip or fail", strategy, table)
+		}
+		strategies[table] = strategy
+	}
+	return strategies, nil
+}
+
+// shouldWrite reports whether a CVE's rows in table may be written under the
+// table's conflict strategy. Under skip and fail it only allows CVEs without
+// stored rows; fail turns a conflict into an error.
+func shouldWrite(tx *sql.Tx, table, cveID string) (bool, error) {
+	strategy := conflictStrategies[table]
+	if strategy == "" || strategy == conflictUpdate {
+		return true, nil
+	}
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+table+` WHERE cve_id = $1)`, cveID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check %s for CVE ID %s: %v", table, cveID, err)
+	}
+	if !exists {
+		return true, nil
+	}
+	if strategy == conflictFail {
+		return false, fmt.Errorf("conflict in %s: CVE ID %s is already stored", table, cveID)
+	}
+	debugf("Keeping stored %s rows for CVE ID %s", table, cveID)
+	return false, nil
+}
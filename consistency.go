@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+)
+
+// runConsistency implements doctor consistency. It samples stored CVEs,
+// fetches them again from the NVD API and reports every field whose stored
+// value differs from what ingesting the fetched record would store. A
+// mismatch on CVEs NVD has not changed points at a bug in the mapping.
+func runConsistency(args []string) error {
+	fs := flag.NewFlagSet("doctor consistency", flag.ExitOnError)
+	n := fs.Int("n", 20, "number of random CVEs to check")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT cve_id FROM cve_data1 ORDER BY random() LIMIT $1`, *n)
+	if err != nil {
+		return fmt.Errorf("failed to sample CVEs: %v", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	checked, inconsistent := 0, 0
+	for _, id := range ids {
+		item, err := fetchCVEItem(id)
+		if err != nil {
+			log.Printf("Skipping %s: %v\n", id, err)
+			continue
+		}
+		if !keepCVEItem(item) {
+			log.Printf("Skipping %s: now excluded by the ingestion filters\n", id)
+			continue
+		}
+		mismatches, err := compareStoredCVE(db, item)
+		if err != nil {
+			return err
+		}
+		checked++
+		if len(mismatches) == 0 {
+			fmt.Printf("ok   %s\n", id)
+			continue
+		}
+		inconsistent++
+		fmt.Printf("FAIL %s\n", id)
+		for _, m := range mismatches {
+			fmt.Printf("     - %s\n", m)
+		}
+	}
+
+	fmt.Printf("%d of %d checked CVEs match the source\n", checked-inconsistent, checked)
+	if inconsistent > 0 {
+		return fmt.Errorf("%d CVEs do not match the source", inconsistent)
+	}
+	return nil
+}
+
+// compareStoredCVE lists the fields of the stored CVE that differ from item.
+// The fetched record can be newer than the stored one; a changed last
+// modified date says so.
+func compareStoredCVE(db *sql.DB, item CVEItem) ([]string, error) {
+	cveID := item.CVE.CVEDataMeta.ID
+	stored, err := getCVE(db, defaultTenant, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", cveID, err)
+	}
+	source := recordFromItem(item)
+
+	var mismatches []string
+	compare := func(field string, stored, source []string) {
+		slices.Sort(stored)
+		slices.Sort(source)
+		if !slices.Equal(stored, source) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: stored %q, source %q", field, stored, source))
+		}
+	}
+	compare("description", []string{stored.Description}, []string{source.Description})
+	compare("assigner", []string{stored.Assigner}, []string{source.Assigner})
+	compare("published_date", []string{stored.PublishedDate}, []string{source.PublishedDate})
+	compare("last_modified_date", []string{stored.LastModifiedDate}, []string{source.LastModifiedDate})
+	compare("cvss", cvssStrings(stored.CVSS), cvssStrings(source.CVSS))
+	compare("cvss_scores", cvssScoreStrings(stored.CVSSScores), cvssScoreStrings(source.CVSSScores))
+	compare("cwes", stored.CWEs, source.CWEs)
+	compare("cve_tags", stored.CVETags, source.CVETags)
+	compare("advisories", advisoryStrings(stored.Advisories), advisoryStrings(source.Advisories))
+	compare("comments", commentStrings(stored.Comments), commentStrings(source.Comments))
+
+	cpes, err := storedCPEs(db, cveID)
+	if err != nil {
+		return nil, err
+	}
+	compare("cpes", cpes, expectedCPEs(item.Configurations.Nodes))
+	return mismatches, nil
+}
+
+func cvssStrings(c *CVSSRecord) []string {
+	if c == nil {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s %s %.1f %s", c.Version, c.VectorString, c.BaseScore, c.BaseSeverity)}
+}
+
+func cvssScoreStrings(scores []CVSSScoreRecord) []string {
+	var s []string
+	for _, c := range scores {
+		s = append(s, fmt.Sprintf("%s %s %s %s %.1f %s", c.Source, c.Type, c.Version, c.VectorString, c.BaseScore, c.BaseSeverity))
+	}
+	return s
+}
+
+func advisoryStrings(advisories []AdvisoryRecord) []string {
+	var s []string
+	for _, a := range advisories {
+		s = append(s, strings.Join([]string{a.Vendor, a.AdvisoryID, a.URL}, " "))
+	}
+	return s
+}
+
+func commentStrings(comments []CommentRecord) []string {
+	var s []string
+	for _, c := range comments {
+		s = append(s, strings.Join([]string{c.Kind, c.Organization, c.Comment}, " "))
+	}
+	return s
+}
+
+func cpeString(uri string, vulnerable bool, versionStart, versionEnd string, startExcluding, endIncluding bool) string {
+	open, closed := "[", ")"
+	if startExcluding {
+		open = "("
+	}
+	if endIncluding {
+		closed = "]"
+	}
+	return fmt.Sprintf("%s %s%s, %s%s vulnerable=%t", uri, open, versionStart, versionEnd, closed, vulnerable)
+}
+
+func storedCPEs(db *sql.DB, cveID string) ([]string, error) {
+	rows, err := db.Query(`SELECT cpe_uri, vulnerable, COALESCE(version_start, ''), COALESCE(version_end, ''),
+								  version_start_excluding, version_end_including
+						   FROM cpe_data WHERE cve_id = $1`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CPEs of %s: %v", cveID, err)
+	}
+	defer rows.Close()
+	var cpes []string
+	for rows.Next() {
+		var uri, versionStart, versionEnd string
+		var vulnerable, startExcluding, endIncluding bool
+		if err := rows.Scan(&uri, &vulnerable, &versionStart, &versionEnd, &startExcluding, &endIncluding); err != nil {
+			return nil, err
+		}
+		cpes = append(cpes, cpeString(uri, vulnerable, versionStart, versionEnd, startExcluding, endIncluding))
+	}
+	return cpes, rows.Err()
+}
+
+// expectedCPEs lists the cpe_data rows insertConfigurations writes for nodes:
+// a CPE and range that appears in several nodes is stored once, as first seen.
+func expectedCPEs(nodes []ConfigNode) []string {
+	type cpeKey struct {
+		uri string
+		r   versionRange
+	}
+	seen := map[cpeKey]bool{}
+	var cpes []string
+	var walk func(nodes []ConfigNode)
+	walk = func(nodes []ConfigNode) {
+		for _, node := range nodes {
+			for _, cpe := range node.CPEMatch {
+				uri, r := normalizeCPEURI(cpe.CPE23URI), cpe.versionRange()
+				key := cpeKey{uri, r}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				cpes = append(cpes, cpeString(uri, cpe.Vulnerable, normalizeVersion(r.start), normalizeVersion(r.end), r.startExcluding, r.endIncluding))
+			}
+			walk(node.Children)
+		}
+	}
+	walk(nodes)
+	return cpes
+}
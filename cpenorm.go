@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+var cpeRulesFile = flag.String("cpe-rules", "", "JSON file of rewrites applied to CPE names as they are stored and matched (default: store them as published)")
+
+// cpeRewrites is loaded from -cpe-rules at startup; empty passes CPE names
+// through unchanged.
+var cpeRewrites []CPERewrite
+
+// CPERewrite replaces the matches of Pattern in a CPE name with Replace, which
+// may refer to submatches as $1. Rules apply in order, each to the result of
+// the previous one. For example:
+//
+//	[{"pattern": "^cpe:2\\.3:a:nodejs:node\\.js:", "replace": "cpe:2.3:a:nodejs:node_js:"}]
+type CPERewrite struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace"`
+	re      *regexp.Regexp
+}
+
+func loadCPERules(path string) ([]CPERewrite, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CPE rules: %v", err)
+	}
+	var rules []CPERewrite
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse CPE rules: %v", err)
+	}
+	for i := range rules {
+		if rules[i].re, err = regexp.Compile(rules[i].Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern in CPE rule %d: %v", i, err)
+		}
+	}
+	return rules, nil
+}
+
+// normalizeCPEURI applies the -cpe-rules rewrites to a CPE name.
+func normalizeCPEURI(cpeURI string) string {
+	for _, r := range cpeRewrites {
+		cpeURI = r.re.ReplaceAllString(cpeURI, r.Replace)
+	}
+	return cpeURI
+}
+
+// unsplitCPEURI undoes the rewrite earlier versions applied to every CPE
+// name, which split a product containing one underscore into product and
+// version (cpe:2.3:a:nodejs:node_js:... became cpe:2.3:a:nodejs:node:js:...).
+// Such names have 14 components instead of 13, so the split is reversible.
+func unsplitCPEURI(cpeURI string) (string, bool) {
+	if strings.Contains(cpeURI, `\:`) {
+		return cpeURI, false
+	}
+	parts := strings.Split(cpeURI, ":")
+	if len(parts) != 14 || parts[0] != "cpe" || parts[1] != "2.3" {
+		return cpeURI, false
+	}
+	parts = slices.Replace(parts, 4, 6, parts[4]+"_"+parts[5])
+	return strings.Join(parts, ":"), true
+}
+
+// repairCPEs rewrites the CPE names split by earlier versions in cpe_data and
+// internal_advisory_products to the names as published, then applies the
+// -cpe-rules rewrites. A repaired row that now duplicates another is dropped.
+// It returns the number of names repaired.
+func repairCPEs(db *sql.DB, dryRun bool) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	repaired := 0
+	touched := map[string]bool{}
+	for _, t := range []struct{ table, sameKey string }{
+		{"cpe_data", "d.cve_id = t.cve_id AND d.version_start_raw = t.version_start_raw AND d.version_end_raw = t.version_end_raw AND d.version_start_excluding = t.version_start_excluding AND d.version_end_including = t.version_end_including"},
+		{"internal_advisory_products", "d.tenant = t.tenant AND d.advisory_id = t.advisory_id"},
+	} {
+		rows, err := tx.Query(`SELECT DISTINCT cpe_uri FROM ` + t.table + ` WHERE cardinality(string_to_array(cpe_uri, ':')) = 14`)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find split CPE names in %s: %v", t.table, err)
+		}
+		var split []string
+		for rows.Next() {
+			var uri string
+			if err := rows.Scan(&uri); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			split = append(split, uri)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, fmt.Errorf("failed to find split CPE names in %s: %v", t.table, err)
+		}
+
+		for _, uri := range split {
+			fixed, ok := unsplitCPEURI(uri)
+			if !ok {
+				continue
+			}
+			fixed = normalizeCPEURI(fixed)
+			repaired++
+			if dryRun {
+				fmt.Printf("%s: %s -> %s\n", t.table, uri, fixed)
+				continue
+			}
+			if t.table == "cpe_data" {
+				ids, err := tx.Query(`SELECT DISTINCT cve_id FROM cpe_data WHERE cpe_uri = $1`, uri)
+				if err != nil {
+					return 0, fmt.Errorf("failed to find the CVEs of %s: %v", uri, err)
+				}
+				for ids.Next() {
+					var id string
+					if err := ids.Scan(&id); err != nil {
+						ids.Close()
+						return 0, err
+					}
+					touched[id] = true
+				}
+				ids.Close()
+				if err := ids.Err(); err != nil {
+					return 0, fmt.Errorf("failed to find the CVEs of %s: %v", uri, err)
+				}
+			}
+			_, err := tx.Exec(`UPDATE `+t.table+` t SET cpe_uri = $2
+							   WHERE t.cpe_uri = $1 AND NOT EXISTS (
+								   SELECT 1 FROM `+t.table+` d
+								   WHERE `+t.sameKey+` AND d.cpe_uri = $2
+								   AND d.version_start IS NOT DISTINCT FROM t.version_start
+								   AND d.version_end IS NOT DISTINCT FROM t.version_end)`, uri, fixed)
+			if err != nil {
+				return 0, fmt.Errorf("failed to repair %s in %s: %v", uri, t.table, err)
+			}
+			if _, err := tx.Exec(`DELETE FROM `+t.table+` WHERE cpe_uri = $1`, uri); err != nil {
+				return 0, fmt.Errorf("failed to drop duplicates of %s in %s: %v", fixed, t.table, err)
+			}
+		}
+	}
+	if dryRun {
+		return repaired, nil
+	}
+
+	for id := range touched {
+		if err := storeContentHash(tx, id); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("transaction commit error: %v", err)
+	}
+	return repaired, nil
+}
+
+// runRepairCPEs implements the repair-cpes subcommand, which fixes the CPE
+// names stored by versions that split products at an underscore.
+func runRepairCPEs(args []string) error {
+	fs := flag.NewFlagSet("repair-cpes", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "list the names that would be repaired without changing them")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
+
+	n, err := repairCPEs(db, *dryRun)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		log.Printf("%d CPE names need repair\n", n)
+		return nil
+	}
+	if err := refreshDerivedFields(db); err != nil {
+		return err
+	}
+	log.Printf("Repaired %d CPE names\n", n)
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// csvMapping describes a legacy vulnerability spreadsheet exported as CSV:
+//
+//	columns:                 # header names in the CSV, matched case-insensitively
+//	  cve_id: CVE            # required
+//	  product: Product       # optional: a CPE prefix or vendor:product
+//	  status: Status         # optional
+//	  note: Comments         # optional
+//	tenant: default          # tenant of the annotations and watchlist entries
+//	author: legacy-tracker   # author of the annotations (default csv-import)
+//	delimiter: ";"           # default ","
+//	cpe_part: a              # CPE part for vendor:product values (default a)
+type csvMapping struct {
+	Columns struct {
+		CVEID   string `yaml:"cve_id"`
+		Product string `yaml:"product"`
+		Status  string `yaml:"status"`
+		Note    string `yaml:"note"`
+	} `yaml:"columns"`
+	Tenant    string `yaml:"tenant"`
+	Author    string `yaml:"author"`
+	Delimiter string `yaml:"delimiter"`
+	CPEPart   string `yaml:"cpe_part"`
+}
+
+func loadCSVMapping(path string) (*csvMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping: %v", err)
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	m := csvMapping{Tenant: defaultTenant, Author: "csv-import", Delimiter: ",", CPEPart: "a"}
+	if err := dec.Decode(&m); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse mapping: %v", err)
+	}
+	if m.Columns.CVEID == "" {
+		return nil, fmt.Errorf("the mapping must name the cve_id column")
+	}
+	if utf8.RuneCountInString(m.Delimiter) != 1 {
+		return nil, fmt.Errorf("delimiter must be a single character")
+	}
+	if m.CPEPart != "a" && m.CPEPart != "o" && m.CPEPart != "h" {
+		return nil, fmt.Errorf("cpe_part must be a, o or h")
+	}
+	return &m, nil
+}
+
+// csvProductPrefix turns a product cell into a watchlist CPE prefix. It
+// accepts CPE prefixes and vendor:product pairs; anything else, such as a
+// bare product name, cannot be mapped.
+func csvProductPrefix(product, part string) (string, bool) {
+	product = strings.ToLower(strings.TrimSpace(product))
+	if strings.HasPrefix(product, "cpe:2.3:") {
+		return product, true
+	}
+	vendor, name, ok := strings.Cut(product, ":")
+	if !ok || vendor == "" || name == "" || strings.ContainsAny(name, ": ") {
+		return "", false
+	}
+	return "cpe:2.3:" + part + ":" + vendor + ":" + name + ":", true
+}
+
+// csvImportStats counts what an import did.
+type csvImportStats struct {
+	rows, annotations, watchlist, unknownCVEs, invalid int
+}
+
+// importCSV loads the rows of a legacy spreadsheet in one transaction: each
+// row becomes an annotation on its CVE recording the status, product and note,
+// and each mappable product a watchlist entry of the tenant. Rows already
+// imported and products already watched are skipped, so importing a file
+// again is harmless. With dryRun nothing is committed.
+func importCSV(db *sql.DB, m *csvMapping, path string, dryRun bool) (*csvImportStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comma, _ = utf8.DecodeRuneInString(m.Delimiter)
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CSV header: %v", err)
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	column := func(name string) (int, error) {
+		if name == "" {
+			return -1, nil
+		}
+		i, ok := index[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("column %q not found in the CSV header", name)
+		}
+		return i, nil
+	}
+	var cols [4]int
+	for i, name := range []string{m.Columns.CVEID, m.Columns.Product, m.Columns.Status, m.Columns.Note} {
+		if cols[i], err = column(name); err != nil {
+			return nil, err
+		}
+	}
+	cell := func(record []string, col int) string {
+		if col < 0 || col >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[col])
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stats := &csvImportStats{}
+	source := filepath.Base(path)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", source, err)
+		}
+		stats.rows++
+		line, _ := r.FieldPos(0)
+
+		cveID, ok := normalizeCVEID(cell(record, cols[0]))
+		if !ok {
+			log.Printf("Skipping %s line %d: invalid CVE ID %q\n", source, line, cell(record, cols[0]))
+			stats.invalid++
+			continue
+		}
+		product, status, note := cell(record, cols[1]), cell(record, cols[2]), cell(record, cols[3])
+
+		text := fmt.Sprintf("Imported from %s", source)
+		if status != "" {
+			text += fmt.Sprintf(", status **%s**", status)
+		}
+		if product != "" {
+			text += fmt.Sprintf(", product %s", product)
+		}
+		text += "."
+		if note != "" {
+			text += "\n\n" + note
+		}
+		res, err := tx.Exec(`INSERT INTO annotations (tenant, cve_id, author, text)
+							 SELECT $4, cve_id, $2, $3 FROM cve_data1 c WHERE cve_id = $1
+							 AND NOT EXISTS (SELECT 1 FROM annotations a
+											 WHERE a.tenant = $4 AND a.cve_id = c.cve_id AND a.author = $2 AND a.text = $3)`,
+			cveID, m.Author, text, m.Tenant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to annotate %s: %v", cveID, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			stats.annotations++
+		} else {
+			var exists bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM cve_data1 WHERE cve_id = $1)`, cveID).Scan(&exists); err != nil {
+				return nil, err
+			}
+			if !exists {
+				log.Printf("Skipping the annotation of %s line %d: %s is not stored\n", source, line, cveID)
+				stats.unknownCVEs++
+			}
+		}
+
+		if product == "" {
+			continue
+		}
+		prefix, ok := csvProductPrefix(product, m.CPEPart)
+		if !ok {
+			log.Printf("Not watching %q (%s line %d): want a CPE prefix or vendor:product\n", product, source, line)
+			continue
+		}
+		res, err = tx.Exec(`INSERT INTO watchlist (tenant, name, cpe_prefix)
+							SELECT $1, $2, $3
+							WHERE NOT EXISTS (SELECT 1 FROM watchlist WHERE tenant = $1 AND cpe_prefix = $3)`,
+			m.Tenant, product, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add watchlist entry %s: %v", prefix, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			stats.watchlist++
+		}
+	}
+
+	if dryRun {
+		return stats, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("transaction commit error: %v", err)
+	}
+	return stats, nil
+}
+
+// runImportCSV implements "import csv", which migrates a spreadsheet of
+// manually tracked vulnerabilities into annotations and the watchlist.
+func runImportCSV(args []string) error {
+	fs := flag.NewFlagSet("import csv", flag.ExitOnError)
+	mappingPath := fs.String("mapping", "", "YAML file mapping the CSV columns (required)")
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without storing it")
+	fs.Parse(args)
+	if *mappingPath == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: import csv -mapping map.yaml [-dry-run] <file.csv>")
+	}
+	mapping, err := loadCSVMapping(*mappingPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
+
+	stats, err := importCSV(db, mapping, fs.Arg(0), *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	log.Printf("%s %d rows: %d annotations and %d watchlist entries added; %d rows with an unknown CVE, %d with an invalid CVE ID\n",
+		verb, stats.rows, stats.annotations, stats.watchlist, stats.unknownCVEs, stats.invalid)
+	return nil
+}
@@ -1,17 +1,27 @@
 CREATE TABLE cpe_data (
-    cve_id VARCHAR(255) PRIMARY KEY,
+    cve_id VARCHAR(255),
     cpe_uri TEXT,
     vulnerable BOOLEAN,
     version_start VARCHAR(255),
     version_end VARCHAR(255),
-    config INTEGER
+    config INTEGER,
+    node_id INTEGER,
+    parent_node_id INTEGER,
+    match_criteria_id VARCHAR(255),
+    PRIMARY KEY (cve_id, cpe_uri, version_start, version_end)
 );
 
+CREATE TYPE exploit_maturity AS ENUM ('none', 'poc', 'weaponized', 'active');
+
 CREATE TABLE cve_data1 (
     cve_id VARCHAR(255) PRIMARY KEY,
     description TEXT,
     published_date DATE,
-    last_modified_date DATE
+    last_modified_date DATE,
+    has_public_exploit BOOLEAN DEFAULT false,
+    has_metasploit BOOLEAN DEFAULT false,
+    exploit_maturity exploit_maturity DEFAULT 'none',
+    risk_score NUMERIC
 );
 
 CREATE TABLE impact_data (
@@ -20,4 +30,218 @@ CREATE TABLE impact_data (
     cvss_vector_string VARCHAR(255),
     cvss_base_score NUMERIC,
     cvss_base_severity VARCHAR(255)
-);
\ No newline at end of file
+);
+
+CREATE TABLE cve_quarantine (
+    id SERIAL PRIMARY KEY,
+    cve_id VARCHAR(255),
+    reasons TEXT,
+    record JSONB,
+    quarantined_at TIMESTAMP DEFAULT now()
+);
+
+
+CREATE TABLE match_criteria (
+    match_criteria_id VARCHAR(255) PRIMARY KEY,
+    criteria TEXT,
+    version_start_including VARCHAR(255),
+    version_start_excluding VARCHAR(255),
+    version_end_including VARCHAR(255),
+    version_end_excluding VARCHAR(255),
+    status VARCHAR(50),
+    last_modified TIMESTAMP
+);
+
+CREATE TABLE match_criteria_names (
+    match_criteria_id VARCHAR(255),
+    cpe_name TEXT,
+    cpe_name_id VARCHAR(255),
+    PRIMARY KEY (match_criteria_id, cpe_name)
+);
+
+CREATE TABLE cpe_name_lookup (
+    cve_id VARCHAR(255),
+    cpe_name TEXT,
+    match_criteria_id VARCHAR(255),
+    PRIMARY KEY (cve_id, cpe_name, match_criteria_id)
+);
+
+CREATE INDEX cpe_name_lookup_cpe_name_idx ON cpe_name_lookup (cpe_name);
+
+CREATE TABLE advisories (
+    cve_id VARCHAR(255),
+    vendor VARCHAR(255),
+    advisory_id VARCHAR(255),
+    url TEXT,
+    PRIMARY KEY (cve_id, url)
+);
+
+CREATE INDEX advisories_advisory_id_idx ON advisories (advisory_id);
+
+CREATE TABLE exploits (
+    exploit_id VARCHAR(50),
+    cve_id VARCHAR(255),
+    description TEXT,
+    type VARCHAR(50),
+    platform VARCHAR(100),
+    date_published DATE,
+    verified BOOLEAN,
+    PRIMARY KEY (exploit_id, cve_id)
+);
+
+CREATE INDEX exploits_cve_id_idx ON exploits (cve_id);
+
+CREATE TABLE metasploit_modules (
+    module_name VARCHAR(255),
+    cve_id VARCHAR(255),
+    name TEXT,
+    type VARCHAR(50),
+    rank INTEGER,
+    disclosure_date DATE,
+    PRIMARY KEY (module_name, cve_id)
+);
+
+CREATE INDEX metasploit_modules_cve_id_idx ON metasploit_modules (cve_id);
+
+CREATE TABLE kev (
+    cve_id VARCHAR(255) PRIMARY KEY,
+    vendor_project VARCHAR(255),
+    product VARCHAR(255),
+    vulnerability_name TEXT,
+    date_added DATE,
+    due_date DATE,
+    known_ransomware_campaign_use VARCHAR(50)
+);
+
+CREATE TABLE epss (
+    cve_id VARCHAR(255) PRIMARY KEY,
+    score NUMERIC,
+    percentile NUMERIC,
+    score_date DATE
+);
+
+CREATE TABLE cve_cwe (
+    cve_id VARCHAR(255),
+    cwe_id VARCHAR(50),
+    PRIMARY KEY (cve_id, cwe_id)
+);
+
+CREATE INDEX cve_cwe_cwe_id_idx ON cve_cwe (cwe_id);
+
+CREATE TABLE capec_patterns (
+    capec_id VARCHAR(50) PRIMARY KEY,
+    name TEXT,
+    description TEXT,
+    abstraction VARCHAR(50),
+    likelihood VARCHAR(50),
+    severity VARCHAR(50),
+    status VARCHAR(50)
+);
+
+CREATE TABLE cwe_capec (
+    cwe_id VARCHAR(50),
+    capec_id VARCHAR(50),
+    PRIMARY KEY (cwe_id, capec_id)
+);
+
+CREATE TABLE capec_attack (
+    capec_id VARCHAR(50),
+    technique_id VARCHAR(50),
+    technique_name TEXT,
+    PRIMARY KEY (capec_id, technique_id)
+);
+
+CREATE TABLE cwe_entries (
+    cwe_id VARCHAR(50) PRIMARY KEY,
+    name TEXT,
+    description TEXT,
+    kind VARCHAR(20),
+    status VARCHAR(50)
+);
+
+CREATE TABLE cwe_relations (
+    child_id VARCHAR(50),
+    parent_id VARCHAR(50),
+    view_id VARCHAR(20),
+    PRIMARY KEY (child_id, parent_id, view_id)
+);
+
+CREATE TABLE watchlist (
+    id SERIAL PRIMARY KEY,
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    name TEXT,
+    cpe_prefix TEXT NOT NULL
+);
+
+CREATE TABLE jira_issues (
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    cve_id VARCHAR(255),
+    product VARCHAR(255),
+    issue_key VARCHAR(50),
+    status VARCHAR(20),
+    last_modified VARCHAR(50),
+    PRIMARY KEY (tenant, cve_id, product)
+);
+
+CREATE TABLE alerts (
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    cve_id VARCHAR(255),
+    rule VARCHAR(255),
+    status VARCHAR(20) NOT NULL,
+    triggered_at TIMESTAMP DEFAULT now(),
+    updated_at TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (tenant, cve_id)
+);
+
+CREATE TABLE alert_transitions (
+    id SERIAL PRIMARY KEY,
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    cve_id VARCHAR(255),
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    actor TEXT,
+    note TEXT,
+    at TIMESTAMP DEFAULT now(),
+    FOREIGN KEY (tenant, cve_id) REFERENCES alerts (tenant, cve_id)
+);
+
+CREATE INDEX alert_transitions_cve_id_idx ON alert_transitions (tenant, cve_id);
+
+CREATE TABLE tags (
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    cve_id VARCHAR(255) REFERENCES cve_data1 (cve_id),
+    tag VARCHAR(64),
+    created_at TIMESTAMP DEFAULT now(),
+    PRIMARY KEY (tenant, cve_id, tag)
+);
+
+CREATE INDEX tags_tag_idx ON tags (tenant, tag);
+
+CREATE TABLE annotations (
+    id SERIAL PRIMARY KEY,
+    cve_id VARCHAR(255) REFERENCES cve_data1 (cve_id),
+    author TEXT NOT NULL,
+    text TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT now()
+);
+
+CREATE INDEX annotations_cve_id_idx ON annotations (cve_id);
+
+CREATE TABLE suppressions (
+    id SERIAL PRIMARY KEY,
+    cve_id VARCHAR(255),
+    cpe_prefix TEXT,
+    package VARCHAR(255),
+    justification TEXT NOT NULL,
+    created_by TEXT,
+    created_at TIMESTAMP DEFAULT now(),
+    expires_at TIMESTAMP,
+    CHECK (cve_id IS NOT NULL OR cpe_prefix IS NOT NULL OR package IS NOT NULL)
+);
+
+CREATE TABLE api_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    tenant VARCHAR(64) NOT NULL,
+    name TEXT,
+    created_at TIMESTAMP DEFAULT now()
+);
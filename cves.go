@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// CVERecord is the stored view of a CVE returned by the query API.
+type CVERecord struct {
+	ID               string      `json:"cve_id"`
+	Assigner         string      `json:"assigner,omitempty"`
+	Description      string      `json:"description"`
+	PublishedDate    string      `json:"published_date"`
+	LastModifiedDate string      `json:"last_modified_date"`
+	HasPublicExploit bool        `json:"has_public_exploit"`
+	HasMetasploit    bool        `json:"has_metasploit"`
+	ExploitMaturity  string      `json:"exploit_maturity"`
+	RiskScore        *float64    `json:"risk_score,omitempty"`
+	InKEV            bool        `json:"in_kev"`
+	EPSSScore        *float64    `json:"epss_score,omitempty"`
+	EPSSPercentile   *float64    `json:"epss_percentile,omitempty"`
+	CVSS             *CVSSRecord `json:"cvss,omitempty"`
+	// CVSSScores are the scores of every provider; CVSS is the preferred one.
+	CVSSScores        []CVSSScoreRecord `json:"cvss_scores,omitempty"`
+	CWEs              []string          `json:"cwes,omitempty"`
+	MetasploitModules []string          `json:"metasploit_modules,omitempty"`
+	Advisories        []AdvisoryRecord  `json:"advisories,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
+	CVETags           []string          `json:"cve_tags,omitempty"`
+	Comments          []CommentRecord   `json:"comments,omitempty"`
+	// Enrichments hold the data of each third-party enricher.
+	Enrichments map[string]json.RawMessage `json:"enrichments,omitempty"`
+	// AsOf is set when the record was rebuilt from cve_history.
+	AsOf       *time.Time  `json:"as_of,omitempty"`
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+type CVSSRecord struct {
+	Version      string  `json:"version"`
+	VectorString string  `json:"vector_string"`
+	BaseScore    float64 `json:"base_score"`
+	BaseSeverity string  `json:"base_severity"`
+	// Temporal metrics are only set when the vector carries them.
+	ExploitCodeMaturity string   `json:"exploit_code_maturity,omitempty"`
+	RemediationLevel    string   `json:"remediation_level,omitempty"`
+	ReportConfidence    string   `json:"report_confidence,omitempty"`
+	TemporalScore       *float64 `json:"temporal_score,omitempty"`
+	// Environmental metrics are the overrides set through the API.
+	EnvironmentalMetrics string   `json:"environmental_metrics,omitempty"`
+	EnvironmentalScore   *float64 `json:"environmental_score,omitempty"`
+}
+
+type CVSSScoreRecord struct {
+	Source       string  `json:"source"`
+	Type         string  `json:"type"`
+	Version      string  `json:"version"`
+	VectorString string  `json:"vector_string"`
+	BaseScore    float64 `json:"base_score"`
+	BaseSeverity string  `json:"base_severity"`
+}
+
+type AdvisoryRecord struct {
+	Vendor     string `json:"vendor"`
+	AdvisoryID string `json:"advisory_id,omitempty"`
+	URL        string `json:"url"`
+}
+
+// getCVE loads a stored CVE with the tenant's tags, environmental overrides
+// and risk score. It returns sql.ErrNoRows if the CVE is unknown.
+func getCVE(db *sql.DB, tenant, cveID string) (*CVERecord, error) {
+	r := &CVERecord{ID: cveID}
+	var source, recordID sql.NullString
+	var ingestedAt sql.NullTime
+	var runID sql.NullInt64
+	err := db.QueryRow(`SELECT COALESCE(c.assigner, ''), c.description, `+utcTimestampSQL("c.published_date")+`, `+utcTimestampSQL("c.last_modified_date")+`,
+							   c.has_public_exploit, c.has_metasploit, c.exploit_maturity, COALESCE(rs.risk_score, c.risk_score),
+							   k.cve_id IS NOT NULL, e.score, e.percentile,
+							   c.source, c.source_record_id, c.ingested_at, c.run_id
+						FROM cve_data1 c
+						LEFT JOIN kev k ON k.cve_id = c.cve_id
+						LEFT JOIN epss e ON e.cve_id = c.cve_id
+						LEFT JOIN tenant_risk_scores rs ON rs.tenant = $2 AND rs.cve_id = c.cve_id
+						WHERE c.cve_id = $1`, cveID, tenant).
+		Scan(&r.Assigner, &r.Description, &r.PublishedDate, &r.LastModifiedDate, &r.HasPublicExploit, &r.HasMetasploit,
+			&r.ExploitMaturity, &r.RiskScore, &r.InKEV, &r.EPSSScore, &r.EPSSPercentile,
+			&source, &recordID, &ingestedAt, &runID)
+	if err != nil {
+		return nil, err
+	}
+	if source.Valid {
+		r.Provenance = &Provenance{Source: source.String, RecordID: recordID.String, IngestedAt: ingestedAt.Time.UTC()}
+		if runID.Valid {
+			r.Provenance.RunID = &runID.Int64
+		}
+	}
+
+	var cvss CVSSRecord
+	err = db.QueryRow(`SELECT i.cvss_version, i.cvss_vector_string, i.cvss_base_score, i.cvss_base_severity,
+							  COALESCE(i.exploit_code_maturity, ''), COALESCE(i.remediation_level, ''), COALESCE(i.report_confidence, ''),
+							  i.temporal_score, COALESCE(e.metrics, ''), e.environmental_score
+					   FROM impact_data i
+					   LEFT JOIN cvss_environmental e ON e.tenant = $2 AND e.cve_id = i.cve_id
+					   WHERE i.cve_id = $1`, cveID, tenant).
+		Scan(&cvss.Version, &cvss.VectorString, &cvss.BaseScore, &cvss.BaseSeverity,
+			&cvss.ExploitCodeMaturity, &cvss.RemediationLevel, &cvss.ReportConfidence,
+			&cvss.TemporalScore, &cvss.EnvironmentalMetrics, &cvss.EnvironmentalScore)
+	switch {
+	case err == nil:
+		r.CVSS = &cvss
+	case err != sql.ErrNoRows:
+		return nil, fmt.Errorf("failed to load impact data: %v", err)
+	}
+
+	cwes, err := db.Query(`SELECT cwe_id FROM cve_cwe WHERE cve_id = $1 ORDER BY cwe_id`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CWEs: %v", err)
+	}
+	defer cwes.Close()
+	for cwes.Next() {
+		var cweID string
+		if err := cwes.Scan(&cweID); err != nil {
+			return nil, err
+		}
+		r.CWEs = append(r.CWEs, cweID)
+	}
+	if err := cwes.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT module_name FROM metasploit_modules WHERE cve_id = $1 ORDER BY module_name`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Metasploit modules: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		r.MetasploitModules = append(r.MetasploitModules, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	advisories, err := db.Query(`SELECT vendor, advisory_id, url FROM advisories WHERE cve_id = $1 ORDER BY url`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load advisories: %v", err)
+	}
+	defer advisories.Close()
+	for advisories.Next() {
+		var a AdvisoryRecord
+		if err := advisories.Scan(&a.Vendor, &a.AdvisoryID, &a.URL); err != nil {
+			return nil, err
+		}
+		r.Advisories = append(r.Advisories, a)
+	}
+	if err := advisories.Err(); err != nil {
+		return nil, err
+	}
+
+	r.Tags, err = getTags(db, tenant, cveID)
+	if err != nil {
+		return nil, err
+	}
+	err = db.QueryRow(`SELECT array_agg(tag ORDER BY tag) FROM cve_tags WHERE cve_id = $1`, cveID).Scan(pq.Array(&r.CVETags))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cveTags: %v", err)
+	}
+	r.Comments, err = getComments(db, cveID)
+	if err != nil {
+		return nil, err
+	}
+	r.CVSSScores, err = getCVSSScores(db, cveID)
+	if err != nil {
+		return nil, err
+	}
+	r.Enrichments, err = getEnrichments(db, cveID)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CVEFilter narrows a CVE search. Every listed tag must have been set by
+// Tenant.
+type CVEFilter struct {
+	Tenant   string
+	Tags     []string
+	Assigner string
+	Limit    int
+	Offset   int
+}
+
+// CVESummary is a CVE as listed by a search.
+type CVESummary struct {
+	ID            string   `json:"cve_id"`
+	Assigner      string   `json:"assigner,omitempty"`
+	PublishedDate string   `json:"published_date"`
+	BaseScore     *float64 `json:"base_score,omitempty"`
+	BaseSeverity  string   `json:"base_severity,omitempty"`
+	RiskScore     *float64 `json:"risk_score,omitempty"`
+	CVETags       []string `json:"cve_tags,omitempty"`
+	// Internal is set when ID is the ID of an internal advisory.
+	Internal bool `json:"internal,omitempty"`
+}
+
+// searchCVEs lists the stored CVEs matching filter, newest first. The
+// tenant's internal advisories are listed along with them unless the filter
+// names tags or an assigner, which only CVEs have.
+func searchCVEs(db *sql.DB, filter CVEFilter) ([]CVESummary, error) {
+	rows, err := db.Query(`SELECT c.cve_id, c.assigner, `+utcTimestampSQL("c.published_date")+`, c.base_score, c.base_severity, c.risk_score, c.cve_tags, c.internal
+						   FROM (
+							   SELECT c.cve_id, COALESCE(c.assigner, '') AS assigner, c.published_date, i.cvss_base_score AS base_score,
+									  COALESCE(i.cvss_base_severity, '') AS base_severity,
+									  COALESCE((SELECT rs.risk_score FROM tenant_risk_scores rs WHERE rs.tenant = $4 AND rs.cve_id = c.cve_id), c.risk_score) AS risk_score,
+									  (SELECT array_agg(t.tag ORDER BY t.tag) FROM cve_tags t WHERE t.cve_id = c.cve_id) AS cve_tags, false AS internal
+							   FROM cve_data1 c
+							   LEFT JOIN impact_data i ON i.cve_id = c.cve_id
+							   WHERE ($5 = '' OR c.assigner = $5)
+								 AND (cardinality($1::text[]) = 0 OR c.cve_id IN (
+								   SELECT cve_id FROM tags WHERE tenant = $4 AND tag = ANY($1)
+								   GROUP BY cve_id HAVING count(*) = cardinality($1::text[])))
+							   UNION ALL
+							   SELECT id, '', published_at, base_score, severity, NULL, NULL, true
+							   FROM internal_advisories
+							   WHERE tenant = $4 AND $5 = '' AND cardinality($1::text[]) = 0
+						   ) c
+						   ORDER BY c.published_date DESC, c.cve_id DESC
+						   LIMIT $2 OFFSET $3`, pq.Array(filter.Tags), filter.Limit, filter.Offset, filter.Tenant, filter.Assigner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search CVEs: %v", err)
+	}
+	defer rows.Close()
+
+	cves := []CVESummary{}
+	for rows.Next() {
+		var c CVESummary
+		if err := rows.Scan(&c.ID, &c.Assigner, &c.PublishedDate, &c.BaseScore, &c.BaseSeverity, &c.RiskScore, pq.Array(&c.CVETags), &c.Internal); err != nil {
+			return nil, err
+		}
+		cves = append(cves, c)
+	}
+	return cves, rows.Err()
+}
+
+// AssignerCount is the number of stored CVEs a CNA assigned.
+type AssignerCount struct {
+	Assigner string `json:"assigner"`
+	CVEs     int    `json:"cves"`
+}
+
+// assignerReport counts the stored CVEs per assigning CNA, most first.
+func assignerReport(db *sql.DB) ([]AssignerCount, error) {
+	rows, err := db.Query(`SELECT assigner, count(*) FROM cve_data1
+						   WHERE assigner IS NOT NULL
+						   GROUP BY assigner
+						   ORDER BY 2 DESC, 1`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build assigner report: %v", err)
+	}
+	defer rows.Close()
+
+	report := []AssignerCount{}
+	for rows.Next() {
+		var c AssignerCount
+		if err := rows.Scan(&c.Assigner, &c.CVEs); err != nil {
+			return nil, err
+		}
+		report = append(report, c)
+	}
+	return report, rows.Err()
+}
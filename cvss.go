@@ -0,0 +1,391 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+)
+
+// cvssWeights are the CVSS v3 metric values by metric and value. Privileges
+// Required depends on Scope and is handled separately.
+var cvssWeights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+	"E":  {"X": 1, "H": 1, "F": 0.97, "P": 0.94, "U": 0.91},
+	"RL": {"X": 1, "U": 1, "W": 0.97, "T": 0.96, "O": 0.95},
+	"RC": {"X": 1, "C": 1, "R": 0.96, "U": 0.92},
+	"CR": {"X": 1, "H": 1.5, "M": 1, "L": 0.5},
+	"IR": {"X": 1, "H": 1.5, "M": 1, "L": 0.5},
+	"AR": {"X": 1, "H": 1.5, "M": 1, "L": 0.5},
+}
+
+// cvssValues are the valid values of every CVSS v3 metric.
+var cvssValues = map[string]string{
+	"AV": "NALP", "AC": "LH", "PR": "NLH", "UI": "NR", "S": "UC", "C": "HLN", "I": "HLN", "A": "HLN",
+	"E": "XHFPU", "RL": "XUWTO", "RC": "XCRU",
+	"CR": "XHML", "IR": "XHML", "AR": "XHML",
+	"MAV": "XNALP", "MAC": "XLH", "MPR": "XNLH", "MUI": "XNR", "MS": "XUC", "MC": "XHLN", "MI": "XHLN", "MA": "XHLN",
+}
+
+var (
+	cvssBaseMetrics          = []string{"AV", "AC", "PR", "UI", "S", "C", "I", "A"}
+	cvssTemporalMetrics      = []string{"E", "RL", "RC"}
+	cvssEnvironmentalMetrics = []string{"CR", "IR", "AR", "MAV", "MAC", "MPR", "MUI", "MS", "MC", "MI", "MA"}
+)
+
+var errInvalidEnvironmental = errors.New("environmental metrics must be CR, IR, AR or modified base metrics (MAV, MAC, MPR, MUI, MS, MC, MI, MA), e.g. CR:H/MAV:L")
+
+// cvssVector is a parsed CVSS v3 vector: its version and metric values.
+type cvssVector struct {
+	version string
+	metrics map[string]string
+}
+
+// parseCVSSMetrics parses slash-separated metric:value pairs.
+func parseCVSSMetrics(s string) (map[string]string, error) {
+	metrics := map[string]string{}
+	for _, part := range strings.Split(s, "/") {
+		metric, value, ok := strings.Cut(part, ":")
+		values, known := cvssValues[metric]
+		if !ok || !known || len(value) != 1 || !strings.Contains(values, value) {
+			return nil, fmt.Errorf("invalid CVSS metric %q", part)
+		}
+		metrics[metric] = value
+	}
+	return metrics, nil
+}
+
+// parseCVSSVector parses a CVSS v3.0 or v3.1 vector string, e.g.
+// CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H/E:P/RL:O.
+func parseCVSSVector(s string) (cvssVector, error) {
+	prefix, rest, _ := strings.Cut(s, "/")
+	version := strings.TrimPrefix(prefix, "CVSS:")
+	if version != "3.0" && version != "3.1" {
+		return cvssVector{}, fmt.Errorf("unsupported CVSS vector %q", s)
+	}
+	metrics, err := parseCVSSMetrics(rest)
+	if err != nil {
+		return cvssVector{}, err
+	}
+	for _, m := range cvssBaseMetrics {
+		if metrics[m] == "" {
+			return cvssVector{}, fmt.Errorf("CVSS vector %q lacks %s", s, m)
+		}
+	}
+	return cvssVector{version: version, metrics: metrics}, nil
+}
+
+// parseEnvironmentalMetrics validates user supplied environmental overrides.
+func parseEnvironmentalMetrics(s string) (map[string]string, error) {
+	metrics, err := parseCVSSMetrics(s)
+	if err != nil {
+		return nil, errInvalidEnvironmental
+	}
+	for m := range metrics {
+		if !slices.Contains(cvssEnvironmentalMetrics, m) {
+			return nil, errInvalidEnvironmental
+		}
+	}
+	return metrics, nil
+}
+
+// hasTemporal reports whether the vector sets any temporal metric.
+func (v cvssVector) hasTemporal() bool {
+	for _, m := range cvssTemporalMetrics {
+		if v.metrics[m] != "" && v.metrics[m] != "X" {
+			return true
+		}
+	}
+	return false
+}
+
+// weight returns the weight of a metric, or 1 for an unset temporal or
+// requirement metric.
+func (v cvssVector) weight(metric string) float64 {
+	value := v.metrics[metric]
+	if value == "" {
+		value = "X"
+	}
+	return cvssWeights[metric][value]
+}
+
+// modified returns the value of a modified base metric, falling back to the
+// base metric when it is unset or X.
+func (v cvssVector) modified(metric string) string {
+	if value := v.metrics["M"+metric]; value != "" && value != "X" {
+		return value
+	}
+	return v.metrics[metric]
+}
+
+func privilegesWeight(value string, scopeChanged bool) float64 {
+	switch value {
+	case "N":
+		return 0.85
+	case "L":
+		if scopeChanged {
+			return 0.68
+		}
+		return 0.62
+	default:
+		if scopeChanged {
+			return 0.5
+		}
+		return 0.27
+	}
+}
+
+// cvssRoundup rounds up to one decimal as defined in CVSS v3.1, avoiding
+// floating point artifacts such as 4.000000001 rounding to 4.1.
+func cvssRoundup(x float64) float64 {
+	i := int64(math.Round(x * 100000))
+	if i%10000 == 0 {
+		return float64(i) / 100000
+	}
+	return float64(i/10000+1) / 10
+}
+
+// score computes the score of the vector from the given metric values,
+// which are either the base metrics or the modified ones.
+func (v cvssVector) score(metric func(string) string, requirements bool) float64 {
+	scopeChanged := metric("S") == "C"
+	c, i, a := cvssWeights["C"][metric("C")], cvssWeights["I"][metric("I")], cvssWeights["A"][metric("A")]
+	if requirements {
+		c, i, a = c*v.weight("CR"), i*v.weight("IR"), a*v.weight("AR")
+	}
+	iss := 1 - (1-c)*(1-i)*(1-a)
+	if requirements {
+		iss = math.Min(iss, 0.915)
+	}
+
+	var impact float64
+	switch {
+	case !scopeChanged:
+		impact = 6.42 * iss
+	case requirements && v.version == "3.1":
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss*0.9731-0.02, 13)
+	default:
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	if impact <= 0 {
+		return 0
+	}
+	exploitability := 8.22 * cvssWeights["AV"][metric("AV")] * cvssWeights["AC"][metric("AC")] *
+		privilegesWeight(metric("PR"), scopeChanged) * cvssWeights["UI"][metric("UI")]
+	if scopeChanged {
+		return cvssRoundup(math.Min(1.08*(impact+exploitability), 10))
+	}
+	return cvssRoundup(math.Min(impact+exploitability, 10))
+}
+
+func (v cvssVector) temporalFactor() float64 {
+	return v.weight("E") * v.weight("RL") * v.weight("RC")
+}
+
+// baseScore is the CVSS v3 base score of the vector.
+func (v cvssVector) baseScore() float64 {
+	return v.score(func(m string) string { return v.metrics[m] }, false)
+}
+
+// temporalScore is the base score adjusted by the temporal metrics.
+func (v cvssVector) temporalScore() float64 {
+	return cvssRoundup(v.baseScore() * v.temporalFactor())
+}
+
+// environmentalScore applies the security requirements and modified base
+// metrics, then the temporal metrics.
+func (v cvssVector) environmentalScore() float64 {
+	return cvssRoundup(v.score(v.modified, true) * v.temporalFactor())
+}
+
+// withMetrics returns a copy of the vector with the given metrics set.
+func (v cvssVector) withMetrics(overrides map[string]string) cvssVector {
+	metrics := make(map[string]string, len(v.metrics)+len(overrides))
+	for m, value := range v.metrics {
+		metrics[m] = value
+	}
+	for m, value := range overrides {
+		metrics[m] = value
+	}
+	return cvssVector{version: v.version, metrics: metrics}
+}
+
+// temporalMetrics returns the temporal metric values of a stored CVSS vector
+// and its temporal score, or nils when the vector has no temporal metrics.
+func temporalMetrics(vectorString string) (e, rl, rc sql.NullString, score sql.NullFloat64) {
+	v, err := parseCVSSVector(vectorString)
+	if err != nil || !v.hasTemporal() {
+		return
+	}
+	value := func(m string) sql.NullString {
+		return sql.NullString{String: v.metrics[m], Valid: v.metrics[m] != ""}
+	}
+	return value("E"), value("RL"), value("RC"), sql.NullFloat64{Float64: v.temporalScore(), Valid: true}
+}
+
+// setEnvironmentalMetrics stores a tenant's environmental overrides for a CVE
+// and scores them. It returns sql.ErrNoRows if the CVE has no CVSS v3 vector.
+func setEnvironmentalMetrics(db *sql.DB, tenant, cveID, metrics string) error {
+	overrides, err := parseEnvironmentalMetrics(metrics)
+	if err != nil {
+		return err
+	}
+	var vectorString string
+	if err := db.QueryRow(`SELECT cvss_vector_string FROM impact_data WHERE cve_id = $1`, cveID).Scan(&vectorString); err != nil {
+		return err
+	}
+	v, err := parseCVSSVector(vectorString)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO cvss_environmental (tenant, cve_id, metrics, environmental_score, updated_at)
+					  VALUES ($4, $1, $2, $3, now())
+					  ON CONFLICT (tenant, cve_id) DO UPDATE
+					  SET metrics = EXCLUDED.metrics, environmental_score = EXCLUDED.environmental_score, updated_at = now()`,
+		cveID, metrics, v.withMetrics(overrides).environmentalScore(), tenant)
+	if err != nil {
+		return fmt.Errorf("failed to store environmental metrics for %s: %v", cveID, err)
+	}
+	return nil
+}
+
+func deleteEnvironmentalMetrics(db *sql.DB, tenant, cveID string) error {
+	if _, err := db.Exec(`DELETE FROM cvss_environmental WHERE tenant = $1 AND cve_id = $2`, tenant, cveID); err != nil {
+		return fmt.Errorf("failed to delete environmental metrics for %s: %v", cveID, err)
+	}
+	return nil
+}
+
+// updateEnvironmentalScores rescores the environmental overrides, whose base
+// and temporal metrics may have changed with a sync.
+func updateEnvironmentalScores(db *sql.DB) error {
+	rows, err := db.Query(`SELECT e.tenant, e.cve_id, e.metrics, i.cvss_vector_string, e.environmental_score
+						   FROM cvss_environmental e JOIN impact_data i ON i.cve_id = e.cve_id`)
+	if err != nil {
+		return fmt.Errorf("failed to load environmental metrics: %v", err)
+	}
+	scores := map[[2]string]float64{}
+	for rows.Next() {
+		var tenant, cveID, metrics, vectorString string
+		var current sql.NullFloat64
+		if err := rows.Scan(&tenant, &cveID, &metrics, &vectorString, &current); err != nil {
+			rows.Close()
+			return err
+		}
+		overrides, err := parseEnvironmentalMetrics(metrics)
+		if err != nil {
+			continue
+		}
+		v, err := parseCVSSVector(vectorString)
+		if err != nil {
+			log.Printf("Cannot score environmental metrics of %s: %v\n", cveID, err)
+			continue
+		}
+		if score := v.withMetrics(overrides).environmentalScore(); !current.Valid || current.Float64 != score {
+			scores[[2]string{tenant, cveID}] = score
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for key, score := range scores {
+		if _, err := db.Exec(`UPDATE cvss_environmental SET environmental_score = $3 WHERE tenant = $1 AND cve_id = $2`, key[0], key[1], score); err != nil {
+			return fmt.Errorf("failed to update environmental score of %s: %v", key[1], err)
+		}
+	}
+	return nil
+}
+
+// nvdSource is the source identifier of NVD's own analysis.
+const nvdSource = "nvd@nist.gov"
+
+// CVSSMetric is one CVSS v3 score published for a CVE. Type is Primary for
+// NVD's own analysis and Secondary for other sources such as the CNA.
+type CVSSMetric struct {
+	Source       string  `json:"source"`
+	Type         string  `json:"type"`
+	Version      string  `json:"version"`
+	VectorString string  `json:"vectorString"`
+	BaseScore    float64 `json:"baseScore"`
+	BaseSeverity string  `json:"baseSeverity"`
+}
+
+// cvssMetrics returns every CVSS v3 score of the CVE. The 1.1 feeds carry a
+// single score, which is NVD's.
+func (item CVEItem) cvssMetrics() []CVSSMetric {
+	if len(item.CVSSMetrics) > 0 {
+		return item.CVSSMetrics
+	}
+	cvss := item.Impact.BaseMetricV3.CVSSV3
+	if cvss.Version == "" {
+		return nil
+	}
+	return []CVSSMetric{{Source: nvdSource, Type: "Primary", Version: cvss.Version,
+		VectorString: cvss.VectorString, BaseScore: cvss.BaseScore, BaseSeverity: cvss.BaseSeverity}}
+}
+
+// preferredCVSS picks the canonical score of a CVE assigned by assigner: the
+// provider ranked first by the cvss merge policy (by default NVD), then CVSS
+// 3.1 before 3.0, then by source so the choice is deterministic.
+func preferredCVSS(metrics []CVSSMetric, assigner string) *CVSSMetric {
+	if len(metrics) == 0 {
+		return nil
+	}
+	best := slices.MinFunc(metrics, func(a, b CVSSMetric) int {
+		return cmp.Or(
+			cmp.Compare(mergePolicies.rank(mergeFieldCVSS, a.Source, assigner), mergePolicies.rank(mergeFieldCVSS, b.Source, assigner)),
+			-cmp.Compare(a.Version, b.Version),
+			cmp.Compare(a.Source, b.Source),
+		)
+	})
+	return &best
+}
+
+// insertCVSSMetrics replaces the CVSS scores stored for a CVE. A source that
+// published the same version twice keeps its first score.
+func insertCVSSMetrics(tx *sql.Tx, cveID string, metrics []CVSSMetric) error {
+	if _, err := tx.Exec(`DELETE FROM cvss_metrics WHERE cve_id = $1`, cveID); err != nil {
+		return fmt.Errorf("failed to delete CVSS metrics for CVE ID %s: %v", cveID, err)
+	}
+	for _, m := range metrics {
+		_, err := tx.Exec(`INSERT INTO cvss_metrics (cve_id, source, type, version, vector_string, base_score, base_severity)
+						   VALUES ($1, $2, $3, $4, $5, $6, $7)
+						   ON CONFLICT (cve_id, source, version) DO NOTHING`,
+			cveID, m.Source, m.Type, m.Version, m.VectorString, m.BaseScore, m.BaseSeverity)
+		if err != nil {
+			return fmt.Errorf("failed to insert CVSS metric from %s for CVE ID %s: %v", m.Source, cveID, err)
+		}
+	}
+	return nil
+}
+
+// getCVSSScores returns the scores of every provider of a CVE, NVD's first.
+func getCVSSScores(db *sql.DB, cveID string) ([]CVSSScoreRecord, error) {
+	rows, err := db.Query(`SELECT source, type, version, vector_string, base_score, base_severity
+						   FROM cvss_metrics WHERE cve_id = $1
+						   ORDER BY type = 'Primary' DESC, version DESC, source`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CVSS scores: %v", err)
+	}
+	defer rows.Close()
+	var scores []CVSSScoreRecord
+	for rows.Next() {
+		var s CVSSScoreRecord
+		if err := rows.Scan(&s.Source, &s.Type, &s.Version, &s.VectorString, &s.BaseScore, &s.BaseSeverity); err != nil {
+			return nil, err
+		}
+		scores = append(scores, s)
+	}
+	return scores, rows.Err()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	cweURL = "https://cwe.mitre.org/data/xml/cwec_latest.xml.zip"
+	// cweResearchView is the Research Concepts view whose ChildOf relations
+	// form the weakness hierarchy.
+	cweResearchView = "1000"
+	// cweCategoryView groups weaknesses into categories such as
+	// "Memory Safety" (Comprehensive Categorization).
+	cweCategoryView = "1400"
+)
+
+var syncCWECatalog = flag.Bool("cwe", false, "sync the MITRE CWE catalog daily for category roll-ups")
+
+type cweCatalog struct {
+	Weaknesses []struct {
+		ID                string `xml:"ID,attr"`
+		Name              string `xml:"Name,attr"`
+		Status            string `xml:"Status,attr"`
+		Description       string `xml:"Description"`
+		RelatedWeaknesses []struct {
+			Nature string `xml:"Nature,attr"`
+			CWEID  string `xml:"CWE_ID,attr"`
+			ViewID string `xml:"View_ID,attr"`
+		} `xml:"Related_Weaknesses>Related_Weakness"`
+	} `xml:"Weaknesses>Weakness"`
+	Categories []struct {
+		ID      string `xml:"ID,attr"`
+		Name    string `xml:"Name,attr"`
+		Status  string `xml:"Status,attr"`
+		Summary string `xml:"Summary"`
+		Members []struct {
+			CWEID  string `xml:"CWE_ID,attr"`
+			ViewID string `xml:"View_ID,attr"`
+		} `xml:"Relationships>Has_Member"`
+	} `xml:"Categories>Category"`
+}
+
+func downloadCWE() (*cweCatalog, error) {
+	resp, err := http.Get(cweURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download CWE catalog: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download CWE catalog: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CWE catalog: %v", err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CWE archive: %v", err)
+	}
+
+	for _, f := range archive.File {
+		if !strings.HasSuffix(f.Name, ".xml") {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", f.Name, err)
+		}
+		defer r.Close()
+
+		var catalog cweCatalog
+		if err := xml.NewDecoder(r).Decode(&catalog); err != nil {
+			return nil, fmt.Errorf("failed to decode CWE catalog: %v", err)
+		}
+		return &catalog, nil
+	}
+	return nil, fmt.Errorf("CWE archive contains no XML file")
+}
+
+// syncCWE replaces cwe_entries and cwe_relations with the current catalog.
+// Weakness ChildOf relations and category membership are both stored as
+// child -> parent edges qualified by the view they belong to.
+func syncCWE(db *sql.DB) error {
+	catalog, err := downloadCWE()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"cwe_entries", "cwe_relations"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+			return fmt.Errorf("failed to clear %s: %v", table, err)
+		}
+	}
+
+	insertEntry := func(id, name, description, kind, status string) error {
+		_, err := tx.Exec(`INSERT INTO cwe_entries (cwe_id, name, description, kind, status) VALUES ($1, $2, $3, $4, $5)
+						   ON CONFLICT DO NOTHING`, "CWE-"+id, name, strings.TrimSpace(description), kind, status)
+		return err
+	}
+	insertRelation := func(child, parent, view string) error {
+		_, err := tx.Exec(`INSERT INTO cwe_relations (child_id, parent_id, view_id) VALUES ($1, $2, $3)
+						   ON CONFLICT DO NOTHING`, "CWE-"+child, "CWE-"+parent, view)
+		return err
+	}
+
+	for _, w := range catalog.Weaknesses {
+		if err := insertEntry(w.ID, w.Name, w.Description, "weakness", w.Status); err != nil {
+			return fmt.Errorf("failed to insert CWE-%s: %v", w.ID, err)
+		}
+		for _, rel := range w.RelatedWeaknesses {
+			if rel.Nature != "ChildOf" {
+				continue
+			}
+			if err := insertRelation(w.ID, rel.CWEID, rel.ViewID); err != nil {
+				return fmt.Errorf("failed to insert parent of CWE-%s: %v", w.ID, err)
+			}
+		}
+	}
+	for _, c := range catalog.Categories {
+		if err := insertEntry(c.ID, c.Name, c.Summary, "category", c.Status); err != nil {
+			return fmt.Errorf("failed to insert CWE-%s: %v", c.ID, err)
+		}
+		for _, m := range c.Members {
+			if err := insertRelation(m.CWEID, c.ID, m.ViewID); err != nil {
+				return fmt.Errorf("failed to insert member of CWE-%s: %v", c.ID, err)
+			}
+		}
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Synced %d CWE weaknesses and %d categories\n", len(catalog.Weaknesses), len(catalog.Categories))
+	return nil
+}
+
+// insertCWEs replaces the weakness classification of a CVE.
+func insertCWEs(tx *sql.Tx, cveID string, cweIDs []string) error {
+	if _, err := tx.Exec(`DELETE FROM cve_cwe WHERE cve_id = $1`, cveID); err != nil {
+		return fmt.Errorf("failed to delete CWEs for CVE ID %s: %v", cveID, err)
+	}
+	for _, cweID := range cweIDs {
+		if _, err := tx.Exec(`INSERT INTO cve_cwe (cve_id, cwe_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, cveID, cweID); err != nil {
+			return fmt.Errorf("failed to insert %s for CVE ID %s: %v", cweID, cveID, err)
+		}
+	}
+	return nil
+}
+
+// CWECategoryCount is the number of stored CVEs whose weaknesses roll up to a
+// CWE category.
+type CWECategoryCount struct {
+	CategoryID string `json:"category_id"`
+	Name       string `json:"name"`
+	CVEs       int    `json:"cves"`
+}
+
+// cweCategoryReport rolls every CVE's CWEs up the research hierarchy and
+// counts CVEs per category of the given view. A non-empty tag restricts the
+// report to CVEs the tenant tagged with it.
+func cweCategoryReport(db *sql.DB, view, tenant, tag string) ([]CWECategoryCount, error) {
+	rows, err := db.Query(`WITH RECURSIVE ancestors (cve_id, cwe_id) AS (
+							   SELECT cve_id, cwe_id FROM cve_cwe
+							   WHERE $3 = '' OR cve_id IN (SELECT cve_id FROM tags WHERE tenant = $4 AND tag = $3)
+							   UNION
+							   SELECT a.cve_id, r.parent_id
+							   FROM ancestors a
+							   JOIN cwe_relations r ON r.child_id = a.cwe_id AND r.view_id = $1
+						   )
+						   SELECT e.cwe_id, e.name, count(DISTINCT a.cve_id)
+						   FROM ancestors a
+						   JOIN cwe_relations m ON m.child_id = a.cwe_id AND m.view_id = $2
+						   JOIN cwe_entries e ON e.cwe_id = m.parent_id AND e.kind = 'category'
+						   GROUP BY e.cwe_id, e.name
+						   ORDER BY 3 DESC, 1`, cweResearchView, view, tag, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build CWE category report: %v", err)
+	}
+	defer rows.Close()
+
+	report := []CWECategoryCount{}
+	for rows.Next() {
+		var c CWECategoryCount
+		if err := rows.Scan(&c.CategoryID, &c.Name, &c.CVEs); err != nil {
+			return nil, err
+		}
+		report = append(report, c)
+	}
+	return report, rows.Err()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cdxBOM is a CycloneDX 1.5 Vulnerability Disclosure Report: the scanned
+// components and the vulnerabilities affecting them.
+type cdxBOM struct {
+	BOMFormat       string             `json:"bomFormat"`
+	SpecVersion     string             `json:"specVersion"`
+	SerialNumber    string             `json:"serialNumber"`
+	Version         int                `json:"version"`
+	Metadata        cdxMetadata        `json:"metadata"`
+	Components      []cdxComponent     `json:"components"`
+	Vulnerabilities []cdxVulnerability `json:"vulnerabilities"`
+}
+
+type cdxMetadata struct {
+	Timestamp string    `json:"timestamp"`
+	Tools     []cdxTool `json:"tools"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	BOMRef  string `json:"bom-ref"`
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	PURL    string `json:"purl,omitempty"`
+	CPE     string `json:"cpe,omitempty"`
+}
+
+type cdxVulnerability struct {
+	ID             string      `json:"id"`
+	Source         cdxSource   `json:"source"`
+	Ratings        []cdxRating `json:"ratings,omitempty"`
+	Affects        []cdxAffect `json:"affects"`
+	Recommendation string      `json:"recommendation,omitempty"`
+}
+
+type cdxSource struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type cdxRating struct {
+	Score    *float64 `json:"score,omitempty"`
+	Severity string   `json:"severity,omitempty"`
+	Method   string   `json:"method"`
+}
+
+type cdxAffect struct {
+	Ref string `json:"ref"`
+}
+
+// purlTypes maps package ecosystems to their package URL type.
+var purlTypes = map[string]string{
+	"npm": "npm", "pypi": "pypi", "maven": "maven", "go": "golang", "golang": "golang",
+	"crates.io": "cargo", "cargo": "cargo", "rubygems": "gem", "gem": "gem", "nuget": "nuget",
+	"packagist": "composer", "composer": "composer", "debian": "deb", "alpine": "apk",
+}
+
+// packageURL returns the purl of a package, pkg:generic for unknown
+// ecosystems.
+func packageURL(p PackageRef) string {
+	typ, ok := purlTypes[strings.ToLower(p.Ecosystem)]
+	if !ok {
+		typ = "generic"
+	}
+	name := p.Name
+	if typ == "maven" {
+		name = strings.Replace(name, ":", "/", 1)
+	}
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return fmt.Sprintf("pkg:%s/%s@%s", typ, strings.Join(segments, "/"), url.PathEscape(p.Version))
+}
+
+// vdrBuilder collects components and merges the findings of one CVE across
+// components into a single vulnerability.
+type vdrBuilder struct {
+	bom        cdxBOM
+	index      map[string]int
+	components map[string]bool
+}
+
+func newVDRBuilder() *vdrBuilder {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return &vdrBuilder{
+		bom: cdxBOM{
+			BOMFormat:    "CycloneDX",
+			SpecVersion:  "1.5",
+			SerialNumber: fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:]),
+			Version:      1,
+			Metadata: cdxMetadata{
+				Timestamp: time.Now().UTC().Format(time.RFC3339),
+				Tools:     []cdxTool{{Name: "cve-download-update"}},
+			},
+			Components:      []cdxComponent{},
+			Vulnerabilities: []cdxVulnerability{},
+		},
+		index:      map[string]int{},
+		components: map[string]bool{},
+	}
+}
+
+// addComponent adds a component unless one with the same bom-ref was added
+// already, as bom-refs must be unique within a BOM. It reports whether the
+// component was added.
+func (b *vdrBuilder) addComponent(c cdxComponent) bool {
+	if b.components[c.BOMRef] {
+		return false
+	}
+	b.components[c.BOMRef] = true
+	b.bom.Components = append(b.bom.Components, c)
+	return true
+}
+
+// addFinding records that the component ref is affected by a CVE. fixed is
+// the first unaffected version, if known.
+func (b *vdrBuilder) addFinding(ref, cveID string, score *float64, severity, fixed string) {
+	i, ok := b.index[cveID]
+	if !ok {
+		v := cdxVulnerability{
+			ID:     cveID,
+			Source: cdxSource{Name: "NVD", URL: "https://nvd.nist.gov/vuln/detail/" + cveID},
+		}
+		if score != nil || severity != "" {
+			v.Ratings = []cdxRating{{Score: score, Severity: strings.ToLower(severity), Method: "CVSSv3"}}
+		}
+		i = len(b.bom.Vulnerabilities)
+		b.index[cveID] = i
+		b.bom.Vulnerabilities = append(b.bom.Vulnerabilities, v)
+	}
+	v := &b.bom.Vulnerabilities[i]
+	v.Affects = append(v.Affects, cdxAffect{Ref: ref})
+	if fixed != "" && v.Recommendation == "" {
+		v.Recommendation = "Upgrade to " + fixed + " or later"
+	}
+}
+
+// packageScanVDR renders POST /scan/packages results as a VDR. Packages that
+// could not be scanned are left out, and a package listed more than once is
+// one component.
+func packageScanVDR(results []PackageScanResult) cdxBOM {
+	b := newVDRBuilder()
+	for _, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		ref := packageURL(r.PackageRef)
+		if !b.addComponent(cdxComponent{BOMRef: ref, Type: "library", Name: r.Name, Version: r.Version, PURL: ref}) {
+			continue
+		}
+		for _, f := range r.Vulnerabilities {
+			b.addFinding(ref, f.CVEID, f.BaseScore, f.BaseSeverity, f.FixedVersion)
+		}
+	}
+	return b.bom
+}
+
+// matchVDR renders POST /match results as a VDR. Items that could not be
+// matched are left out.
+func matchVDR(results []MatchResult) cdxBOM {
+	b := newVDRBuilder()
+	for i, r := range results {
+		if r.Error != "" {
+			continue
+		}
+		ref := fmt.Sprintf("item-%d", i+1)
+		name, version := r.CPE, r.Version
+		if parts := strings.Split(r.CPE, ":"); len(parts) > 5 {
+			name = parts[4]
+			if version == "" {
+				version = parts[5]
+			}
+		}
+		b.addComponent(cdxComponent{BOMRef: ref, Type: "application", Name: name, Version: version, CPE: r.CPE})
+		for _, m := range r.Matches {
+			b.addFinding(ref, m.CVEID, m.BaseScore, m.BaseSeverity, m.fixedVersion())
+		}
+	}
+	return b.bom
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"cve-download-update/nvdmock"
+)
+
+// runDevServer implements the devserver subcommand, which serves the bundled
+// fixture feeds of package nvdmock in place of NVD.
+func runDevServer(args []string) error {
+	fs := flag.NewFlagSet("devserver", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8081", "address to serve the feeds on")
+	fs.Parse(args)
+
+	log.Printf("Serving fixture NVD feeds on %s; point ingestion at them with -nvd-feed-url http://%s%s\n", *addr, *addr, nvdmock.FeedPath)
+	return http.ListenAndServe(*addr, nvdmock.Handler())
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// requiredIndexes are the indexes the sync and the query API rely on.
+// Primary keys are checked implicitly by the tables existing.
+var requiredIndexes = []struct{ table, name string }{
+	{"cve_data1", "cve_data1_last_modified_date_idx"},
+	{"cve_data1", "cve_data1_published_date_idx"},
+	{"cve_data1", "cve_data1_description_trgm_idx"},
+	{"cve_data1", "cve_data1_assigner_idx"},
+	{"cve_data1", "cve_data1_change_seq_idx"},
+	{"cve_data1", "cve_data1_run_id_idx"},
+	{"impact_data", "impact_data_severity_idx"},
+	{"cpe_data", "cpe_data_vendor_product_idx"},
+	{"cpe_data", "cpe_data_product_idx"},
+	{"cve_quarantine", "cve_quarantine_cve_id_idx"},
+	{"cpe_name_lookup", "cpe_name_lookup_cpe_name_idx"},
+	{"advisories", "advisories_advisory_id_idx"},
+	{"cve_cwe", "cve_cwe_cwe_id_idx"},
+	{"tags", "tags_tag_idx"},
+	{"cve_nvd_history", "cve_nvd_history_cve_id_idx"},
+	{"epss_history", "epss_history_score_date_idx"},
+	{"score_history", "score_history_cve_id_idx"},
+	{"event_outbox", "event_outbox_pending_idx"},
+}
+
+const (
+	// bloatMinBytes keeps small indexes out of the bloat report; rebuilding
+	// them gains nothing.
+	bloatMinBytes = 10 << 20
+	// bloatMaxLeafDensity is the leaf page fill below which a B-tree index is
+	// reported as bloated. Freshly built indexes sit around 90%.
+	bloatMaxLeafDensity = 50
+)
+
+// doctorCheck inspects one aspect of the database and returns the problems it
+// found. Notes are informational and do not fail the check.
+type doctorCheck struct {
+	name string
+	run  func(db *sql.DB) (problems, notes []string, err error)
+}
+
+var doctorChecks = []doctorCheck{
+	{"migrations", checkMigrations},
+	{"indexes", checkIndexes},
+	{"index bloat", checkIndexBloat},
+	{"CVE IDs", checkCVEIDs},
+}
+
+// cveIDTables are the tables filled from sources that name CVEs themselves.
+var cveIDTables = []string{"cve_data1", "kev", "epss", "exploits", "metasploit_modules", "cve_nvd_history"}
+
+func checkMigrations(db *sql.DB) ([]string, []string, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, nil, err
+	}
+	var problems []string
+	for _, m := range migrations {
+		var applied bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version).Scan(&applied)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+		}
+		if !applied {
+			problems = append(problems, "pending migration "+m.name)
+		}
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return problems, []string{fmt.Sprintf("schema version %d", version)}, nil
+}
+
+func checkIndexes(db *sql.DB) ([]string, []string, error) {
+	var problems []string
+	for _, idx := range requiredIndexes {
+		var valid bool
+		err := db.QueryRow(`SELECT i.indisvalid
+							FROM pg_class c JOIN pg_index i ON i.indexrelid = c.oid
+							WHERE c.relname = $1 AND c.relkind = 'i' AND pg_table_is_visible(c.oid)`, tableName(idx.name)).Scan(&valid)
+		switch {
+		case err == sql.ErrNoRows:
+			problems = append(problems, fmt.Sprintf("missing index %s on %s", idx.name, idx.table))
+		case err != nil:
+			return nil, nil, fmt.Errorf("failed to look up index %s: %v", idx.name, err)
+		case !valid:
+			problems = append(problems, fmt.Sprintf("invalid index %s on %s (rebuild with REINDEX)", idx.name, idx.table))
+		}
+	}
+	return problems, nil, nil
+}
+
+// checkIndexBloat measures B-tree leaf density of the hot tables' indexes with
+// pgstattuple's pgstatindex. Without the extension the check is skipped.
+func checkIndexBloat(db *sql.DB) ([]string, []string, error) {
+	var installed bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pgstattuple')`).Scan(&installed); err != nil {
+		return nil, nil, err
+	}
+	if !installed {
+		return nil, []string{"skipped: CREATE EXTENSION pgstattuple to measure index bloat"}, nil
+	}
+
+	rows, err := db.Query(`SELECT c.relname, t.relname, pg_relation_size(c.oid), s.avg_leaf_density
+						   FROM pg_index i
+						   JOIN pg_class c ON c.oid = i.indexrelid
+						   JOIN pg_class t ON t.oid = i.indrelid
+						   JOIN pg_am a ON a.oid = c.relam AND a.amname = 'btree'
+						   CROSS JOIN LATERAL pgstatindex(c.oid::regclass) s
+						   WHERE t.relname = ANY($1) AND pg_table_is_visible(t.oid) AND pg_relation_size(c.oid) >= $2`, pq.Array(tableNames(hotTables)), bloatMinBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to measure index bloat: %v", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var index, table string
+		var size int64
+		var density float64
+		if err := rows.Scan(&index, &table, &size, &density); err != nil {
+			return nil, nil, err
+		}
+		if density < bloatMaxLeafDensity {
+			problems = append(problems, fmt.Sprintf("index %s on %s is bloated: %.0f%% leaf density, %d MB (rebuild with REINDEX CONCURRENTLY)",
+				index, table, density, size>>20))
+		}
+	}
+	return problems, nil, rows.Err()
+}
+
+// checkCVEIDs reports rows stored before CVE IDs were canonicalized on
+// ingest, whose IDs are not in canonical form and so miss their joins.
+func checkCVEIDs(db *sql.DB) ([]string, []string, error) {
+	var problems []string
+	for _, table := range cveIDTables {
+		var n int
+		err := db.QueryRow(`SELECT count(*) FROM ` + table + ` WHERE cve_id !~ '^CVE-[0-9]{4}-([0-9]{4}|[1-9][0-9]{4,})$'`).Scan(&n)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to check CVE IDs in %s: %v", table, err)
+		}
+		if n > 0 {
+			problems = append(problems, fmt.Sprintf("%d rows of %s have a non-canonical CVE ID", n, table))
+		}
+	}
+	return problems, nil, nil
+}
+
+// runDoctor implements the doctor subcommand. It prints one line per check
+// and fails if any check found a problem.
+func runDoctor(args []string) error {
+	if len(args) > 0 && args[0] == "consistency" {
+		return runConsistency(args[1:])
+	}
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	failed := 0
+	for _, check := range doctorChecks {
+		problems, notes, err := check.run(db)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			failed++
+			continue
+		}
+		if len(problems) == 0 {
+			fmt.Printf("ok   %s\n", check.name)
+		} else {
+			fmt.Printf("FAIL %s\n", check.name)
+			failed++
+		}
+		for _, p := range problems {
+			fmt.Printf("     - %s\n", p)
+		}
+		for _, n := range notes {
+			fmt.Printf("     %s\n", n)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(doctorChecks))
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/robfig/cron/v3"
+)
+
+// epssPoCThreshold is the EPSS score at which a CVE without known exploit
+// code is still treated as having a proof of concept.
+const epssPoCThreshold = 0.1
+
+// enrichmentSources are the optional third-party datasets synced daily.
+var enrichmentSources = []struct {
+	name    string
+	source  string
+	enabled *bool
+	sync    func(db *sql.DB) error
+}{
+	{"Exploit-DB", sourceExploitDB, syncExploits, syncExploitDB},
+	{"Metasploit", sourceMetasploit, syncMetasploit, syncMetasploitModules},
+	{"KEV", sourceKEV, syncKEVCatalog, syncKEV},
+	{"EPSS", sourceEPSS, syncEPSSScores, syncEPSS},
+	{"CAPEC", sourceCAPEC, syncCAPECCatalog, syncCAPEC},
+	{"CWE", sourceCWE, syncCWECatalog, syncCWE},
+}
+
+// scheduleEnrichment adds a daily job for every enabled enrichment source.
+func scheduleEnrichment(c *cron.Cron, db *sql.DB) {
+	for _, source := range enrichmentSources {
+		if !*source.enabled {
+			continue
+		}
+		c.AddFunc("@daily", func() {
+			run := beginSyncRun(db, "enrichment", source.source, source.source)
+			err := source.sync(db)
+			run.finish(db, err)
+			if err != nil {
+				log.Printf("Error syncing %s: %v\n", source.name, err)
+				return
+			}
+			if err := refreshDerivedFields(db); err != nil {
+				log.Println(err)
+				return
+			}
+			if err := notifyIntegrations(db); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+}
+
+// refreshDerivedFields recomputes the per-CVE fields derived from the
+// ingested data after a sync, and drops the API responses computed from the
+// old data.
+func refreshDerivedFields(db *sql.DB) error {
+	defer invalidateResponseCache()
+	if err := updateExploitMaturity(db); err != nil {
+		return err
+	}
+	if err := updateEnvironmentalScores(db); err != nil {
+		return err
+	}
+	if riskConfig != nil {
+		if err := updateRiskScores(db, riskConfig); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyIntegrations brings the enabled ticketing, paging and MISP integrations in
+// line with the data after a sync.
+func notifyIntegrations(db *sql.DB) error {
+	if jiraEnabled() {
+		if err := syncJiraIssues(db); err != nil {
+			return err
+		}
+	}
+	if pagerEnabled() {
+		if err := syncPages(db); err != nil {
+			return err
+		}
+	}
+	if mispEnabled() {
+		if err := syncMISPEvents(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateExploitMaturity folds the KEV, Metasploit, Exploit-DB and EPSS
+// signals into cve_data1.exploit_maturity:
+//
+//	active      listed in KEV
+//	weaponized  a Metasploit module exists
+//	poc         public exploit code exists or EPSS >= epssPoCThreshold
+//	none        otherwise
+func updateExploitMaturity(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE cve_data1 c SET exploit_maturity = m.maturity
+					   FROM (
+						   SELECT c2.cve_id, CASE
+							   WHEN k.cve_id IS NOT NULL THEN 'active'
+							   WHEN c2.has_metasploit THEN 'weaponized'
+							   WHEN c2.has_public_exploit OR COALESCE(e.score, 0) >= $1 THEN 'poc'
+							   ELSE 'none'
+						   END::exploit_maturity AS maturity
+						   FROM cve_data1 c2
+						   LEFT JOIN kev k ON k.cve_id = c2.cve_id
+						   LEFT JOIN epss e ON e.cve_id = c2.cve_id
+					   ) m
+					   WHERE m.cve_id = c.cve_id AND c.exploit_maturity IS DISTINCT FROM m.maturity;`, epssPoCThreshold)
+	if err != nil {
+		return fmt.Errorf("failed to update exploit maturity: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	enricherSpec     = flag.String("enrichers", "", "third-party enrichers to run after ingestion, each with an optional rate limit in requests per second, e.g. vulncheck,vulners:0.5")
+	enrichCacheTTL   = flag.Duration("enrich-cache-ttl", 7*24*time.Hour, "ask an enricher about a CVE again after this long, even if NVD did not modify it")
+	enrichBatchLimit = flag.Int("enrich-batch", 1000, "maximum number of CVEs each enricher looks up per run")
+)
+
+// An Enricher looks up a CVE in a third-party service. Enrich returns the
+// fields to store for the CVE, or nil if the service knows nothing about it.
+type Enricher interface {
+	Name() string
+	Enrich(cveID string) (map[string]any, error)
+}
+
+// knownEnrichers are the enrichers -enrichers can name, with the rate limit
+// used when none is given.
+var knownEnrichers = map[string]struct {
+	rate float64
+	new  func() Enricher
+}{
+	"vulncheck": {5, func() Enricher { return vulnCheckEnricher{} }},
+	"vulners":   {1, func() Enricher { return vulnersEnricher{} }},
+}
+
+// enricherRun is an enricher configured by -enrichers.
+type enricherRun struct {
+	Enricher
+	interval time.Duration
+}
+
+// enricherRuns is parsed from -enrichers at startup.
+var enricherRuns []enricherRun
+
+// parseEnrichers parses -enrichers: a comma-separated list of enricher names,
+// each optionally followed by :<requests per second>.
+func parseEnrichers(spec string) ([]enricherRun, error) {
+	var runs []enricherRun
+	if spec == "" {
+		return runs, nil
+	}
+	var names []string
+	for name := range knownEnrichers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, entry := range strings.Split(spec, ",") {
+		name, rateText, hasRate := strings.Cut(strings.TrimSpace(entry), ":")
+		known, ok := knownEnrichers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown enricher %q: must be one of %s", name, strings.Join(names, ", "))
+		}
+		rate := known.rate
+		if hasRate {
+			var err error
+			if rate, err = strconv.ParseFloat(rateText, 64); err != nil || rate <= 0 {
+				return nil, fmt.Errorf("invalid rate limit %q for enricher %s: want requests per second", rateText, name)
+			}
+		}
+		runs = append(runs, enricherRun{known.new(), time.Duration(float64(time.Second) / rate)})
+	}
+	return runs, nil
+}
+
+// scheduleEnrichers looks up newly ingested and modified CVEs with every
+// configured enricher shortly after each update. A run that is still waiting
+// on rate limits delays the next one instead of overlapping it.
+func scheduleEnrichers(c *cron.Cron, db *sql.DB) {
+	if len(enricherRuns) == 0 {
+		return
+	}
+	job := cron.FuncJob(func() {
+		var wg sync.WaitGroup
+		for _, run := range enricherRuns {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := runEnricher(db, run); err != nil {
+					log.Printf("Error running enricher %s: %v\n", run.Name(), err)
+				}
+			}()
+		}
+		wg.Wait()
+		invalidateResponseCache()
+	})
+	c.AddJob("*/2 * * * *", cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(job))
+}
+
+// runEnricher looks up at most -enrich-batch CVEs, most recently modified
+// first, that the enricher was never asked about, that NVD modified since, or
+// whose cached answer is older than -enrich-cache-ttl.
+func runEnricher(db *sql.DB, run enricherRun) error {
+	rows, err := db.Query(`SELECT c.cve_id, c.last_modified_date
+						   FROM cve_data1 c
+						   LEFT JOIN cve_enrichments e ON e.cve_id = c.cve_id AND e.enricher = $1
+						   WHERE e.cve_id IS NULL
+							  OR e.cve_last_modified IS DISTINCT FROM c.last_modified_date
+							  OR e.fetched_at < $2
+						   ORDER BY c.last_modified_date DESC NULLS LAST, c.cve_id
+						   LIMIT $3`, run.Name(), time.Now().Add(-*enrichCacheTTL), *enrichBatchLimit)
+	if err != nil {
+		return fmt.Errorf("failed to select CVEs to enrich: %v", err)
+	}
+	type staleCVE struct {
+		id           string
+		lastModified sql.NullTime
+	}
+	var cves []staleCVE
+	for rows.Next() {
+		var cve staleCVE
+		if err := rows.Scan(&cve.id, &cve.lastModified); err != nil {
+			rows.Close()
+			return err
+		}
+		cves = append(cves, cve)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var next time.Time
+	for _, cve := range cves {
+		time.Sleep(time.Until(next))
+		next = time.Now().Add(run.interval)
+
+		data, err := run.Enrich(cve.id)
+		if err != nil {
+			return fmt.Errorf("failed to enrich %s: %v", cve.id, err)
+		}
+		var encoded []byte
+		if data != nil {
+			if encoded, err = json.Marshal(data); err != nil {
+				return err
+			}
+		}
+		_, err = db.Exec(`INSERT INTO cve_enrichments (cve_id, enricher, data, cve_last_modified, fetched_at)
+						  VALUES ($1, $2, $3, $4, now())
+						  ON CONFLICT (cve_id, enricher) DO UPDATE
+						  SET data = EXCLUDED.data, cve_last_modified = EXCLUDED.cve_last_modified, fetched_at = EXCLUDED.fetched_at`,
+			cve.id, run.Name(), encoded, cve.lastModified)
+		if err != nil {
+			return fmt.Errorf("failed to store %s data for %s: %v", run.Name(), cve.id, err)
+		}
+	}
+	if len(cves) > 0 {
+		log.Printf("Enriched %d CVEs with %s\n", len(cves), run.Name())
+	}
+	return nil
+}
+
+// getEnrichments returns the stored enricher data of a CVE by enricher name.
+func getEnrichments(db *sql.DB, cveID string) (map[string]json.RawMessage, error) {
+	rows, err := db.Query(`SELECT enricher, data FROM cve_enrichments WHERE cve_id = $1 AND data IS NOT NULL`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load enrichments: %v", err)
+	}
+	defer rows.Close()
+	var enrichments map[string]json.RawMessage
+	for rows.Next() {
+		var name string
+		var data []byte
+		if err := rows.Scan(&name, &data); err != nil {
+			return nil, err
+		}
+		if enrichments == nil {
+			enrichments = map[string]json.RawMessage{}
+		}
+		enrichments[name] = data
+	}
+	return enrichments, rows.Err()
+}
+
+// enricherGet performs a request for an enricher and decodes its JSON
+// response into result.
+func enricherGet(req *http.Request, result any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// vulnCheckEnricher looks CVEs up in VulnCheck KEV, which also lists
+// exploitation evidence and public exploits CISA KEV does not
+// (token from VULNCHECK_API_TOKEN).
+type vulnCheckEnricher struct{}
+
+func (vulnCheckEnricher) Name() string { return "vulncheck" }
+
+func (vulnCheckEnricher) Enrich(cveID string) (map[string]any, error) {
+	req, err := http.NewRequest(http.MethodGet, "https://api.vulncheck.com/v3/index/vulncheck-kev?cve="+url.QueryEscape(cveID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("VULNCHECK_API_TOKEN"))
+	var result struct {
+		Data []struct {
+			DateAdded                  string `json:"date_added"`
+			KnownRansomwareCampaignUse string `json:"knownRansomwareCampaignUse"`
+			XDB                        []struct {
+				URL string `json:"xdb_url"`
+			} `json:"vulncheck_xdb"`
+			ReportedExploitation []struct {
+				URL string `json:"url"`
+			} `json:"vulncheck_reported_exploitation"`
+		} `json:"data"`
+	}
+	if err := enricherGet(req, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, nil
+	}
+	entry := result.Data[0]
+	exploits := []string{}
+	for _, x := range entry.XDB {
+		exploits = append(exploits, x.URL)
+	}
+	reports := []string{}
+	for _, r := range entry.ReportedExploitation {
+		reports = append(reports, r.URL)
+	}
+	return map[string]any{
+		"in_kev":                        true,
+		"date_added":                    entry.DateAdded,
+		"known_ransomware_campaign_use": entry.KnownRansomwareCampaignUse,
+		"exploit_urls":                  exploits,
+		"exploitation_reports":          reports,
+	}, nil
+}
+
+// vulnersEnricher adds Vulners' own score and in-the-wild exploitation flag
+// (key from VULNERS_API_KEY).
+type vulnersEnricher struct{}
+
+func (vulnersEnricher) Name() string { return "vulners" }
+
+func (vulnersEnricher) Enrich(cveID string) (map[string]any, error) {
+	body, err := json.Marshal(map[string]string{"id": cveID})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://vulners.com/api/v3/search/id/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Api-Key", os.Getenv("VULNERS_API_KEY"))
+	var result struct {
+		Data struct {
+			Documents map[string]struct {
+				Href         string `json:"href"`
+				Enchantments struct {
+					Score struct {
+						Value  *float64 `json:"value"`
+						Vector string   `json:"vector"`
+					} `json:"score"`
+					Exploitation *struct {
+						WildExploited bool `json:"wildExploited"`
+					} `json:"exploitation"`
+				} `json:"enchantments"`
+			} `json:"documents"`
+		} `json:"data"`
+	}
+	if err := enricherGet(req, &result); err != nil {
+		return nil, err
+	}
+	doc, ok := result.Data.Documents[cveID]
+	if !ok {
+		return nil, nil
+	}
+	data := map[string]any{"url": doc.Href}
+	if doc.Enchantments.Score.Value != nil {
+		data["score"] = *doc.Enchantments.Score.Value
+		data["score_vector"] = doc.Enchantments.Score.Vector
+	}
+	if doc.Enchantments.Exploitation != nil {
+		data["wild_exploited"] = doc.Enchantments.Exploitation.WildExploited
+	}
+	return data, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+const epssURL = "https://epss.cyentia.com/epss_scores-current.csv.gz"
+
+var (
+	syncEPSSScores  = flag.Bool("epss", false, "sync FIRST EPSS scores daily")
+	epssHistoryDays = flag.Int("epss-history-days", 365, "days of daily EPSS scores to keep in epss_history (0 keeps all)")
+)
+
+var epssScoreDatePattern = regexp.MustCompile(`score_date:(\d{4}-\d{2}-\d{2})`)
+
+type epssScore struct {
+	CVEID      string
+	Score      float64
+	Percentile float64
+}
+
+// parseEPSS reads the EPSS CSV. The first line is a comment carrying the
+// model version and score date, followed by a cve,epss,percentile header.
+func parseEPSS(r io.Reader) (scoreDate string, scores []epssScore, err error) {
+	br := bufio.NewReader(r)
+	comment, err := br.ReadString('\n')
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read EPSS header: %v", err)
+	}
+	if m := epssScoreDatePattern.FindStringSubmatch(comment); m != nil {
+		scoreDate = m[1]
+	}
+
+	reader := csv.NewReader(br)
+	if _, err := reader.Read(); err != nil {
+		return "", nil, fmt.Errorf("failed to read EPSS columns: %v", err)
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read EPSS scores: %v", err)
+		}
+		score, err := strconv.ParseFloat(record[1], 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid EPSS score for %s: %v", record[0], err)
+		}
+		percentile, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid EPSS percentile for %s: %v", record[0], err)
+		}
+		cveID, ok := normalizeCVEID(record[0])
+		if !ok {
+			log.Printf("Skipping EPSS score with malformed CVE ID %q\n", record[0])
+			continue
+		}
+		scores = append(scores, epssScore{cveID, score, percentile})
+	}
+	return scoreDate, scores, nil
+}
+
+// syncEPSS replaces the epss table with the current day's scores and adds
+// them to epss_history.
+func syncEPSS(db *sql.DB) error {
+	resp, err := http.Get(epssURL)
+	if err != nil {
+		return fmt.Errorf("failed to download EPSS scores: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download EPSS scores: %s", resp.Status)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gz.Close()
+
+	scoreDate, scores, err := parseEPSS(gz)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if err := setProvenance(tx, sourceEPSS); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM epss`); err != nil {
+		return fmt.Errorf("failed to clear EPSS scores: %v", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO epss (cve_id, score, percentile, score_date, source_record_id)
+							 VALUES ($1, $2, $3, NULLIF($4, '')::date, $1)
+							 ON CONFLICT (cve_id) DO NOTHING;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare EPSS insert: %v", err)
+	}
+	defer stmt.Close()
+
+	for _, s := range scores {
+		if _, err := stmt.Exec(s.CVEID, s.Score, s.Percentile, scoreDate); err != nil {
+			return fmt.Errorf("failed to insert EPSS score for %s: %v", s.CVEID, err)
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO epss_history (cve_id, score_date, score, percentile)
+					  SELECT cve_id, COALESCE(score_date, current_date), score, percentile FROM epss
+					  ON CONFLICT (cve_id, score_date) DO UPDATE
+					  SET score = EXCLUDED.score, percentile = EXCLUDED.percentile`)
+	if err != nil {
+		return fmt.Errorf("failed to record EPSS history: %v", err)
+	}
+	if *epssHistoryDays > 0 {
+		if _, err := tx.Exec(`DELETE FROM epss_history WHERE score_date < current_date - $1::int`, *epssHistoryDays); err != nil {
+			return fmt.Errorf("failed to prune EPSS history: %v", err)
+		}
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Synced %d EPSS scores for %s\n", len(scores), scoreDate)
+	return nil
+}
+
+// EPSSPoint is a CVE's EPSS score on one day.
+type EPSSPoint struct {
+	Date       string  `json:"date"`
+	Score      float64 `json:"score"`
+	Percentile float64 `json:"percentile"`
+}
+
+// getEPSSHistory returns a CVE's daily EPSS scores of the last days days,
+// oldest first.
+func getEPSSHistory(db *sql.DB, cveID string, days int) ([]EPSSPoint, error) {
+	rows, err := db.Query(`SELECT score_date::text, score, percentile FROM epss_history
+						   WHERE cve_id = $1 AND score_date > current_date - $2::int
+						   ORDER BY score_date`, cveID, days)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load EPSS history: %v", err)
+	}
+	defer rows.Close()
+
+	points := []EPSSPoint{}
+	for rows.Next() {
+		var p EPSSPoint
+		if err := rows.Scan(&p.Date, &p.Score, &p.Percentile); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// EPSSTrend is the change of a CVE's EPSS score over a period.
+type EPSSTrend struct {
+	CVEID        string  `json:"cve_id"`
+	FromDate     string  `json:"from_date"`
+	FromScore    float64 `json:"from_score"`
+	Score        float64 `json:"score"`
+	Percentile   float64 `json:"percentile"`
+	Increase     float64 `json:"increase"`
+	BaseSeverity string  `json:"base_severity,omitempty"`
+	InKEV        bool    `json:"in_kev"`
+}
+
+// risingEPSS lists the CVEs whose EPSS score rose by at least minIncrease
+// since their first score of the last days days, steepest rise first.
+func risingEPSS(db *sql.DB, days int, minIncrease float64, limit int) ([]EPSSTrend, error) {
+	rows, err := db.Query(`SELECT e.cve_id, f.score_date::text, f.score, e.score, e.percentile, e.score - f.score,
+								  COALESCE(i.cvss_base_severity, ''), k.cve_id IS NOT NULL
+						   FROM epss e
+						   JOIN LATERAL (
+							   SELECT h.score_date, h.score FROM epss_history h
+							   WHERE h.cve_id = e.cve_id AND h.score_date >= current_date - $1::int
+							   ORDER BY h.score_date LIMIT 1
+						   ) f ON true
+						   LEFT JOIN impact_data i ON i.cve_id = e.cve_id
+						   LEFT JOIN kev k ON k.cve_id = e.cve_id
+						   WHERE e.score - f.score >= $2
+						   ORDER BY e.score - f.score DESC, e.cve_id
+						   LIMIT $3`, days, minIncrease, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find rising EPSS scores: %v", err)
+	}
+	defer rows.Close()
+
+	trends := []EPSSTrend{}
+	for rows.Next() {
+		var t EPSSTrend
+		if err := rows.Scan(&t.CVEID, &t.FromDate, &t.FromScore, &t.Score, &t.Percentile, &t.Increase, &t.BaseSeverity, &t.InKEV); err != nil {
+			return nil, err
+		}
+		trends = append(trends, t)
+	}
+	return trends, rows.Err()
+}
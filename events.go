@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Events are written to event_outbox in the transaction of the change they
+// describe, so a rolled-back write never emits one, and delivered by the
+// scheduler afterwards. Delivery is at least once and in outbox order: a
+// failing event is retried with backoff and holds back the ones after it.
+const (
+	eventCVEChanged        = "cve.changed"
+	eventAlertTransitioned = "alert.transitioned"
+
+	eventBatchSize  = 100
+	eventMaxBackoff = time.Hour
+)
+
+var (
+	eventWebhook   = flag.String("event-webhook", "", "POST cve.changed and alert.transitioned events to this URL, signed with EVENT_WEBHOOK_SECRET if set (disabled if empty)")
+	eventRetention = flag.Duration("event-retention", 7*24*time.Hour, "how long delivered events are kept in the outbox")
+)
+
+var eventClient = &http.Client{Timeout: 30 * time.Second}
+
+func eventsEnabled() bool {
+	return *eventWebhook != ""
+}
+
+type cveChangedEvent struct {
+	CVEID            string `json:"cve_id"`
+	ChangeSeq        int64  `json:"change_seq"`
+	LastModifiedDate string `json:"last_modified_date"`
+}
+
+type alertTransitionedEvent struct {
+	Tenant string `json:"tenant"`
+	CVEID  string `json:"cve_id"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to"`
+	Actor  string `json:"actor"`
+	Note   string `json:"note,omitempty"`
+}
+
+// enqueueEvent adds an event to the outbox as part of tx. Nothing is written
+// while publishing is disabled.
+func enqueueEvent(tx *sql.Tx, eventType string, payload any) error {
+	if !eventsEnabled() {
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO event_outbox (event_type, payload) VALUES ($1, $2)`, eventType, data); err != nil {
+		return fmt.Errorf("failed to enqueue %s event: %v", eventType, err)
+	}
+	return nil
+}
+
+// outboxEvent is the body POSTed to -event-webhook. Consumers should use ID to
+// drop events delivered twice.
+type outboxEvent struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func scheduleEventDelivery(c *cron.Cron, db *sql.DB) {
+	if !eventsEnabled() {
+		return
+	}
+	job := cron.FuncJob(func() {
+		if err := deliverEvents(db); err != nil {
+			log.Printf("Error delivering events: %v\n", err)
+		}
+	})
+	c.AddJob("@every 10s", cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(job))
+}
+
+// deliverEvents publishes pending events oldest first until the outbox is
+// empty or an event fails, then drops delivered events older than
+// -event-retention.
+func deliverEvents(db *sql.DB) error {
+	for {
+		n, err := deliverEventBatch(db)
+		if err != nil {
+			return err
+		}
+		if n < eventBatchSize {
+			break
+		}
+	}
+	if _, err := db.Exec(`DELETE FROM event_outbox WHERE delivered_at < now() - $1 * interval '1 second'`, eventRetention.Seconds()); err != nil {
+		return fmt.Errorf("failed to prune delivered events: %v", err)
+	}
+	return nil
+}
+
+// deliverEventBatch publishes up to eventBatchSize pending events and returns
+// how many it delivered. It stops at the first event that is waiting for a
+// retry or fails.
+func deliverEventBatch(db *sql.DB) (int, error) {
+	rows, err := db.Query(`SELECT id, event_type, created_at, payload, attempts, next_attempt_at <= now()
+						   FROM event_outbox WHERE delivered_at IS NULL ORDER BY id LIMIT $1`, eventBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the event outbox: %v", err)
+	}
+	type pendingEvent struct {
+		outboxEvent
+		attempts int
+		due      bool
+	}
+	var pending []pendingEvent
+	for rows.Next() {
+		var e pendingEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.CreatedAt, &e.Data, &e.attempts, &e.due); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read the event outbox: %v", err)
+	}
+
+	for i, e := range pending {
+		if !e.due {
+			return i, nil
+		}
+		if err := publishEvent(e.outboxEvent); err != nil {
+			backoff := eventMaxBackoff
+			if e.attempts < 8 {
+				backoff = min(10*time.Second<<e.attempts, eventMaxBackoff)
+			}
+			_, uerr := db.Exec(`UPDATE event_outbox SET attempts = attempts + 1, last_error = $2,
+									next_attempt_at = now() + $3 * interval '1 second'
+								WHERE id = $1`, e.ID, err.Error(), backoff.Seconds())
+			if uerr != nil {
+				return i, fmt.Errorf("failed to record failed delivery of event %d: %v", e.ID, uerr)
+			}
+			return i, fmt.Errorf("event %d (attempt %d, retrying in %s): %v", e.ID, e.attempts+1, backoff, err)
+		}
+		if _, err := db.Exec(`UPDATE event_outbox SET delivered_at = now(), last_error = NULL WHERE id = $1`, e.ID); err != nil {
+			return i, fmt.Errorf("failed to mark event %d delivered: %v", e.ID, err)
+		}
+	}
+	return len(pending), nil
+}
+
+// publishEvent POSTs an event to -event-webhook. With EVENT_WEBHOOK_SECRET
+// set, X-Signature carries the hex HMAC-SHA256 of the body.
+func publishEvent(e outboxEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, *eventWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", fmt.Sprint(e.ID))
+	req.Header.Set("X-Event-Type", e.Type)
+	if secret := os.Getenv("EVENT_WEBHOOK_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook request failed: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+)
+
+var expandCPENames = flag.Bool("expand-cpe-names", false, "materialize the concrete CPE names inside each stored version range into cpe_name_lookup (requires -source api)")
+
+// expandCVECPENames rebuilds the cpe_name_lookup rows of a CVE from its
+// vulnerable CPE rows and the match criteria names synced from /cpematch, so
+// exact-CPE queries can use an index instead of comparing version ranges.
+func expandCVECPENames(tx *sql.Tx, cveID string) error {
+	if _, err := tx.Exec(`DELETE FROM cpe_name_lookup WHERE cve_id = $1`, cveID); err != nil {
+		return fmt.Errorf("failed to delete CPE names for CVE ID %s: %v", cveID, err)
+	}
+	_, err := tx.Exec(`INSERT INTO cpe_name_lookup (cve_id, cpe_name, match_criteria_id)
+					   SELECT c.cve_id, n.cpe_name, n.match_criteria_id
+					   FROM cpe_data c
+					   JOIN match_criteria_names n ON n.match_criteria_id = c.match_criteria_id
+					   WHERE c.cve_id = $1 AND c.vulnerable
+					   ON CONFLICT DO NOTHING;`, cveID)
+	if err != nil {
+		return fmt.Errorf("failed to expand CPE names for CVE ID %s: %v", cveID, err)
+	}
+	return nil
+}
+
+// expandMatchCriteriaNames refreshes the cpe_name_lookup rows of every CVE
+// that uses a match criteria whose names were just re-synced.
+func expandMatchCriteriaNames(tx *sql.Tx, matchCriteriaID string) error {
+	if _, err := tx.Exec(`DELETE FROM cpe_name_lookup WHERE match_criteria_id = $1`, matchCriteriaID); err != nil {
+		return fmt.Errorf("failed to delete CPE names for match criteria %s: %v", matchCriteriaID, err)
+	}
+	_, err := tx.Exec(`INSERT INTO cpe_name_lookup (cve_id, cpe_name, match_criteria_id)
+					   SELECT c.cve_id, n.cpe_name, n.match_criteria_id
+					   FROM cpe_data c
+					   JOIN match_criteria_names n ON n.match_criteria_id = c.match_criteria_id
+					   WHERE c.match_criteria_id = $1 AND c.vulnerable
+					   ON CONFLICT DO NOTHING;`, matchCriteriaID)
+	if err != nil {
+		return fmt.Errorf("failed to expand CPE names for match criteria %s: %v", matchCriteriaID, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const exploitDBURL = "https://gitlab.com/exploit-database/exploitdb/-/raw/main/files_exploits.csv"
+
+var syncExploits = flag.Bool("exploitdb", false, "sync the Exploit-DB index daily and flag CVEs with public exploit code")
+
+type exploitDBEntry struct {
+	ID            string
+	Description   string
+	Type          string
+	Platform      string
+	DatePublished string
+	Verified      bool
+	CVEIDs        []string
+}
+
+// parseExploitDB reads the Exploit-DB files_exploits.csv index, keeping only
+// entries that reference at least one CVE.
+func parseExploitDB(r io.Reader) ([]exploitDBEntry, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Exploit-DB header: %v", err)
+	}
+	column := map[string]int{}
+	for i, name := range header {
+		column[name] = i
+	}
+	for _, name := range []string{"id", "description", "type", "platform", "date_published", "verified", "codes"} {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("Exploit-DB index is missing column %q", name)
+		}
+	}
+
+	var entries []exploitDBEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Exploit-DB index: %v", err)
+		}
+
+		var cveIDs []string
+		for _, code := range strings.Split(record[column["codes"]], ";") {
+			if id, ok := normalizeCVEID(code); ok {
+				cveIDs = append(cveIDs, id)
+			}
+		}
+		if len(cveIDs) == 0 {
+			continue
+		}
+
+		entries = append(entries, exploitDBEntry{
+			ID:            record[column["id"]],
+			Description:   record[column["description"]],
+			Type:          record[column["type"]],
+			Platform:      record[column["platform"]],
+			DatePublished: record[column["date_published"]],
+			Verified:      record[column["verified"]] == "1",
+			CVEIDs:        cveIDs,
+		})
+	}
+	return entries, nil
+}
+
+// syncExploitDB replaces the exploits table with the current Exploit-DB index
+// and refreshes cve_data1.has_public_exploit.
+func syncExploitDB(db *sql.DB) error {
+	resp, err := http.Get(exploitDBURL)
+	if err != nil {
+		return fmt.Errorf("failed to download Exploit-DB index: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download Exploit-DB index: %s", resp.Status)
+	}
+
+	entries, err := parseExploitDB(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if err := setProvenance(tx, sourceExploitDB); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM exploits`); err != nil {
+		return fmt.Errorf("failed to clear exploits: %v", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO exploits (exploit_id, cve_id, description, type, platform, date_published, verified, source_record_id)
+							 VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::date, $7, $1)
+							 ON CONFLICT DO NOTHING;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare exploit insert: %v", err)
+	}
+	defer stmt.Close()
+
+	mapped := 0
+	for _, e := range entries {
+		for _, cveID := range e.CVEIDs {
+			if _, err := stmt.Exec(e.ID, cveID, e.Description, e.Type, e.Platform, e.DatePublished, e.Verified); err != nil {
+				return fmt.Errorf("failed to insert exploit %s for %s: %v", e.ID, cveID, err)
+			}
+			mapped++
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE cve_data1 SET has_public_exploit = EXISTS (
+							  SELECT 1 FROM exploits e WHERE e.cve_id = cve_data1.cve_id);`); err != nil {
+		return fmt.Errorf("failed to flag CVEs with public exploits: %v", err)
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Synced %d Exploit-DB entries (%d CVE mappings)\n", len(entries), mapped)
+	return nil
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nvdFeed is the envelope of an NVD 1.1 JSON feed.
+type nvdFeed struct {
+	DataType     string    `json:"CVE_data_type"`
+	DataFormat   string    `json:"CVE_data_format"`
+	DataVersion  string    `json:"CVE_data_version"`
+	NumberOfCVEs string    `json:"CVE_data_numberOfCVEs"`
+	Timestamp    string    `json:"CVE_data_timestamp"`
+	CVEItems     []CVEItem `json:"CVE_Items"`
+}
+
+// feedSelection picks the CVEs of an exported feed: the CVE IDs of a year, as
+// NVD's year feeds do, or the CVEs last modified within [since, until).
+type feedSelection struct {
+	year         int
+	since, until time.Time
+}
+
+func (s feedSelection) where() (string, []any) {
+	if s.year != 0 {
+		return `c.cve_id LIKE $1`, []any{fmt.Sprintf("CVE-%d-%%", s.year)}
+	}
+	return `c.last_modified_date >= $1 AND c.last_modified_date < $2`, []any{s.since, s.until}
+}
+
+// exportCVEItems rebuilds the NVD records of the selected CVEs from the
+// stored rows. Only what is stored comes back: references are limited to the
+// vendor advisories, and configurations are the stored trees.
+func exportCVEItems(db *sql.DB, sel feedSelection) ([]CVEItem, error) {
+	cond, args := sel.where()
+	rows, err := db.Query(`SELECT c.cve_id, COALESCE(c.assigner, ''), COALESCE(c.description, ''),
+								  COALESCE(to_char(c.published_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI"Z"'), ''),
+								  COALESCE(to_char(c.last_modified_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI"Z"'), '')
+						   FROM cve_data1 c WHERE `+cond+` ORDER BY c.cve_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CVEs: %v", err)
+	}
+	var items []CVEItem
+	index := map[string]int{}
+	for rows.Next() {
+		var item CVEItem
+		var description string
+		if err := rows.Scan(&item.CVE.CVEDataMeta.ID, &item.CVE.CVEDataMeta.Assigner, &description,
+			&item.PublishedDate, &item.LastModifiedDate); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		item.CVE.Description.DescriptionData = []DescriptionData{{Value: description}}
+		index[item.CVE.CVEDataMeta.ID] = len(items)
+		items = append(items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read CVEs: %v", err)
+	}
+
+	selected := `cve_id IN (SELECT c.cve_id FROM cve_data1 c WHERE ` + cond + `)`
+	forRows := func(table, query string, scan func(rows *sql.Rows) error) error {
+		rows, err := db.Query(strings.Replace(query, "$selected", selected, 1), args...)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", table, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+
+	err = forRows("impact_data", `SELECT cve_id, cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity
+								  FROM impact_data WHERE $selected AND cvss_version IS NOT NULL`, func(rows *sql.Rows) error {
+		var id string
+		var v3 struct {
+			version, vector, severity string
+			score                     float64
+		}
+		if err := rows.Scan(&id, &v3.version, &v3.vector, &v3.score, &v3.severity); err != nil {
+			return err
+		}
+		cvss := &items[index[id]].Impact.BaseMetricV3.CVSSV3
+		cvss.Version, cvss.VectorString, cvss.BaseScore, cvss.BaseSeverity = v3.version, v3.vector, v3.score, v3.severity
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = forRows("cve_cwe", `SELECT cve_id, cwe_id FROM cve_cwe WHERE $selected ORDER BY cve_id, cwe_id`, func(rows *sql.Rows) error {
+		var id, cwe string
+		if err := rows.Scan(&id, &cwe); err != nil {
+			return err
+		}
+		pt := &items[index[id]].CVE.ProblemType
+		if len(pt.ProblemTypeData) == 0 {
+			pt.ProblemTypeData = make([]struct {
+				Description []DescriptionData `json:"description"`
+			}, 1)
+		}
+		pt.ProblemTypeData[0].Description = append(pt.ProblemTypeData[0].Description, DescriptionData{Value: cwe})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = forRows("advisories", `SELECT cve_id, url FROM advisories WHERE $selected ORDER BY cve_id, url`, func(rows *sql.Rows) error {
+		var id, url string
+		if err := rows.Scan(&id, &url); err != nil {
+			return err
+		}
+		refs := &items[index[id]].CVE.References.ReferenceData
+		*refs = append(*refs, Reference{URL: url, Name: url, Tags: []string{"Vendor Advisory"}})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cpeRows := map[string][]cpeRow{}
+	err = forRows("cpe_data", `SELECT cve_id, cpe_uri, vulnerable, COALESCE(NULLIF(version_start_raw, ''), version_start, ''), version_start_excluding,
+								  COALESCE(NULLIF(version_end_raw, ''), version_end, ''), version_end_including,
+								  COALESCE(node_id, 0), COALESCE(parent_node_id, 0), COALESCE(match_criteria_id, '')
+							   FROM cpe_data WHERE $selected ORDER BY cve_id, node_id, cpe_uri`, func(rows *sql.Rows) error {
+		var id string
+		var r cpeRow
+		var startExcluding, endIncluding bool
+		m := &r.match
+		if err := rows.Scan(&id, &m.CPE23URI, &m.Vulnerable, &m.VersionStart, &startExcluding, &m.VersionEnd, &endIncluding,
+			&r.nodeID, &r.parentID, &m.MatchCriteriaID); err != nil {
+			return err
+		}
+		if startExcluding {
+			m.VersionStart, m.VersionStartExcluding = "", m.VersionStart
+		}
+		if endIncluding {
+			m.VersionEnd, m.VersionEndIncluding = "", m.VersionEnd
+		}
+		cpeRows[id] = append(cpeRows[id], r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for id, rows := range cpeRows {
+		nodes := buildConfigNodes(rows)
+		for i := range nodes {
+			nodes[i] = withDefaultOperators(nodes[i])
+		}
+		items[index[id]].Configurations.Nodes = nodes
+	}
+
+	// The stored trees keep the operators, negate flags and published
+	// version bounds the cpe_data rows lose; CVEs stored before the trees were
+	// kept fall back to the rows.
+	trees := map[string][]ConfigNode{}
+	err = forRows("cve_configurations", `SELECT cve_id, node FROM cve_configurations WHERE $selected ORDER BY cve_id, config`, func(rows *sql.Rows) error {
+		var id string
+		var data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		var node ConfigNode
+		if err := json.Unmarshal(data, &node); err != nil {
+			return fmt.Errorf("invalid configuration of %s: %v", id, err)
+		}
+		trees[id] = append(trees[id], withDefaultOperators(node))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for id, nodes := range trees {
+		items[index[id]].Configurations.Nodes = nodes
+	}
+	return items, nil
+}
+
+// withDefaultOperators returns n with the implicit OR spelled out on every
+// node, as NVD 1.1 feeds do.
+func withDefaultOperators(n ConfigNode) ConfigNode {
+	if n.Operator == "" {
+		n.Operator = "OR"
+	}
+	if n.Children != nil {
+		children := make([]ConfigNode, len(n.Children))
+		for i, c := range n.Children {
+			children[i] = withDefaultOperators(c)
+		}
+		n.Children = children
+	}
+	return n
+}
+
+// cpeRow is a cpe_data row with its place in the configuration tree.
+type cpeRow struct {
+	nodeID, parentID int
+	match            CPEMatch
+}
+
+// buildConfigNodes rebuilds a CVE's configuration tree from its cpe_data rows,
+// in node_id order. A parent node without CPE rows of its own is recreated
+// from its children's parent_node_id; the rows do not keep operators, so it
+// is taken to be an AND node, as NVD's parents with children are.
+func buildConfigNodes(rows []cpeRow) []ConfigNode {
+	var tops []int
+	nodes := map[int]*ConfigNode{}
+	children := map[int][]int{}
+	get := func(id int) *ConfigNode {
+		if nodes[id] == nil {
+			nodes[id] = &ConfigNode{}
+		}
+		return nodes[id]
+	}
+	for _, r := range rows {
+		top := r.nodeID
+		if r.parentID != 0 {
+			top = r.parentID
+			if _, ok := nodes[r.nodeID]; !ok {
+				children[top] = append(children[top], r.nodeID)
+			}
+		}
+		if _, ok := nodes[top]; !ok {
+			tops = append(tops, top)
+		}
+		get(top)
+		get(r.nodeID).CPEMatch = append(get(r.nodeID).CPEMatch, r.match)
+	}
+	result := make([]ConfigNode, 0, len(tops))
+	for _, top := range tops {
+		n := *nodes[top]
+		for _, c := range children[top] {
+			n.Children = append(n.Children, *nodes[c])
+		}
+		if n.Children != nil {
+			n.Operator = "AND"
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// nvdModifiedFeedDays is how far back the modified feed reaches, as NVD's.
+const nvdModifiedFeedDays = 8
+
+// feedSelectionFor maps the name part of an NVD feed file name
+// (nvdcve-1.1-<name>.json.gz) to the CVEs it holds: a year or "modified".
+func feedSelectionFor(name string) (feedSelection, bool) {
+	if name == "modified" {
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		return feedSelection{since: today.AddDate(0, 0, -nvdModifiedFeedDays), until: today.AddDate(0, 0, 1)}, true
+	}
+	year, err := strconv.Atoi(name)
+	if err != nil || year < 1999 || year > time.Now().Year() {
+		return feedSelection{}, false
+	}
+	return feedSelection{year: year}, true
+}
+
+// renderNVDFeed renders the selected CVEs as a gzipped NVD 1.1 feed and its
+// .meta file. The meta's lastModifiedDate is the time of the last sync, so
+// consumers polling it download the feed again after every sync. The feed is
+// stamped with that time too, so between syncs it renders the same bytes and
+// a cached meta stays valid.
+func renderNVDFeed(db *sql.DB, sel feedSelection) (feed []byte, meta string, err error) {
+	lastModified, err := readLastModified()
+	if err != nil {
+		lastModified = time.Now().Format(time.RFC3339)
+	}
+	stamp, err := time.Parse(time.RFC3339, lastModified)
+	if err != nil {
+		stamp = time.Now()
+	}
+
+	items, err := exportCVEItems(db, sel)
+	if err != nil {
+		return nil, "", err
+	}
+	if items == nil {
+		items = []CVEItem{}
+	}
+	data, err := json.Marshal(nvdFeed{
+		DataType:     "CVE",
+		DataFormat:   "MITRE",
+		DataVersion:  "4.0",
+		NumberOfCVEs: strconv.Itoa(len(items)),
+		Timestamp:    stamp.UTC().Format("2006-01-02T15:04Z"),
+		CVEItems:     items,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(data)
+	meta = fmt.Sprintf("lastModifiedDate:%s\r\nsize:%d\r\ngzSize:%d\r\nsha256:%s\r\n",
+		lastModified, len(data), buf.Len(), strings.ToUpper(hex.EncodeToString(sum[:])))
+	return buf.Bytes(), meta, nil
+}
+
+// feedMetas caches the .meta of each served feed by feed name, so polling a
+// meta only renders the feed again after a sync. An entry is valid while its
+// key, the last sync time and the selection, is unchanged.
+var feedMetas = struct {
+	sync.Mutex
+	m map[string]cachedFeedMeta
+}{m: map[string]cachedFeedMeta{}}
+
+type cachedFeedMeta struct {
+	key  string
+	meta string
+}
+
+func feedMetaKey(sel feedSelection) string {
+	lastModified, _ := readLastModified()
+	return fmt.Sprintf("%s|%d|%s", lastModified, sel.year, sel.since.Format(time.DateOnly))
+}
+
+// handleNVDFeed serves feeds rendered from the database under NVD's file
+// names, e.g. /feeds/json/cve/1.1/nvdcve-1.1-2023.json.gz and
+// nvdcve-1.1-modified.meta, so tools that read NVD feeds can be pointed here.
+func handleNVDFeed(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file := r.PathValue("file")
+		name, isMeta := strings.CutSuffix(strings.TrimPrefix(file, "nvdcve-1.1-"), ".meta")
+		if !isMeta {
+			var ok bool
+			if name, ok = strings.CutSuffix(name, ".json.gz"); !ok {
+				writeError(w, http.StatusNotFound, "unknown feed")
+				return
+			}
+		}
+		sel, ok := feedSelectionFor(name)
+		if !strings.HasPrefix(file, "nvdcve-1.1-") || !ok {
+			writeError(w, http.StatusNotFound, "unknown feed")
+			return
+		}
+
+		key := feedMetaKey(sel)
+		if isMeta {
+			feedMetas.Lock()
+			cached, ok := feedMetas.m[name]
+			feedMetas.Unlock()
+			if ok && cached.key == key {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, cached.meta)
+				return
+			}
+		}
+
+		feed, meta, err := renderNVDFeed(db, sel)
+		if err != nil {
+			log.Printf("Failed to render feed %s: %v\n", file, err)
+			writeError(w, http.StatusInternalServerError, "failed to render feed")
+			return
+		}
+		feedMetas.Lock()
+		feedMetas.m[name] = cachedFeedMeta{key: key, meta: meta}
+		feedMetas.Unlock()
+		if isMeta {
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, meta)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(feed)
+	}
+}
+
+// runExport implements the export subcommand, which writes a feed rendered
+// from the database and its .meta file.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	year := fs.Int("year", 0, "export the CVE IDs of this year, like NVD's year feeds")
+	since := fs.String("modified-since", "", "export the CVEs last modified on or after this date (2024-01-15)")
+	until := fs.String("modified-until", "", "with -modified-since, export the CVEs last modified before this date (default: tomorrow)")
+	out := fs.String("o", "", "file to write the gzipped feed to (default nvdcve-1.1-<year>.json.gz or nvdcve-1.1-export.json.gz); the .meta file is written next to it")
+	fs.Parse(args)
+
+	var sel feedSelection
+	switch {
+	case *year != 0 && *since == "":
+		sel.year = *year
+	case *year == 0 && *since != "":
+		var err error
+		if sel.since, err = time.Parse(time.DateOnly, *since); err != nil {
+			return fmt.Errorf("invalid -modified-since: %v", err)
+		}
+		sel.until = time.Now().UTC().AddDate(0, 0, 1)
+		if *until != "" {
+			if sel.until, err = time.Parse(time.DateOnly, *until); err != nil {
+				return fmt.Errorf("invalid -modified-until: %v", err)
+			}
+		}
+	default:
+		return fmt.Errorf("export needs either -year or -modified-since")
+	}
+	if *out == "" {
+		*out = "nvdcve-1.1-export.json.gz"
+		if sel.year != 0 {
+			*out = fmt.Sprintf("nvdcve-1.1-%d.json.gz", sel.year)
+		}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	feed, meta, err := renderNVDFeed(db, sel)
+	if err != nil {
+		return fmt.Errorf("export failed: %v", err)
+	}
+	if err := os.WriteFile(*out, feed, 0644); err != nil {
+		return err
+	}
+	metaFile := strings.TrimSuffix(strings.TrimSuffix(*out, ".gz"), ".json") + ".meta"
+	if err := os.WriteFile(metaFile, []byte(meta), 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s and %s\n", *out, metaFile)
+	return nil
+}
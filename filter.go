@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	minSeverity = flag.String("min-severity", "", "only store CVEs whose CVSS v3 severity is at least this (LOW, MEDIUM, HIGH or CRITICAL)")
+	minScore    = flag.Float64("min-score", 0, "only store CVEs whose CVSS v3 base score is at least this (0 disables)")
+	windowYears = flag.Int("window-years", 0, "only store CVEs published (or, with -window-by modified, last modified) within this many years, and prune older ones after syncs (0 disables)")
+	windowBy    = flag.String("window-by", "published", "date the -window-years window applies to: published or modified")
+	cpeAllow    = flag.String("cpe-allow", "", "only store CVEs affecting a CPE vendor:product matching one of these comma-separated glob patterns, e.g. cisco:*,juniper:junos")
+)
+
+// cpeAllowlist is parsed from -cpe-allow at startup.
+var cpeAllowlist []string
+
+func parseCPEAllowlist(spec string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil || strings.Count(p, ":") != 1 {
+			return nil, fmt.Errorf("invalid CPE pattern %q: want vendor:product with * and ? wildcards", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// allowedCPE reports whether the vendor:product of a CPE 2.3 URI matches the
+// allowlist.
+func allowedCPE(cpeURI string) bool {
+	parts := strings.Split(strings.ToLower(cpeURI), ":")
+	if len(parts) < 5 {
+		return false
+	}
+	name := parts[3] + ":" + parts[4]
+	for _, p := range cpeAllowlist {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// affectsAllowedCPE reports whether any vulnerable CPE in the nodes matches
+// the allowlist.
+func affectsAllowedCPE(nodes []ConfigNode) bool {
+	for _, node := range nodes {
+		for _, m := range node.CPEMatch {
+			if m.Vulnerable && allowedCPE(m.CPE23URI) {
+				return true
+			}
+		}
+		if affectsAllowedCPE(node.Children) {
+			return true
+		}
+	}
+	return false
+}
+
+// severityRanks orders the CVSS v3 qualitative severities.
+var severityRanks = map[string]int{"NONE": 0, "LOW": 1, "MEDIUM": 2, "HIGH": 3, "CRITICAL": 4}
+
+func validSeverity(s string) bool {
+	_, ok := severityRanks[strings.ToUpper(s)]
+	return ok
+}
+
+// ingestFiltered reports whether any ingestion filter is set, in which case
+// fewer CVEs are stored than the feeds contain.
+func ingestFiltered() bool {
+	return *minSeverity != "" || *minScore > 0 || len(cpeAllowlist) > 0 || *windowYears > 0
+}
+
+// windowStart is the oldest date the -window-years window keeps.
+func windowStart() time.Time {
+	return time.Now().UTC().AddDate(-*windowYears, 0, 0)
+}
+
+// inWindow reports whether the CVE's published or last modified date, as
+// selected by -window-by, falls within the window.
+func inWindow(item CVEItem) bool {
+	date := item.PublishedDate
+	if *windowBy == "modified" {
+		date = item.LastModifiedDate
+	}
+	t, err := parseNVDTime(date)
+	return err == nil && !t.Before(windowStart())
+}
+
+// keepCVEItem reports whether an ingested CVE passes the ingestion filters.
+// CVEs that are not scored or analyzed yet fail a threshold or the CPE
+// allowlist; they are stored once an update brings data that passes. Rows stored before a
+// filter was set are left alone.
+func keepCVEItem(item CVEItem) bool {
+	cvss := item.Impact.BaseMetricV3.CVSSV3
+	if *minSeverity != "" {
+		rank, ok := severityRanks[strings.ToUpper(cvss.BaseSeverity)]
+		if !ok || rank < severityRanks[strings.ToUpper(*minSeverity)] {
+			return false
+		}
+	}
+	if *minScore > 0 && (cvss.Version == "" || cvss.BaseScore < *minScore) {
+		return false
+	}
+	if len(cpeAllowlist) > 0 && !affectsAllowedCPE(item.Configurations.Nodes) {
+		return false
+	}
+	if *windowYears > 0 && !inWindow(item) {
+		return false
+	}
+	return true
+}
+
+// pruneOutOfWindow deletes the CVEs that have aged out of the -window-years
+// window. CVEs with tags or annotations are kept, as is their cve_history.
+func pruneOutOfWindow(db *sql.DB) error {
+	if *windowYears <= 0 {
+		return nil
+	}
+	column := "published_date"
+	if *windowBy == "modified" {
+		column = "last_modified_date"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`CREATE TEMP TABLE pruned_cves ON COMMIT DROP AS
+						 SELECT c.cve_id FROM cve_data1 c
+						 WHERE c.`+column+` < $1
+						   AND NOT EXISTS (SELECT 1 FROM tags t WHERE t.cve_id = c.cve_id)
+						   AND NOT EXISTS (SELECT 1 FROM annotations a WHERE a.cve_id = c.cve_id)`, windowStart())
+	if err != nil {
+		return fmt.Errorf("failed to select CVEs outside the window: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		return nil
+	}
+	for _, table := range []string{"cpe_data", "cve_configurations", "impact_data", "cve_cwe", "cve_tags", "cve_comments", "cvss_metrics", "advisories", "cpe_name_lookup", "cve_enrichments", "score_history", "cve_data1"} {
+		if _, err := tx.Exec(`DELETE FROM ` + table + ` WHERE cve_id IN (SELECT cve_id FROM pruned_cves)`); err != nil {
+			return fmt.Errorf("failed to prune %s: %v", table, err)
+		}
+	}
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Pruned %d CVEs older than %d years\n", n, *windowYears)
+	return nil
+}
@@ -3,6 +3,11 @@ module cve-download-update
 go 1.23.4
 
 require (
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/robfig/cron/v3 v3.0.1 // indirect
+	github.com/klauspost/pgzip v1.2.6
+	github.com/lib/pq v1.10.9
+	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/sys v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require github.com/klauspost/compress v1.17.11 // indirect
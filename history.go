@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var historyMode = flag.Bool("history", false, "keep every version of every CVE record in cve_history (valid_from/valid_to)")
+
+// recordCVEVersion adds the item to cve_history as the CVE's current version.
+// The previous version is closed out at the same instant, so exactly one
+// version is valid at any time. Re-ingesting an unchanged record is a no-op.
+func recordCVEVersion(tx *sql.Tx, item CVEItem) error {
+	cveID := item.CVE.CVEDataMeta.ID
+	record, hash, err := historyRecord(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode CVE ID %s for history: %v", cveID, err)
+	}
+
+	var current string
+	err = tx.QueryRow(`SELECT content_hash FROM cve_history WHERE cve_id = $1 AND valid_to IS NULL`, cveID).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to load current version of CVE ID %s: %v", cveID, err)
+	}
+	if current == hash {
+		return nil
+	}
+	legacy, err := legacyHistoryHashes(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode CVE ID %s for history: %v", cveID, err)
+	}
+	if slices.Contains(legacy, current) {
+		return nil
+	}
+
+	if _, err := tx.Exec(`UPDATE cve_history SET valid_to = now() WHERE cve_id = $1 AND valid_to IS NULL`, cveID); err != nil {
+		return fmt.Errorf("failed to close out version of CVE ID %s: %v", cveID, err)
+	}
+	var lastModified any
+	if t, err := parseNVDTime(item.LastModifiedDate); err == nil {
+		lastModified = t
+	}
+	_, err = tx.Exec(`INSERT INTO cve_history (cve_id, valid_from, last_modified_date, content_hash, record, record_hash)
+					  VALUES ($1, now(), $2, $3, $4, `+recordHashSQL("$4::jsonb")+`)`,
+		cveID, lastModified, hash, string(record))
+	if err != nil {
+		return fmt.Errorf("failed to record version of CVE ID %s: %v", cveID, err)
+	}
+	return nil
+}
+
+// historyRecord encodes item as cve_history stores it and returns the record
+// and its content hash.
+func historyRecord(item CVEItem) ([]byte, string, error) {
+	record, err := json.Marshal(item)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(record)
+	return record, hex.EncodeToString(sum[:]), nil
+}
+
+// legacyHistoryHashes returns the content hashes item had under the encodings
+// of earlier versions, which lacked fields added to CVEItem since. A current
+// version recorded under one of them holds the same data as far as it went,
+// so re-ingesting the record does not add a version just for the new fields.
+func legacyHistoryHashes(item CVEItem) ([]string, error) {
+	var hashes []string
+	add := func(item CVEItem) error {
+		_, hash, err := historyRecord(item)
+		hashes = append(hashes, hash)
+		return err
+	}
+	// Before node operators and negate flags were kept, then also before the
+	// assigner was kept.
+	if item.Configurations.Nodes != nil {
+		nodes := make([]ConfigNode, len(item.Configurations.Nodes))
+		for i, n := range item.Configurations.Nodes {
+			nodes[i] = withoutOperators(n)
+		}
+		item.Configurations.Nodes = nodes
+	}
+	if err := add(item); err != nil {
+		return nil, err
+	}
+	item.CVE.CVEDataMeta.Assigner = ""
+	if err := add(item); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// withoutOperators returns n with the operator and negate flag of every node
+// cleared.
+func withoutOperators(n ConfigNode) ConfigNode {
+	n.Operator, n.Negate = "", false
+	if n.Children != nil {
+		children := make([]ConfigNode, len(n.Children))
+		for i, c := range n.Children {
+			children[i] = withoutOperators(c)
+		}
+		n.Children = children
+	}
+	return n
+}
+
+// parseAsOf parses the asOf query parameter. A date means the end of that day
+// in UTC, i.e. what the database said once the day's syncs were done.
+func parseAsOf(s string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t.Add(24*time.Hour - time.Microsecond), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid asOf %q: want a date (2024-01-15) or an RFC 3339 timestamp", s)
+	}
+	return t, nil
+}
+
+// getCVEAsOf rebuilds a CVE from the version in cve_history that was current
+// at t. Only the NVD record is versioned: exploit, KEV and EPSS enrichment is
+// left empty, while tags are the tenant's current ones. It returns
+// sql.ErrNoRows if the CVE had not been stored yet at t.
+func getCVEAsOf(db *sql.DB, tenant, cveID string, t time.Time) (*CVERecord, error) {
+	var record []byte
+	err := db.QueryRow(`SELECT record FROM cve_history
+						WHERE cve_id = $1 AND valid_from <= $2::timestamptz
+						  AND (valid_to IS NULL OR valid_to > $2::timestamptz)`, cveID, t).Scan(&record)
+	if err != nil {
+		return nil, err
+	}
+	var item CVEItem
+	if err := json.Unmarshal(record, &item); err != nil {
+		return nil, fmt.Errorf("failed to decode version of CVE ID %s: %v", cveID, err)
+	}
+
+	r := recordFromItem(item)
+	r.AsOf = &t
+	r.Tags, err = getTags(db, tenant, cveID)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// recordFromItem builds the API record of an NVD record as it would be
+// stored, without enrichment or tags.
+func recordFromItem(item CVEItem) *CVERecord {
+	r := &CVERecord{
+		ID:               item.CVE.CVEDataMeta.ID,
+		Assigner:         item.CVE.CVEDataMeta.Assigner,
+		PublishedDate:    utcTimestamp(item.PublishedDate),
+		LastModifiedDate: utcTimestamp(item.LastModifiedDate),
+		CWEs:             item.cweIDs(),
+		CVETags:          item.cveTags(),
+		Comments:         item.comments(),
+	}
+	if len(item.CVE.Description.DescriptionData) > 0 {
+		r.Description = item.CVE.Description.DescriptionData[0].Value
+	}
+	if v3 := item.Impact.BaseMetricV3.CVSSV3; v3.Version != "" {
+		r.CVSS = &CVSSRecord{Version: v3.Version, VectorString: v3.VectorString, BaseScore: v3.BaseScore, BaseSeverity: v3.BaseSeverity}
+	}
+	for _, m := range item.cvssMetrics() {
+		r.CVSSScores = append(r.CVSSScores, CVSSScoreRecord(m))
+	}
+	slices.Sort(r.CWEs)
+	for _, ref := range item.CVE.References.ReferenceData {
+		if slices.Contains(ref.Tags, "Vendor Advisory") {
+			vendor, advisoryID := recognizeAdvisory(ref)
+			r.Advisories = append(r.Advisories, AdvisoryRecord{Vendor: vendor, AdvisoryID: advisoryID, URL: ref.URL})
+		}
+	}
+	slices.SortFunc(r.Advisories, func(a, b AdvisoryRecord) int { return strings.Compare(a.URL, b.URL) })
+	return r
+}
+
+// searchCVEsAsOf is searchCVEs over the versions in cve_history that were
+// current at t.
+func searchCVEsAsOf(db *sql.DB, filter CVEFilter, t time.Time) ([]CVESummary, error) {
+	rows, err := db.Query(`SELECT h.cve_id, COALESCE(h.record->'cve'->'CVE_data_meta'->>'ASSIGNER', ''), h.record->>'publishedDate',
+								  (h.record->'impact'->'baseMetricV3'->'cvssV3'->>'baseScore')::float8,
+								  COALESCE(h.record->'impact'->'baseMetricV3'->'cvssV3'->>'baseSeverity', '')
+						   FROM cve_history h
+						   WHERE h.valid_from <= $5::timestamptz AND (h.valid_to IS NULL OR h.valid_to > $5::timestamptz)
+							 AND ($6 = '' OR h.record->'cve'->'CVE_data_meta'->>'ASSIGNER' = $6)
+							 AND (cardinality($1::text[]) = 0 OR h.cve_id IN (
+							   SELECT cve_id FROM tags WHERE tenant = $4 AND tag = ANY($1)
+							   GROUP BY cve_id HAVING count(*) = cardinality($1::text[])))
+						   ORDER BY h.record->>'publishedDate' DESC, h.cve_id DESC
+						   LIMIT $2 OFFSET $3`, pq.Array(filter.Tags), filter.Limit, filter.Offset, filter.Tenant, t, filter.Assigner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search CVE history: %v", err)
+	}
+	defer rows.Close()
+
+	cves := []CVESummary{}
+	for rows.Next() {
+		var c CVESummary
+		if err := rows.Scan(&c.ID, &c.Assigner, &c.PublishedDate, &c.BaseScore, &c.BaseSeverity); err != nil {
+			return nil, err
+		}
+		c.PublishedDate = utcTimestamp(c.PublishedDate)
+		cves = append(cves, c)
+	}
+	return cves, rows.Err()
+}
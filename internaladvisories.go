@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// internalAdvisoryIDPattern admits IDs such as ACME-2025-0042 or SEC-117.
+// CVE IDs are rejected so an internal advisory never shadows a public CVE.
+var internalAdvisoryIDPattern = regexp.MustCompile(`^[A-Z][A-Z0-9]*(-[A-Z0-9]+)+$`)
+
+// Sources of internal advisories: created through the API, or imported from
+// advisory files, which also removes those whose file is gone.
+const (
+	internalSourceAPI   = "api"
+	internalSourceFiles = "files"
+)
+
+var errInvalidInternalAdvisory = errors.New("an internal advisory needs an ID such as ACME-2025-0042 (not a CVE ID), a title, a severity of LOW, MEDIUM, HIGH or CRITICAL, a base score from 0 to 10 if set, and cpe:2.3: product names")
+
+// InternalAdvisory is a non-public issue a tenant tracks itself. It is listed
+// by CVE searches, matched against inventories and paged on like a CVE,
+// under its own ID and with Internal set.
+type InternalAdvisory struct {
+	ID          string                    `json:"id"`
+	Internal    bool                      `json:"internal"`
+	Title       string                    `json:"title"`
+	Description string                    `json:"description,omitempty"`
+	Severity    string                    `json:"severity"`
+	BaseScore   *float64                  `json:"base_score,omitempty"`
+	Products    []InternalAdvisoryProduct `json:"products"`
+	Source      string                    `json:"source"`
+	PublishedAt time.Time                 `json:"published_at"`
+	UpdatedAt   time.Time                 `json:"updated_at"`
+}
+
+// InternalAdvisoryProduct is an affected product: a CPE name, and unless the
+// name carries a version, an optional range from VersionStart (inclusive) to
+// VersionEnd (exclusive).
+type InternalAdvisoryProduct struct {
+	CPE          string `json:"cpe"`
+	VersionStart string `json:"version_start,omitempty"`
+	VersionEnd   string `json:"version_end,omitempty"`
+}
+
+// normalizeInternalAdvisory canonicalizes a as it is stored and checks it.
+func normalizeInternalAdvisory(a *InternalAdvisory) error {
+	a.ID = strings.ToUpper(strings.TrimSpace(a.ID))
+	a.Severity = strings.ToUpper(a.Severity)
+	if len(a.ID) > 64 || !internalAdvisoryIDPattern.MatchString(a.ID) || cveIDPattern.MatchString(a.ID) ||
+		strings.TrimSpace(a.Title) == "" || !validSeverity(a.Severity) || a.Severity == "NONE" ||
+		(a.BaseScore != nil && (*a.BaseScore < 0 || *a.BaseScore > 10)) {
+		return errInvalidInternalAdvisory
+	}
+	for i, p := range a.Products {
+		uri := normalizeCPEURI(strings.ToLower(strings.TrimSpace(p.CPE)))
+		if len(strings.Split(uri, ":")) < 6 || !strings.HasPrefix(uri, "cpe:2.3:") {
+			return errInvalidInternalAdvisory
+		}
+		a.Products[i] = InternalAdvisoryProduct{CPE: uri, VersionStart: normalizeVersion(p.VersionStart), VersionEnd: normalizeVersion(p.VersionEnd)}
+	}
+	return nil
+}
+
+// putInternalAdvisory creates or replaces one of a tenant's advisories and
+// reports whether it was created.
+func putInternalAdvisory(db *sql.DB, tenant string, a InternalAdvisory) (*InternalAdvisory, bool, error) {
+	if err := normalizeInternalAdvisory(&a); err != nil {
+		return nil, false, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	created, err := storeInternalAdvisory(tx, tenant, &a)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("transaction commit error: %v", err)
+	}
+	return &a, created, nil
+}
+
+// storeInternalAdvisory upserts a normalized advisory and its products and
+// fills in its timestamps. A replaced advisory keeps its publication time
+// unless a new one is given.
+func storeInternalAdvisory(tx *sql.Tx, tenant string, a *InternalAdvisory) (bool, error) {
+	var publishedAt *time.Time
+	if !a.PublishedAt.IsZero() {
+		publishedAt = &a.PublishedAt
+	}
+	if a.Source == "" {
+		a.Source = internalSourceAPI
+	}
+
+	var created bool
+	err := tx.QueryRow(`INSERT INTO internal_advisories (tenant, id, title, description, severity, base_score, published_at, source)
+						VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, now()), $8)
+						ON CONFLICT (tenant, id) DO UPDATE SET title = EXCLUDED.title, description = EXCLUDED.description,
+							severity = EXCLUDED.severity, base_score = EXCLUDED.base_score,
+							published_at = COALESCE($7, internal_advisories.published_at), source = EXCLUDED.source, updated_at = now()
+						RETURNING published_at, updated_at, xmax = 0`,
+		tenant, a.ID, a.Title, a.Description, a.Severity, a.BaseScore, publishedAt, a.Source).Scan(&a.PublishedAt, &a.UpdatedAt, &created)
+	if err != nil {
+		return false, fmt.Errorf("failed to store internal advisory %s: %v", a.ID, err)
+	}
+	if _, err := tx.Exec(`DELETE FROM internal_advisory_products WHERE tenant = $1 AND advisory_id = $2`, tenant, a.ID); err != nil {
+		return false, fmt.Errorf("failed to delete products of internal advisory %s: %v", a.ID, err)
+	}
+	for _, p := range a.Products {
+		_, err := tx.Exec(`INSERT INTO internal_advisory_products (tenant, advisory_id, cpe_uri, version_start, version_end)
+						   VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`, tenant, a.ID, p.CPE, p.VersionStart, p.VersionEnd)
+		if err != nil {
+			return false, fmt.Errorf("failed to store product %s of internal advisory %s: %v", p.CPE, a.ID, err)
+		}
+	}
+	if a.Products == nil {
+		a.Products = []InternalAdvisoryProduct{}
+	}
+	a.Internal = true
+	return created, nil
+}
+
+// loadInternalAdvisories returns a tenant's advisories that satisfy the SQL
+// condition where on internal_advisories a, whose parameters start at $2.
+func loadInternalAdvisories(db *sql.DB, tenant, where string, args ...any) ([]InternalAdvisory, error) {
+	rows, err := db.Query(`SELECT a.id, a.title, a.description, a.severity, a.base_score, a.source, a.published_at, a.updated_at,
+								  COALESCE((SELECT json_agg(json_build_object('cpe', p.cpe_uri, 'version_start', p.version_start, 'version_end', p.version_end)
+											ORDER BY p.cpe_uri, p.version_start)
+											FROM internal_advisory_products p
+											WHERE p.tenant = a.tenant AND p.advisory_id = a.id), '[]')
+						   FROM internal_advisories a
+						   WHERE a.tenant = $1 AND `+where+`
+						   ORDER BY a.published_at DESC, a.id`, append([]any{tenant}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load internal advisories: %v", err)
+	}
+	defer rows.Close()
+
+	advisories := []InternalAdvisory{}
+	for rows.Next() {
+		a := InternalAdvisory{Internal: true}
+		var products []byte
+		if err := rows.Scan(&a.ID, &a.Title, &a.Description, &a.Severity, &a.BaseScore, &a.Source, &a.PublishedAt, &a.UpdatedAt, &products); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(products, &a.Products); err != nil {
+			return nil, fmt.Errorf("failed to decode products of internal advisory %s: %v", a.ID, err)
+		}
+		advisories = append(advisories, a)
+	}
+	return advisories, rows.Err()
+}
+
+func listInternalAdvisories(db *sql.DB, tenant string) ([]InternalAdvisory, error) {
+	return loadInternalAdvisories(db, tenant, "true")
+}
+
+// getInternalAdvisory returns one of a tenant's advisories, or sql.ErrNoRows.
+func getInternalAdvisory(db *sql.DB, tenant, id string) (*InternalAdvisory, error) {
+	advisories, err := loadInternalAdvisories(db, tenant, "a.id = $2", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(advisories) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &advisories[0], nil
+}
+
+// deleteInternalAdvisory removes one of a tenant's advisories. It returns
+// sql.ErrNoRows if the tenant has no such advisory.
+func deleteInternalAdvisory(db *sql.DB, tenant, id string) error {
+	res, err := db.Exec(`DELETE FROM internal_advisories WHERE tenant = $1 AND id = $2`, tenant, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete internal advisory %s: %v", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// matchInternalAdvisories returns the tenant's advisories with a product
+// covering the given CPE part, vendor, product and version, one hit per
+// advisory. Suppressions apply as they do to CVEs.
+func matchInternalAdvisories(db *sql.DB, tenant, part, vendor, product, version string) ([]CPEMatchHit, error) {
+	rows, err := db.Query(`SELECT a.id, p.cpe_uri, p.version_start, p.version_end, a.base_score, a.severity
+						   FROM internal_advisory_products p
+						   JOIN internal_advisories a ON a.tenant = p.tenant AND a.id = p.advisory_id
+						   WHERE p.tenant = $1
+							 AND split_part(p.cpe_uri, ':', 4) = $2 AND split_part(p.cpe_uri, ':', 5) = $3
+							 AND split_part(p.cpe_uri, ':', 3) = $4
+							 AND NOT `+suppressedCPE("a.tenant", "a.id", "p.cpe_uri")+`
+						   ORDER BY a.id, p.cpe_uri`, tenant, vendor, product, part)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up internal advisories: %v", err)
+	}
+	defer rows.Close()
+
+	hits := []CPEMatchHit{}
+	for rows.Next() {
+		h := CPEMatchHit{Internal: true}
+		if err := rows.Scan(&h.CVEID, &h.CPEURI, &h.VersionStart, &h.VersionEnd, &h.BaseScore, &h.BaseSeverity); err != nil {
+			return nil, err
+		}
+		if len(hits) > 0 && hits[len(hits)-1].CVEID == h.CVEID {
+			continue
+		}
+		if cpeCoversVersion(h.CPEURI, h.versionRange(), version) {
+			hits = append(hits, h)
+		}
+	}
+	return hits, rows.Err()
+}
+
+// matchInternalPageRule returns the advisories of the rule's tenant that the
+// rule selects. Internal advisories are never in KEV and have no EPSS score,
+// so rules requiring either do not select them.
+func matchInternalPageRule(db *sql.DB, rule PageRule, since string) ([]pageMatch, error) {
+	rows, err := db.Query(`SELECT a.id, a.title, a.severity, COALESCE(a.base_score, 0), a.published_at >= $6::date,
+							   `+suppressedInternalAdvisory("a.tenant", "a.id")+`
+						   FROM internal_advisories a
+						   WHERE a.tenant = $7
+						   AND ($1 = '' OR a.severity = upper($1))
+						   AND COALESCE(a.base_score, 0) >= $2::numeric
+						   AND NOT $3::boolean AND $4::numeric <= 0
+						   AND ($5 = '' OR EXISTS (
+							   SELECT 1 FROM internal_advisory_products p
+							   WHERE p.tenant = a.tenant AND p.advisory_id = a.id AND starts_with(p.cpe_uri, $5)))`,
+		rule.Severity, rule.MinCVSS, rule.KEV, rule.MinEPSS, rule.CPEPrefix, since, rule.Tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate page rule %s on internal advisories: %v", rule.Name, err)
+	}
+	defer rows.Close()
+
+	var matches []pageMatch
+	for rows.Next() {
+		m := pageMatch{Tenant: rule.Tenant, Rule: rule.Name, Internal: true}
+		if err := rows.Scan(&m.CVEID, &m.Description, &m.Severity, &m.Score, &m.Recent, &m.Suppressed); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
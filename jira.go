@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+var (
+	jiraURL             = flag.String("jira-url", "", "Jira base URL; enables issues for watchlist hits (credentials from JIRA_USER and JIRA_API_TOKEN)")
+	jiraProject         = flag.String("jira-project", "", "Jira project key for watchlist issues")
+	jiraIssueType       = flag.String("jira-issue-type", "Bug", "Jira issue type for watchlist issues")
+	jiraCloseTransition = flag.String("jira-close-transition", "Done", "name of the Jira transition that closes an issue")
+	jiraTemplateFile    = flag.String("jira-template", "", "text/template file for the issue description (built-in template if empty)")
+)
+
+const defaultJiraTemplate = `{{.CVEID}} affects {{.Product}} (watchlist: {{.Watchlist}}).
+
+Severity: {{if .Severity}}{{.Severity}} ({{.Score}}){{else}}not yet scored{{end}}
+Published: {{.Published}}
+Last modified: {{.LastModified}}
+
+{{.Description}}
+
+https://nvd.nist.gov/vuln/detail/{{.CVEID}}
+`
+
+// watchlistHit is a CVE with a vulnerable CPE of a product on a tenant's
+// watchlist. Issues are deduplicated per tenant, CVE and product.
+type watchlistHit struct {
+	Tenant       string
+	CVEID        string
+	Product      string
+	Watchlist    string
+	Description  string
+	Severity     string
+	Score        float64
+	Published    string
+	LastModified string
+}
+
+func jiraEnabled() bool {
+	return *jiraURL != ""
+}
+
+// syncJiraIssues opens an issue for every new watchlist hit, comments on
+// issues whose CVE changed since the last sync, and closes issues whose CVE no
+// longer matches the watchlist or was suppressed.
+func syncJiraIssues(db *sql.DB) error {
+	tmplText := defaultJiraTemplate
+	if *jiraTemplateFile != "" {
+		data, err := os.ReadFile(*jiraTemplateFile)
+		if err != nil {
+			return fmt.Errorf("failed to read Jira template: %v", err)
+		}
+		tmplText = string(data)
+	}
+	tmpl, err := template.New("jira").Parse(tmplText)
+	if err != nil {
+		return fmt.Errorf("failed to parse Jira template: %v", err)
+	}
+
+	hits, err := watchlistHits(db)
+	if err != nil {
+		return err
+	}
+
+	current := map[[3]string]bool{}
+	for _, hit := range hits {
+		current[[3]string{hit.Tenant, hit.CVEID, hit.Product}] = true
+
+		var issueKey, lastModified string
+		err := db.QueryRow(`SELECT issue_key, last_modified FROM jira_issues WHERE tenant = $1 AND cve_id = $2 AND product = $3 AND status = 'open'`,
+			hit.Tenant, hit.CVEID, hit.Product).Scan(&issueKey, &lastModified)
+		switch {
+		case err == sql.ErrNoRows:
+			var description bytes.Buffer
+			if err := tmpl.Execute(&description, hit); err != nil {
+				return fmt.Errorf("failed to render Jira template: %v", err)
+			}
+			key, err := createJiraIssue(hit.Tenant, fmt.Sprintf("%s in %s", hit.CVEID, hit.Product), description.String())
+			if err != nil {
+				return err
+			}
+			_, err = db.Exec(`INSERT INTO jira_issues (tenant, cve_id, product, issue_key, status, last_modified)
+							  VALUES ($1, $2, $3, $4, 'open', $5)
+							  ON CONFLICT (tenant, cve_id, product) DO UPDATE
+							  SET issue_key = EXCLUDED.issue_key, status = 'open', last_modified = EXCLUDED.last_modified;`,
+				hit.Tenant, hit.CVEID, hit.Product, key, hit.LastModified)
+			if err != nil {
+				return fmt.Errorf("failed to record Jira issue %s: %v", key, err)
+			}
+			log.Printf("Opened Jira issue %s for %s in %s\n", key, hit.CVEID, hit.Product)
+		case err != nil:
+			return fmt.Errorf("failed to look up Jira issue: %v", err)
+		case lastModified != hit.LastModified:
+			var description bytes.Buffer
+			if err := tmpl.Execute(&description, hit); err != nil {
+				return fmt.Errorf("failed to render Jira template: %v", err)
+			}
+			if err := commentJiraIssue(issueKey, "NVD updated this CVE:\n\n"+description.String()); err != nil {
+				return err
+			}
+			if _, err := db.Exec(`UPDATE jira_issues SET last_modified = $4 WHERE tenant = $1 AND cve_id = $2 AND product = $3`,
+				hit.Tenant, hit.CVEID, hit.Product, hit.LastModified); err != nil {
+				return fmt.Errorf("failed to record Jira update for %s: %v", issueKey, err)
+			}
+		}
+	}
+
+	rows, err := db.Query(`SELECT tenant, cve_id, product, issue_key FROM jira_issues WHERE status = 'open'`)
+	if err != nil {
+		return fmt.Errorf("failed to list open Jira issues: %v", err)
+	}
+	var stale [][4]string
+	for rows.Next() {
+		var s [4]string
+		if err := rows.Scan(&s[0], &s[1], &s[2], &s[3]); err != nil {
+			rows.Close()
+			return err
+		}
+		if !current[[3]string{s[0], s[1], s[2]}] {
+			stale = append(stale, s)
+		}
+	}
+	rows.Close()
+
+	for _, s := range stale {
+		if err := closeJiraIssue(s[3], fmt.Sprintf("%s no longer affects a watchlisted product.", s[1])); err != nil {
+			return err
+		}
+		if _, err := db.Exec(`UPDATE jira_issues SET status = 'closed' WHERE tenant = $1 AND cve_id = $2 AND product = $3`, s[0], s[1], s[2]); err != nil {
+			return fmt.Errorf("failed to record closing of %s: %v", s[3], err)
+		}
+		log.Printf("Closed Jira issue %s for %s in %s\n", s[3], s[1], s[2])
+	}
+	return nil
+}
+
+// watchlistHits lists every (tenant, CVE, vendor:product) triple where a
+// vulnerable, unsuppressed CPE starts with a prefix on the tenant's watchlist.
+func watchlistHits(db *sql.DB) ([]watchlistHit, error) {
+	rows, err := db.Query(`SELECT DISTINCT ON (w.tenant, c.cve_id, product)
+							   w.tenant, c.cve_id, split_part(p.cpe_uri, ':', 4) || ':' || split_part(p.cpe_uri, ':', 5) AS product,
+							   w.name, c.description, COALESCE(i.cvss_base_severity, ''), COALESCE(i.cvss_base_score, 0),
+							   ` + utcTimestampSQL("c.published_date") + `, ` + utcTimestampSQL("c.last_modified_date") + `
+						   FROM cpe_data p
+						   JOIN watchlist w ON starts_with(p.cpe_uri, w.cpe_prefix)
+						   JOIN cve_data1 c ON c.cve_id = p.cve_id
+						   LEFT JOIN impact_data i ON i.cve_id = c.cve_id
+						   WHERE p.vulnerable AND NOT ` + suppressedCPE("w.tenant", "p.cve_id", "p.cpe_uri") + `
+						   ORDER BY w.tenant, c.cve_id, product, w.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find watchlist hits: %v", err)
+	}
+	defer rows.Close()
+
+	var hits []watchlistHit
+	for rows.Next() {
+		var h watchlistHit
+		if err := rows.Scan(&h.Tenant, &h.CVEID, &h.Product, &h.Watchlist, &h.Description, &h.Severity, &h.Score, &h.Published, &h.LastModified); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+func jiraRequest(method, path string, body, result any) error {
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*jiraURL, "/")+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(os.Getenv("JIRA_USER"), os.Getenv("JIRA_API_TOKEN"))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Jira request %s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Jira request %s %s failed: %s", method, path, resp.Status)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// createJiraIssue opens an issue labelled with the tenant it was raised for.
+func createJiraIssue(tenant, summary, description string) (string, error) {
+	body := map[string]any{
+		"fields": map[string]any{
+			"project":     map[string]string{"key": *jiraProject},
+			"issuetype":   map[string]string{"name": *jiraIssueType},
+			"summary":     summary,
+			"description": description,
+			"labels":      []string{"cve", "tenant-" + tenant},
+		},
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	if err := jiraRequest(http.MethodPost, "/rest/api/2/issue", body, &created); err != nil {
+		return "", err
+	}
+	return created.Key, nil
+}
+
+func commentJiraIssue(key, comment string) error {
+	return jiraRequest(http.MethodPost, "/rest/api/2/issue/"+key+"/comment", map[string]string{"body": comment}, nil)
+}
+
+// closeJiraIssue comments on the issue and applies the configured close
+// transition.
+func closeJiraIssue(key, comment string) error {
+	if err := commentJiraIssue(key, comment); err != nil {
+		return err
+	}
+
+	var transitions struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"transitions"`
+	}
+	if err := jiraRequest(http.MethodGet, "/rest/api/2/issue/"+key+"/transitions", nil, &transitions); err != nil {
+		return err
+	}
+	for _, t := range transitions.Transitions {
+		if strings.EqualFold(t.Name, *jiraCloseTransition) {
+			return jiraRequest(http.MethodPost, "/rest/api/2/issue/"+key+"/transitions",
+				map[string]any{"transition": map[string]string{"id": t.ID}}, nil)
+		}
+	}
+	return fmt.Errorf("Jira issue %s has no %q transition", key, *jiraCloseTransition)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const kevURL = "https://www.cisa.gov/sites/default/files/feeds/known_exploited_vulnerabilities.json"
+
+var syncKEVCatalog = flag.Bool("kev", false, "sync the CISA Known Exploited Vulnerabilities catalog daily")
+
+type kevCatalog struct {
+	Vulnerabilities []struct {
+		CVEID                      string `json:"cveID"`
+		VendorProject              string `json:"vendorProject"`
+		Product                    string `json:"product"`
+		VulnerabilityName          string `json:"vulnerabilityName"`
+		DateAdded                  string `json:"dateAdded"`
+		DueDate                    string `json:"dueDate"`
+		KnownRansomwareCampaignUse string `json:"knownRansomwareCampaignUse"`
+	} `json:"vulnerabilities"`
+}
+
+// syncKEV replaces the kev table with the current CISA KEV catalog.
+func syncKEV(db *sql.DB) error {
+	resp, err := http.Get(kevURL)
+	if err != nil {
+		return fmt.Errorf("failed to download KEV catalog: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download KEV catalog: %s", resp.Status)
+	}
+
+	var catalog kevCatalog
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		return fmt.Errorf("failed to decode KEV catalog: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if err := setProvenance(tx, sourceKEV); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM kev`); err != nil {
+		return fmt.Errorf("failed to clear KEV entries: %v", err)
+	}
+	for _, v := range catalog.Vulnerabilities {
+		cveID, ok := normalizeCVEID(v.CVEID)
+		if !ok {
+			log.Printf("Skipping KEV entry with malformed CVE ID %q\n", v.CVEID)
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO kev (cve_id, vendor_project, product, vulnerability_name, date_added, due_date, known_ransomware_campaign_use, source_record_id)
+						   VALUES ($1, $2, $3, $4, NULLIF($5, '')::date, NULLIF($6, '')::date, $7, $1)
+						   ON CONFLICT (cve_id) DO NOTHING;`,
+			cveID, v.VendorProject, v.Product, v.VulnerabilityName, v.DateAdded, v.DueDate, v.KnownRansomwareCampaignUse)
+		if err != nil {
+			return fmt.Errorf("failed to insert KEV entry %s: %v", v.CVEID, err)
+		}
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Synced %d KEV entries\n", len(catalog.Vulnerabilities))
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// leaderLockKey is the Postgres advisory lock key shared by all replicas.
+	leaderLockKey       = 0x43564544 // "CVED"
+	leaderRetryInterval = 15 * time.Second
+	leaderCheckInterval = 10 * time.Second
+)
+
+var (
+	// leaderElected is set once runLeaderElection starts; until then
+	// checkLeadership lets every write through.
+	leaderElected atomic.Bool
+	// leaderPID is the backend PID of the connection holding the leader lock,
+	// or 0 while this replica does not hold it.
+	leaderPID atomic.Int64
+)
+
+var errNotLeader = errors.New("this replica no longer holds the leader lock")
+
+// checkLeadership returns errNotLeader if leader election is enabled and this
+// replica no longer holds the leader lock. Scheduled write paths call it in
+// their transaction just before committing, so a deposed leader stops writing
+// at its next batch instead of finishing the job alongside the new leader.
+func checkLeadership(tx *sql.Tx) error {
+	if !leaderElected.Load() {
+		return nil
+	}
+	pid := leaderPID.Load()
+	if pid == 0 {
+		return errNotLeader
+	}
+	// A bigint advisory key is split across classid (high 32 bits) and objid
+	// (low 32 bits), with objsubid 1.
+	var held bool
+	err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND classid = $1 AND objid = $2 AND objsubid = 1 AND pid = $3 AND granted)`,
+		int64(leaderLockKey)>>32, int64(leaderLockKey)&0xffffffff, pid).Scan(&held)
+	if err != nil {
+		return fmt.Errorf("failed to check leadership: %v", err)
+	}
+	if !held {
+		leaderPID.Store(0)
+		return errNotLeader
+	}
+	return nil
+}
+
+// runLeaderElection competes with other replicas for the leader lock until
+// shutdown is closed. While this replica holds the lock, lead runs; the stop
+// channel passed to it is closed when leadership is lost and lead must return.
+//
+// The lock is a session-level advisory lock held on a dedicated connection, so
+// Postgres releases it automatically if the leader dies or its connection drops.
+func runLeaderElection(db *sql.DB, shutdown <-chan struct{}, lead func(stop <-chan struct{})) {
+	ctx := context.Background()
+	leaderElected.Store(true)
+	for {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			log.Printf("Leader election: failed to get connection: %v\n", err)
+			if !waitOrShutdown(shutdown, leaderRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		var acquired bool
+		var pid int64
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1), pg_backend_pid()", leaderLockKey).Scan(&acquired, &pid); err != nil {
+			log.Printf("Leader election: failed to query lock: %v\n", err)
+		}
+		if !acquired {
+			conn.Close()
+			if !waitOrShutdown(shutdown, leaderRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		log.Println("Leader election: acquired leadership")
+		leaderPID.Store(pid)
+		holdLeadership(ctx, conn, shutdown, lead)
+		leaderPID.Store(0)
+		log.Println("Leader election: released leadership")
+		conn.Close()
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+	}
+}
+
+// waitOrShutdown sleeps for d and reports false if shutdown was closed first.
+func waitOrShutdown(shutdown <-chan struct{}, d time.Duration) bool {
+	select {
+	case <-shutdown:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// holdLeadership runs lead until the connection holding the lock fails or
+// shutdown is closed. When the lock is lost, leaderPID is cleared before
+// waiting for lead to return, so any batch still in flight fails its
+// checkLeadership rather than committing.
+func holdLeadership(ctx context.Context, conn *sql.Conn, shutdown <-chan struct{}, lead func(stop <-chan struct{})) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		lead(stop)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(leaderCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			// lead returned on its own; release the lock for another replica.
+			conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", leaderLockKey)
+			return
+		case <-shutdown:
+			close(stop)
+			<-done
+			conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", leaderLockKey)
+			return
+		case <-ticker.C:
+			if err := conn.PingContext(ctx); err != nil {
+				log.Printf("Leader election: lock connection lost: %v\n", err)
+				leaderPID.Store(0)
+				close(stop)
+				<-done
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// loadgenIDBase puts synthetic CVE IDs in the unassigned CVE-YYYY-7xxxxxx
+// range, clear of real CVEs and of the seed data.
+const loadgenIDBase = 7000000
+
+var loadgenProducts = []struct{ part, vendor, product string }{
+	{"a", "apache", "http_server"}, {"a", "apache", "tomcat"}, {"a", "openssl", "openssl"},
+	{"a", "f5", "nginx"}, {"a", "google", "chrome"}, {"a", "mozilla", "firefox"},
+	{"a", "php", "php"}, {"a", "python", "python"}, {"a", "nodejs", "node.js"},
+	{"a", "wordpress", "wordpress"}, {"a", "jenkins", "jenkins"}, {"a", "gitlab", "gitlab"},
+	{"a", "oracle", "mysql"}, {"a", "postgresql", "postgresql"}, {"a", "redis", "redis"},
+	{"o", "linux", "linux_kernel"}, {"o", "microsoft", "windows_server_2022"},
+	{"o", "cisco", "ios_xe"}, {"o", "fortinet", "fortios"}, {"o", "juniper", "junos"},
+}
+
+var loadgenPlatforms = []string{
+	"cpe:2.3:h:cisco:catalyst_9300:-:*:*:*:*:*:*:*",
+	"cpe:2.3:h:fortinet:fortigate:-:*:*:*:*:*:*:*",
+	"cpe:2.3:h:juniper:srx300:-:*:*:*:*:*:*:*",
+}
+
+var loadgenCWEs = []string{"CWE-79", "CWE-89", "CWE-787", "CWE-20", "CWE-22", "CWE-78", "CWE-416", "CWE-352", "CWE-200", "CWE-287", "CWE-400", "CWE-502", "NVD-CWE-noinfo"}
+
+var loadgenWords = strings.Fields(`a an the in of via allows remote local authenticated unauthenticated attacker
+	to execute arbitrary code commands read write files cause denial service crafted request
+	parameter component vulnerability improper validation input buffer overflow memory
+	corruption injection cross-site scripting privilege escalation bypass authentication
+	sensitive information disclosure before version affected configuration module handler`)
+
+// syntheticCVE returns a schema-valid CVE of the given year. Sizes and shapes
+// roughly follow the NVD corpus: a few hundred characters of description, one
+// to three configurations of up to four CPE matches, some AND configurations
+// with a platform, and a CVSS v3.1 score for most CVEs.
+func syntheticCVE(r *rand.Rand, year, n int) CVEItem {
+	var item CVEItem
+	item.CVE.CVEDataMeta.ID = fmt.Sprintf("CVE-%d-%d", year, loadgenIDBase+n)
+	item.CVE.CVEDataMeta.Assigner = "loadgen@example.com"
+
+	words := make([]string, 20+r.IntN(50))
+	for i := range words {
+		words[i] = loadgenWords[r.IntN(len(loadgenWords))]
+	}
+	item.CVE.Description.DescriptionData = []DescriptionData{{strings.Join(words, " ") + "."}}
+
+	published := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(r.Int64N(int64(365 * 24 * time.Hour))))
+	modified := published.Add(time.Duration(r.Int64N(int64(90 * 24 * time.Hour))))
+	if now := time.Now().UTC(); modified.After(now) {
+		modified = now
+	}
+	item.PublishedDate = published.Format(nvdTimeLayouts[0])
+	item.LastModifiedDate = modified.Format(nvdTimeLayouts[0])
+
+	item.CVE.ProblemType.ProblemTypeData = make([]struct {
+		Description []DescriptionData `json:"description"`
+	}, 1)
+	item.CVE.ProblemType.ProblemTypeData[0].Description = []DescriptionData{{loadgenCWEs[r.IntN(len(loadgenCWEs))]}}
+
+	for i := range 1 + r.IntN(4) {
+		item.CVE.References.ReferenceData = append(item.CVE.References.ReferenceData, Reference{
+			URL:       fmt.Sprintf("https://example.com/advisories/%s/%d", item.CVE.CVEDataMeta.ID, i),
+			RefSource: "MISC",
+			Tags:      []string{"Vendor Advisory"},
+		})
+	}
+
+	for range 1 + r.IntN(3) {
+		p := loadgenProducts[r.IntN(len(loadgenProducts))]
+		var node ConfigNode
+		for range 1 + r.IntN(4) {
+			major, minor := r.IntN(20), r.IntN(10)
+			node.CPEMatch = append(node.CPEMatch, CPEMatch{
+				CPE23URI:     fmt.Sprintf("cpe:2.3:%s:%s:%s:*:*:*:*:*:*:*:*", p.part, p.vendor, p.product),
+				Vulnerable:   true,
+				VersionStart: fmt.Sprintf("%d.%d.0", major, minor),
+				VersionEnd:   fmt.Sprintf("%d.%d.%d", major, minor, 1+r.IntN(30)),
+			})
+		}
+		if p.part == "o" && r.IntN(4) == 0 {
+			platform := ConfigNode{CPEMatch: []CPEMatch{{CPE23URI: loadgenPlatforms[r.IntN(len(loadgenPlatforms))]}}}
+			node = ConfigNode{Operator: "AND", Children: []ConfigNode{node, platform}}
+		}
+		item.Configurations.Nodes = append(item.Configurations.Nodes, node)
+	}
+
+	if r.IntN(10) > 0 {
+		vector := syntheticCVSSVector(r)
+		v, _ := parseCVSSVector(vector)
+		score := v.baseScore()
+		cvss := &item.Impact.BaseMetricV3.CVSSV3
+		cvss.Version, cvss.VectorString, cvss.BaseScore, cvss.BaseSeverity = "3.1", vector, score, cvssV3Severity(score)
+	}
+	return item
+}
+
+func syntheticCVSSVector(r *rand.Rand) string {
+	pick := func(values ...string) string { return values[r.IntN(len(values))] }
+	return fmt.Sprintf("CVSS:3.1/AV:%s/AC:%s/PR:%s/UI:%s/S:%s/C:%s/I:%s/A:%s",
+		pick("N", "N", "N", "A", "L", "P"), pick("L", "L", "H"), pick("N", "N", "L", "H"), pick("N", "R"),
+		pick("U", "U", "U", "C"), pick("H", "L", "N"), pick("H", "L", "N"), pick("H", "L", "N"))
+}
+
+// cvssV3Severity is the qualitative rating of a CVSS v3 score.
+func cvssV3Severity(score float64) string {
+	switch {
+	case score == 0:
+		return "NONE"
+	case score < 4:
+		return "LOW"
+	case score < 7:
+		return "MEDIUM"
+	case score < 9:
+		return "HIGH"
+	}
+	return "CRITICAL"
+}
+
+// runLoadgen implements the loadgen subcommand, which pushes synthetic CVEs
+// through the regular insert path to benchmark ingestion, storage size and
+// queries before a rollout. The same -seed produces the same CVEs.
+func runLoadgen(args []string) error {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	count := fs.Int("cves", 100000, "number of synthetic CVEs to insert")
+	batch := fs.Int("batch", 1000, "CVEs per transaction")
+	from := fs.Int("from", 2002, "first year of the synthetic CVEs")
+	to := fs.Int("to", time.Now().Year(), "last year of the synthetic CVEs")
+	seed := fs.Uint64("seed", 1, "random seed")
+	force := fs.Bool("force", false, "insert even if the database already holds CVEs")
+	fs.Parse(args)
+	if *count < 1 || *batch < 1 || *from > *to {
+		return fmt.Errorf("loadgen needs -cves and -batch of at least 1 and -from <= -to")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
+	var existing int
+	if err := db.QueryRow(`SELECT count(*) FROM cve_data1`).Scan(&existing); err != nil {
+		return fmt.Errorf("failed to count CVEs: %v", err)
+	}
+	if existing > 0 && !*force {
+		return fmt.Errorf("the database already holds %d CVEs; loadgen is meant for benchmark databases (use -force to insert anyway)", existing)
+	}
+
+	syncProgress.start("loadgen", *from, *to)
+	defer syncProgress.finish()
+	syncProgress.setFeedItems(*count)
+	done := make(chan struct{})
+	defer close(done)
+	go syncProgress.logPeriodically(done)
+	run := beginSyncRun(db, "loadgen", datasetNVD, sourceLoadgen)
+
+	r := rand.New(rand.NewPCG(*seed, 0))
+	years := *to - *from + 1
+	start := time.Now()
+	items := make([]CVEItem, 0, *batch)
+	for i := 0; i < *count; i++ {
+		items = append(items, syntheticCVE(r, *from+i%years, i/years))
+		if len(items) == *batch || i == *count-1 {
+			if err := insertBatch(db, items, i+1-len(items)); err != nil {
+				run.finish(db, err)
+				return fmt.Errorf("failed to insert synthetic CVEs: %v", err)
+			}
+			items = items[:0]
+		}
+	}
+	run.finish(db, nil)
+	elapsed := time.Since(start)
+	log.Printf("Inserted %d synthetic CVEs in %s (%.0f CVEs/s)\n", *count, elapsed.Round(time.Second), float64(*count)/elapsed.Seconds())
+
+	rows, err := db.Query(`SELECT c.relname, pg_size_pretty(pg_total_relation_size(c.oid))
+						   FROM pg_class c
+						   WHERE c.relname = ANY($1) AND c.relkind = 'r' AND pg_table_is_visible(c.oid)
+						   ORDER BY pg_total_relation_size(c.oid) DESC`, pq.Array(tableNames(hotTables)))
+	if err != nil {
+		return fmt.Errorf("failed to read table sizes: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, size string
+		if err := rows.Scan(&table, &size); err != nil {
+			return err
+		}
+		log.Printf("%-16s %s (with indexes)\n", table, size)
+	}
+	return rows.Err()
+}
@@ -5,58 +5,63 @@ import (
 	"compress/gzip"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/klauspost/pgzip"
+	"github.com/lib/pq"
 	"github.com/robfig/cron/v3"
 )
 
 const (
-	dbUser             = "hp"
-	dbName             = "newcvedb2"
-	dbSSLMode          = "disable"
-	cveBaseURL         = "https://nvd.nist.gov/feeds/json/cve/1.1/nvdcve-1.1-%d.json.gz"
-	cveModifiedURL     = "https://nvd.nist.gov/feeds/json/cve/1.1-modified.json.gz"
-	cveModifiedMetaURL = "https://nvd.nist.gov/feeds/json/cve/1.1-modified.json.gz.meta"
-	initialDownload    = true
-	lastModifiedFile   = "last_modified.txt" 
+	dbUser           = "hp"
+	dbName           = "newcvedb2"
+	dbSSLMode        = "disable"
+	lastModifiedFile = "last_modified.txt"
 )
 
+var (
+	leaderElect     = flag.Bool("leader-elect", false, "only run the scheduler on the replica holding the Postgres leader lock")
+	logLevel        = flag.String("log-level", "info", "log verbosity: info, or debug for per-CVE detail")
+	initialDownload = flag.Bool("initial-download", true, "download the 2023-2025 year feeds before starting the update schedule")
+	role            = flag.String("role", "all", "what this process runs: sync (migrations, syncs and scheduled jobs; /status only), serve (the query API against a migrated database), or all")
+	nvdFeedURL      = flag.String("nvd-feed-url", "https://nvd.nist.gov/feeds/json/cve", "base URL of the NVD 1.1 JSON feeds, e.g. http://localhost:8081/feeds/json/cve for devserver")
+	dbSchema        = flag.String("db-schema", "", "Postgres schema holding the tables, searched before public, to share a database with other applications (default: public)")
+	tablePrefix     = flag.String("table-prefix", "", "prefix of the names of the tables, their indexes and sequences, e.g. cve_ for cve_cve_data1, to share a schema with other applications")
+)
+
+var schemaPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
 type CVEItem struct {
 	CVE struct {
 		CVEDataMeta struct {
-			ID string `json:"ID"`
+			ID       string `json:"ID"`
+			Assigner string `json:"ASSIGNER,omitempty"`
 		} `json:"CVE_data_meta"`
 		Description struct {
-			DescriptionData []struct {
-				Value string `json:"value"`
-			} `json:"description_data"`
+			DescriptionData []DescriptionData `json:"description_data"`
 		} `json:"description"`
+		ProblemType struct {
+			ProblemTypeData []struct {
+				Description []DescriptionData `json:"description"`
+			} `json:"problemtype_data"`
+		} `json:"problemtype"`
+		References struct {
+			ReferenceData []Reference `json:"reference_data"`
+		} `json:"references"`
 	} `json:"cve"`
 	Configurations struct {
-		Nodes []struct {
-			CPEMatch []struct {
-				CPE23URI     string `json:"cpe23Uri"`
-				Vulnerable   bool   `json:"vulnerable"`
-				VersionStart string `json:"versionStartIncluding"`
-				VersionEnd   string `json:"versionEndExcluding"`
-			} `json:"cpe_match"`
-			Children []struct {
-				CPEMatch []struct {
-					CPE23URI     string `json:"cpe23Uri"`
-					Vulnerable   bool   `json:"vulnerable"`
-					VersionStart string `json:"versionStartIncluding"`
-					VersionEnd   string `json:"versionEndExcluding"`
-				} `json:"cpe_match"`
-			} `json:"children"`
-		} `json:"nodes"`
+		Nodes []ConfigNode `json:"nodes"`
 	} `json:"configurations"`
 	Impact struct {
 		BaseMetricV3 struct {
@@ -70,69 +75,521 @@ type CVEItem struct {
 	} `json:"impact"`
 	PublishedDate    string `json:"publishedDate"`
 	LastModifiedDate string `json:"lastModifiedDate"`
+	// CVSSMetrics, CVETags, vendor comments and evaluator notes only come
+	// from the NVD 2.0 API.
+	CVSSMetrics       []CVSSMetric    `json:"cvssMetrics,omitempty"`
+	CVETags           []CVETag        `json:"cveTags,omitempty"`
+	VendorComments    []VendorComment `json:"vendorComments,omitempty"`
+	EvaluatorComment  string          `json:"evaluatorComment,omitempty"`
+	EvaluatorSolution string          `json:"evaluatorSolution,omitempty"`
+	EvaluatorImpact   string          `json:"evaluatorImpact,omitempty"`
+}
+
+// CVETag is a set of NVD cveTags, such as "disputed", and the source that
+// applied them.
+type CVETag struct {
+	SourceIdentifier string   `json:"sourceIdentifier"`
+	Tags             []string `json:"tags"`
+}
+
+// cweIDs returns the weakness IDs (e.g. "CWE-79") the CVE is classified as.
+func (item CVEItem) cweIDs() []string {
+	var ids []string
+	for _, pt := range item.CVE.ProblemType.ProblemTypeData {
+		for _, d := range pt.Description {
+			if d.Value != "" && !slices.Contains(ids, d.Value) {
+				ids = append(ids, d.Value)
+			}
+		}
+	}
+	return ids
+}
+
+// cveTags returns the distinct NVD cveTags of the CVE.
+func (item CVEItem) cveTags() []string {
+	var tags []string
+	for _, t := range item.CVETags {
+		for _, tag := range t.Tags {
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+type DescriptionData struct {
+	Value string `json:"value"`
+}
+
+type Reference struct {
+	URL       string   `json:"url"`
+	Name      string   `json:"name"`
+	RefSource string   `json:"refsource"`
+	Tags      []string `json:"tags"`
+}
+
+// ConfigNode is a node of a CVE's applicability configuration. Children of an
+// AND node hold the application and "running on" platform lists. A node is
+// satisfied when all (AND) or any (OR, the default) of its CPE matches and
+// children are, inverted if Negate is set.
+type ConfigNode struct {
+	Operator string       `json:"operator,omitempty"`
+	Negate   bool         `json:"negate,omitempty"`
+	CPEMatch []CPEMatch   `json:"cpe_match"`
+	Children []ConfigNode `json:"children"`
+}
+
+// CPEMatch is a CPE name with an optional version range. NVD publishes at
+// most one start bound, inclusive or exclusive, and one end bound.
+type CPEMatch struct {
+	CPE23URI              string `json:"cpe23Uri"`
+	Vulnerable            bool   `json:"vulnerable"`
+	VersionStart          string `json:"versionStartIncluding"`
+	VersionStartExcluding string `json:"versionStartExcluding,omitempty"`
+	VersionEndIncluding   string `json:"versionEndIncluding,omitempty"`
+	VersionEnd            string `json:"versionEndExcluding"`
+	MatchCriteriaID       string `json:"matchCriteriaId,omitempty"` // NVD 2.0 API only
+}
+
+// versionRange returns the range the match's bounds describe.
+func (m CPEMatch) versionRange() versionRange {
+	r := versionRange{start: strings.TrimSpace(m.VersionStart), end: strings.TrimSpace(m.VersionEnd)}
+	if v := strings.TrimSpace(m.VersionStartExcluding); r.start == "" && v != "" {
+		r.start, r.startExcluding = v, true
+	}
+	if v := strings.TrimSpace(m.VersionEndIncluding); r.end == "" && v != "" {
+		r.end, r.endIncluding = v, true
+	}
+	return r
 }
 
 type CVEResponse struct {
-	CVEItems []CVEItem `json:"CVE_Items"`
+	NumberOfCVEs string    `json:"CVE_data_numberOfCVEs"`
+	CVEItems     []CVEItem `json:"CVE_Items"`
+}
+
+// count returns the number of CVEs the feed header reports, falling back to
+// the number of decoded items.
+func (r CVEResponse) count() int {
+	if n, err := strconv.Atoi(r.NumberOfCVEs); err == nil {
+		return n
+	}
+	return len(r.CVEItems)
 }
 
 func main() {
+	flag.Parse()
+	if *dbSchema != "" && !schemaPattern.MatchString(*dbSchema) {
+		log.Fatalf("invalid -db-schema %q: must be a lower-case SQL identifier", *dbSchema)
+	}
+	if err := checkTablePrefix(); err != nil {
+		log.Fatal(err)
+	}
+	if *role != "sync" && *role != "serve" && *role != "all" {
+		log.Fatalf("invalid -role %q: must be sync, serve or all", *role)
+	}
+	if *readOnly {
+		// Only an API replica can be read-only.
+		if *role == "sync" {
+			log.Fatal("-read-only cannot be combined with -role sync")
+		}
+		*role = "serve"
+	}
+	if *role == "serve" && *statusAddr == "" {
+		log.Fatal("-role serve requires -status-addr")
+	}
+	if *logLevel != "info" && *logLevel != "debug" {
+		log.Fatalf("invalid -log-level %q: must be info or debug", *logLevel)
+	}
+	if *source != "feeds" && *source != "api" && *source != "mirror" {
+		log.Fatalf("invalid -source %q: must be feeds, api or mirror", *source)
+	}
+	if *source == "mirror" && *mirrorURL == "" {
+		log.Fatal("-source mirror requires -mirror-url")
+	}
+	if *source == "mirror" && *mirrorVerifyKey == "" && !*mirrorAllowUnsigned {
+		log.Fatal("-source mirror needs -mirror-verify-key, or -mirror-allow-unsigned to skip the signature check")
+	}
+	if *expandCPENames && *source != "api" {
+		log.Fatal("-expand-cpe-names requires -source api, which syncs the match criteria it expands")
+	}
+	if jiraEnabled() && *jiraProject == "" {
+		log.Fatal("-jira-url requires -jira-project")
+	}
+	if *pager != "" && *pager != "pagerduty" && *pager != "opsgenie" {
+		log.Fatalf("invalid -pager %q: must be pagerduty or opsgenie", *pager)
+	}
+	if *windowBy != "published" && *windowBy != "modified" {
+		log.Fatalf("invalid -window-by %q: must be published or modified", *windowBy)
+	}
+	if *fullReconcileSchedule != "" {
+		if _, err := cron.ParseStandard(*fullReconcileSchedule); err != nil {
+			log.Fatalf("invalid -full-reconcile %q: %v", *fullReconcileSchedule, err)
+		}
+	}
+	if *minSeverity != "" && !validSeverity(*minSeverity) {
+		log.Fatalf("invalid -min-severity %q: must be LOW, MEDIUM, HIGH or CRITICAL", *minSeverity)
+	}
+	if !validSeverity(*mispMinSeverity) {
+		log.Fatalf("invalid -misp-min-severity %q: must be LOW, MEDIUM, HIGH or CRITICAL", *mispMinSeverity)
+	}
+	strategies, err := parseConflictStrategies(*conflictStrategySpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conflictStrategies = strategies
+	if mergePolicies, err = parseMergePolicy(*mergePolicySpec); err != nil {
+		log.Fatal(err)
+	}
+	if cpeAllowlist, err = parseCPEAllowlist(*cpeAllow); err != nil {
+		log.Fatal(err)
+	}
+	if enricherRuns, err = parseEnrichers(*enricherSpec); err != nil {
+		log.Fatal(err)
+	}
+	if cpeRewrites, err = loadCPERules(*cpeRulesFile); err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "backfill":
+		err = runBackfill(flag.Args()[1:])
+	case "token":
+		err = runToken(flag.Args()[1:])
+	case "backup":
+		err = runBackup(flag.Args()[1:])
+	case "restore":
+		err = runRestore(flag.Args()[1:])
+	case "snapshot":
+		err = runSnapshot(flag.Args()[1:])
+	case "verify":
+		err = runVerify(flag.Args()[1:])
+	case "reingest":
+		err = runReingest(flag.Args()[1:])
+	case "rollback":
+		err = runRollback(flag.Args()[1:])
+	case "repair-cpes":
+		err = runRepairCPEs(flag.Args()[1:])
+	case "export":
+		err = runExport(flag.Args()[1:])
+	case "migrate":
+		err = runMigrate()
+	case "devserver":
+		err = runDevServer(flag.Args()[1:])
+	case "seed":
+		err = runSeed(flag.Args()[1:])
+	case "loadgen":
+		err = runLoadgen(flag.Args()[1:])
+	case "import":
+		err = runImport(flag.Args()[1:])
+	case "grants":
+		err = runGrants(flag.Args()[1:])
+	case "schema":
+		err = runSchema()
+	case "doctor":
+		err = runDoctor(flag.Args()[1:])
+	case "install":
+		err = installService()
+	case "uninstall":
+		err = removeService()
+	default:
+		if isWindowsService() {
+			err = runService()
+		} else {
+			err = runWithLogFile()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runWithLogFile() error {
 	logFile, err := os.OpenFile("cve_data.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Fatalf("failed to open log file: %v", err)
+		return fmt.Errorf("failed to open log file: %v", err)
 	}
 	defer logFile.Close()
 	log.SetOutput(logFile)
 
-	db, err := sql.Open("postgres", fmt.Sprintf("user=%s dbname=%s sslmode=%s", dbUser, dbName, dbSSLMode))
+	return run(nil)
+}
+
+// runBackfill loads the historical year feeds and exits. Inserts are upserts, so
+// it can safely be rerun, e.g. as a Kubernetes Job or init container ahead of
+// a daemon started with -initial-download=false. It logs to stderr.
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := fs.Int("from", 2002, "first year feed to load")
+	to := fs.Int("to", time.Now().Year(), "last year feed to load")
+	fs.Parse(args)
+
+	db, err := openDB()
 	if err != nil {
-		log.Fatalf("failed to open database: %v", err)
+		return err
 	}
 	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
 
-	if initialDownload {
-		for year := 2023; year <= 2025; year++ {
-			log.Printf("Processing year: %d\n", year)
-			err := downloadAndInsertData(fmt.Sprintf(cveBaseURL, year), db)
-			if err != nil {
-				log.Printf("Error processing year %d: %v\n", year, err)
-			}
+	if *statusAddr != "" {
+		startServer(*statusAddr, db)
+	}
+
+	if err := backfillYears(db, *from, *to, nil); err != nil {
+		return fmt.Errorf("backfill failed: %v", err)
+	}
+	log.Printf("Backfill of %d-%d complete\n", *from, *to)
+	return nil
+}
+
+// openDB connects to the database. With -db-schema, every connection's
+// search_path starts with that schema, so the unqualified table names of the
+// queries and migrations refer to its tables; public stays on the path for
+// extensions such as pg_trgm. With -table-prefix, the connections apply the
+// prefix to the table names of every statement.
+func openDB() (*sql.DB, error) {
+	dsn := fmt.Sprintf("user=%s dbname=%s sslmode=%s", dbUser, dbName, dbSSLMode)
+	if *dbSchema != "" {
+		dsn += fmt.Sprintf(" search_path=%s,public", *dbSchema)
+	}
+	if *tablePrefix != "" {
+		connector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %v", err)
 		}
-		// Create or update last_modified.txt after initial download
-		modifiedDate := time.Now().Format(time.RFC3339)
-		if err := saveLastModified(modifiedDate); err != nil {
-			log.Printf("Failed to save initial last modified date: %v", err)
+		return sql.OpenDB(prefixConnector{connector}), nil
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	return db, nil
+}
+
+// run starts the daemon and blocks until stop is closed. A nil stop channel
+// runs forever.
+func run(stop <-chan struct{}) error {
+	if *riskConfigFile != "" {
+		cfg, err := loadRiskConfig(*riskConfigFile)
+		if err != nil {
+			return err
+		}
+		riskConfig = cfg
+	}
+	if pagerEnabled() {
+		rules, err := loadPageRules(*pageRulesFile)
+		if err != nil {
+			return err
+		}
+		pageRules = rules
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if *role == "serve" {
+		return serveAPI(db, stop)
+	}
+	if err := migrate(db); err != nil {
+		return err
+	}
+
+	if *statusAddr != "" {
+		startServer(*statusAddr, db)
+	}
+
+	go runWatchdog()
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v\n", err)
+	}
+
+	if *leaderElect {
+		runLeaderElection(db, stop, func(stop <-chan struct{}) { runScheduler(db, stop) })
+	} else {
+		runScheduler(db, stop)
+	}
+	return nil
+}
+
+// serveAPI runs -role serve: it serves the query API against a database a
+// sync process migrates and keeps up to date, until stop is closed.
+func serveAPI(db *sql.DB, stop <-chan struct{}) error {
+	if err := checkSchemaCurrent(db); err != nil {
+		return err
+	}
+	startServer(*statusAddr, db)
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v\n", err)
+	}
+	<-stop
+	return nil
+}
+
+// debugf logs per-item detail, which is only wanted with -log-level=debug.
+func debugf(format string, args ...any) {
+	if *logLevel == "debug" {
+		log.Printf(format, args...)
+	}
+}
+
+// runScheduler performs the initial download (if enabled) and runs the update
+// schedule until stop is closed. A nil stop channel runs forever.
+func runScheduler(db *sql.DB, stop <-chan struct{}) {
+	// A mirror's first update imports the upstream's complete snapshot.
+	if *initialDownload && *source != "mirror" {
+		if err := backfillYears(db, 2023, 2025, stop); err != nil {
+			log.Printf("Initial download incomplete: %v\n", err)
 		}
 	}
 
 	c := cron.New()
 	c.AddFunc("*/2 * * * *", func() {
+		if !syncLock.TryLock() {
+			log.Println("Skipping update check: a full reconciliation is running")
+			return
+		}
+		defer syncLock.Unlock()
 		log.Println("Checking for updates...")
-		err := checkAndUpdateData(cveModifiedURL, cveModifiedMetaURL, db)
+		markSyncStart()
+		defer markSyncEnd()
+		syncProgress.start("update", 0, 0)
+		defer syncProgress.finish()
+		run := beginSyncRun(db, "update", datasetNVD, configuredNVDSource())
+		var err error
+		switch *source {
+		case "api":
+			err = syncFromAPI(db)
+			if err == nil {
+				err = syncCPEMatch(db)
+			}
+			if err == nil {
+				err = syncCVEHistory(db)
+			}
+		case "mirror":
+			err = syncFromMirror(db)
+		default:
+			err = checkAndUpdateData(modifiedFeedURL(), modifiedFeedURL()+".meta", db)
+		}
+		if err == nil {
+			err = refreshDerivedFields(db)
+		}
+		if err == nil {
+			err = notifyIntegrations(db)
+		}
+		if err == nil {
+			err = pruneOutOfWindow(db)
+		}
+		if err == nil {
+			err = pruneUndo(db)
+		}
+		if err == nil {
+			err = runMaintenance(db)
+		}
+		if err == nil && *mirrorDir != "" {
+			err = publishMirror(db)
+		}
+		run.finish(db, err)
 		if err != nil {
 			log.Printf("Error checking for updates: %v\n", err)
 		}
+		log.Println(syncProgress.snapshot())
 	})
+	if *fullReconcileSchedule != "" && *source != "mirror" {
+		c.AddFunc(*fullReconcileSchedule, func() {
+			syncLock.Lock()
+			defer syncLock.Unlock()
+			if err := fullReconciliation(db); err != nil {
+				log.Printf("Error during full reconciliation: %v\n", err)
+			}
+			log.Println(syncProgress.snapshot())
+		})
+	}
+	scheduleEnrichment(c, db)
+	scheduleEnrichers(c, db)
+	scheduleEventDelivery(c, db)
 	c.Start()
 
-	select {}
+	<-stop
+	<-c.Stop().Done()
 }
 
-func downloadAndInsertData(url string, db *sql.DB) error {
+// backfillYears downloads and inserts the year feeds from..to, then records the
+// sync time in last_modified.txt. Failed years are logged and skipped; an error
+// is returned if any year failed or stop was closed before all were loaded.
+func backfillYears(db *sql.DB, from, to int, stop <-chan struct{}) (err error) {
+	markSyncStart()
+	defer markSyncEnd()
+	syncProgress.start("backfill", from, to)
+	defer syncProgress.finish()
+	run := beginSyncRun(db, "backfill", datasetNVD, sourceNVDFeeds)
+	defer func() { run.finish(db, err) }()
+	done := make(chan struct{})
+	defer close(done)
+	go syncProgress.logPeriodically(done)
+
+	var failed []int
+	for year := from; year <= to; year++ {
+		select {
+		case <-stop:
+			return fmt.Errorf("stopped before year %d", year)
+		default:
+		}
+		log.Printf("Processing year: %d\n", year)
+		syncProgress.startYear(year)
+		expected, err := loadYearStaged(db, year, false)
+		if err != nil {
+			log.Printf("Error processing year %d: %v\n", year, err)
+			failed = append(failed, year)
+		} else {
+			reconcileYear(db, year, expected)
+		}
+		syncProgress.finishYear()
+	}
+	log.Println(syncProgress.snapshot())
+	invalidateResponseCache()
+
+	// Create or update last_modified.txt after initial download
+	modifiedDate := time.Now().Format(time.RFC3339)
+	if err := saveLastModified(modifiedDate); err != nil {
+		log.Printf("Failed to save initial last modified date: %v", err)
+	}
+	if err := pruneOutOfWindow(db); err != nil {
+		log.Println(err)
+	}
+	if err := runMaintenance(db); err != nil {
+		log.Println(err)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed years: %v", failed)
+	}
+	return nil
+}
+
+// downloadAndInsertData downloads the feed at url and inserts its CVEs. It
+// returns the number of CVEs the feed reports containing. With skipUnchanged,
+// CVEs whose stored rows already match the feed are not rewritten.
+func downloadAndInsertData(url string, db *sql.DB, skipUnchanged bool) (int, error) {
 	response, err := http.Get(url)
 	if err != nil {
-		return fmt.Errorf("failed to download data: %v", err)
+		return 0, fmt.Errorf("failed to download data: %v", err)
 	}
 	defer response.Body.Close()
 
 	tempFile, err := os.CreateTemp("", "cve_data_*.json.gz")
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %v", err)
+		return 0, fmt.Errorf("failed to create temp file: %v", err)
 	}
 	defer os.Remove(tempFile.Name())
 
-	if _, err = io.Copy(tempFile, response.Body); err != nil {
-		return fmt.Errorf("failed to copy data to temp file: %v", err)
+	if _, err = io.Copy(tempFile, progressReader{response.Body}); err != nil {
+		return 0, fmt.Errorf("failed to copy data to temp file: %v", err)
 	}
 
 	log.Printf("Data downloaded to: %s\n", tempFile.Name())
@@ -140,144 +597,363 @@ func downloadAndInsertData(url string, db *sql.DB) error {
 	tempFile.Seek(0, io.SeekStart)
 
 	var buf bytes.Buffer
-	gzipReader, err := gzip.NewReader(tempFile)
+	gzipReader, err := newGzipReader(tempFile)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %v", err)
+		return 0, fmt.Errorf("failed to create gzip reader: %v", err)
 	}
 	defer gzipReader.Close()
 
 	if _, err = io.Copy(&buf, gzipReader); err != nil {
-		return fmt.Errorf("failed to copy data from gzip reader: %v", err)
+		return 0, fmt.Errorf("failed to copy data from gzip reader: %v", err)
 	}
 
-	var cveData CVEResponse
+	var raw struct {
+		NumberOfCVEs string            `json:"CVE_data_numberOfCVEs"`
+		CVEItems     []json.RawMessage `json:"CVE_Items"`
+	}
 	decoder := json.NewDecoder(bytes.NewReader(buf.Bytes()))
-	if err = decoder.Decode(&cveData); err != nil {
-		return fmt.Errorf("failed to decode JSON data: %v", err)
+	if err = decoder.Decode(&raw); err != nil {
+		return 0, fmt.Errorf("failed to decode JSON data: %v", err)
 	}
+	items, parseErrs := decodeRecords(url, 0, raw.CVEItems, func(item CVEItem) string { return item.CVE.CVEDataMeta.ID })
+	if err := recordParseErrors(db, parseErrs); err != nil {
+		return 0, err
+	}
+	cveData := CVEResponse{NumberOfCVEs: raw.NumberOfCVEs, CVEItems: items}
 
-	log.Printf("Decoded CVE Data: %+v\n", cveData)
+	log.Printf("Decoded %d CVEs from %s\n", len(cveData.CVEItems), url)
 
+	start := resumeOffset(db, sourceNVDFeeds, url, cveData.CVEItems)
+	if start > 0 {
+		log.Printf("Resuming %s from checkpoint at item %d\n", url, start)
+	}
+	syncProgress.setFeedItems(len(cveData.CVEItems) - start)
+
+	for batchStart := start; batchStart < len(cveData.CVEItems); batchStart += batchSize {
+		batchEnd := min(batchStart+batchSize, len(cveData.CVEItems))
+		batch := cveData.CVEItems[batchStart:batchEnd]
+		if skipUnchanged {
+			if batch, err = dropUnchanged(db, batch); err != nil {
+				return 0, err
+			}
+		}
+		cp := checkpoint{Source: sourceNVDFeeds, Position: url, Offset: batchEnd, LastCVEID: cveData.CVEItems[batchEnd-1].CVE.CVEDataMeta.ID}
+		if err := insertCheckpointedBatch(db, batch, batchStart, &cp); err != nil {
+			return 0, err
+		}
+		log.Printf("Committed CVEs %d-%d of %d from %s\n", batchStart+1, batchEnd, len(cveData.CVEItems), url)
+	}
+
+	if err := clearCheckpoint(db, sourceNVDFeeds); err != nil {
+		log.Println(err)
+	}
+	return cveData.count(), nil
+}
+
+// insertBatch inserts items in a single transaction. offset is the index of
+// the first item within the feed.
+func insertBatch(db *sql.DB, items []CVEItem, offset int) error {
+	return insertCheckpointedBatch(db, items, offset, nil)
+}
+
+// insertCheckpointedBatch is insertBatch that also saves cp, if not nil, in
+// the batch's transaction, so the checkpoint moves exactly when the batch is
+// committed.
+func insertCheckpointedBatch(db *sql.DB, items []CVEItem, offset int, cp *checkpoint) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %v", err)
 	}
 	defer tx.Rollback()
+	if err := useStaging(tx); err != nil {
+		return err
+	}
+	if err := setProvenance(tx, datasetNVD); err != nil {
+		return err
+	}
+	if err := captureUndo(tx, items); err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		markSyncProgress()
+		normalizeCVEItem(&item)
+		if !keepCVEItem(item) {
+			debugf("Skipping CVE ID %s: excluded by the ingestion filters", item.CVE.CVEDataMeta.ID)
+		} else if reasons := validateCVEItem(item); reasons != nil {
+			log.Printf("Quarantining CVE ID %s: %s\n", item.CVE.CVEDataMeta.ID, strings.Join(reasons, "; "))
+			if err := quarantineCVEItem(tx, item, reasons); err != nil {
+				return err
+			}
+		} else if err := insertCVEItemIsolated(tx, offset+i, item); err != nil {
+			return err
+		}
+		syncProgress.itemDone()
+	}
+	if cp != nil {
+		if err := saveCheckpoint(tx, *cp); err != nil {
+			return err
+		}
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+
+	return nil
+}
 
-	for i, item := range cveData.CVEItems {
-		cveID := item.CVE.CVEDataMeta.ID
-		description := ""
-		if len(item.CVE.Description.DescriptionData) > 0 {
-			description = item.CVE.Description.DescriptionData[0].Value
+// insertCVEItemIsolated inserts item under a savepoint. If the insert fails,
+// e.g. on a bad date, an oversize field or a conflict under the fail strategy,
+// only the item is rolled back and quarantined with the error, and the rest of
+// the batch is still committed. The item's rows record its CVE ID as their
+// source record.
+func insertCVEItemIsolated(tx *sql.Tx, i int, item CVEItem) error {
+	if _, err := tx.Exec(`SAVEPOINT cve_item; SELECT set_config('cve.record_id', ` + pq.QuoteLiteral(item.CVE.CVEDataMeta.ID) + `, true)`); err != nil {
+		return fmt.Errorf("failed to create savepoint: %v", err)
+	}
+	if err := insertCVEItem(tx, i, item); err != nil {
+		if _, rbErr := tx.Exec(`ROLLBACK TO SAVEPOINT cve_item`); rbErr != nil {
+			return fmt.Errorf("failed to roll back CVE ID %s: %v (after %v)", item.CVE.CVEDataMeta.ID, rbErr, err)
 		}
-		publishedDate := item.PublishedDate
-		lastModifiedDate := item.LastModifiedDate
-		log.Printf("============================starting new cve=======================================================================")
-		log.Printf("Inserting CVE ID %d: %s, Description: %s\n", i+1, cveID, description)
+		log.Printf("Quarantining CVE ID %s after failed insert: %v\n", item.CVE.CVEDataMeta.ID, err)
+		return quarantineCVEItem(tx, item, []string{"insert failed: " + err.Error()})
+	}
+	if _, err := tx.Exec(`RELEASE SAVEPOINT cve_item`); err != nil {
+		return fmt.Errorf("failed to release savepoint: %v", err)
+	}
+	return nil
+}
 
-		_, err := tx.Exec(`INSERT INTO cve_data1 (cve_id, description, published_date, last_modified_date)
-						   VALUES ($1, $2, $3, $4)
+func insertCVEItem(tx *sql.Tx, i int, item CVEItem) error {
+	cveID := item.CVE.CVEDataMeta.ID
+	description := ""
+	if len(item.CVE.Description.DescriptionData) > 0 {
+		description = item.CVE.Description.DescriptionData[0].Value
+	}
+	publishedDate, err := parseNVDTime(item.PublishedDate)
+	if err != nil {
+		return fmt.Errorf("published date: %v", err)
+	}
+	lastModifiedDate, err := parseNVDTime(item.LastModifiedDate)
+	if err != nil {
+		return fmt.Errorf("last modified date: %v", err)
+	}
+	debugf("Inserting CVE ID %d: %s, Description: %s\n", i+1, cveID, description)
+
+	write, err := shouldWrite(tx, "cve_data1", cveID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if write {
+		_, err := tx.Exec(`INSERT INTO cve_data1 (cve_id, description, published_date, last_modified_date, assigner)
+						   VALUES ($1, $2, $3, $4, NULLIF($5, ''))
 						   ON CONFLICT (cve_id) DO UPDATE
 						   SET description = EXCLUDED.description,
 							   published_date = EXCLUDED.published_date,
-							   last_modified_date = EXCLUDED.last_modified_date;`,
-			cveID, description, publishedDate, lastModifiedDate)
+							   last_modified_date = EXCLUDED.last_modified_date,
+							   assigner = EXCLUDED.assigner,
+							   source = EXCLUDED.source,
+							   source_record_id = EXCLUDED.source_record_id,
+							   ingested_at = EXCLUDED.ingested_at,
+							   run_id = EXCLUDED.run_id;`,
+			cveID, description, publishedDate, lastModifiedDate, item.CVE.CVEDataMeta.Assigner)
 		if err != nil {
 			log.Printf("Error inserting data for CVE ID %s: %v\n", cveID, err)
 			return err
 		}
-		log.Printf("Nodes length = %d", len(item.Configurations.Nodes))
-
-		if len(item.Configurations.Nodes) > 0 {
-			for configIndex, node := range item.Configurations.Nodes {
-				configNumber := configIndex + 1 // Configuration starts from 1
-
-				// Process CPE URIs in the CPEMatch array of the node
-				for k, cpe := range node.CPEMatch {
-					cpeURI := normalizeCPEURI(cpe.CPE23URI)
-					versionStart := normalizeVersion(cpe.VersionStart)
-					versionEnd := normalizeVersion(cpe.VersionEnd)
-					log.Printf("Inserting cpeURI = %s in cpe_data table with configNumber = %d", cpeURI, configNumber)
-
-					_, err := tx.Exec(`INSERT INTO cpe_data (cve_id, cpe_uri, vulnerable, version_start, version_end, config)
-									   VALUES ($1, $2, $3, $4, $5, $6)
-									   ON CONFLICT (cve_id, cpe_uri) DO UPDATE
-									   SET vulnerable = EXCLUDED.vulnerable,
-										   version_start = EXCLUDED.version_start,
-										   version_end = EXCLUDED.version_end,
-										   config = EXCLUDED.config;`,
-						cveID, cpeURI, cpe.Vulnerable, versionStart, versionEnd, configNumber)
-					if err != nil {
-						log.Printf("Error inserting CPE data for CVE ID %s, Config %d, CPE %d: %v\n", cveID, configNumber, k+1, err)
-						return err
-					}
-				}
+	}
+	if *historyMode {
+		if err := recordCVEVersion(tx, item); err != nil {
+			log.Println(err)
+			return err
+		}
+	}
+	debugf("Nodes length = %d", len(item.Configurations.Nodes))
 
-				// Process CPE URIs in the Children array of the node
-				for _, child := range node.Children {
-					for l, cpe := range child.CPEMatch {
-						cpeURI := normalizeCPEURI(cpe.CPE23URI)
-						versionStart := normalizeVersion(cpe.VersionStart)
-						versionEnd := normalizeVersion(cpe.VersionEnd)
-						log.Printf("Inserting cpeURI = %s from child node in cpe_data table with configNumber = %d", cpeURI, configNumber)
-
-						_, err := tx.Exec(`INSERT INTO cpe_data (cve_id, cpe_uri, vulnerable, version_start, version_end, config)
-										   VALUES ($1, $2, $3, $4, $5, $6)
-										   ON CONFLICT (cve_id, cpe_uri) DO UPDATE
-										   SET vulnerable = EXCLUDED.vulnerable,
-											   version_start = EXCLUDED.version_start,
-											   version_end = EXCLUDED.version_end,
-											   config = EXCLUDED.config;`,
-							cveID, cpeURI, cpe.Vulnerable, versionStart, versionEnd, configNumber)
-						if err != nil {
-							log.Printf("Error inserting CPE data for CVE ID %s, Config %d, Child Node, CPE %d: %v\n", cveID, configNumber, l+1, err)
-							return err
-						}
-					}
-				}
-			}
+	if err := insertConfigurations(tx, cveID, item.Configurations.Nodes); err != nil {
+		return err
+	}
 
-		}
+	write, err = shouldWrite(tx, "cve_cwe", cveID)
+	if err == nil && write {
+		err = insertCWEs(tx, cveID, item.cweIDs())
+	}
+	if err != nil {
+		log.Println(err)
+		return err
+	}
 
-		if item.Impact.BaseMetricV3.CVSSV3.Version != "" {
-			_, err := tx.Exec(`INSERT INTO impact_data (cve_id, cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity)
-							   VALUES ($1, $2, $3, $4, $5)
-							   ON CONFLICT (cve_id) DO UPDATE
-							   SET cvss_version = EXCLUDED.cvss_version,
-								   cvss_vector_string = EXCLUDED.cvss_vector_string,
-								   cvss_base_score = EXCLUDED.cvss_base_score,
-								   cvss_base_severity = EXCLUDED.cvss_base_severity;`,
-				cveID,
-				item.Impact.BaseMetricV3.CVSSV3.Version,
-				item.Impact.BaseMetricV3.CVSSV3.VectorString,
-				item.Impact.BaseMetricV3.CVSSV3.BaseScore,
-				item.Impact.BaseMetricV3.CVSSV3.BaseSeverity)
-			if err != nil {
-				log.Printf("Error inserting impact data for CVE ID %s: %v\n", cveID, err)
-				return err
-			}
+	if err := insertCVSSMetrics(tx, cveID, item.cvssMetrics()); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := insertCVETags(tx, cveID, item.CVETags); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := insertComments(tx, cveID, item.comments()); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	write, err = shouldWrite(tx, "advisories", cveID)
+	if err == nil && write {
+		err = insertAdvisories(tx, cveID, item.CVE.References.ReferenceData)
+	}
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	if *expandCPENames {
+		if err := expandCVECPENames(tx, cveID); err != nil {
+			log.Println(err)
+			return err
 		}
-		log.Printf("========================================end===========================================================================")
 	}
 
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("transaction commit error: %v", err)
+	if item.Impact.BaseMetricV3.CVSSV3.Version == "" {
+		return storeContentHash(tx, cveID)
+	}
+	write, err = shouldWrite(tx, "impact_data", cveID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if write {
+		cvss := item.Impact.BaseMetricV3.CVSSV3
+		if err := recordScoreChange(tx, cveID, cvss.Version, cvss.VectorString, cvss.BaseScore, cvss.BaseSeverity, lastModifiedDate); err != nil {
+			log.Println(err)
+			return err
+		}
+		e, rl, rc, temporalScore := temporalMetrics(item.Impact.BaseMetricV3.CVSSV3.VectorString)
+		_, err := tx.Exec(`INSERT INTO impact_data (cve_id, cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity,
+												   exploit_code_maturity, remediation_level, report_confidence, temporal_score)
+						   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+						   ON CONFLICT (cve_id) DO UPDATE
+						   SET cvss_version = EXCLUDED.cvss_version,
+							   cvss_vector_string = EXCLUDED.cvss_vector_string,
+							   cvss_base_score = EXCLUDED.cvss_base_score,
+							   cvss_base_severity = EXCLUDED.cvss_base_severity,
+							   exploit_code_maturity = EXCLUDED.exploit_code_maturity,
+							   remediation_level = EXCLUDED.remediation_level,
+							   report_confidence = EXCLUDED.report_confidence,
+							   temporal_score = EXCLUDED.temporal_score,
+							   source = EXCLUDED.source,
+							   source_record_id = EXCLUDED.source_record_id,
+							   ingested_at = EXCLUDED.ingested_at,
+							   run_id = EXCLUDED.run_id;`,
+			cveID,
+			item.Impact.BaseMetricV3.CVSSV3.Version,
+			item.Impact.BaseMetricV3.CVSSV3.VectorString,
+			item.Impact.BaseMetricV3.CVSSV3.BaseScore,
+			item.Impact.BaseMetricV3.CVSSV3.BaseSeverity,
+			e, rl, rc, temporalScore)
+		if err != nil {
+			log.Printf("Error inserting impact data for CVE ID %s: %v\n", cveID, err)
+			return err
+		}
 	}
+	return storeContentHash(tx, cveID)
+}
 
-	return nil
+// newGzipReader uses a parallel gzip reader when more than one CPU is
+// available, which speeds up decompressing the large year feeds.
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	if runtime.GOMAXPROCS(0) > 1 {
+		return pgzip.NewReaderN(r, 1<<20, runtime.GOMAXPROCS(0))
+	}
+	return gzip.NewReader(r)
 }
 
-func normalizeCPEURI(cpeURI string) string {
-	parts := strings.Split(cpeURI, ":")
-	if len(parts) >= 5 {
-		osAndVersion := parts[4]
-		osVersionParts := strings.Split(osAndVersion, "_")
-		if len(osVersionParts) == 2 {
-			parts[4] = osVersionParts[0]
-			parts = append(parts[:5], append([]string{osVersionParts[1]}, parts[5:]...)...)
+// insertConfigurations replaces the CVE's CPE rows and configuration trees so
+// matches dropped by NVD re-analysis go away and node numbering stays
+// consistent.
+func insertConfigurations(tx *sql.Tx, cveID string, nodes []ConfigNode) error {
+	write, err := shouldWrite(tx, "cpe_data", cveID)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if !write {
+		return nil
+	}
+
+	if _, err := tx.Exec(`DELETE FROM cpe_data WHERE cve_id = $1`, cveID); err != nil {
+		log.Printf("Error deleting CPE data for CVE ID %s: %v\n", cveID, err)
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM cve_configurations WHERE cve_id = $1`, cveID); err != nil {
+		log.Printf("Error deleting configurations for CVE ID %s: %v\n", cveID, err)
+		return err
+	}
+
+	// Nodes are numbered in document order across the whole CVE. Child nodes
+	// (e.g. the "running on" platform list of an AND node) record the node
+	// they belong to in parent_node_id.
+	nodeID := 0
+	for configIndex, node := range nodes {
+		configNumber := configIndex + 1 // Configuration starts from 1
+		nodeID++
+		parentID := nodeID
+
+		tree, err := json.Marshal(normalizeConfigNode(node))
+		if err != nil {
+			return fmt.Errorf("failed to encode configuration %d of CVE ID %s: %v", configNumber, cveID, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO cve_configurations (cve_id, config, node) VALUES ($1, $2, $3)`, cveID, configNumber, tree); err != nil {
+			log.Printf("Error inserting configuration %d for CVE ID %s: %v\n", configNumber, cveID, err)
+			return err
+		}
+
+		// Process CPE URIs in the CPEMatch array of the node
+		for k, cpe := range node.CPEMatch {
+			if err := insertCPEMatch(tx, cveID, cpe, configNumber, nodeID, 0); err != nil {
+				log.Printf("Error inserting CPE data for CVE ID %s, Config %d, CPE %d: %v\n", cveID, configNumber, k+1, err)
+				return err
+			}
+		}
+
+		// Process CPE URIs in the Children array of the node
+		for _, child := range node.Children {
+			nodeID++
+			for l, cpe := range child.CPEMatch {
+				if err := insertCPEMatch(tx, cveID, cpe, configNumber, nodeID, parentID); err != nil {
+					log.Printf("Error inserting CPE data for CVE ID %s, Config %d, Child Node, CPE %d: %v\n", cveID, configNumber, l+1, err)
+					return err
+				}
+			}
 		}
 	}
-	return strings.Join(parts, ":")
+	return nil
+}
+
+// insertCPEMatch stores one CPE match of node nodeID. parentNodeID is zero for
+// top-level nodes. Identical (cve_id, cpe_uri, range) tuples are stored once;
+// the first node they appear in wins. The range is stored both normalized and
+// as published, with whether its start is exclusive and its end inclusive.
+func insertCPEMatch(tx *sql.Tx, cveID string, cpe CPEMatch, configNumber, nodeID, parentNodeID int) error {
+	cpeURI := normalizeCPEURI(cpe.CPE23URI)
+	r := cpe.versionRange()
+	versionStart := normalizeVersion(r.start)
+	versionEnd := normalizeVersion(r.end)
+	debugf("Inserting cpeURI = %s in cpe_data table with configNumber = %d, node = %d", cpeURI, configNumber, nodeID)
+
+	parent := sql.NullInt64{Int64: int64(parentNodeID), Valid: parentNodeID != 0}
+	matchCriteriaID := sql.NullString{String: cpe.MatchCriteriaID, Valid: cpe.MatchCriteriaID != ""}
+	_, err := tx.Exec(`INSERT INTO cpe_data (cve_id, cpe_uri, vulnerable, version_start, version_end, config, node_id, parent_node_id, match_criteria_id,
+											version_start_raw, version_end_raw, version_start_excluding, version_end_including)
+					   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+					   ON CONFLICT (cve_id, cpe_uri, version_start, version_end, version_start_raw, version_end_raw,
+									version_start_excluding, version_end_including) DO NOTHING;`,
+		cveID, cpeURI, cpe.Vulnerable, versionStart, versionEnd, configNumber, nodeID, parent, matchCriteriaID,
+		r.start, r.end, r.startExcluding, r.endIncluding)
+	return err
 }
 
 func normalizeVersion(version string) string {
@@ -285,6 +961,16 @@ func normalizeVersion(version string) string {
 	return re.FindString(version)
 }
 
+// yearFeedURL is the URL of a year's NVD 1.1 JSON feed.
+func yearFeedURL(year int) string {
+	return fmt.Sprintf("%s/1.1/nvdcve-1.1-%d.json.gz", strings.TrimSuffix(*nvdFeedURL, "/"), year)
+}
+
+// modifiedFeedURL is the URL of the NVD 1.1 feed of recently modified CVEs.
+func modifiedFeedURL() string {
+	return strings.TrimSuffix(*nvdFeedURL, "/") + "/1.1-modified.json.gz"
+}
+
 func checkAndUpdateData(url, metaURL string, db *sql.DB) error {
 	resp, err := http.Get(metaURL)
 	if err != nil {
@@ -307,7 +993,7 @@ func checkAndUpdateData(url, metaURL string, db *sql.DB) error {
 
 	if modifiedDate != lastModified {
 		log.Println("New data available, downloading and updating...")
-		if err := downloadAndInsertData(url, db); err != nil {
+		if _, err := downloadAndInsertData(url, db, false); err != nil {
 			return fmt.Errorf("failed to update data: %v", err)
 		}
 
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+var (
+	maintenance        = flag.Bool("maintenance", false, "ANALYZE and VACUUM the hot tables after syncs according to the maintenance thresholds")
+	analyzeChangeRatio = flag.Float64("analyze-ratio", 0.1, "ANALYZE a hot table once rows changed since its last analyze exceed this fraction of its rows (0 disables)")
+	vacuumDeadRatio    = flag.Float64("vacuum-ratio", 0.2, "VACUUM a hot table once dead rows exceed this fraction of its rows (0 disables)")
+)
+
+// hotTables are rewritten by every sync and queried by the API.
+var hotTables = []string{
+	"cve_data1", "cpe_data", "impact_data", "cve_cwe", "advisories",
+	"cpe_name_lookup", "match_criteria", "match_criteria_names",
+}
+
+// runMaintenance applies the maintenance policy to the hot tables, using the
+// statistics collector's counts of changed and dead rows. Autovacuum works on
+// the same signals but lags behind bulk loads, which leaves the planner with
+// stale estimates right when the API is busiest.
+func runMaintenance(db *sql.DB) error {
+	if !*maintenance {
+		return nil
+	}
+
+	rows, err := db.Query(`SELECT relname, n_live_tup, n_dead_tup, n_mod_since_analyze
+						   FROM pg_stat_user_tables
+						   WHERE relname = ANY($1) AND schemaname = current_schema()`, pq.Array(tableNames(hotTables)))
+	if err != nil {
+		return fmt.Errorf("failed to read table statistics: %v", err)
+	}
+	type tableStats struct {
+		name                    string
+		live, dead, modSinceAnz float64
+	}
+	var stats []tableStats
+	for rows.Next() {
+		var s tableStats
+		if err := rows.Scan(&s.name, &s.live, &s.dead, &s.modSinceAnz); err != nil {
+			rows.Close()
+			return err
+		}
+		stats = append(stats, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range stats {
+		live := max(s.live, 1)
+		table := pq.QuoteIdentifier(s.name)
+		switch {
+		case *vacuumDeadRatio > 0 && s.dead/live > *vacuumDeadRatio:
+			log.Printf("Vacuuming %s (%.0f dead of %.0f rows)\n", s.name, s.dead, s.live)
+			if _, err := db.Exec(`VACUUM (ANALYZE) ` + table); err != nil {
+				return fmt.Errorf("failed to vacuum %s: %v", s.name, err)
+			}
+		case *analyzeChangeRatio > 0 && s.modSinceAnz/live > *analyzeChangeRatio:
+			log.Printf("Analyzing %s (%.0f changed of %.0f rows)\n", s.name, s.modSinceAnz, s.live)
+			if _, err := db.Exec(`ANALYZE ` + table); err != nil {
+				return fmt.Errorf("failed to analyze %s: %v", s.name, err)
+			}
+		}
+	}
+	return nil
+}
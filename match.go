@@ -0,0 +1,307 @@
+package main
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxMatchItems bounds the inventory size of one POST /match request.
+	maxMatchItems = 1000
+	// matchWorkers is the number of inventory items or packages matched
+	// concurrently.
+	matchWorkers = 8
+)
+
+var (
+	errInvalidCPE      = errors.New("want a CPE 2.3 name such as cpe:2.3:a:f5:nginx:1.20.1:*:*:*:*:*:*:*")
+	errVersionRequired = errors.New("a version is required, in the CPE name or as version")
+)
+
+// MatchItem is one entry of a software inventory. The version comes from the
+// CPE name unless Version is set.
+type MatchItem struct {
+	CPE     string `json:"cpe"`
+	Version string `json:"version,omitempty"`
+}
+
+// MatchResult lists the CVEs affecting one inventory item, or why it could not
+// be matched.
+type MatchResult struct {
+	CPE     string        `json:"cpe"`
+	Version string        `json:"version,omitempty"`
+	Matches []CPEMatchHit `json:"matches"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// CPEMatchHit is a vulnerable CPE row an inventory item falls into. The range
+// starts at VersionStart inclusive and ends at VersionEnd exclusive unless
+// the flags say otherwise.
+type CPEMatchHit struct {
+	CVEID                 string   `json:"cve_id"`
+	CPEURI                string   `json:"cpe_uri"`
+	VersionStart          string   `json:"version_start,omitempty"`
+	VersionStartExcluding bool     `json:"version_start_excluding,omitempty"`
+	VersionEnd            string   `json:"version_end,omitempty"`
+	VersionEndIncluding   bool     `json:"version_end_including,omitempty"`
+	BaseScore             *float64 `json:"base_score,omitempty"`
+	BaseSeverity          string   `json:"base_severity,omitempty"`
+	// Internal is set when CVEID is the ID of an internal advisory.
+	Internal bool `json:"internal,omitempty"`
+}
+
+func (h CPEMatchHit) versionRange() versionRange {
+	return versionRange{start: h.VersionStart, end: h.VersionEnd, startExcluding: h.VersionStartExcluding, endIncluding: h.VersionEndIncluding}
+}
+
+// fixedVersion returns the first version outside the range, if NVD records
+// one: the end of a range that excludes it.
+func (h CPEMatchHit) fixedVersion() string {
+	if h.VersionEndIncluding {
+		return ""
+	}
+	return h.VersionEnd
+}
+
+// matchInventory matches every item concurrently against the CVEs and the
+// tenant's internal advisories, and returns the results in the order of items.
+// CVE configurations are evaluated against the whole inventory; see
+// inventory.satisfies for anyPlatform.
+func matchInventory(db *sql.DB, tenant string, items []MatchItem, anyPlatform bool) []MatchResult {
+	var inv inventory
+	for _, item := range items {
+		if c, err := parseMatchItem(item); err == nil {
+			inv = append(inv, c)
+		}
+	}
+	results := make([]MatchResult, len(items))
+	forEachParallel(len(items), func(i int) {
+		results[i] = MatchResult{CPE: items[i].CPE, Version: items[i].Version, Matches: []CPEMatchHit{}}
+		hits, err := matchCPE(db, tenant, items[i], inv, anyPlatform)
+		if err != nil {
+			results[i].Error = err.Error()
+			return
+		}
+		results[i].Matches = hits
+	})
+	return results
+}
+
+// forEachParallel calls f for 0..n-1 on up to matchWorkers goroutines.
+func forEachParallel(n int, f func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(matchWorkers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := range n {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// matchCPE returns the CVEs with a vulnerable CPE row covering the item's
+// product and version and a configuration inv satisfies, one hit per CVE,
+// followed by the tenant's internal advisories affecting it. Ranges are
+// compared as published where the raw bounds are stored. Suppressed CPEs are
+// left out.
+func matchCPE(db *sql.DB, tenant string, item MatchItem, inv inventory, anyPlatform bool) ([]CPEMatchHit, error) {
+	c, err := parseMatchItem(item)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT c.cve_id, c.cpe_uri, COALESCE(NULLIF(c.version_start_raw, ''), c.version_start, ''), c.version_start_excluding,
+								  COALESCE(NULLIF(c.version_end_raw, ''), c.version_end, ''), c.version_end_including,
+								  i.cvss_base_score, COALESCE(i.cvss_base_severity, '')
+						   FROM cpe_data c
+						   LEFT JOIN impact_data i ON i.cve_id = c.cve_id
+						   WHERE c.vulnerable
+							 AND split_part(c.cpe_uri, ':', 4) = $1 AND split_part(c.cpe_uri, ':', 5) = $2
+							 AND split_part(c.cpe_uri, ':', 3) = $3
+							 AND NOT `+suppressedCPE("$4", "c.cve_id", "c.cpe_uri")+`
+						   ORDER BY c.cve_id, c.cpe_uri`, c.vendor, c.product, c.part, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %v", item.CPE, err)
+	}
+	defer rows.Close()
+
+	hits := []CPEMatchHit{}
+	for rows.Next() {
+		var h CPEMatchHit
+		if err := rows.Scan(&h.CVEID, &h.CPEURI, &h.VersionStart, &h.VersionStartExcluding, &h.VersionEnd, &h.VersionEndIncluding,
+			&h.BaseScore, &h.BaseSeverity); err != nil {
+			return nil, err
+		}
+		if len(hits) > 0 && hits[len(hits)-1].CVEID == h.CVEID {
+			continue
+		}
+		if cpeCoversVersion(h.CPEURI, h.versionRange(), c.version) {
+			hits = append(hits, h)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if hits, err = applicableHits(db, hits, c, inv, anyPlatform); err != nil {
+		return nil, err
+	}
+
+	internal, err := matchInternalAdvisories(db, tenant, c.part, c.vendor, c.product, c.version)
+	if err != nil {
+		return nil, err
+	}
+	return append(hits, internal...), nil
+}
+
+// versionRange is the version range of a CPE match. A bound is inclusive at
+// the start and exclusive at the end unless its flag says otherwise; an empty
+// bound is open.
+type versionRange struct {
+	start, end                   string
+	startExcluding, endIncluding bool
+}
+
+// cpeCoversVersion reports whether a vulnerable CPE row covers version: an
+// exact version in the CPE name must be equal, otherwise the version must lie
+// in the range. Only a range without bounds covers every version.
+func cpeCoversVersion(cpeURI string, r versionRange, version string) bool {
+	if v := cpeVersion(cpeURI); v != "" {
+		return strings.EqualFold(v, version)
+	}
+	if r.start == "" && r.end == "" {
+		return true
+	}
+	if normalizeVersion(version) == "" {
+		return false
+	}
+	if r.start != "" {
+		if c := compareVersions(version, r.start); c < 0 || (c == 0 && r.startExcluding) {
+			return false
+		}
+	}
+	if r.end != "" {
+		if c := compareVersions(version, r.end); c > 0 || (c == 0 && !r.endIncluding) {
+			return false
+		}
+	}
+	return true
+}
+
+// cpeVersion returns the version component of a CPE name, or "" if it is a
+// wildcard (*) or not applicable (-).
+func cpeVersion(cpeURI string) string {
+	parts := strings.Split(cpeURI, ":")
+	if len(parts) > 5 && parts[5] != "*" && parts[5] != "-" {
+		return parts[5]
+	}
+	return ""
+}
+
+// preReleaseRanks orders the labels that mark a version before its release,
+// as in 2.0-beta1 < 2.0-rc1 < 2.0.
+var preReleaseRanks = map[string]int{
+	"dev": 1, "snapshot": 1, "a": 2, "alpha": 2, "b": 3, "beta": 3,
+	"pre": 4, "preview": 4, "c": 5, "cr": 5, "rc": 5,
+}
+
+// compareVersions compares versions as published. They are split into runs
+// of digits, compared as numbers so that 1.10 sorts after 1.9, and runs of
+// letters; separators are ignored. Missing components count as 0. A
+// pre-release label (beta, rc, ...) sorts before the release and other labels
+// after it, before the next number: 9.1 < 9.1p2 < 9.1.1, and 2.4.0-beta1 <
+// 2.4.0.
+func compareVersions(a, b string) int {
+	as, bs := versionTokens(a), versionTokens(b)
+	for i := range max(len(as), len(bs)) {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if c := compareVersionTokens(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// versionTokens splits a lowercased version into runs of digits and letters.
+func versionTokens(v string) []string {
+	v = strings.ToLower(v)
+	var tokens []string
+	start := -1
+	for i, r := range v {
+		digit := r >= '0' && r <= '9'
+		letter := r >= 'a' && r <= 'z'
+		if start >= 0 && (!digit && !letter || isDigit(v[start]) != digit) {
+			tokens = append(tokens, v[start:i])
+			start = -1
+		}
+		if start < 0 && (digit || letter) {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, v[start:])
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// compareVersionTokens compares two components of a version; "" is a missing
+// one. Numbers sort above labels, and a missing component sorts as 0 against
+// a number and between pre-release and other labels.
+func compareVersionTokens(x, y string) int {
+	rank := func(t string) int {
+		switch {
+		case t == "":
+			return 1
+		case isDigit(t[0]):
+			return 3
+		case preReleaseRanks[t] > 0:
+			return 0
+		default:
+			return 2
+		}
+	}
+	rx, ry := rank(x), rank(y)
+	if rx == 1 && ry == 3 {
+		x, rx = "0", 3
+	}
+	if ry == 1 && rx == 3 {
+		y, ry = "0", 3
+	}
+	if c := cmp.Compare(rx, ry); c != 0 {
+		return c
+	}
+	switch rx {
+	case 3:
+		x, y = strings.TrimLeft(x, "0"), strings.TrimLeft(y, "0")
+		if c := cmp.Compare(len(x), len(y)); c != 0 {
+			return c
+		}
+		return strings.Compare(x, y)
+	case 0:
+		if c := cmp.Compare(preReleaseRanks[x], preReleaseRanks[y]); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(x, y)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Fields of the canonical record that several providers publish values for.
+// NVD 2.0 records carry NVD's own analysis next to that of the CNA and of
+// ADPs such as CISA, each identified by its source. The description is not
+// one of them: NVD 2.0 records carry only the CNA's descriptions, by language,
+// without a source to rank.
+const (
+	mergeFieldCVSS = "cvss"
+	mergeFieldCWE  = "cwe"
+)
+
+// Provider classes a precedence list can name besides exact source
+// identifiers such as psirt@cisco.com: NVD itself, and the CNA that assigned
+// the CVE.
+const (
+	mergeProviderNVD = "nvd"
+	mergeProviderCNA = "cna"
+)
+
+var mergePolicySpec = flag.String("merge-policy", "", "per-field provider precedence for building the canonical record from NVD 2.0 data, e.g. cvss=cna>nvd,cwe=nvd>cna (providers: nvd, cna or a source identifier; default cvss=nvd and every provider's CWEs)")
+
+// mergePolicy maps a field to its providers, most preferred first. A field
+// without an entry keeps its default: NVD's score first, then the newest CVSS
+// version of any other provider, and the union of all providers' CWEs.
+type mergePolicy map[string][]string
+
+// mergePolicies is parsed from -merge-policy at startup.
+var mergePolicies = mergePolicy{}
+
+func parseMergePolicy(spec string) (mergePolicy, error) {
+	policy := mergePolicy{}
+	if spec == "" {
+		return policy, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		field, list, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid merge policy %q: want field=provider>provider", entry)
+		}
+		if field != mergeFieldCVSS && field != mergeFieldCWE {
+			return nil, fmt.Errorf("merge policy for unknown field %q: must be %s or %s", field, mergeFieldCVSS, mergeFieldCWE)
+		}
+		var providers []string
+		for _, p := range strings.Split(list, ">") {
+			p = strings.TrimSpace(p)
+			if p == "" || slices.Contains(providers, p) {
+				return nil, fmt.Errorf("invalid merge policy for %s: providers must be non-empty and distinct", field)
+			}
+			providers = append(providers, p)
+		}
+		policy[field] = providers
+	}
+	return policy, nil
+}
+
+// rank returns the position of the value of the provider source for field in
+// the precedence list; values of unlisted providers rank after all listed
+// ones. NVD is identified by its source identifier, not by the Primary type,
+// which NVD 2.0 also gives the CNA's values of CVEs NVD has not analyzed.
+// assigner is the CVE's assigning CNA.
+func (p mergePolicy) rank(field, source, assigner string) int {
+	providers, ok := p[field]
+	if !ok && field == mergeFieldCVSS {
+		providers = []string{mergeProviderNVD}
+	}
+	for i, provider := range providers {
+		switch provider {
+		case mergeProviderNVD:
+			if strings.EqualFold(source, nvdSource) {
+				return i
+			}
+		case mergeProviderCNA:
+			if !strings.EqualFold(source, nvdSource) && assigner != "" && strings.EqualFold(source, assigner) {
+				return i
+			}
+		default:
+			if strings.EqualFold(provider, source) {
+				return i
+			}
+		}
+	}
+	return len(providers)
+}
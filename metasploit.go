@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const metasploitMetadataURL = "https://raw.githubusercontent.com/rapid7/metasploit-framework/master/db/modules_metadata_base.json"
+
+var syncMetasploit = flag.Bool("metasploit", false, "sync Metasploit module metadata daily and flag CVEs with a Metasploit module")
+
+type metasploitModule struct {
+	Name           string   `json:"name"`
+	FullName       string   `json:"fullname"`
+	Type           string   `json:"type"`
+	Rank           int      `json:"rank"`
+	DisclosureDate string   `json:"disclosure_date"`
+	References     []string `json:"references"`
+}
+
+// cveIDs returns the CVE IDs among the module's references.
+func (m metasploitModule) cveIDs() []string {
+	var ids []string
+	for _, ref := range m.References {
+		if id, ok := normalizeCVEID(ref); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// syncMetasploitModules replaces the metasploit_modules table with the current
+// framework module metadata and refreshes cve_data1.has_metasploit.
+func syncMetasploitModules(db *sql.DB) error {
+	resp, err := http.Get(metasploitMetadataURL)
+	if err != nil {
+		return fmt.Errorf("failed to download Metasploit metadata: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download Metasploit metadata: %s", resp.Status)
+	}
+
+	var modules map[string]metasploitModule
+	if err := json.NewDecoder(resp.Body).Decode(&modules); err != nil {
+		return fmt.Errorf("failed to decode Metasploit metadata: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if err := setProvenance(tx, sourceMetasploit); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM metasploit_modules`); err != nil {
+		return fmt.Errorf("failed to clear Metasploit modules: %v", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO metasploit_modules (module_name, cve_id, name, type, rank, disclosure_date, source_record_id)
+							 VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')::date, $1)
+							 ON CONFLICT DO NOTHING;`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare Metasploit insert: %v", err)
+	}
+	defer stmt.Close()
+
+	mapped := 0
+	for _, m := range modules {
+		for _, cveID := range m.cveIDs() {
+			if _, err := stmt.Exec(m.FullName, cveID, m.Name, m.Type, m.Rank, m.DisclosureDate); err != nil {
+				return fmt.Errorf("failed to insert Metasploit module %s for %s: %v", m.FullName, cveID, err)
+			}
+			mapped++
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE cve_data1 SET has_metasploit = EXISTS (
+							  SELECT 1 FROM metasploit_modules m WHERE m.cve_id = cve_data1.cve_id);`); err != nil {
+		return fmt.Errorf("failed to flag CVEs with Metasploit modules: %v", err)
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Synced %d Metasploit modules (%d CVE mappings)\n", len(modules), mapped)
+	return nil
+}
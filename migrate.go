@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// migrationFiles are applied on top of the base schema in cvedb.sql, in the
+// order of their numeric prefix, e.g. 0001_workload_indexes.sql.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, e := range entries {
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("migration %s has no numeric prefix", e.Name())
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: e.Name(), sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// migrateLockKey is the Postgres advisory lock key that serializes migrations
+// of instances starting at the same time.
+const migrateLockKey = 0x43564d47 // "CVMG"
+
+// migrate applies every migration not yet recorded in schema_migrations, each
+// in its own transaction. With -db-schema, the schema is created first so the
+// migrations create their objects inside it. Migrations run under an advisory
+// lock held on a dedicated connection, and which ones are applied is read
+// after taking it, so an instance waiting for another skips the migrations
+// the other applied.
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrateLockKey); err != nil {
+		return fmt.Errorf("failed to take the migration lock: %v", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrateLockKey)
+
+	if *dbSchema != "" {
+		if _, err := conn.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+pq.QuoteIdentifier(*dbSchema)); err != nil {
+			return fmt.Errorf("failed to create schema %s: %v", *dbSchema, err)
+		}
+	}
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+						   version INTEGER PRIMARY KEY,
+						   name TEXT,
+						   applied_at TIMESTAMP DEFAULT now()
+					   )`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %v", err)
+	}
+	for _, m := range migrations {
+		var applied bool
+		if err := conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.version).Scan(&applied); err != nil {
+			return fmt.Errorf("failed to check migration %s: %v", m.name, err)
+		}
+		if applied {
+			continue
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		if _, err := tx.Exec(m.sql); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s failed: %v", m.name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %v", m.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("transaction commit error: %v", err)
+		}
+		log.Printf("Applied migration %s\n", m.name)
+	}
+	return nil
+}
+
+// checkSchemaCurrent returns an error unless every migration of this binary
+// has been applied, for -read-only replicas, which never migrate themselves.
+func checkSchemaCurrent(db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %v", err)
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if latest := migrations[len(migrations)-1].version; version < latest {
+		return fmt.Errorf("database schema is at version %d but this binary needs %d: run migrate or upgrade the sync instance first", version, latest)
+	}
+	return nil
+}
+
+// schemaVersion is the highest applied migration.
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(max(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// runMigrate implements the migrate subcommand, for applying migrations
+// without starting the service.
+func runMigrate() error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrate(db)
+}
+
+// runGrants implements the grants subcommand. It prints the statements giving
+// a role read access to the tables of -db-schema, including tables later
+// migrations create, for a DBA to run; query API users then need neither
+// ownership of the tables nor superuser access.
+func runGrants(args []string) error {
+	if len(args) != 1 || !schemaPattern.MatchString(args[0]) {
+		return fmt.Errorf("usage: grants <read-only role>")
+	}
+	schema := "public"
+	if *dbSchema != "" {
+		schema = *dbSchema
+	}
+	s, role := pq.QuoteIdentifier(schema), pq.QuoteIdentifier(args[0])
+	fmt.Printf("GRANT USAGE ON SCHEMA %s TO %s;\n", s, role)
+	fmt.Printf("GRANT SELECT ON ALL TABLES IN SCHEMA %s TO %s;\n", s, role)
+	fmt.Printf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s GRANT SELECT ON TABLES TO %s;\n", pq.QuoteIdentifier(dbUser), s, role)
+	return nil
+}
@@ -0,0 +1,31 @@
+-- Indexes for the query API, the paging rules and the CPE lookups. IF NOT
+-- EXISTS keeps this safe on databases where they were created by hand.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS cve_quarantine_cve_id_idx ON cve_quarantine (cve_id);
+CREATE INDEX IF NOT EXISTS cve_data1_last_modified_date_idx ON cve_data1 (last_modified_date);
+CREATE INDEX IF NOT EXISTS cve_data1_published_date_idx ON cve_data1 (published_date);
+CREATE INDEX IF NOT EXISTS impact_data_severity_idx ON impact_data (cvss_base_severity);
+CREATE INDEX IF NOT EXISTS cpe_data_vendor_product_idx ON cpe_data (split_part(cpe_uri, ':', 4), split_part(cpe_uri, ':', 5));
+CREATE INDEX IF NOT EXISTS cve_data1_description_trgm_idx ON cve_data1 USING gin (description gin_trgm_ops);
+
+-- Databases created from the original schema key cpe_data by cve_id alone and
+-- lack the node linkage and match criteria columns, so the inserts' ON
+-- CONFLICT on the range would fail there. Key columns cannot be NULL, so
+-- missing bounds become ''.
+ALTER TABLE cpe_data
+    ADD COLUMN IF NOT EXISTS node_id INTEGER,
+    ADD COLUMN IF NOT EXISTS parent_node_id INTEGER,
+    ADD COLUMN IF NOT EXISTS match_criteria_id VARCHAR(255);
+
+DO $$
+BEGIN
+    IF (SELECT indnatts FROM pg_index WHERE indrelid = 'cpe_data'::regclass AND indisprimary) = 1 THEN
+        UPDATE cpe_data SET cpe_uri = COALESCE(cpe_uri, ''), version_start = COALESCE(version_start, ''), version_end = COALESCE(version_end, '')
+        WHERE cpe_uri IS NULL OR version_start IS NULL OR version_end IS NULL;
+        ALTER TABLE cpe_data
+            DROP CONSTRAINT cpe_data_pkey,
+            ADD PRIMARY KEY (cve_id, cpe_uri, version_start, version_end);
+    END IF;
+END
+$$;
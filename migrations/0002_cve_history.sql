@@ -0,0 +1,14 @@
+-- Every version of every CVE record when -history is enabled. The current
+-- version of a CVE has valid_to NULL.
+CREATE TABLE IF NOT EXISTS cve_history (
+    id BIGSERIAL PRIMARY KEY,
+    cve_id VARCHAR(255) NOT NULL,
+    valid_from TIMESTAMP NOT NULL DEFAULT now(),
+    valid_to TIMESTAMP,
+    last_modified_date DATE,
+    content_hash CHAR(64) NOT NULL,
+    record JSONB NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS cve_history_current_idx ON cve_history (cve_id) WHERE valid_to IS NULL;
+CREATE INDEX IF NOT EXISTS cve_history_cve_id_valid_from_idx ON cve_history (cve_id, valid_from);
@@ -0,0 +1,3 @@
+-- Hash of the NVD-derived rows stored for each CVE, set on ingest and checked
+-- by the verify command.
+ALTER TABLE cve_data1 ADD COLUMN IF NOT EXISTS content_hash CHAR(64);
@@ -0,0 +1,11 @@
+-- Feed and API records that could not be decoded, kept with the offending
+-- JSON so the rest of the feed can still be loaded.
+CREATE TABLE IF NOT EXISTS parse_errors (
+    id SERIAL PRIMARY KEY,
+    source TEXT NOT NULL,
+    item_index INTEGER,
+    cve_id VARCHAR(255),
+    error TEXT,
+    fragment TEXT,
+    recorded_at TIMESTAMP DEFAULT now()
+);
@@ -0,0 +1,5 @@
+-- The CNA that assigned each CVE: ASSIGNER in the 1.1 feeds, sourceIdentifier
+-- in the 2.0 API.
+ALTER TABLE cve_data1 ADD COLUMN IF NOT EXISTS assigner VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS cve_data1_assigner_idx ON cve_data1 (assigner);
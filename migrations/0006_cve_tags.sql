@@ -0,0 +1,10 @@
+-- NVD cveTags such as "disputed" or "unsupported-when-assigned", with the
+-- source that set them. Distinct from tags, which users set per tenant.
+CREATE TABLE IF NOT EXISTS cve_tags (
+    cve_id VARCHAR(255),
+    tag VARCHAR(255),
+    source_identifier VARCHAR(255),
+    PRIMARY KEY (cve_id, tag)
+);
+
+CREATE INDEX IF NOT EXISTS cve_tags_tag_idx ON cve_tags (tag);
@@ -0,0 +1,12 @@
+-- NVD vendorComments and evaluator notes, which often carry mitigation
+-- guidance missing from the description.
+CREATE TABLE IF NOT EXISTS cve_comments (
+    id SERIAL PRIMARY KEY,
+    cve_id VARCHAR(255) NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    organization VARCHAR(255),
+    comment TEXT,
+    last_modified TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS cve_comments_cve_id_idx ON cve_comments (cve_id);
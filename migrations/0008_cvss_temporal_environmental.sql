@@ -0,0 +1,13 @@
+-- Temporal metrics from CVSS vectors that carry them, and user supplied
+-- environmental overrides per CVE.
+ALTER TABLE impact_data ADD COLUMN IF NOT EXISTS exploit_code_maturity VARCHAR(1);
+ALTER TABLE impact_data ADD COLUMN IF NOT EXISTS remediation_level VARCHAR(1);
+ALTER TABLE impact_data ADD COLUMN IF NOT EXISTS report_confidence VARCHAR(1);
+ALTER TABLE impact_data ADD COLUMN IF NOT EXISTS temporal_score NUMERIC;
+
+CREATE TABLE IF NOT EXISTS cvss_environmental (
+    cve_id VARCHAR(255) PRIMARY KEY,
+    metrics TEXT NOT NULL,
+    environmental_score NUMERIC,
+    updated_at TIMESTAMP DEFAULT now()
+);
@@ -0,0 +1,12 @@
+-- Every CVSS v3 score published for a CVE, by source (NVD or the CNA) and
+-- version. impact_data holds the preferred one.
+CREATE TABLE IF NOT EXISTS cvss_metrics (
+    cve_id VARCHAR(255),
+    source VARCHAR(255),
+    type VARCHAR(32),
+    version VARCHAR(8),
+    vector_string VARCHAR(255),
+    base_score NUMERIC,
+    base_severity VARCHAR(32),
+    PRIMARY KEY (cve_id, source, version)
+);
@@ -0,0 +1,11 @@
+-- NVD's own change history per CVE, from the cvehistory 2.0 API.
+CREATE TABLE IF NOT EXISTS cve_nvd_history (
+    cve_change_id VARCHAR(64) PRIMARY KEY,
+    cve_id VARCHAR(255) NOT NULL,
+    event_name VARCHAR(255),
+    source_identifier VARCHAR(255),
+    created TIMESTAMP,
+    details JSONB
+);
+
+CREATE INDEX IF NOT EXISTS cve_nvd_history_cve_id_idx ON cve_nvd_history (cve_id, created);
@@ -0,0 +1,2 @@
+-- Package scans look CPE rows up by product alone.
+CREATE INDEX IF NOT EXISTS cpe_data_product_idx ON cpe_data (split_part(cpe_uri, ':', 5));
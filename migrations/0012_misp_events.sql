@@ -0,0 +1,7 @@
+-- The MISP event published for each CVE, so later syncs update it instead of
+-- publishing a duplicate.
+CREATE TABLE IF NOT EXISTS misp_events (
+    cve_id VARCHAR(255) PRIMARY KEY,
+    event_id VARCHAR(64) NOT NULL,
+    last_modified VARCHAR(50)
+);
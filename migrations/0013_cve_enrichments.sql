@@ -0,0 +1,11 @@
+-- What each third-party enricher returned for a CVE. data is NULL when the
+-- enricher had nothing; fetched_at and cve_last_modified decide when it is
+-- asked again.
+CREATE TABLE IF NOT EXISTS cve_enrichments (
+    cve_id VARCHAR(255),
+    enricher VARCHAR(50),
+    data JSONB,
+    cve_last_modified DATE,
+    fetched_at TIMESTAMP NOT NULL DEFAULT now(),
+    PRIMARY KEY (cve_id, enricher)
+);
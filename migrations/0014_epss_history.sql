@@ -0,0 +1,11 @@
+-- Every daily EPSS score, so a rising score can be spotted. epss keeps only
+-- the current day.
+CREATE TABLE IF NOT EXISTS epss_history (
+    cve_id VARCHAR(255),
+    score_date DATE,
+    score NUMERIC,
+    percentile NUMERIC,
+    PRIMARY KEY (cve_id, score_date)
+);
+
+CREATE INDEX IF NOT EXISTS epss_history_score_date_idx ON epss_history (score_date);
@@ -0,0 +1,44 @@
+-- NVD publishes timestamps, not dates. Stored dates become midnight UTC until
+-- their CVE is next updated; the indexes on both columns are rebuilt with the
+-- new type and keep serving delta queries on last_modified_date.
+ALTER TABLE cve_data1
+    ALTER COLUMN published_date TYPE TIMESTAMPTZ USING published_date::timestamp AT TIME ZONE 'UTC',
+    ALTER COLUMN last_modified_date TYPE TIMESTAMPTZ USING last_modified_date::timestamp AT TIME ZONE 'UTC';
+ALTER TABLE cve_history
+    ALTER COLUMN last_modified_date TYPE TIMESTAMPTZ USING last_modified_date::timestamp AT TIME ZONE 'UTC';
+ALTER TABLE cve_enrichments
+    ALTER COLUMN cve_last_modified TYPE TIMESTAMPTZ USING cve_last_modified::timestamp AT TIME ZONE 'UTC';
+
+-- The integrations remember the last modified date they acted on as text.
+-- Rewrite it in the new format so the conversion is not taken for an update.
+UPDATE jira_issues SET last_modified = last_modified || 'T00:00:00Z' WHERE last_modified ~ '^\d{4}-\d{2}-\d{2}$';
+UPDATE misp_events SET last_modified = last_modified || 'T00:00:00Z' WHERE last_modified ~ '^\d{4}-\d{2}-\d{2}$';
+
+-- Content hashes now cover the full timestamps. Re-hash the CVEs whose rows
+-- still match the hash over dates; the others keep failing verify.
+UPDATE cve_data1 c SET content_hash = encode(sha256(convert_to(concat_ws('|',
+		COALESCE(json_build_array(c.description,
+			to_char(c.published_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(c.last_modified_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'))::text, ''),
+		COALESCE((SELECT json_build_array(cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity)::text
+				  FROM impact_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(cpe_uri, vulnerable, version_start, version_end, config, node_id, parent_node_id, match_criteria_id)
+						 ORDER BY cpe_uri, version_start, version_end)::text
+				  FROM cpe_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(cwe_id ORDER BY cwe_id)::text FROM cve_cwe WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(vendor, advisory_id, url) ORDER BY url)::text
+				  FROM advisories WHERE cve_id = c.cve_id), '')
+	), 'UTF8')), 'hex')
+WHERE c.content_hash = encode(sha256(convert_to(concat_ws('|',
+		COALESCE(json_build_array(c.description,
+			(c.published_date AT TIME ZONE 'UTC')::date,
+			(c.last_modified_date AT TIME ZONE 'UTC')::date)::text, ''),
+		COALESCE((SELECT json_build_array(cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity)::text
+				  FROM impact_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(cpe_uri, vulnerable, version_start, version_end, config, node_id, parent_node_id, match_criteria_id)
+						 ORDER BY cpe_uri, version_start, version_end)::text
+				  FROM cpe_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(cwe_id ORDER BY cwe_id)::text FROM cve_cwe WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(vendor, advisory_id, url) ORDER BY url)::text
+				  FROM advisories WHERE cve_id = c.cve_id), '')
+	), 'UTF8')), 'hex');
@@ -0,0 +1,20 @@
+-- Position of each CVE's current version in the change feed. It is assigned
+-- from cve_change_seq whenever the CVE's content hash changes.
+CREATE SEQUENCE IF NOT EXISTS cve_change_seq;
+ALTER TABLE cve_data1 ADD COLUMN IF NOT EXISTS change_seq BIGINT;
+
+UPDATE cve_data1 c SET change_seq = s.seq
+FROM (SELECT cve_id, row_number() OVER (ORDER BY last_modified_date, cve_id) AS seq FROM cve_data1) s
+WHERE s.cve_id = c.cve_id AND c.change_seq IS NULL;
+SELECT setval('cve_change_seq'::regclass, GREATEST((SELECT max(change_seq) FROM cve_data1), 1));
+
+CREATE INDEX IF NOT EXISTS cve_data1_change_seq_idx ON cve_data1 (change_seq);
+
+-- The position each downstream consumer has acknowledged.
+CREATE TABLE IF NOT EXISTS change_consumers (
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    name VARCHAR(100),
+    cursor BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant, name)
+);
@@ -0,0 +1,28 @@
+-- Non-public issues a tenant manages itself, e.g. found in its own products.
+-- They are searched, matched and paged on next to the public CVEs.
+CREATE TABLE IF NOT EXISTS internal_advisories (
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    id VARCHAR(64) NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    severity VARCHAR(16) NOT NULL,
+    base_score NUMERIC(3,1),
+    published_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant, id)
+);
+
+-- The affected products of an internal advisory, as CPE names with an
+-- optional [version_start, version_end) range like cpe_data.
+CREATE TABLE IF NOT EXISTS internal_advisory_products (
+    tenant VARCHAR(64) NOT NULL DEFAULT 'default',
+    advisory_id VARCHAR(64) NOT NULL,
+    cpe_uri TEXT NOT NULL,
+    version_start TEXT NOT NULL DEFAULT '',
+    version_end TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (tenant, advisory_id, cpe_uri, version_start, version_end),
+    FOREIGN KEY (tenant, advisory_id) REFERENCES internal_advisories (tenant, id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS internal_advisory_products_product_idx
+    ON internal_advisory_products (tenant, split_part(cpe_uri, ':', 4), split_part(cpe_uri, ':', 5));
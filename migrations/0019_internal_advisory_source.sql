@@ -0,0 +1,3 @@
+-- Where an internal advisory comes from: the API, or advisory files imported
+-- with "import advisories", which own the advisories they define.
+ALTER TABLE internal_advisories ADD COLUMN IF NOT EXISTS source VARCHAR(16) NOT NULL DEFAULT 'api';
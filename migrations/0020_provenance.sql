@@ -0,0 +1,41 @@
+-- One row per sync: the scheduled updates, backfills, reconciliations and
+-- enrichment downloads. The rows a sync writes carry its id in run_id.
+CREATE TABLE IF NOT EXISTS sync_runs (
+    id BIGSERIAL PRIMARY KEY,
+    kind VARCHAR(32) NOT NULL,
+    source VARCHAR(64) NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ,
+    status VARCHAR(16) NOT NULL DEFAULT 'running',
+    error TEXT
+);
+
+-- Provenance of the stored facts. The defaults read the settings a sync sets
+-- at the start of its transaction (cve.source, cve.run_id) and before each
+-- record (cve.record_id), so the insert statements need not list them. Rows
+-- stored before this migration keep NULL: their origin is unknown.
+DO $$
+DECLARE
+    t REGCLASS;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['cve_data1'::regclass, 'cpe_data'::regclass, 'impact_data'::regclass, 'cve_cwe'::regclass,
+                             'advisories'::regclass, 'cvss_metrics'::regclass, 'cve_tags'::regclass, 'cve_comments'::regclass,
+                             'match_criteria'::regclass, 'match_criteria_names'::regclass, 'kev'::regclass, 'epss'::regclass,
+                             'exploits'::regclass, 'metasploit_modules'::regclass] LOOP
+        -- cvss_metrics.source already names the provider of the score; the
+        -- source of its rows is that of their run.
+        IF t <> 'cvss_metrics'::regclass THEN
+            EXECUTE format($f$ALTER TABLE %s ADD COLUMN IF NOT EXISTS source VARCHAR(64),
+                                             ALTER COLUMN source SET DEFAULT NULLIF(current_setting('cve.source', true), '')$f$, t);
+        END IF;
+        EXECUTE format('ALTER TABLE %s ADD COLUMN IF NOT EXISTS source_record_id VARCHAR(255),
+                                       ADD COLUMN IF NOT EXISTS ingested_at TIMESTAMPTZ,
+                                       ADD COLUMN IF NOT EXISTS run_id BIGINT', t);
+        EXECUTE format($f$ALTER TABLE %s ALTER COLUMN source_record_id SET DEFAULT NULLIF(current_setting('cve.record_id', true), ''),
+                                         ALTER COLUMN ingested_at SET DEFAULT now(),
+                                         ALTER COLUMN run_id SET DEFAULT NULLIF(current_setting('cve.run_id', true), '')::bigint$f$, t);
+    END LOOP;
+END
+$$;
+
+CREATE INDEX IF NOT EXISTS cve_data1_run_id_idx ON cve_data1 (run_id);
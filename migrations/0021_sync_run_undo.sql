@@ -0,0 +1,20 @@
+-- The CVEs an update run changed, and whether each was stored before the run.
+CREATE TABLE IF NOT EXISTS sync_run_undo_cves (
+    run_id BIGINT NOT NULL,
+    cve_id VARCHAR(255) NOT NULL,
+    existed BOOLEAN NOT NULL,
+    PRIMARY KEY (run_id, cve_id)
+);
+
+CREATE INDEX IF NOT EXISTS sync_run_undo_cves_cve_id_idx ON sync_run_undo_cves (cve_id);
+
+-- The rows those CVEs had before the run, as to_jsonb of the row, so that
+-- rollback can put them back.
+CREATE TABLE IF NOT EXISTS sync_run_undo (
+    run_id BIGINT NOT NULL,
+    cve_id VARCHAR(255) NOT NULL,
+    table_name VARCHAR(64) NOT NULL,
+    row_data JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sync_run_undo_run_id_idx ON sync_run_undo (run_id, table_name);
@@ -0,0 +1,11 @@
+-- How far the running ingest of each source got: the feed or query being
+-- paged through and the number of its records committed. A checkpoint is
+-- written in the transaction of the batch it follows, so it never disagrees
+-- with the stored data.
+CREATE TABLE IF NOT EXISTS sync_checkpoints (
+    source VARCHAR(64) PRIMARY KEY,
+    position TEXT NOT NULL,
+    batch_offset INT NOT NULL,
+    last_cve_id VARCHAR(255) NOT NULL DEFAULT '',
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,5 @@
+-- The version range bounds as published (e.g. 2.4.0-beta1 or 9.1p2), next to
+-- the numeric prefixes in version_start and version_end. NULL for rows stored
+-- before they were kept and for open bounds.
+ALTER TABLE cpe_data ADD COLUMN IF NOT EXISTS version_start_raw TEXT;
+ALTER TABLE cpe_data ADD COLUMN IF NOT EXISTS version_end_raw TEXT;
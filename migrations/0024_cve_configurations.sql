@@ -0,0 +1,11 @@
+-- Each applicability configuration of a CVE as the complete node tree: the
+-- AND/OR operator and negate flag of every node and its CPE matches, with the
+-- version bounds as published. cpe_data flattens the same matches into rows
+-- for lookups; the matcher evaluates these trees to decide whether an
+-- inventory satisfies the configuration as a whole.
+CREATE TABLE IF NOT EXISTS cve_configurations (
+    cve_id VARCHAR(255) NOT NULL,
+    config INT NOT NULL,
+    node JSONB NOT NULL,
+    PRIMARY KEY (cve_id, config)
+);
@@ -0,0 +1,19 @@
+-- Every revision of a CVE's CVSS score or severity after it was first stored:
+-- the values before and after, when the change was stored and NVD's last
+-- modified date of the revised record.
+CREATE TABLE IF NOT EXISTS score_history (
+    id BIGSERIAL PRIMARY KEY,
+    cve_id VARCHAR(255) NOT NULL,
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    nvd_last_modified TIMESTAMPTZ,
+    old_version VARCHAR(255),
+    old_vector_string VARCHAR(255),
+    old_base_score NUMERIC,
+    old_base_severity VARCHAR(255),
+    new_version VARCHAR(255),
+    new_vector_string VARCHAR(255),
+    new_base_score NUMERIC,
+    new_base_severity VARCHAR(255)
+);
+
+CREATE INDEX IF NOT EXISTS score_history_cve_id_idx ON score_history (cve_id, changed_at);
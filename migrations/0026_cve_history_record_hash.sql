@@ -0,0 +1,8 @@
+-- A hash of each history record in its stored form (the text of the JSONB
+-- value), so verify can check records without re-encoding them through the
+-- current CVEItem struct. content_hash stays the key recordCVEVersion uses to
+-- detect changed records. Existing versions are hashed as they are stored now.
+ALTER TABLE cve_history ADD COLUMN IF NOT EXISTS record_hash CHAR(64);
+
+UPDATE cve_history SET record_hash = encode(sha256(convert_to(record::text, 'UTF8')), 'hex')
+WHERE record_hash IS NULL;
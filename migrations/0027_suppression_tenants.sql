@@ -0,0 +1,5 @@
+-- Suppressions belong to a tenant like watchlists and alerts. Existing rules
+-- stay with the default tenant.
+ALTER TABLE suppressions ADD COLUMN IF NOT EXISTS tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS suppressions_tenant_cve_id_idx ON suppressions (tenant, cve_id);
@@ -0,0 +1,16 @@
+-- Ranges that differ only in their published bounds (2.4.0-beta1 and
+-- 2.4.0-rc1 both have the numeric prefix 2.4.0) are distinct rows, so the raw
+-- bounds join the primary key. Key columns cannot be NULL: an open bound, or a
+-- row stored before the raw bounds were kept, has ''.
+UPDATE cpe_data SET version_start_raw = COALESCE(version_start_raw, ''), version_end_raw = COALESCE(version_end_raw, '')
+WHERE version_start_raw IS NULL OR version_end_raw IS NULL;
+
+ALTER TABLE cpe_data
+    ALTER COLUMN version_start_raw SET DEFAULT '',
+    ALTER COLUMN version_start_raw SET NOT NULL,
+    ALTER COLUMN version_end_raw SET DEFAULT '',
+    ALTER COLUMN version_end_raw SET NOT NULL;
+
+ALTER TABLE cpe_data
+    DROP CONSTRAINT cpe_data_pkey,
+    ADD PRIMARY KEY (cve_id, cpe_uri, version_start, version_end, version_start_raw, version_end_raw);
@@ -0,0 +1,5 @@
+-- The TAXII collection is ordered by when CVEs were stored. CVEs stored before
+-- ingested_at was recorded count as stored when NVD last modified them.
+UPDATE cve_data1 SET ingested_at = COALESCE(last_modified_date, published_date, now()) WHERE ingested_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS cve_data1_ingested_at_idx ON cve_data1 (ingested_at, cve_id);
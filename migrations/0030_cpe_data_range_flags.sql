@@ -0,0 +1,14 @@
+-- NVD publishes a range's start as versionStartIncluding or
+-- versionStartExcluding and its end as versionEndExcluding or
+-- versionEndIncluding. version_start and version_end (and their raw columns)
+-- hold whichever was published; these flags record the inclusive end and
+-- exclusive start, which were previously dropped. A range ending at 2.0 and one
+-- ending after 2.0 are distinct rows, so the flags join the primary key.
+ALTER TABLE cpe_data
+    ADD COLUMN IF NOT EXISTS version_start_excluding BOOLEAN NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS version_end_including BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE cpe_data
+    DROP CONSTRAINT cpe_data_pkey,
+    ADD PRIMARY KEY (cve_id, cpe_uri, version_start, version_end, version_start_raw, version_end_raw,
+                     version_start_excluding, version_end_including);
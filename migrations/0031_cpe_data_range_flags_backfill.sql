@@ -0,0 +1,37 @@
+-- Ranges published as versionStartExcluding or versionEndIncluding were
+-- stored without that bound. Their CVEs are re-ingested by the next full
+-- reconciliation, which rewrites their rows and configuration trees: a CVE
+-- without a content hash never counts as unchanged. Until then, rows from the
+-- NVD 2.0 API get the lost bound back from their match criteria.
+UPDATE cve_data1 SET content_hash = NULL
+WHERE cve_id IN (SELECT cve_id FROM cpe_data
+                 WHERE (version_start_raw = '' AND version_start = '' OR version_end_raw = '' AND version_end = '')
+                   AND split_part(cpe_uri, ':', 6) = '*');
+
+UPDATE cpe_data c
+SET version_start_raw = trim(m.version_start_excluding),
+    version_start = COALESCE(substring(trim(m.version_start_excluding) from '^\d+(?:\.\d+)*'), ''),
+    version_start_excluding = true
+FROM match_criteria m
+WHERE m.match_criteria_id = c.match_criteria_id
+  AND c.version_start_raw = '' AND c.version_start = ''
+  AND COALESCE(m.version_start_including, '') = '' AND COALESCE(trim(m.version_start_excluding), '') <> ''
+  AND NOT EXISTS (SELECT 1 FROM cpe_data d
+                  WHERE d.cve_id = c.cve_id AND d.cpe_uri = c.cpe_uri
+                    AND d.version_start_raw = trim(m.version_start_excluding) AND d.version_start_excluding
+                    AND d.version_end = c.version_end AND d.version_end_raw = c.version_end_raw
+                    AND d.version_end_including = c.version_end_including);
+
+UPDATE cpe_data c
+SET version_end_raw = trim(m.version_end_including),
+    version_end = COALESCE(substring(trim(m.version_end_including) from '^\d+(?:\.\d+)*'), ''),
+    version_end_including = true
+FROM match_criteria m
+WHERE m.match_criteria_id = c.match_criteria_id
+  AND c.version_end_raw = '' AND c.version_end = ''
+  AND COALESCE(m.version_end_excluding, '') = '' AND COALESCE(trim(m.version_end_including), '') <> ''
+  AND NOT EXISTS (SELECT 1 FROM cpe_data d
+                  WHERE d.cve_id = c.cve_id AND d.cpe_uri = c.cpe_uri
+                    AND d.version_end_raw = trim(m.version_end_including) AND d.version_end_including
+                    AND d.version_start = c.version_start AND d.version_start_raw = c.version_start_raw
+                    AND d.version_start_excluding = c.version_start_excluding);
@@ -0,0 +1,33 @@
+-- Content hashes now cover the published range bounds and their inclusive or
+-- exclusive flags. Re-hash the CVEs whose rows still match the previous hash;
+-- the others keep failing verify. CVEs without a hash are left for their next
+-- ingest.
+UPDATE cve_data1 c SET content_hash = encode(sha256(convert_to(concat_ws('|',
+		COALESCE((SELECT json_build_array(description,
+			to_char(published_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(last_modified_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'))::text
+				  FROM cve_data1 WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_build_array(cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity)::text
+				  FROM impact_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(cpe_uri, vulnerable, version_start, version_end, config, node_id, parent_node_id, match_criteria_id,
+												   version_start_raw, version_end_raw, version_start_excluding, version_end_including)
+						 ORDER BY cpe_uri, version_start, version_end, version_start_raw, version_end_raw, version_start_excluding, version_end_including)::text
+				  FROM cpe_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(cwe_id ORDER BY cwe_id)::text FROM cve_cwe WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(vendor, advisory_id, url) ORDER BY url)::text
+				  FROM advisories WHERE cve_id = c.cve_id), '')
+	), 'UTF8')), 'hex')
+WHERE c.content_hash = encode(sha256(convert_to(concat_ws('|',
+		COALESCE((SELECT json_build_array(description,
+			to_char(published_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'),
+			to_char(last_modified_date AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"'))::text
+				  FROM cve_data1 WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_build_array(cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity)::text
+				  FROM impact_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(cpe_uri, vulnerable, version_start, version_end, config, node_id, parent_node_id, match_criteria_id)
+						 ORDER BY cpe_uri, version_start, version_end)::text
+				  FROM cpe_data WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(cwe_id ORDER BY cwe_id)::text FROM cve_cwe WHERE cve_id = c.cve_id), ''),
+		COALESCE((SELECT json_agg(json_build_array(vendor, advisory_id, url) ORDER BY url)::text
+				  FROM advisories WHERE cve_id = c.cve_id), '')
+	), 'UTF8')), 'hex');
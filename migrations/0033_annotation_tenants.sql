@@ -0,0 +1,5 @@
+-- Annotations belong to a tenant like tags and suppressions. Existing notes
+-- stay with the default tenant.
+ALTER TABLE annotations ADD COLUMN IF NOT EXISTS tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS annotations_tenant_cve_id_idx ON annotations (tenant, cve_id);
@@ -0,0 +1,16 @@
+-- Environmental overrides belong to a tenant, and so does the risk score they
+-- feed: tenant_risk_scores holds a tenant's score of a CVE it has overrides
+-- for, in place of cve_data1.risk_score. Existing overrides stay with the
+-- default tenant.
+ALTER TABLE cvss_environmental ADD COLUMN IF NOT EXISTS tenant VARCHAR(64) NOT NULL DEFAULT 'default';
+
+ALTER TABLE cvss_environmental
+    DROP CONSTRAINT cvss_environmental_pkey,
+    ADD PRIMARY KEY (tenant, cve_id);
+
+CREATE TABLE IF NOT EXISTS tenant_risk_scores (
+    tenant VARCHAR(64) NOT NULL,
+    cve_id VARCHAR(255) NOT NULL,
+    risk_score NUMERIC,
+    PRIMARY KEY (tenant, cve_id)
+);
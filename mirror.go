@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A mirror directory holds the latest snapshot, its signature and a .meta file
+// in the format of the NVD feed metadata, so downstream instances can check
+// for new data without downloading the snapshot.
+const (
+	mirrorSnapshotFile = "cve-snapshot.tar.gz"
+	mirrorMetaFile     = "cve-snapshot.meta"
+)
+
+var (
+	mirrorDir           = flag.String("mirror-dir", "", "publish a snapshot of the ingested data to this directory after syncs and serve it under /mirror/ for downstream instances (disabled if empty)")
+	mirrorInterval      = flag.Duration("mirror-interval", time.Hour, "minimum time between two snapshots published to -mirror-dir")
+	mirrorSignKey       = flag.String("mirror-sign-key", "", "Ed25519 private key (PKCS #8 PEM) to sign published snapshots with")
+	mirrorURL           = flag.String("mirror-url", "", "base URL of the upstream instance's mirror with -source mirror, e.g. http://cve-upstream:8080/mirror")
+	mirrorVerifyKey     = flag.String("mirror-verify-key", "", "Ed25519 public key (PKIX PEM) upstream snapshots must be signed with")
+	mirrorAllowUnsigned = flag.Bool("mirror-allow-unsigned", false, "import upstream snapshots without checking a signature")
+)
+
+// publishMirror writes a new snapshot to -mirror-dir when the data changed
+// since the last one and -mirror-interval has passed.
+func publishMirror(db *sql.DB) error {
+	lastModified, err := readLastModified()
+	if err != nil {
+		return fmt.Errorf("no last modified date found: %v", err)
+	}
+	metaPath := filepath.Join(*mirrorDir, mirrorMetaFile)
+	if info, err := os.Stat(metaPath); err == nil {
+		meta, err := os.ReadFile(metaPath)
+		if err != nil {
+			return err
+		}
+		if parseLastModified(string(meta)) == lastModified || time.Since(info.ModTime()) < *mirrorInterval {
+			return nil
+		}
+	}
+
+	var key ed25519.PrivateKey
+	if *mirrorSignKey != "" {
+		if key, err = loadSigningKey(*mirrorSignKey); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(*mirrorDir, 0755); err != nil {
+		return err
+	}
+	snapshotPath := filepath.Join(*mirrorDir, mirrorSnapshotFile)
+	if err := createSnapshotFile(db, snapshotPath, key); err != nil {
+		return err
+	}
+
+	f, err := os.Open(snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return fmt.Errorf("failed to hash snapshot: %v", err)
+	}
+	meta := fmt.Sprintf("lastModifiedDate:%s\r\ngzSize:%d\r\nsha256:%s\r\n",
+		lastModified, size, strings.ToUpper(hex.EncodeToString(h.Sum(nil))))
+	tmp := metaPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(meta), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, metaPath)
+}
+
+// mirrorGet fetches path below -mirror-url. MIRROR_API_TOKEN is sent for
+// upstreams that run with -api-auth.
+func mirrorGet(path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(*mirrorURL, "/")+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("MIRROR_API_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// syncFromMirror imports the upstream's snapshot when its .meta reports a
+// different last modified date than the last import.
+func syncFromMirror(db *sql.DB) error {
+	resp, err := mirrorGet(mirrorMetaFile)
+	if err != nil {
+		return err
+	}
+	meta, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %v", err)
+	}
+	modifiedDate := parseLastModified(string(meta))
+	lastModified, _ := readLastModified()
+	if modifiedDate == lastModified {
+		log.Println("No new data available.")
+		return nil
+	}
+
+	log.Println("New data available, downloading snapshot from the mirror...")
+	resp, err = mirrorGet(mirrorSnapshotFile)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	tmp, err := os.CreateTemp("", "cve_snapshot_*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), progressReader{resp.Body})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download snapshot: %v", err)
+	}
+	if sum := strings.ToUpper(hex.EncodeToString(h.Sum(nil))); !strings.Contains(string(meta), "sha256:"+sum) {
+		return fmt.Errorf("downloaded snapshot does not match the sha256 in %s", mirrorMetaFile)
+	}
+
+	var key ed25519.PublicKey
+	var sig []byte
+	if *mirrorVerifyKey != "" {
+		if key, err = loadVerifyKey(*mirrorVerifyKey); err != nil {
+			return err
+		}
+		resp, err := mirrorGet(mirrorSnapshotFile + ".sig")
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read signature: %v", err)
+		}
+		if sig, err = decodeSignature(data); err != nil {
+			return fmt.Errorf("invalid signature: %v", err)
+		}
+	}
+	if err := importSnapshot(db, tmp.Name(), key, sig); err != nil {
+		return fmt.Errorf("failed to import snapshot: %v", err)
+	}
+	if err := saveLastModified(modifiedDate); err != nil {
+		return fmt.Errorf("failed to save last modified date: %v", err)
+	}
+	return nil
+}
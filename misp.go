@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	mispURL           = flag.String("misp-url", "", "MISP base URL; enables publishing new CVEs as MISP events (API key from MISP_API_KEY)")
+	mispMinSeverity   = flag.String("misp-min-severity", "HIGH", "only publish CVEs whose CVSS v3 severity is at least this to MISP")
+	mispWatchlistOnly = flag.Bool("misp-watchlist-only", false, "only publish CVEs affecting a product on a watchlist to MISP")
+	mispMaxAge        = flag.Duration("misp-max-age", 7*24*time.Hour, "only publish CVEs published within this age to MISP; already published events are still updated")
+	mispDistribution  = flag.Int("misp-distribution", 0, "MISP distribution level of the events (0 your organisation only ... 3 all communities)")
+)
+
+// mispThreatLevels maps CVSS v3 severities to MISP threat levels (1 high,
+// 2 medium, 3 low, 4 undefined).
+var mispThreatLevels = map[string]int{"CRITICAL": 1, "HIGH": 1, "MEDIUM": 2, "LOW": 3}
+
+type mispCandidate struct {
+	CVEID        string
+	Description  string
+	Severity     string
+	Score        *float64
+	LastModified string
+	EventID      string
+}
+
+func mispEnabled() bool {
+	return *mispURL != ""
+}
+
+// syncMISPEvents publishes an event for every recently published CVE that
+// passes the severity and watchlist filters, and updates the events of CVEs
+// NVD modified since.
+func syncMISPEvents(db *sql.DB) error {
+	var severities []string
+	for s, rank := range severityRanks {
+		if rank >= severityRanks[strings.ToUpper(*mispMinSeverity)] {
+			severities = append(severities, s)
+		}
+	}
+	rows, err := db.Query(`SELECT c.cve_id, COALESCE(c.description, ''), i.cvss_base_severity, i.cvss_base_score,
+								  `+utcTimestampSQL("c.last_modified_date")+`, COALESCE(m.event_id, '')
+						   FROM cve_data1 c
+						   JOIN impact_data i ON i.cve_id = c.cve_id
+						   LEFT JOIN misp_events m ON m.cve_id = c.cve_id
+						   WHERE upper(i.cvss_base_severity) = ANY($1)
+							 AND (m.cve_id IS NOT NULL OR c.published_date >= $2)
+							 AND m.last_modified IS DISTINCT FROM `+utcTimestampSQL("c.last_modified_date")+`
+							 AND (NOT $3 OR EXISTS (
+							   SELECT 1 FROM cpe_data p JOIN watchlist w ON starts_with(p.cpe_uri, w.cpe_prefix)
+							   WHERE p.cve_id = c.cve_id AND p.vulnerable AND NOT `+suppressedCPE("w.tenant", "p.cve_id", "p.cpe_uri")+`))
+						   ORDER BY c.cve_id`,
+		pq.Array(severities), time.Now().Add(-*mispMaxAge), *mispWatchlistOnly)
+	if err != nil {
+		return fmt.Errorf("failed to find CVEs for MISP: %v", err)
+	}
+	var candidates []mispCandidate
+	for rows.Next() {
+		var c mispCandidate
+		if err := rows.Scan(&c.CVEID, &c.Description, &c.Severity, &c.Score, &c.LastModified, &c.EventID); err != nil {
+			rows.Close()
+			return err
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		if c.EventID == "" {
+			id, err := createMISPEvent(c)
+			if err != nil {
+				return err
+			}
+			c.EventID = id
+			log.Printf("Published MISP event %s for %s\n", id, c.CVEID)
+		} else if err := updateMISPEvent(c); err != nil {
+			return err
+		}
+		_, err := db.Exec(`INSERT INTO misp_events (cve_id, event_id, last_modified) VALUES ($1, $2, $3)
+						   ON CONFLICT (cve_id) DO UPDATE SET last_modified = EXCLUDED.last_modified`,
+			c.CVEID, c.EventID, c.LastModified)
+		if err != nil {
+			return fmt.Errorf("failed to record MISP event %s: %v", c.EventID, err)
+		}
+	}
+	return nil
+}
+
+// mispEventInfo is the event title: the CVE ID and severity, then the start
+// of the description.
+func mispEventInfo(c mispCandidate) string {
+	info := fmt.Sprintf("%s (%s", c.CVEID, c.Severity)
+	if c.Score != nil {
+		info += fmt.Sprintf(" %.1f", *c.Score)
+	}
+	info += ")"
+	if d := strings.Join(strings.Fields(c.Description), " "); d != "" {
+		if r := []rune(d); len(r) > 200 {
+			d = string(r[:200]) + "..."
+		}
+		info += ": " + d
+	}
+	return info
+}
+
+// mispTLP is the TLP tag matching a distribution level, so the marking never
+// allows wider sharing than the event's distribution does.
+func mispTLP(distribution int) string {
+	switch distribution {
+	case 0:
+		return "tlp:amber+strict"
+	case 1, 2:
+		return "tlp:green"
+	case 3:
+		return "tlp:clear"
+	default:
+		return "tlp:amber"
+	}
+}
+
+func mispThreatLevel(severity string) int {
+	if level, ok := mispThreatLevels[strings.ToUpper(severity)]; ok {
+		return level
+	}
+	return 4
+}
+
+func createMISPEvent(c mispCandidate) (string, error) {
+	event := map[string]any{
+		"info":            mispEventInfo(c),
+		"distribution":    *mispDistribution,
+		"threat_level_id": mispThreatLevel(c.Severity),
+		"analysis":        2,
+		"Attribute": []map[string]any{
+			{"type": "vulnerability", "category": "External analysis", "value": c.CVEID, "to_ids": false},
+			{"type": "link", "category": "External analysis", "value": "https://nvd.nist.gov/vuln/detail/" + c.CVEID, "to_ids": false},
+		},
+		"Tag": []map[string]string{{"name": mispTLP(*mispDistribution)}},
+	}
+	var created struct {
+		Event struct {
+			ID string `json:"id"`
+		} `json:"Event"`
+	}
+	if err := mispRequest(http.MethodPost, "/events/add", map[string]any{"Event": event}, &created); err != nil {
+		return "", err
+	}
+	return created.Event.ID, nil
+}
+
+// updateMISPEvent refreshes the title and threat level of a CVE's event.
+func updateMISPEvent(c mispCandidate) error {
+	event := map[string]any{
+		"info":            mispEventInfo(c),
+		"threat_level_id": mispThreatLevel(c.Severity),
+	}
+	return mispRequest(http.MethodPost, "/events/edit/"+c.EventID, map[string]any{"Event": event}, nil)
+}
+
+func mispRequest(method, path string, body, result any) error {
+	var payload bytes.Buffer
+	if err := json.NewEncoder(&payload).Encode(body); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(*mispURL, "/")+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", os.Getenv("MISP_API_KEY"))
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("MISP request %s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("MISP request %s %s failed: %s", method, path, resp.Status)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nvdCVEAPIURL             = "https://services.nvd.nist.gov/rest/json/cves/2.0"
+	nvdCPEMatchAPIURL        = "https://services.nvd.nist.gov/rest/json/cpematch/2.0"
+	nvdPageSize              = 2000
+	nvdMaxDateRange          = 120 * 24 * time.Hour // API limit for lastMod ranges
+	nvdTimeParamLayout       = "2006-01-02T15:04:05.000Z"
+	cpeMatchLastModifiedFile = "cpematch_last_modified.txt"
+)
+
+var source = flag.String("source", "feeds", "where scheduled updates come from: feeds (NVD 1.1 JSON feeds), api (NVD 2.0 API) or mirror (an upstream instance's -mirror-dir, see -mirror-url)")
+
+// NVD 2.0 API response types. Only the fields that are stored are decoded.
+type nvdCVEResponse struct {
+	ResultsPerPage  int               `json:"resultsPerPage"`
+	StartIndex      int               `json:"startIndex"`
+	TotalResults    int               `json:"totalResults"`
+	Vulnerabilities []json.RawMessage `json:"vulnerabilities"`
+}
+
+type nvdVulnerability struct {
+	CVE nvdCVE `json:"cve"`
+}
+
+type nvdCVE struct {
+	ID                string          `json:"id"`
+	SourceIdentifier  string          `json:"sourceIdentifier"`
+	Published         string          `json:"published"`
+	LastModified      string          `json:"lastModified"`
+	CVETags           []CVETag        `json:"cveTags"`
+	VendorComments    []VendorComment `json:"vendorComments"`
+	EvaluatorComment  string          `json:"evaluatorComment"`
+	EvaluatorSolution string          `json:"evaluatorSolution"`
+	EvaluatorImpact   string          `json:"evaluatorImpact"`
+	Descriptions      []struct {
+		Lang  string `json:"lang"`
+		Value string `json:"value"`
+	} `json:"descriptions"`
+	Weaknesses []nvdWeakness `json:"weaknesses"`
+	References []struct {
+		URL    string   `json:"url"`
+		Source string   `json:"source"`
+		Tags   []string `json:"tags"`
+	} `json:"references"`
+	Metrics struct {
+		CVSSMetricV31 []nvdCVSSMetric `json:"cvssMetricV31"`
+		CVSSMetricV30 []nvdCVSSMetric `json:"cvssMetricV30"`
+	} `json:"metrics"`
+	Configurations []struct {
+		Operator string    `json:"operator"`
+		Nodes    []nvdNode `json:"nodes"`
+	} `json:"configurations"`
+}
+
+type nvdWeakness struct {
+	Source      string `json:"source"`
+	Type        string `json:"type"`
+	Description []struct {
+		Value string `json:"value"`
+	} `json:"description"`
+}
+
+type nvdCVSSMetric struct {
+	Source   string `json:"source"`
+	Type     string `json:"type"`
+	CVSSData struct {
+		Version      string  `json:"version"`
+		VectorString string  `json:"vectorString"`
+		BaseScore    float64 `json:"baseScore"`
+		BaseSeverity string  `json:"baseSeverity"`
+	} `json:"cvssData"`
+}
+
+type nvdNode struct {
+	Operator string `json:"operator"`
+	Negate   bool   `json:"negate"`
+	CPEMatch []struct {
+		Vulnerable            bool   `json:"vulnerable"`
+		Criteria              string `json:"criteria"`
+		MatchCriteriaID       string `json:"matchCriteriaId"`
+		VersionStartIncluding string `json:"versionStartIncluding"`
+		VersionStartExcluding string `json:"versionStartExcluding"`
+		VersionEndIncluding   string `json:"versionEndIncluding"`
+		VersionEndExcluding   string `json:"versionEndExcluding"`
+	} `json:"cpeMatch"`
+}
+
+type nvdCPEMatchResponse struct {
+	ResultsPerPage int `json:"resultsPerPage"`
+	StartIndex     int `json:"startIndex"`
+	TotalResults   int `json:"totalResults"`
+	MatchStrings   []struct {
+		MatchString nvdMatchString `json:"matchString"`
+	} `json:"matchStrings"`
+}
+
+type nvdMatchString struct {
+	MatchCriteriaID       string `json:"matchCriteriaId"`
+	Criteria              string `json:"criteria"`
+	VersionStartIncluding string `json:"versionStartIncluding"`
+	VersionStartExcluding string `json:"versionStartExcluding"`
+	VersionEndIncluding   string `json:"versionEndIncluding"`
+	VersionEndExcluding   string `json:"versionEndExcluding"`
+	Status                string `json:"status"`
+	LastModified          string `json:"lastModified"`
+	Matches               []struct {
+		CPEName   string `json:"cpeName"`
+		CPENameID string `json:"cpeNameId"`
+	} `json:"matches"`
+}
+
+// toCVEItem converts a 2.0 API record into the 1.1 feed shape used by the
+// insert path. A configuration with several nodes (an AND of an application
+// list and a platform list) becomes a 1.1 node with children.
+func (c nvdCVE) toCVEItem() CVEItem {
+	var item CVEItem
+	item.CVE.CVEDataMeta.ID = c.ID
+	item.CVE.CVEDataMeta.Assigner = c.SourceIdentifier
+	item.PublishedDate = c.Published
+	item.LastModifiedDate = c.LastModified
+	item.CVETags = c.CVETags
+	item.VendorComments = c.VendorComments
+	item.EvaluatorComment = c.EvaluatorComment
+	item.EvaluatorSolution = c.EvaluatorSolution
+	item.EvaluatorImpact = c.EvaluatorImpact
+
+	for _, d := range c.Descriptions {
+		if d.Lang == "en" {
+			item.CVE.Description.DescriptionData = append(item.CVE.Description.DescriptionData, DescriptionData{d.Value})
+		}
+	}
+
+	weaknesses := c.Weaknesses
+	if providers, ok := mergePolicies[mergeFieldCWE]; ok {
+		// Keep only the CWEs of the most preferred provider that has any.
+		best := len(providers)
+		for _, w := range weaknesses {
+			best = min(best, mergePolicies.rank(mergeFieldCWE, w.Source, c.SourceIdentifier))
+		}
+		if best < len(providers) {
+			weaknesses = slices.DeleteFunc(slices.Clone(weaknesses), func(w nvdWeakness) bool {
+				return mergePolicies.rank(mergeFieldCWE, w.Source, c.SourceIdentifier) != best
+			})
+		}
+	}
+	for _, w := range weaknesses {
+		var pt struct {
+			Description []DescriptionData `json:"description"`
+		}
+		for _, d := range w.Description {
+			pt.Description = append(pt.Description, DescriptionData{d.Value})
+		}
+		item.CVE.ProblemType.ProblemTypeData = append(item.CVE.ProblemType.ProblemTypeData, pt)
+	}
+
+	for _, r := range c.References {
+		item.CVE.References.ReferenceData = append(item.CVE.References.ReferenceData, Reference{
+			URL:       r.URL,
+			Name:      r.URL,
+			RefSource: r.Source,
+			Tags:      r.Tags,
+		})
+	}
+
+	for _, config := range c.Configurations {
+		var node ConfigNode
+		if len(config.Nodes) == 1 && config.Operator != "AND" {
+			n := config.Nodes[0]
+			node = ConfigNode{Operator: n.Operator, Negate: n.Negate, CPEMatch: n.cpeMatches()}
+		} else {
+			node.Operator = config.Operator
+			for _, n := range config.Nodes {
+				node.Children = append(node.Children, ConfigNode{Operator: n.Operator, Negate: n.Negate, CPEMatch: n.cpeMatches()})
+			}
+		}
+		item.Configurations.Nodes = append(item.Configurations.Nodes, node)
+	}
+
+	for _, m := range append(c.Metrics.CVSSMetricV31, c.Metrics.CVSSMetricV30...) {
+		item.CVSSMetrics = append(item.CVSSMetrics, CVSSMetric{
+			Source:       m.Source,
+			Type:         m.Type,
+			Version:      m.CVSSData.Version,
+			VectorString: m.CVSSData.VectorString,
+			BaseScore:    m.CVSSData.BaseScore,
+			BaseSeverity: m.CVSSData.BaseSeverity,
+		})
+	}
+	if m := preferredCVSS(item.CVSSMetrics, c.SourceIdentifier); m != nil {
+		cvss := &item.Impact.BaseMetricV3.CVSSV3
+		cvss.Version = m.Version
+		cvss.VectorString = m.VectorString
+		cvss.BaseScore = m.BaseScore
+		cvss.BaseSeverity = m.BaseSeverity
+	}
+
+	return item
+}
+
+func (n nvdNode) cpeMatches() []CPEMatch {
+	matches := make([]CPEMatch, 0, len(n.CPEMatch))
+	for _, m := range n.CPEMatch {
+		matches = append(matches, CPEMatch{
+			CPE23URI:              m.Criteria,
+			Vulnerable:            m.Vulnerable,
+			VersionStart:          m.VersionStartIncluding,
+			VersionStartExcluding: m.VersionStartExcluding,
+			VersionEndIncluding:   m.VersionEndIncluding,
+			VersionEnd:            m.VersionEndExcluding,
+			MatchCriteriaID:       m.MatchCriteriaID,
+		})
+	}
+	return matches
+}
+
+// nvdGet fetches one page from the NVD 2.0 API into v. Requests are spaced to
+// stay within the public rate limit (5 requests per 30s, or 50 with an API
+// key in NVD_API_KEY).
+func nvdGet(endpoint string, params url.Values, v any) error {
+	apiKey := os.Getenv("NVD_API_KEY")
+	delay := 6 * time.Second
+	if apiKey != "" {
+		delay = 600 * time.Millisecond
+	}
+	time.Sleep(delay)
+
+	req, err := http.NewRequest(http.MethodGet, endpoint+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if apiKey != "" {
+		req.Header.Set("apiKey", apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to query %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to query %s: %s", endpoint, resp.Status)
+	}
+
+	if err := json.NewDecoder(progressReader{resp.Body}).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s response: %v", endpoint, err)
+	}
+	return nil
+}
+
+// dateWindows splits [since, until) into ranges the API accepts.
+func dateWindows(since, until time.Time) [][2]time.Time {
+	var windows [][2]time.Time
+	for start := since; start.Before(until); {
+		end := start.Add(nvdMaxDateRange)
+		if end.After(until) {
+			end = until
+		}
+		windows = append(windows, [2]time.Time{start, end})
+		start = end
+	}
+	return windows
+}
+
+// syncFromAPI inserts every CVE modified since the last recorded sync using
+// the NVD 2.0 CVE API, then records the new sync time.
+func syncFromAPI(db *sql.DB) error {
+	lastModified, err := readLastModified()
+	if err != nil {
+		return fmt.Errorf("no last modified date found, run backfill first: %v", err)
+	}
+	since, err := time.Parse(time.RFC3339, lastModified)
+	if err != nil {
+		return fmt.Errorf("invalid last modified date %q: %v", lastModified, err)
+	}
+	until := time.Now()
+
+	windows, first, err := resumeWindows(db, since, until)
+	if err != nil {
+		return err
+	}
+	for i, window := range windows {
+		params := url.Values{
+			"lastModStartDate": {window[0].UTC().Format(nvdTimeParamLayout)},
+			"lastModEndDate":   {window[1].UTC().Format(nvdTimeParamLayout)},
+			"resultsPerPage":   {strconv.Itoa(nvdPageSize)},
+		}
+		startIndex := 0
+		if i == 0 {
+			startIndex = first
+		}
+		for {
+			params.Set("startIndex", strconv.Itoa(startIndex))
+			var page nvdCVEResponse
+			if err := nvdGet(nvdCVEAPIURL, params, &page); err != nil {
+				return err
+			}
+
+			vulns, parseErrs := decodeRecords(nvdCVEAPIURL, startIndex, page.Vulnerabilities, func(v nvdVulnerability) string { return v.CVE.ID })
+			if err := recordParseErrors(db, parseErrs); err != nil {
+				return err
+			}
+			items := make([]CVEItem, 0, len(vulns))
+			for _, v := range vulns {
+				items = append(items, v.CVE.toCVEItem())
+			}
+			cp := checkpoint{Source: sourceNVDAPI, Position: formatWindow(window), Offset: startIndex + len(page.Vulnerabilities)}
+			if len(items) > 0 {
+				cp.LastCVEID = items[len(items)-1].CVE.CVEDataMeta.ID
+			}
+			if err := insertCheckpointedBatch(db, items, startIndex, &cp); err != nil {
+				return fmt.Errorf("failed to update data: %v", err)
+			}
+			log.Printf("Committed CVEs %d-%d of %d modified between %s and %s\n",
+				startIndex+1, startIndex+len(items), page.TotalResults, window[0].Format(time.RFC3339), window[1].Format(time.RFC3339))
+
+			startIndex += len(page.Vulnerabilities)
+			if len(page.Vulnerabilities) == 0 || startIndex >= page.TotalResults {
+				break
+			}
+		}
+	}
+
+	if err := saveLastModified(until.Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("failed to save last modified date: %v", err)
+	}
+	return clearCheckpoint(db, sourceNVDAPI)
+}
+
+// formatWindow is how a date window is recorded as a checkpoint position.
+func formatWindow(w [2]time.Time) string {
+	return w[0].UTC().Format(time.RFC3339Nano) + "/" + w[1].UTC().Format(time.RFC3339Nano)
+}
+
+// resumeWindows returns the date windows an API sync of [since, until) still
+// has to page through and the start index within the first one. A sync that
+// crashed resumes in the window and at the page its checkpoint names; the
+// last modified date is only saved at the end, so since has not moved.
+func resumeWindows(db *sql.DB, since, until time.Time) ([][2]time.Time, int, error) {
+	cp, ok, err := readCheckpoint(db, sourceNVDAPI)
+	if err != nil || !ok {
+		return dateWindows(since, until), 0, err
+	}
+	start, end, found := strings.Cut(cp.Position, "/")
+	if !found {
+		return dateWindows(since, until), 0, nil
+	}
+	var w [2]time.Time
+	var err0, err1 error
+	w[0], err0 = time.Parse(time.RFC3339Nano, start)
+	w[1], err1 = time.Parse(time.RFC3339Nano, end)
+	if err0 != nil || err1 != nil || w[0].Before(since) || !w[1].After(w[0]) || w[1].After(until) {
+		return dateWindows(since, until), 0, nil
+	}
+	log.Printf("Resuming API sync at index %d of the window %s\n", cp.Offset, cp.Position)
+	return append([][2]time.Time{w}, dateWindows(w[1], until)...), cp.Offset, nil
+}
+
+// syncCPEMatch mirrors the NVD match criteria (the concrete CPE names each
+// matchCriteriaId resolves to) into match_criteria and match_criteria_names.
+// The first run loads everything; later runs fetch only modified criteria.
+func syncCPEMatch(db *sql.DB) error {
+	var windows [][2]time.Time
+	until := time.Now()
+	if data, err := os.ReadFile(cpeMatchLastModifiedFile); err == nil {
+		since, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("invalid match criteria last modified date: %v", err)
+		}
+		windows = dateWindows(since, until)
+	} else {
+		log.Println("No match criteria sync recorded, loading all match criteria...")
+		windows = [][2]time.Time{{}}
+	}
+
+	for _, window := range windows {
+		params := url.Values{"resultsPerPage": {"500"}}
+		if !window[0].IsZero() {
+			params.Set("lastModStartDate", window[0].UTC().Format(nvdTimeParamLayout))
+			params.Set("lastModEndDate", window[1].UTC().Format(nvdTimeParamLayout))
+		}
+		for startIndex := 0; ; {
+			params.Set("startIndex", strconv.Itoa(startIndex))
+			var page nvdCPEMatchResponse
+			if err := nvdGet(nvdCPEMatchAPIURL, params, &page); err != nil {
+				return err
+			}
+			if err := insertMatchCriteria(db, page); err != nil {
+				return err
+			}
+
+			startIndex += len(page.MatchStrings)
+			if len(page.MatchStrings) == 0 || startIndex >= page.TotalResults {
+				break
+			}
+		}
+	}
+
+	return os.WriteFile(cpeMatchLastModifiedFile, []byte(until.Format(time.RFC3339)), 0644)
+}
+
+func insertMatchCriteria(db *sql.DB, page nvdCPEMatchResponse) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if err := setProvenance(tx, datasetNVD); err != nil {
+		return err
+	}
+
+	for _, ms := range page.MatchStrings {
+		m := ms.MatchString
+		_, err := tx.Exec(`INSERT INTO match_criteria (match_criteria_id, criteria, version_start_including, version_start_excluding,
+						       version_end_including, version_end_excluding, status, last_modified, source_record_id)
+						   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $1)
+						   ON CONFLICT (match_criteria_id) DO UPDATE
+						   SET criteria = EXCLUDED.criteria,
+							   version_start_including = EXCLUDED.version_start_including,
+							   version_start_excluding = EXCLUDED.version_start_excluding,
+							   version_end_including = EXCLUDED.version_end_including,
+							   version_end_excluding = EXCLUDED.version_end_excluding,
+							   status = EXCLUDED.status,
+							   last_modified = EXCLUDED.last_modified,
+							   source = EXCLUDED.source,
+							   source_record_id = EXCLUDED.source_record_id,
+							   ingested_at = EXCLUDED.ingested_at,
+							   run_id = EXCLUDED.run_id;`,
+			m.MatchCriteriaID, m.Criteria, m.VersionStartIncluding, m.VersionStartExcluding,
+			m.VersionEndIncluding, m.VersionEndExcluding, m.Status, m.LastModified)
+		if err != nil {
+			return fmt.Errorf("failed to insert match criteria %s: %v", m.MatchCriteriaID, err)
+		}
+
+		if _, err := tx.Exec(`DELETE FROM match_criteria_names WHERE match_criteria_id = $1`, m.MatchCriteriaID); err != nil {
+			return fmt.Errorf("failed to delete names for match criteria %s: %v", m.MatchCriteriaID, err)
+		}
+		for _, name := range m.Matches {
+			_, err := tx.Exec(`INSERT INTO match_criteria_names (match_criteria_id, cpe_name, cpe_name_id, source_record_id)
+							   VALUES ($1, $2, $3, $1)
+							   ON CONFLICT DO NOTHING;`,
+				m.MatchCriteriaID, name.CPEName, name.CPENameID)
+			if err != nil {
+				return fmt.Errorf("failed to insert name for match criteria %s: %v", m.MatchCriteriaID, err)
+			}
+		}
+		if *expandCPENames {
+			if err := expandMatchCriteriaNames(tx, m.MatchCriteriaID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nvdCVEHistoryAPIURL        = "https://services.nvd.nist.gov/rest/json/cvehistory/2.0"
+	cveHistoryLastModifiedFile = "cvehistory_last_modified.txt"
+)
+
+type nvdCVEHistoryResponse struct {
+	TotalResults int `json:"totalResults"`
+	CVEChanges   []struct {
+		Change nvdCVEChange `json:"change"`
+	} `json:"cveChanges"`
+}
+
+type nvdCVEChange struct {
+	CVEID            string            `json:"cveId"`
+	EventName        string            `json:"eventName"`
+	CVEChangeID      string            `json:"cveChangeId"`
+	SourceIdentifier string            `json:"sourceIdentifier"`
+	Created          string            `json:"created"`
+	Details          []nvdChangeDetail `json:"details"`
+}
+
+type nvdChangeDetail struct {
+	Action   string `json:"action,omitempty"`
+	Type     string `json:"type"`
+	OldValue string `json:"oldValue,omitempty"`
+	NewValue string `json:"newValue,omitempty"`
+}
+
+// NVDChange is one event of NVD's change history for a CVE.
+type NVDChange struct {
+	ChangeID         string            `json:"change_id"`
+	EventName        string            `json:"event_name"`
+	SourceIdentifier string            `json:"source_identifier"`
+	Created          time.Time         `json:"created"`
+	Details          []nvdChangeDetail `json:"details"`
+}
+
+// syncCVEHistory copies NVD's change events since the last run into
+// cve_nvd_history. Without a recorded run it starts one API date range back,
+// as the full history goes back to 1999.
+func syncCVEHistory(db *sql.DB) error {
+	until := time.Now()
+	since := until.Add(-nvdMaxDateRange)
+	if data, err := os.ReadFile(cveHistoryLastModifiedFile); err == nil {
+		since, err = time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("invalid CVE history last modified date: %v", err)
+		}
+	}
+
+	for _, window := range dateWindows(since, until) {
+		params := url.Values{
+			"changeStartDate": {window[0].UTC().Format(nvdTimeParamLayout)},
+			"changeEndDate":   {window[1].UTC().Format(nvdTimeParamLayout)},
+			"resultsPerPage":  {"5000"},
+		}
+		for startIndex := 0; ; {
+			params.Set("startIndex", strconv.Itoa(startIndex))
+			var page nvdCVEHistoryResponse
+			if err := nvdGet(nvdCVEHistoryAPIURL, params, &page); err != nil {
+				return err
+			}
+			if err := insertCVEChanges(db, page); err != nil {
+				return err
+			}
+
+			startIndex += len(page.CVEChanges)
+			if len(page.CVEChanges) == 0 || startIndex >= page.TotalResults {
+				break
+			}
+		}
+	}
+
+	return os.WriteFile(cveHistoryLastModifiedFile, []byte(until.Format(time.RFC3339)), 0644)
+}
+
+func insertCVEChanges(db *sql.DB, page nvdCVEHistoryResponse) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, c := range page.CVEChanges {
+		ch := c.Change
+		cveID, ok := normalizeCVEID(ch.CVEID)
+		if !ok {
+			log.Printf("Skipping change %s with malformed CVE ID %q\n", ch.CVEChangeID, ch.CVEID)
+			continue
+		}
+		details, err := json.Marshal(ch.Details)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO cve_nvd_history (cve_change_id, cve_id, event_name, source_identifier, created, details)
+						  VALUES ($1, $2, $3, $4, $5, $6)
+						  ON CONFLICT (cve_change_id) DO NOTHING;`,
+			ch.CVEChangeID, cveID, ch.EventName, ch.SourceIdentifier, ch.Created, string(details))
+		if err != nil {
+			return fmt.Errorf("failed to insert change %s for CVE ID %s: %v", ch.CVEChangeID, cveID, err)
+		}
+	}
+
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	if len(page.CVEChanges) > 0 {
+		log.Printf("Stored %d NVD change events\n", len(page.CVEChanges))
+	}
+	return nil
+}
+
+// getNVDChanges returns NVD's change events for a CVE, oldest first.
+func getNVDChanges(db *sql.DB, cveID string) ([]NVDChange, error) {
+	rows, err := db.Query(`SELECT cve_change_id, COALESCE(event_name, ''), COALESCE(source_identifier, ''), created, details
+						   FROM cve_nvd_history WHERE cve_id = $1 ORDER BY created, cve_change_id`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load NVD change history: %v", err)
+	}
+	defer rows.Close()
+
+	changes := []NVDChange{}
+	for rows.Next() {
+		var c NVDChange
+		var details []byte
+		if err := rows.Scan(&c.ChangeID, &c.EventName, &c.SourceIdentifier, &c.Created, &details); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(details, &c.Details); err != nil {
+			return nil, fmt.Errorf("failed to decode change %s: %v", c.ChangeID, err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
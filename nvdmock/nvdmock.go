@@ -0,0 +1,86 @@
+// Package nvdmock serves bundled NVD 1.1 JSON feeds under NVD's paths, so
+// ingestion can be exercised end to end without internet access. It backs the
+// devserver command and can be used from tests:
+//
+//	srv := nvdmock.NewServer()
+//	defer srv.Close()
+//	feedURL := srv.URL + nvdmock.FeedPath
+package nvdmock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+)
+
+// FeedPath is where the feeds are served, like https://nvd.nist.gov/feeds/json/cve.
+const FeedPath = "/feeds/json/cve"
+
+// LastModified is the lastModifiedDate of every .meta file.
+const LastModified = "2025-03-05T13:00:00-05:00"
+
+// The fixtures hold a few CVEs of 2023 to 2025 (including an AND
+// configuration and a rejected CVE) and a modified feed updating two of them.
+// Other years are served as empty feeds.
+//
+//go:embed fixtures/*.json
+var fixtures embed.FS
+
+var (
+	yearFeed     = regexp.MustCompile(`^/1\.1/nvdcve-1\.1-(\d{4})\.(json\.gz|meta)$`)
+	modifiedFeed = regexp.MustCompile(`^/1\.1-modified\.json\.gz(\.meta)?$`)
+)
+
+// Handler serves the year feeds at FeedPath/1.1/nvdcve-1.1-<year>.json.gz
+// with their .meta files, and the modified feed at
+// FeedPath/1.1-modified.json.gz and FeedPath/1.1-modified.json.gz.meta.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := strings.CutPrefix(r.URL.Path, FeedPath)
+		if !ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			http.NotFound(w, r)
+			return
+		}
+		var name string
+		var meta bool
+		if m := yearFeed.FindStringSubmatch(path); m != nil {
+			name, meta = m[1], m[2] == "meta"
+		} else if m := modifiedFeed.FindStringSubmatch(path); m != nil {
+			name, meta = "modified", m[1] != ""
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := fixtures.ReadFile("fixtures/nvdcve-1.1-" + name + ".json")
+		if err != nil {
+			data = []byte(`{"CVE_data_type":"CVE","CVE_data_format":"MITRE","CVE_data_version":"4.0","CVE_data_numberOfCVEs":"0","CVE_Items":[]}`)
+		}
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		zw.Write(data)
+		zw.Close()
+
+		if meta {
+			sum := sha256.Sum256(data)
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "lastModifiedDate:%s\r\nsize:%d\r\ngzSize:%d\r\nsha256:%s\r\n",
+				LastModified, len(data), gz.Len(), strings.ToUpper(hex.EncodeToString(sum[:])))
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Write(gz.Bytes())
+	})
+}
+
+// NewServer starts a server for Handler on a local port. Callers close it.
+func NewServer() *httptest.Server {
+	return httptest.NewServer(Handler())
+}
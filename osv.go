@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const osvSchemaVersion = "1.6.0"
+
+// OSVRecord is a CVE in the OSV schema (https://ossf.github.io/osv-schema/).
+type OSVRecord struct {
+	SchemaVersion    string         `json:"schema_version"`
+	ID               string         `json:"id"`
+	Modified         string         `json:"modified"`
+	Published        string         `json:"published,omitempty"`
+	Details          string         `json:"details"`
+	Severity         []OSVSeverity  `json:"severity,omitempty"`
+	Affected         []OSVAffected  `json:"affected,omitempty"`
+	References       []OSVReference `json:"references,omitempty"`
+	DatabaseSpecific map[string]any `json:"database_specific,omitempty"`
+}
+
+type OSVSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+// OSVAffected is one vulnerable CPE. NVD names no package ecosystem, so the
+// CPE is given in database_specific and the range events are plain versions.
+type OSVAffected struct {
+	Ranges           []OSVRange     `json:"ranges,omitempty"`
+	Versions         []string       `json:"versions,omitempty"`
+	DatabaseSpecific map[string]any `json:"database_specific"`
+}
+
+type OSVRange struct {
+	Type   string           `json:"type"`
+	Events []map[string]any `json:"events"`
+}
+
+type OSVReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+// getOSVRecord renders a stored CVE as an OSV record. It returns
+// sql.ErrNoRows if the CVE is unknown.
+func getOSVRecord(db *sql.DB, tenant, cveID string) (*OSVRecord, error) {
+	r, err := getCVE(db, tenant, cveID)
+	if err != nil {
+		return nil, err
+	}
+	osv := &OSVRecord{
+		SchemaVersion: osvSchemaVersion,
+		ID:            r.ID,
+		Modified:      r.LastModifiedDate,
+		Published:     r.PublishedDate,
+		Details:       r.Description,
+	}
+	if r.CVSS != nil && r.CVSS.VectorString != "" {
+		osv.Severity = []OSVSeverity{{Type: "CVSS_V3", Score: r.CVSS.VectorString}}
+	}
+	for _, a := range r.Advisories {
+		osv.References = append(osv.References, OSVReference{Type: "ADVISORY", URL: a.URL})
+	}
+	osv.DatabaseSpecific = map[string]any{}
+	if len(r.CWEs) > 0 {
+		osv.DatabaseSpecific["cwe_ids"] = r.CWEs
+	}
+	if r.CVSS != nil {
+		osv.DatabaseSpecific["severity"] = r.CVSS.BaseSeverity
+	}
+
+	rows, err := db.Query(`SELECT cpe_uri, COALESCE(version_start, ''), COALESCE(version_end, ''), version_end_including
+						   FROM cpe_data WHERE cve_id = $1 AND vulnerable ORDER BY cpe_uri, version_start, version_end`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CPEs: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cpeURI, versionStart, versionEnd string
+		var endIncluding bool
+		if err := rows.Scan(&cpeURI, &versionStart, &versionEnd, &endIncluding); err != nil {
+			return nil, err
+		}
+		osv.Affected = append(osv.Affected, osvAffected(cpeURI, versionStart, versionEnd, endIncluding))
+	}
+	return osv, rows.Err()
+}
+
+// osvAffected maps a vulnerable CPE row: an exact version in the CPE name
+// becomes a version, a range becomes introduced and fixed (or, for an
+// inclusive end, last_affected) events. OSV has no exclusive introduced
+// event, so an exclusive start is given as introduced.
+func osvAffected(cpeURI, versionStart, versionEnd string, endIncluding bool) OSVAffected {
+	a := OSVAffected{DatabaseSpecific: map[string]any{"cpe": cpeURI}}
+	if v := cpeVersion(cpeURI); v != "" {
+		a.Versions = []string{v}
+		return a
+	}
+	introduced := versionStart
+	if introduced == "" {
+		introduced = "0"
+	}
+	events := []map[string]any{{"introduced": introduced}}
+	if versionEnd != "" && endIncluding {
+		events = append(events, map[string]any{"last_affected": versionEnd})
+	} else if versionEnd != "" {
+		events = append(events, map[string]any{"fixed": versionEnd})
+	}
+	a.Ranges = []OSVRange{{Type: "ECOSYSTEM", Events: events}}
+	return a
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	opsgenieAlertsURL  = "https://api.opsgenie.com/v2/alerts"
+)
+
+var (
+	pager         = flag.String("pager", "", "page on-call through pagerduty or opsgenie (key from PAGERDUTY_ROUTING_KEY or OPSGENIE_API_KEY; disabled if empty)")
+	pageRulesFile = flag.String("page-rules", "", "JSON file of paging rules (default: CRITICAL and KEV-listed)")
+	pageMaxAge    = flag.Duration("page-max-age", 72*time.Hour, "only page for CVEs published or added to KEV within this window")
+)
+
+// pageRules is loaded from -page-rules at startup when -pager is set.
+var pageRules []PageRule
+
+var defaultPageRule = PageRule{Name: "critical-kev", Tenant: defaultTenant, Severity: "CRITICAL", KEV: true}
+
+// PageRule selects CVEs that page on-call. All set conditions must hold.
+// Alerts raised by a rule belong to its tenant.
+type PageRule struct {
+	Name      string  `json:"name"`
+	Tenant    string  `json:"tenant"`
+	Severity  string  `json:"severity"`
+	MinCVSS   float64 `json:"min_cvss"`
+	KEV       bool    `json:"kev"`
+	MinEPSS   float64 `json:"min_epss"`
+	CPEPrefix string  `json:"cpe_prefix"`
+}
+
+func pagerEnabled() bool {
+	return *pager != ""
+}
+
+func loadPageRules(path string) ([]PageRule, error) {
+	if path == "" {
+		return []PageRule{defaultPageRule}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page rules: %v", err)
+	}
+	var rules []PageRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse page rules: %v", err)
+	}
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("page rule %d has no name", i)
+		}
+		if r.Tenant == "" {
+			rules[i].Tenant = defaultTenant
+		}
+	}
+	return rules, nil
+}
+
+// pageMatch is a CVE selected by a paging rule. Recent is false for CVEs that
+// were published and added to KEV outside -page-max-age; those keep an
+// existing page open but never trigger a new one. Suppressed CVEs never page
+// and their open alerts are closed as suppressed. For an internal advisory,
+// CVEID is the advisory ID and Description its title.
+type pageMatch struct {
+	Tenant      string
+	CVEID       string
+	Rule        string
+	Description string
+	Severity    string
+	Score       float64
+	Recent      bool
+	Suppressed  bool
+	Internal    bool
+}
+
+func matchPageRule(db *sql.DB, rule PageRule) ([]pageMatch, error) {
+	since := time.Now().Add(-*pageMaxAge).Format("2006-01-02")
+	rows, err := db.Query(`SELECT c.cve_id, c.description, COALESCE(i.cvss_base_severity, ''), COALESCE(i.cvss_base_score, 0),
+							   c.published_date >= $6::date OR COALESCE(k.date_added >= $6::date, false),
+							   `+suppressedCVE("$7", "c.cve_id")+`
+						   FROM cve_data1 c
+						   LEFT JOIN impact_data i ON i.cve_id = c.cve_id
+						   LEFT JOIN kev k ON k.cve_id = c.cve_id
+						   LEFT JOIN epss e ON e.cve_id = c.cve_id
+						   WHERE c.description NOT LIKE '** REJECT **%'
+						   AND ($1 = '' OR upper(i.cvss_base_severity) = upper($1))
+						   AND COALESCE(i.cvss_base_score, 0) >= $2::numeric
+						   AND (NOT $3::boolean OR k.cve_id IS NOT NULL)
+						   AND COALESCE(e.score, 0) >= $4::numeric
+						   AND ($5 = '' OR EXISTS (
+							   SELECT 1 FROM cpe_data p
+							   WHERE p.cve_id = c.cve_id AND p.vulnerable AND starts_with(p.cpe_uri, $5)))`,
+		rule.Severity, rule.MinCVSS, rule.KEV, rule.MinEPSS, rule.CPEPrefix, since, rule.Tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate page rule %s: %v", rule.Name, err)
+	}
+	defer rows.Close()
+
+	var matches []pageMatch
+	for rows.Next() {
+		m := pageMatch{Tenant: rule.Tenant, Rule: rule.Name}
+		if err := rows.Scan(&m.CVEID, &m.Description, &m.Severity, &m.Score, &m.Recent, &m.Suppressed); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	internal, err := matchInternalPageRule(db, rule, since)
+	if err != nil {
+		return nil, err
+	}
+	return append(matches, internal...), nil
+}
+
+// syncPages opens an alert for every recent CVE matching a rule that has
+// never been alerted, suppresses open or acknowledged alerts covered by a
+// suppression rule, and resolves those whose CVE no longer matches any rule,
+// e.g. because it was rejected or its product left the watchlist.
+func syncPages(db *sql.DB) error {
+	matched := map[[2]string]pageMatch{}
+	for _, rule := range pageRules {
+		matches, err := matchPageRule(db, rule)
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			key := [2]string{m.Tenant, m.CVEID}
+			if prev, ok := matched[key]; !ok || (m.Recent && !prev.Recent) {
+				matched[key] = m
+			}
+		}
+	}
+
+	for _, m := range matched {
+		if !m.Recent || m.Suppressed {
+			continue
+		}
+		if err := openAlert(db, m); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query(`SELECT tenant, cve_id FROM alerts WHERE status IN ($1, $2)`, alertOpen, alertAcknowledged)
+	if err != nil {
+		return fmt.Errorf("failed to list open alerts: %v", err)
+	}
+	var stale, suppressed [][2]string
+	for rows.Next() {
+		var key [2]string
+		if err := rows.Scan(&key[0], &key[1]); err != nil {
+			rows.Close()
+			return err
+		}
+		if m, ok := matched[key]; !ok {
+			stale = append(stale, key)
+		} else if m.Suppressed {
+			suppressed = append(suppressed, key)
+		}
+	}
+	rows.Close()
+
+	for _, key := range stale {
+		if err := transitionAlert(db, key[0], key[1], alertResolved, "sync", "no longer matches a paging rule"); err != nil {
+			return err
+		}
+		log.Printf("Resolved alert for %s (tenant %s)\n", key[1], key[0])
+	}
+	for _, key := range suppressed {
+		if err := transitionAlert(db, key[0], key[1], alertSuppressed, "sync", "covered by a suppression rule"); err != nil {
+			return err
+		}
+		log.Printf("Suppressed alert for %s (tenant %s)\n", key[1], key[0])
+	}
+	return nil
+}
+
+// loadPageMatch loads the details a page needs for an existing alert.
+func loadPageMatch(tx *sql.Tx, tenant, cveID, rule string) (pageMatch, error) {
+	m := pageMatch{Tenant: tenant, CVEID: cveID, Rule: rule}
+	err := tx.QueryRow(`SELECT COALESCE(c.description, ''), COALESCE(i.cvss_base_severity, ''), COALESCE(i.cvss_base_score, 0)
+						FROM cve_data1 c LEFT JOIN impact_data i ON i.cve_id = c.cve_id
+						WHERE c.cve_id = $1`, cveID).Scan(&m.Description, &m.Severity, &m.Score)
+	if err == sql.ErrNoRows {
+		m.Internal = true
+		err = tx.QueryRow(`SELECT title, severity, COALESCE(base_score, 0) FROM internal_advisories WHERE tenant = $1 AND id = $2`,
+			tenant, cveID).Scan(&m.Description, &m.Severity, &m.Score)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return m, fmt.Errorf("failed to load %s for paging: %v", cveID, err)
+	}
+	return m, nil
+}
+
+// sendPage triggers, acknowledges or resolves the page for a CVE. The CVE ID,
+// prefixed by the tenant outside the default tenant, is used as the dedup key
+// (PagerDuty) or alias (Opsgenie), so repeated triggers collapse into one
+// incident.
+func sendPage(action string, m pageMatch) error {
+	dedupKey := m.CVEID
+	summary := fmt.Sprintf("%s: %s %.1f, rule %s", m.CVEID, m.Severity, m.Score, m.Rule)
+	details := map[string]string{"description": m.Description, "nvd": "https://nvd.nist.gov/vuln/detail/" + m.CVEID}
+	if m.Internal {
+		details = map[string]string{"description": m.Description, "source": "internal advisory"}
+	}
+	if m.Tenant != defaultTenant {
+		dedupKey = m.Tenant + "-" + m.CVEID
+		summary = "[" + m.Tenant + "] " + summary
+	}
+
+	switch *pager {
+	case "pagerduty":
+		event := map[string]any{
+			"routing_key":  os.Getenv("PAGERDUTY_ROUTING_KEY"),
+			"event_action": action,
+			"dedup_key":    dedupKey,
+		}
+		if action == "trigger" {
+			event["payload"] = map[string]any{
+				"summary":        summary,
+				"source":         "cve-download-update",
+				"severity":       "critical",
+				"custom_details": details,
+			}
+		}
+		return postPage(pagerDutyEventsURL, "", event)
+	case "opsgenie":
+		auth := "GenieKey " + os.Getenv("OPSGENIE_API_KEY")
+		switch action {
+		case "acknowledge":
+			return postPage(opsgenieAlertsURL+"/"+dedupKey+"/acknowledge?identifierType=alias", auth, map[string]string{})
+		case "resolve":
+			return postPage(opsgenieAlertsURL+"/"+dedupKey+"/close?identifierType=alias", auth, map[string]string{})
+		}
+		return postPage(opsgenieAlertsURL, auth, map[string]any{
+			"message":     summary,
+			"alias":       dedupKey,
+			"description": m.Description,
+			"priority":    "P1",
+			"details":     details,
+		})
+	}
+	return fmt.Errorf("unknown pager %q", *pager)
+}
+
+func postPage(url, auth string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send %s page: %v", *pager, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to send %s page: %s", *pager, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// maxFragmentSize caps the JSON kept for a record that failed to decode.
+const maxFragmentSize = 64 << 10
+
+// parseError is a record of a feed or API page that could not be decoded.
+type parseError struct {
+	source   string
+	index    int
+	cveID    string
+	err      error
+	fragment []byte
+}
+
+// decodeRecords decodes each record on its own, so a malformed record is set
+// aside instead of failing the whole feed. offset is the index of the first
+// record within source; cveID extracts whatever ID a partial decode found.
+func decodeRecords[T any](source string, offset int, raw []json.RawMessage, cveID func(T) string) ([]T, []parseError) {
+	records := make([]T, 0, len(raw))
+	var errs []parseError
+	for i, r := range raw {
+		var record T
+		if err := json.Unmarshal(r, &record); err != nil {
+			errs = append(errs, parseError{source: source, index: offset + i, cveID: cveID(record), err: err, fragment: r})
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, errs
+}
+
+// recordParseErrors stores errs in parse_errors and counts them in the sync
+// progress.
+func recordParseErrors(db *sql.DB, errs []parseError) error {
+	for _, e := range errs {
+		log.Printf("Skipping malformed record %d of %s (CVE ID %q): %v\n", e.index, e.source, e.cveID, e.err)
+		fragment := e.fragment
+		if len(fragment) > maxFragmentSize {
+			fragment = fragment[:maxFragmentSize]
+		}
+		_, err := db.Exec(`INSERT INTO parse_errors (source, item_index, cve_id, error, fragment) VALUES ($1, $2, $3, $4, $5)`,
+			e.source, e.index, e.cveID, e.err.Error(), string(fragment))
+		if err != nil {
+			return fmt.Errorf("failed to record parse error: %v", err)
+		}
+		syncProgress.addParseError()
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const progressLogInterval = 30 * time.Second
+
+// syncProgress tracks the sync currently in progress so it can be reported in
+// the log and on the status endpoint.
+var syncProgress progressTracker
+
+type progressTracker struct {
+	mu        sync.Mutex
+	running   bool
+	kind      string
+	started   time.Time
+	yearFrom  int
+	yearTo    int
+	year      int
+	yearsDone int
+	bytes     int64
+	cves      int
+	feedItems int
+	feedDone  int
+	parseErrs int
+}
+
+// ProgressStatus is a point-in-time snapshot of the running sync.
+type ProgressStatus struct {
+	Running         bool       `json:"running"`
+	Kind            string     `json:"kind,omitempty"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	Year            int        `json:"year,omitempty"`
+	YearsDone       int        `json:"years_done"`
+	YearsTotal      int        `json:"years_total"`
+	BytesDownloaded int64      `json:"bytes_downloaded"`
+	CVEsProcessed   int        `json:"cves_processed"`
+	ParseErrors     int        `json:"parse_errors"`
+	ETASeconds      int64      `json:"eta_seconds,omitempty"`
+}
+
+// start begins tracking a sync. yearFrom and yearTo are zero for syncs that
+// are not year based, which have no ETA.
+func (p *progressTracker) start(kind string, yearFrom, yearTo int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running, p.kind, p.started = true, kind, time.Now()
+	p.yearFrom, p.yearTo, p.year, p.yearsDone = yearFrom, yearTo, 0, 0
+	p.bytes, p.cves, p.feedItems, p.feedDone, p.parseErrs = 0, 0, 0, 0, 0
+}
+
+func (p *progressTracker) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running = false
+}
+
+func (p *progressTracker) startYear(year int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.year = year
+	p.feedItems, p.feedDone = 0, 0
+}
+
+func (p *progressTracker) finishYear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.yearsDone++
+	p.feedItems, p.feedDone = 0, 0
+}
+
+func (p *progressTracker) addBytes(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytes += int64(n)
+}
+
+func (p *progressTracker) setFeedItems(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.feedItems = n
+}
+
+func (p *progressTracker) itemDone() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cves++
+	p.feedDone++
+}
+
+func (p *progressTracker) addParseError() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.parseErrs++
+}
+
+// logPeriodically logs a progress line every progressLogInterval until done
+// is closed.
+func (p *progressTracker) logPeriodically(done <-chan struct{}) {
+	ticker := time.NewTicker(progressLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			log.Println(p.snapshot())
+		}
+	}
+}
+
+func (p *progressTracker) snapshot() ProgressStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := ProgressStatus{
+		Running:         p.running,
+		Kind:            p.kind,
+		Year:            p.year,
+		YearsDone:       p.yearsDone,
+		BytesDownloaded: p.bytes,
+		CVEsProcessed:   p.cves,
+		ParseErrors:     p.parseErrs,
+	}
+	if !p.started.IsZero() {
+		started := p.started
+		s.StartedAt = &started
+	}
+	if p.yearTo >= p.yearFrom && p.yearFrom > 0 {
+		s.YearsTotal = p.yearTo - p.yearFrom + 1
+	}
+	if p.running && s.YearsTotal > 0 {
+		done := float64(p.yearsDone)
+		if p.feedItems > 0 {
+			done += float64(p.feedDone) / float64(p.feedItems)
+		}
+		if fraction := done / float64(s.YearsTotal); fraction > 0 {
+			elapsed := time.Since(p.started)
+			s.ETASeconds = int64(elapsed.Seconds() * (1 - fraction) / fraction)
+		}
+	}
+	return s
+}
+
+func (s ProgressStatus) String() string {
+	msg := fmt.Sprintf("%s progress: %.1f MB downloaded, %d CVEs processed", s.Kind, float64(s.BytesDownloaded)/1e6, s.CVEsProcessed)
+	if s.ParseErrors > 0 {
+		msg += fmt.Sprintf(", %d malformed records skipped", s.ParseErrors)
+	}
+	if s.YearsTotal > 0 {
+		msg += fmt.Sprintf(", year %d (%d/%d years done)", s.Year, s.YearsDone, s.YearsTotal)
+	}
+	if s.ETASeconds > 0 {
+		msg += fmt.Sprintf(", ETA %v", time.Duration(s.ETASeconds)*time.Second)
+	}
+	return msg
+}
+
+// progressReader counts bytes read from a download.
+type progressReader struct {
+	r io.Reader
+}
+
+func (pr progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	syncProgress.addBytes(n)
+	return n, err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sources of the stored rows, recorded in their source column. The NVD rows
+// name the way they were fetched (see configuredNVDSource).
+const (
+	sourceNVDFeeds   = "nvd-feeds"
+	sourceNVDAPI     = "nvd-api"
+	sourceMirror     = "mirror"
+	sourceSeed       = "seed"
+	sourceLoadgen    = "loadgen"
+	sourceExploitDB  = "exploit-db"
+	sourceMetasploit = "metasploit"
+	sourceKEV        = "cisa-kev"
+	sourceEPSS       = "first-epss"
+	sourceCAPEC      = "mitre-capec"
+	sourceCWE        = "mitre-cwe"
+)
+
+// datasetNVD is the dataset of the CVE records and match criteria, whatever
+// their source. Every other dataset has a single source and is named by it.
+const datasetNVD = "nvd"
+
+// configuredNVDSource is the source -source fetches NVD data from.
+func configuredNVDSource() string {
+	switch *source {
+	case "api":
+		return sourceNVDAPI
+	case "mirror":
+		return sourceMirror
+	}
+	return sourceNVDFeeds
+}
+
+// syncRun is a sync recorded in sync_runs. The rows written while it is the
+// active run of its dataset carry its id and source.
+type syncRun struct {
+	ID      int64     `json:"id"`
+	Kind    string    `json:"kind"`
+	Source  string    `json:"source"`
+	Started time.Time `json:"started_at"`
+	// Finished, Status and Error are only set when the run is loaded from
+	// sync_runs.
+	Finished *time.Time `json:"finished_at,omitempty"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+
+	dataset string
+}
+
+// activeRuns maps a dataset to the *syncRun currently writing it.
+var activeRuns sync.Map
+
+// beginSyncRun records the start of a sync of dataset from source and makes it
+// the dataset's active run. If the run cannot be recorded the sync still goes
+// ahead, and its rows only carry their source; the returned nil run is safe to
+// finish.
+func beginSyncRun(db *sql.DB, kind, dataset, source string) *syncRun {
+	run := &syncRun{Kind: kind, Source: source, Status: "running", dataset: dataset}
+	err := db.QueryRow(`INSERT INTO sync_runs (kind, source) VALUES ($1, $2) RETURNING id, started_at`, kind, source).
+		Scan(&run.ID, &run.Started)
+	if err != nil {
+		log.Printf("Failed to record the %s run of %s: %v\n", kind, source, err)
+		return nil
+	}
+	activeRuns.Store(dataset, run)
+	return run
+}
+
+// finish records the outcome of the run and ends it as the active run.
+func (run *syncRun) finish(db *sql.DB, syncErr error) {
+	if run == nil {
+		return
+	}
+	activeRuns.CompareAndDelete(run.dataset, run)
+	status, message := "succeeded", ""
+	if syncErr != nil {
+		status, message = "failed", syncErr.Error()
+	}
+	_, err := db.Exec(`UPDATE sync_runs SET finished_at = now(), status = $2, error = NULLIF($3, '') WHERE id = $1`,
+		run.ID, status, message)
+	if err != nil {
+		log.Printf("Failed to record the end of run %d: %v\n", run.ID, err)
+	}
+}
+
+// activeRun returns the run currently writing dataset, or nil.
+func activeRun(dataset string) *syncRun {
+	if v, ok := activeRuns.Load(dataset); ok {
+		return v.(*syncRun)
+	}
+	return nil
+}
+
+// setProvenance sets the settings the provenance columns default to for the
+// rest of tx: the source and run id of the dataset's active run, or the
+// dataset name alone when no run is active.
+func setProvenance(tx *sql.Tx, dataset string) error {
+	source, runID := dataset, ""
+	if run := activeRun(dataset); run != nil {
+		source, runID = run.Source, strconv.FormatInt(run.ID, 10)
+	}
+	_, err := tx.Exec(`SELECT set_config('cve.source', $1, true), set_config('cve.run_id', $2, true)`, source, runID)
+	if err != nil {
+		return fmt.Errorf("failed to set provenance: %v", err)
+	}
+	return nil
+}
+
+// Provenance tells where a stored CVE record came from. It is unset for CVEs
+// stored before provenance was recorded.
+type Provenance struct {
+	Source     string    `json:"source"`
+	RecordID   string    `json:"source_record_id,omitempty"`
+	IngestedAt time.Time `json:"ingested_at"`
+	RunID      *int64    `json:"run_id,omitempty"`
+}
+
+// listSyncRuns returns the most recent sync runs, newest first.
+func listSyncRuns(db *sql.DB, limit int) ([]syncRun, error) {
+	rows, err := db.Query(`SELECT id, kind, source, started_at, finished_at, status, COALESCE(error, '')
+						   FROM sync_runs ORDER BY id DESC LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sync runs: %v", err)
+	}
+	defer rows.Close()
+	runs := []syncRun{}
+	for rows.Next() {
+		var run syncRun
+		if err := rows.Scan(&run.ID, &run.Kind, &run.Source, &run.Started, &run.Finished, &run.Status, &run.Error); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// runReingest implements the reingest subcommand. It fetches the CVEs last
+// written by a sync run, or from a source, from the NVD API again and stores
+// them, e.g. after a run stored bad data.
+func runReingest(args []string) error {
+	fs := flag.NewFlagSet("reingest", flag.ExitOnError)
+	runID := fs.Int64("run", 0, "re-ingest the CVEs last written by this sync run")
+	from := fs.String("source", "", "re-ingest the CVEs last written from this source, e.g. "+sourceMirror)
+	dryRun := fs.Bool("dry-run", false, "list the CVEs without fetching them")
+	fs.Parse(args)
+	if (*runID == 0) == (*from == "") {
+		return fmt.Errorf("usage: reingest -run id | -source name [-dry-run]")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`SELECT cve_id FROM cve_data1 WHERE ($1 > 0 AND run_id = $1) OR ($2 <> '' AND source = $2) ORDER BY cve_id`,
+		*runID, *from)
+	if err != nil {
+		return fmt.Errorf("failed to find CVEs: %v", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find CVEs: %v", err)
+	}
+	if *dryRun {
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	}
+
+	run := beginSyncRun(db, "reingest", datasetNVD, sourceNVDAPI)
+	failed := 0
+	for _, id := range ids {
+		if err := repairCVE(db, id); err != nil {
+			log.Printf("Failed to re-ingest %s: %v\n", id, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d CVEs failed to re-ingest", failed, len(ids))
+	}
+	run.finish(db, err)
+	if err != nil {
+		return err
+	}
+	log.Printf("Re-ingested %d CVEs\n", len(ids))
+	return nil
+}
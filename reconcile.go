@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// feedHashesFile records the SHA-256 of each year feed and the number of CVEs
+// stored for its year as of its last full reconciliation.
+const feedHashesFile = "feed_hashes.json"
+
+// feedState is the entry of a year feed in feedHashesFile.
+type feedState struct {
+	SHA256 string `json:"sha256"`
+	Stored int    `json:"stored"`
+}
+
+var fullReconcileSchedule = flag.String("full-reconcile", "0 3 * * 0", "cron schedule of the full reconciliation that re-walks every stored year feed (or, with -source api, the whole CVE API) to repair drift (disabled if empty)")
+
+// syncLock keeps the update check from running during a full reconciliation.
+var syncLock sync.Mutex
+
+// YearReconciliation compares the CVEs stored for a year against the count the
+// NVD year feed reports, to catch syncs that silently ingested only part of a
+// feed.
+type YearReconciliation struct {
+	Year      int       `json:"year"`
+	Expected  int       `json:"expected"`
+	Stored    int       `json:"stored"`
+	Mismatch  bool      `json:"mismatch"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+var reconciliation = struct {
+	sync.Mutex
+	years map[int]YearReconciliation
+}{years: map[int]YearReconciliation{}}
+
+// reconcileYear counts the stored CVEs with IDs from year and records the
+// result for the status endpoint. With ingestion filters set, storing fewer
+// CVEs than the feed reports is expected.
+func reconcileYear(db *sql.DB, year, expected int) {
+	stored, err := storedYearCVEs(db, year)
+	if err != nil {
+		log.Printf("Failed to reconcile year %d: %v\n", year, err)
+		return
+	}
+
+	r := YearReconciliation{
+		Year:      year,
+		Expected:  expected,
+		Stored:    stored,
+		Mismatch:  stored > expected || (stored < expected && !ingestFiltered()),
+		CheckedAt: time.Now(),
+	}
+	if r.Mismatch {
+		log.Printf("Reconciliation mismatch for year %d: feed reports %d CVEs, database has %d\n", year, expected, stored)
+	}
+
+	reconciliation.Lock()
+	reconciliation.years[year] = r
+	reconciliation.Unlock()
+}
+
+// reconciliationStatus returns the latest result for every reconciled year.
+func reconciliationStatus() []YearReconciliation {
+	reconciliation.Lock()
+	defer reconciliation.Unlock()
+
+	results := make([]YearReconciliation, 0, len(reconciliation.years))
+	for _, r := range reconciliation.years {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Year < results[j].Year })
+	return results
+}
+
+// fullReconciliation ingests the complete data set again to repair CVEs the
+// incremental syncs missed, e.g. while the service was down for longer than
+// the modified feed reaches back. Unchanged feeds and CVEs are skipped, so a
+// run mostly costs the downloads.
+func fullReconciliation(db *sql.DB) error {
+	log.Println("Starting full reconciliation...")
+	markSyncStart()
+	defer markSyncEnd()
+
+	run := beginSyncRun(db, "reconcile", datasetNVD, configuredNVDSource())
+	var err error
+	if *source == "api" {
+		syncProgress.start("reconcile", 0, 0)
+		err = reconcileAPI(db)
+	} else {
+		err = reconcileFeeds(db)
+	}
+	syncProgress.finish()
+	run.finish(db, err)
+	if err == nil {
+		err = refreshDerivedFields(db)
+	}
+	if err == nil {
+		err = notifyIntegrations(db)
+	}
+	if err == nil {
+		err = pruneOutOfWindow(db)
+	}
+	if err == nil {
+		err = runMaintenance(db)
+	}
+	return err
+}
+
+// reconcileFeeds re-ingests the year feeds from the oldest stored year on.
+// A feed whose SHA-256 has not changed since its last reconciliation is not
+// downloaded, unless the year's stored rows have drifted since.
+func reconcileFeeds(db *sql.DB) error {
+	var from sql.NullInt64
+	if err := db.QueryRow(`SELECT min(split_part(cve_id, '-', 2)::int) FROM cve_data1`).Scan(&from); err != nil {
+		return fmt.Errorf("failed to find the oldest stored year: %v", err)
+	}
+	if !from.Valid {
+		log.Println("No CVEs stored, nothing to reconcile")
+		return nil
+	}
+	to := time.Now().Year()
+	if *windowYears > 0 {
+		from.Int64 = max(from.Int64, int64(windowStart().Year()))
+	}
+
+	hashes := map[string]feedState{}
+	if data, err := os.ReadFile(feedHashesFile); err == nil {
+		// Files written before the stored counts were recorded do not parse;
+		// every year is then reconciled once.
+		if err := json.Unmarshal(data, &hashes); err != nil {
+			log.Printf("Ignoring %s: %v\n", feedHashesFile, err)
+			hashes = map[string]feedState{}
+		}
+	}
+
+	syncProgress.start("reconcile", int(from.Int64), to)
+	var failed []int
+	for year := int(from.Int64); year <= to; year++ {
+		feedURL := yearFeedURL(year)
+		sum, err := feedSHA256(strings.TrimSuffix(feedURL, ".json.gz") + ".meta")
+		if err != nil {
+			log.Printf("Error reconciling year %d: %v\n", year, err)
+			failed = append(failed, year)
+			continue
+		}
+		if state, ok := hashes[feedURL]; ok && sum == state.SHA256 {
+			drifted, err := yearDrifted(db, year, state.Stored)
+			if err != nil {
+				log.Printf("Error reconciling year %d: %v\n", year, err)
+				failed = append(failed, year)
+				continue
+			}
+			if !drifted {
+				log.Printf("Year %d unchanged since the last reconciliation\n", year)
+				continue
+			}
+			log.Printf("Year %d feed unchanged but stored CVEs drifted, reconciling\n", year)
+		}
+
+		syncProgress.startYear(year)
+		expected, err := loadYearStaged(db, year, true)
+		syncProgress.finishYear()
+		if err != nil {
+			log.Printf("Error reconciling year %d: %v\n", year, err)
+			failed = append(failed, year)
+			continue
+		}
+		reconcileYear(db, year, expected)
+
+		stored, err := storedYearCVEs(db, year)
+		if err != nil {
+			log.Printf("Error reconciling year %d: %v\n", year, err)
+			failed = append(failed, year)
+			continue
+		}
+		hashes[feedURL] = feedState{SHA256: sum, Stored: stored}
+		data, err := json.Marshal(hashes)
+		if err == nil {
+			err = os.WriteFile(feedHashesFile, data, 0644)
+		}
+		if err != nil {
+			log.Printf("Failed to save feed hashes: %v\n", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed years: %v", failed)
+	}
+	return nil
+}
+
+// yearDrifted reports whether the CVEs stored for year changed outside of the
+// syncs since its last reconciliation: fewer of them are stored than were
+// then, or one no longer matches its content hash.
+func yearDrifted(db *sql.DB, year, reconciled int) (bool, error) {
+	stored, err := storedYearCVEs(db, year)
+	if err != nil {
+		return false, err
+	}
+	if stored < reconciled {
+		return true, nil
+	}
+	var drifted bool
+	err = db.QueryRow(`SELECT EXISTS (SELECT 1 FROM cve_data1 c
+						   WHERE c.cve_id LIKE $1
+						   AND c.content_hash IS DISTINCT FROM `+contentHashSQL("c.cve_id")+`)`,
+		fmt.Sprintf("CVE-%d-%%", year)).Scan(&drifted)
+	if err != nil {
+		return false, fmt.Errorf("failed to hash stored CVEs for year %d: %v", year, err)
+	}
+	return drifted, nil
+}
+
+func storedYearCVEs(db *sql.DB, year int) (int, error) {
+	var stored int
+	err := db.QueryRow(`SELECT count(*) FROM cve_data1 WHERE cve_id LIKE $1`, fmt.Sprintf("CVE-%d-%%", year)).Scan(&stored)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count stored CVEs for year %d: %v", year, err)
+	}
+	return stored, nil
+}
+
+// feedSHA256 reads the sha256 line of a feed's .meta file.
+func feedSHA256(metaURL string) (string, error) {
+	resp, err := http.Get(metaURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch metadata: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch metadata: %s", resp.Status)
+	}
+	meta, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata: %v", err)
+	}
+	matches := regexp.MustCompile(`sha256:(\w+)`).FindSubmatch(meta)
+	if matches == nil {
+		return "", fmt.Errorf("no sha256 in %s", metaURL)
+	}
+	return strings.ToUpper(string(matches[1])), nil
+}
+
+// reconcileCheckpointSource keys the checkpoint of an API reconciliation
+// apart from that of the incremental API sync.
+const reconcileCheckpointSource = sourceNVDAPI + "/reconcile"
+
+// reconcileAPI pages through every CVE the NVD 2.0 API publishes, resuming
+// at the page after the last one committed by an interrupted reconciliation.
+func reconcileAPI(db *sql.DB) error {
+	cp, ok, err := readCheckpoint(db, reconcileCheckpointSource)
+	if err != nil {
+		return err
+	}
+	startIndex := 0
+	if ok {
+		startIndex = cp.Offset
+		log.Printf("Resuming API reconciliation at index %d\n", startIndex)
+	}
+	params := url.Values{"resultsPerPage": {strconv.Itoa(nvdPageSize)}}
+	for {
+		params.Set("startIndex", strconv.Itoa(startIndex))
+		var page nvdCVEResponse
+		if err := nvdGet(nvdCVEAPIURL, params, &page); err != nil {
+			return err
+		}
+
+		vulns, parseErrs := decodeRecords(nvdCVEAPIURL, startIndex, page.Vulnerabilities, func(v nvdVulnerability) string { return v.CVE.ID })
+		if err := recordParseErrors(db, parseErrs); err != nil {
+			return err
+		}
+		items := make([]CVEItem, 0, len(vulns))
+		for _, v := range vulns {
+			items = append(items, v.CVE.toCVEItem())
+		}
+		items, err := dropUnchanged(db, items)
+		if err != nil {
+			return err
+		}
+		cp := checkpoint{Source: reconcileCheckpointSource, Position: "all", Offset: startIndex + len(page.Vulnerabilities)}
+		if len(vulns) > 0 {
+			cp.LastCVEID = vulns[len(vulns)-1].CVE.ID
+		}
+		if err := insertCheckpointedBatch(db, items, startIndex, &cp); err != nil {
+			return fmt.Errorf("failed to update data: %v", err)
+		}
+		log.Printf("Reconciled CVEs %d-%d of %d\n", startIndex+1, startIndex+len(page.Vulnerabilities), page.TotalResults)
+
+		startIndex += len(page.Vulnerabilities)
+		if len(page.Vulnerabilities) == 0 || startIndex >= page.TotalResults {
+			return clearCheckpoint(db, reconcileCheckpointSource)
+		}
+	}
+}
+
+// dropUnchanged removes the items that are already stored with the same
+// last modified date and whose rows still match their content hash.
+func dropUnchanged(db *sql.DB, items []CVEItem) ([]CVEItem, error) {
+	ids := make([]string, len(items))
+	modified := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.CVE.CVEDataMeta.ID
+		if t, err := parseNVDTime(item.LastModifiedDate); err == nil {
+			modified[i] = t.Format(time.RFC3339Nano)
+		}
+	}
+	rows, err := db.Query(`SELECT c.cve_id FROM cve_data1 c
+						   JOIN unnest($1::text[], $2::text[]) AS u(cve_id, last_modified) ON u.cve_id = c.cve_id
+						   WHERE c.last_modified_date = NULLIF(u.last_modified, '')::timestamptz
+						   AND c.content_hash = `+contentHashSQL("c.cve_id"), pq.Array(ids), pq.Array(modified))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for unchanged CVEs: %v", err)
+	}
+	defer rows.Close()
+	unchanged := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		unchanged[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	kept := make([]CVEItem, 0, len(items))
+	for _, item := range items {
+		if unchanged[item.CVE.CVEDataMeta.ID] {
+			syncProgress.itemDone()
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept, nil
+}
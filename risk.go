@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/lib/pq"
+)
+
+var riskConfigFile = flag.String("risk-config", "", "JSON file defining the organizational risk score (disabled if empty)")
+
+// riskConfig is loaded from -risk-config at startup; nil disables scoring.
+var riskConfig *RiskConfig
+
+// RiskConfig defines the organizational risk score: a weighted average of
+// normalized inputs, scaled to 0-100. For example:
+//
+//	{
+//	  "weights": {"cvss": 4, "epss": 2, "kev": 2, "exploit_maturity": 1, "watchlist": 1, "asset_exposure": 2},
+//	  "assets": [{"cpe_prefix": "cpe:2.3:a:apache:http_server:", "exposure": 1.0}],
+//	  "cve_tag_factors": {"disputed": 0.5}
+//	}
+type RiskConfig struct {
+	Weights struct {
+		CVSS            float64 `json:"cvss"`
+		EPSS            float64 `json:"epss"`
+		KEV             float64 `json:"kev"`
+		ExploitMaturity float64 `json:"exploit_maturity"`
+		Watchlist       float64 `json:"watchlist"`
+		AssetExposure   float64 `json:"asset_exposure"`
+	} `json:"weights"`
+	// Assets assign an exposure between 0 and 1 to vulnerable CPEs starting
+	// with CPEPrefix; a CVE takes the highest exposure of its CPEs.
+	Assets []struct {
+		CPEPrefix string  `json:"cpe_prefix"`
+		Exposure  float64 `json:"exposure"`
+	} `json:"assets"`
+	// CVETagFactors scale down the score of CVEs carrying an NVD cveTag; a
+	// CVE with several takes the lowest factor.
+	CVETagFactors map[string]float64 `json:"cve_tag_factors"`
+}
+
+func loadRiskConfig(path string) (*RiskConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read risk config: %v", err)
+	}
+	var cfg RiskConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse risk config: %v", err)
+	}
+
+	w := cfg.Weights
+	for _, weight := range []float64{w.CVSS, w.EPSS, w.KEV, w.ExploitMaturity, w.Watchlist, w.AssetExposure} {
+		if weight < 0 {
+			return nil, fmt.Errorf("risk config weights must not be negative")
+		}
+	}
+	if cfg.totalWeight() == 0 {
+		return nil, fmt.Errorf("risk config needs at least one positive weight")
+	}
+	for _, a := range cfg.Assets {
+		if a.CPEPrefix == "" || a.Exposure < 0 || a.Exposure > 1 {
+			return nil, fmt.Errorf("risk config asset %q needs a CPE prefix and an exposure between 0 and 1", a.CPEPrefix)
+		}
+	}
+	for tag, factor := range cfg.CVETagFactors {
+		if factor < 0 || factor > 1 {
+			return nil, fmt.Errorf("risk config factor for cveTag %q must be between 0 and 1", tag)
+		}
+	}
+	return &cfg, nil
+}
+
+func (cfg *RiskConfig) totalWeight() float64 {
+	w := cfg.Weights
+	return w.CVSS + w.EPSS + w.KEV + w.ExploitMaturity + w.Watchlist + w.AssetExposure
+}
+
+// riskScoreSQL returns the SQL expression of the risk score of the CVE c2
+// with the CVSS score in cvssScore, for the parameters updateRiskScores
+// passes.
+func riskScoreSQL(cvssScore string) string {
+	return `round((
+			   $1::numeric * ` + cvssScore + ` / 10 +
+			   $2::numeric * COALESCE(e.score, 0) +
+			   $3::numeric * (k.cve_id IS NOT NULL)::int +
+			   $4::numeric * CASE c2.exploit_maturity
+					   WHEN 'active' THEN 1
+					   WHEN 'weaponized' THEN 2.0 / 3
+					   WHEN 'poc' THEN 1.0 / 3
+					   ELSE 0 END +
+			   $5::numeric * (EXISTS (
+					   SELECT 1 FROM cpe_data p JOIN watchlist wl ON starts_with(p.cpe_uri, wl.cpe_prefix)
+					   WHERE p.cve_id = c2.cve_id AND p.vulnerable))::int +
+			   $6::numeric * COALESCE((
+					   SELECT max(a.exposure)
+					   FROM cpe_data p, unnest($7::text[], $8::numeric[]) AS a (prefix, exposure)
+					   WHERE p.cve_id = c2.cve_id AND p.vulnerable AND starts_with(p.cpe_uri, a.prefix)), 0)
+		   ) * 100 / $9::numeric * COALESCE((
+					   SELECT min(f.factor)
+					   FROM cve_tags t JOIN unnest($10::text[], $11::numeric[]) AS f (tag, factor) ON f.tag = t.tag
+					   WHERE t.cve_id = c2.cve_id), 1), 1)`
+}
+
+// updateRiskScores recomputes cve_data1.risk_score for every CVE, and the
+// tenant_risk_scores of the CVEs a tenant has environmental overrides for.
+// Inputs are normalized to 0-1: CVSS score / 10 (the tenant's environmental,
+// else temporal, else base), EPSS score, KEV listing, exploit maturity (none
+// 0, poc 1/3, weaponized 2/3, active 1), a vulnerable CPE on the watchlist,
+// and the highest configured asset exposure. The result is then scaled by the
+// lowest factor of the CVE's cveTags.
+func updateRiskScores(db *sql.DB, cfg *RiskConfig) error {
+	var prefixes []string
+	var exposures []float64
+	for _, a := range cfg.Assets {
+		prefixes = append(prefixes, a.CPEPrefix)
+		exposures = append(exposures, a.Exposure)
+	}
+	var cveTags []string
+	var factors []float64
+	for tag, factor := range cfg.CVETagFactors {
+		cveTags = append(cveTags, tag)
+		factors = append(factors, factor)
+	}
+	w := cfg.Weights
+	args := []any{w.CVSS, w.EPSS, w.KEV, w.ExploitMaturity, w.Watchlist, w.AssetExposure,
+		pq.Array(prefixes), pq.Array(exposures), cfg.totalWeight(), pq.Array(cveTags), pq.Array(factors)}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE cve_data1 c SET risk_score = s.score
+					  FROM (
+						  SELECT c2.cve_id, `+riskScoreSQL("COALESCE(i.temporal_score, i.cvss_base_score, 0)")+` AS score
+						  FROM cve_data1 c2
+						  LEFT JOIN impact_data i ON i.cve_id = c2.cve_id
+						  LEFT JOIN epss e ON e.cve_id = c2.cve_id
+						  LEFT JOIN kev k ON k.cve_id = c2.cve_id
+					  ) s
+					  WHERE s.cve_id = c.cve_id AND c.risk_score IS DISTINCT FROM s.score;`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update risk scores: %v", err)
+	}
+	_, err = tx.Exec(`DELETE FROM tenant_risk_scores r
+					  WHERE NOT EXISTS (SELECT 1 FROM cvss_environmental env WHERE env.tenant = r.tenant AND env.cve_id = r.cve_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to delete tenant risk scores: %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO tenant_risk_scores (tenant, cve_id, risk_score)
+					  SELECT env.tenant, c2.cve_id, `+riskScoreSQL("COALESCE(env.environmental_score, i.temporal_score, i.cvss_base_score, 0)")+`
+					  FROM cvss_environmental env
+					  JOIN cve_data1 c2 ON c2.cve_id = env.cve_id
+					  LEFT JOIN impact_data i ON i.cve_id = c2.cve_id
+					  LEFT JOIN epss e ON e.cve_id = c2.cve_id
+					  LEFT JOIN kev k ON k.cve_id = c2.cve_id
+					  ON CONFLICT (tenant, cve_id) DO UPDATE SET risk_score = EXCLUDED.risk_score
+					  WHERE tenant_risk_scores.risk_score IS DISTINCT FROM EXCLUDED.risk_score`, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update tenant risk scores: %v", err)
+	}
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	return nil
+}
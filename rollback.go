@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var rollbackRetention = flag.Duration("rollback-retention", 7*24*time.Hour, "how long the rows replaced by an update run are kept for rollback (0 disables recording them)")
+
+// undoTables returns the tables a rollback restores: those a CVE insert writes
+// but the history tables, which keep the versions and score revisions a run
+// recorded as an audit trail.
+func undoTables() []string {
+	var tables []string
+	for _, table := range cveInsertTables() {
+		if table != "cve_history" && table != "score_history" {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// captureUndo saves the stored rows of the CVEs in items before an update run
+// overwrites them, once per CVE and run, in the transaction that overwrites
+// them. Year loads are not recorded: they are staged and merged atomically,
+// and the full reconciliation repeats them.
+func captureUndo(tx *sql.Tx, items []CVEItem) error {
+	run := activeRun(datasetNVD)
+	if run == nil || run.Kind != "update" || *rollbackRetention <= 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		normalizeCVEItem(&item)
+		ids = append(ids, item.CVE.CVEDataMeta.ID)
+	}
+
+	rows, err := tx.Query(`INSERT INTO sync_run_undo_cves (run_id, cve_id, existed)
+						   SELECT $1, u.cve_id, EXISTS (SELECT 1 FROM cve_data1 c WHERE c.cve_id = u.cve_id)
+						   FROM (SELECT DISTINCT unnest($2::text[]) AS cve_id) u
+						   ON CONFLICT DO NOTHING
+						   RETURNING cve_id`, run.ID, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to record the CVEs of run %d: %v", run.ID, err)
+	}
+	var captured []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		captured = append(captured, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to record the CVEs of run %d: %v", run.ID, err)
+	}
+	if len(captured) == 0 {
+		return nil
+	}
+	for _, table := range undoTables() {
+		_, err := tx.Exec(`INSERT INTO sync_run_undo (run_id, cve_id, table_name, row_data)
+						   SELECT $1, t.cve_id, $2, to_jsonb(t) FROM `+pq.QuoteIdentifier(table)+` t
+						   WHERE t.cve_id = ANY($3)`, run.ID, table, pq.Array(captured))
+		if err != nil {
+			return fmt.Errorf("failed to save the %s rows replaced by run %d: %v", table, run.ID, err)
+		}
+	}
+	return nil
+}
+
+// pruneUndo drops the saved rows of runs older than -rollback-retention.
+func pruneUndo(db *sql.DB) error {
+	for _, table := range []string{"sync_run_undo", "sync_run_undo_cves"} {
+		_, err := db.Exec(`DELETE FROM `+table+` WHERE run_id IN (SELECT id FROM sync_runs WHERE started_at < now() - make_interval(secs => $1))`,
+			rollbackRetention.Seconds())
+		if err != nil {
+			return fmt.Errorf("failed to prune rollback data: %v", err)
+		}
+	}
+	return nil
+}
+
+// rollbackRun restores the rows the CVEs written by an update run had before
+// it and deletes the CVEs it added. Unless force is set, it refuses when a
+// later run wrote any of those CVEs, as its changes would be lost too, and
+// when the run has not finished.
+func rollbackRun(db *sql.DB, runID int64, force bool) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var kind, status string
+	err = tx.QueryRow(`SELECT kind, status FROM sync_runs WHERE id = $1 FOR UPDATE`, runID).Scan(&kind, &status)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no sync run %d", runID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to load run %d: %v", runID, err)
+	}
+	switch {
+	case status == "running" && !force:
+		return 0, fmt.Errorf("run %d is still running, or was interrupted (use -force if it was)", runID)
+	case status == "rolled_back":
+		return 0, fmt.Errorf("run %d was already rolled back", runID)
+	case kind != "update":
+		return 0, fmt.Errorf("run %d is a %s run; only update runs can be rolled back", runID, kind)
+	}
+	var affected int
+	if err := tx.QueryRow(`SELECT count(*) FROM sync_run_undo_cves WHERE run_id = $1`, runID).Scan(&affected); err != nil {
+		return 0, fmt.Errorf("failed to load the CVEs of run %d: %v", runID, err)
+	}
+	if affected == 0 {
+		return 0, fmt.Errorf("run %d changed no CVEs or its rollback data was pruned", runID)
+	}
+
+	if !force {
+		var later []string
+		rows, err := tx.Query(`SELECT u.cve_id FROM sync_run_undo_cves u
+							   JOIN cve_data1 c ON c.cve_id = u.cve_id
+							   WHERE u.run_id = $1 AND (c.run_id > $1
+								   OR EXISTS (SELECT 1 FROM sync_run_undo_cves l WHERE l.cve_id = u.cve_id AND l.run_id > $1))
+							   ORDER BY u.cve_id LIMIT 10`, runID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check for later runs: %v", err)
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			later = append(later, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, fmt.Errorf("failed to check for later runs: %v", err)
+		}
+		if len(later) > 0 {
+			return 0, fmt.Errorf("later runs changed CVEs of run %d (e.g. %v); use -force to roll back anyway", runID, later)
+		}
+	}
+
+	rows, err := tx.Query(`SELECT cve_id FROM sync_run_undo_cves WHERE run_id = $1 AND existed ORDER BY cve_id`, runID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load the CVEs of run %d: %v", runID, err)
+	}
+	var restored []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		restored = append(restored, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to load the CVEs of run %d: %v", runID, err)
+	}
+
+	// Only the cve_data1 columns the insert writes are restored, so the
+	// enrichment columns keep their current values; the CVEs' other rows are
+	// replaced.
+	if _, err := tx.Exec(`CREATE TEMP TABLE rollback_cve_data1 (LIKE cve_data1) ON COMMIT DROP`); err != nil {
+		return 0, fmt.Errorf("failed to stage the saved cve_data1 rows: %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO rollback_cve_data1
+					  SELECT r.* FROM sync_run_undo u, jsonb_populate_record(NULL::cve_data1, u.row_data) r
+					  WHERE u.run_id = $1 AND u.table_name = 'cve_data1'`, runID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load the saved cve_data1 rows: %v", err)
+	}
+	if err := upsertCVEColumns(tx, "rollback_cve_data1", restored); err != nil {
+		return 0, err
+	}
+	for _, table := range undoTables()[1:] {
+		target := pq.QuoteIdentifier(table)
+		_, err := tx.Exec(`DELETE FROM `+target+` WHERE cve_id IN (SELECT cve_id FROM sync_run_undo_cves WHERE run_id = $1)`, runID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to roll back %s: %v", table, err)
+		}
+		_, err = tx.Exec(`INSERT INTO `+target+`
+						  SELECT r.* FROM sync_run_undo u, jsonb_populate_record(NULL::`+target+`, u.row_data) r
+						  WHERE u.run_id = $1 AND u.table_name = $2`, runID, table)
+		if err != nil {
+			return 0, fmt.Errorf("failed to restore %s: %v", table, err)
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM cve_data1 WHERE cve_id IN (SELECT cve_id FROM sync_run_undo_cves WHERE run_id = $1 AND NOT existed)`, runID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete the CVEs added by run %d (tagged or annotated since?): %v", runID, err)
+	}
+
+	for _, id := range restored {
+		if err := advanceChangeSeq(tx, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE sync_runs SET status = 'rolled_back' WHERE id = $1`, runID); err != nil {
+		return 0, fmt.Errorf("failed to mark run %d rolled back: %v", runID, err)
+	}
+	for _, table := range []string{"sync_run_undo", "sync_run_undo_cves"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE run_id = $1`, runID); err != nil {
+			return 0, fmt.Errorf("failed to drop the rollback data of run %d: %v", runID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("transaction commit error: %v", err)
+	}
+	return affected, nil
+}
+
+// runRollback implements the rollback subcommand, which undoes what an
+// update run stored, e.g. after NVD published broken data.
+func runRollback(args []string) error {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	runID := fs.Int64("run", 0, "id of the update run to roll back, see GET /sync-runs (required)")
+	force := fs.Bool("force", false, "roll back even if later runs changed the same CVEs, losing their changes")
+	fs.Parse(args)
+	if *runID <= 0 {
+		return fmt.Errorf("usage: rollback -run id [-force]")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
+
+	n, err := rollbackRun(db, *runID, *force)
+	if err != nil {
+		return err
+	}
+	if err := refreshDerivedFields(db); err != nil {
+		return err
+	}
+	log.Printf("Rolled back run %d: restored %d CVEs\n", *runID, n)
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxScanPackages bounds the number of packages of one POST /scan/packages
+// request.
+const maxScanPackages = 5000
+
+// PackageRef is a package as CI pipelines and lock files name it.
+type PackageRef struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+}
+
+// PackageScanResult lists the CVEs affecting one package, or why it could not
+// be scanned.
+type PackageScanResult struct {
+	PackageRef
+	Vulnerabilities []PackageFinding `json:"vulnerabilities"`
+	Error           string           `json:"error,omitempty"`
+}
+
+// PackageFinding is a CVE affecting a package. FixedVersion is the end of the
+// affected version range, when NVD records one that excludes it.
+type PackageFinding struct {
+	CVEID        string   `json:"cve_id"`
+	CPEURI       string   `json:"cpe_uri"`
+	FixedVersion string   `json:"fixed_version,omitempty"`
+	BaseScore    *float64 `json:"base_score,omitempty"`
+	BaseSeverity string   `json:"base_severity,omitempty"`
+}
+
+// cpeProduct maps a package name to the CPE product it is most likely
+// recorded under: the last component of scoped (npm), grouped (Maven) and
+// path-like (Go) names, lowercased.
+func cpeProduct(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// ecosystemPlatforms maps the package URL type of an ecosystem to the
+// target_sw NVD records for its packages. OS package ecosystems have none.
+var ecosystemPlatforms = map[string]string{
+	"npm": "node.js", "pypi": "python", "maven": "java", "golang": "go", "cargo": "rust",
+	"gem": "ruby", "nuget": ".net", "composer": "php", "deb": "", "apk": "",
+}
+
+// scanPackages scans every package concurrently and returns the results in the
+// order of pkgs.
+func scanPackages(db *sql.DB, tenant string, pkgs []PackageRef) []PackageScanResult {
+	results := make([]PackageScanResult, len(pkgs))
+	forEachParallel(len(pkgs), func(i int) {
+		results[i] = PackageScanResult{PackageRef: pkgs[i], Vulnerabilities: []PackageFinding{}}
+		findings, err := scanPackage(db, tenant, pkgs[i])
+		if err != nil {
+			results[i].Error = err.Error()
+			return
+		}
+		results[i].Vulnerabilities = findings
+	})
+	return results
+}
+
+// scanPackage matches a package against the vulnerable CPE rows of the same
+// product, of any vendor, one finding per CVE. Rows whose target_sw names
+// another ecosystem's platform are left out, so a Python package does not
+// report the CVEs of an npm package of the same name; rows without a
+// target_sw still match any ecosystem. CPEs the tenant suppresses are left
+// out too.
+func scanPackage(db *sql.DB, tenant string, pkg PackageRef) ([]PackageFinding, error) {
+	product := cpeProduct(pkg.Name)
+	if product == "" || pkg.Version == "" {
+		return nil, errors.New("name and version are required")
+	}
+	platform, ok := ecosystemPlatforms[purlTypes[strings.ToLower(strings.TrimSpace(pkg.Ecosystem))]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported ecosystem %q", pkg.Ecosystem)
+	}
+
+	rows, err := db.Query(`SELECT c.cve_id, c.cpe_uri, COALESCE(NULLIF(c.version_start_raw, ''), c.version_start, ''), c.version_start_excluding,
+								  COALESCE(NULLIF(c.version_end_raw, ''), c.version_end, ''), c.version_end_including, i.cvss_base_score, COALESCE(i.cvss_base_severity, '')
+						   FROM cpe_data c
+						   LEFT JOIN impact_data i ON i.cve_id = c.cve_id
+						   WHERE c.vulnerable AND split_part(c.cpe_uri, ':', 5) = $1
+							 AND split_part(c.cpe_uri, ':', 3) = 'a'
+							 AND split_part(c.cpe_uri, ':', 11) IN ('*', '-', $3)
+							 AND NOT `+suppressedCPE("$2", "c.cve_id", "c.cpe_uri")+`
+						   ORDER BY c.cve_id, c.cpe_uri`, product, tenant, platform)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %v", pkg.Name, err)
+	}
+	defer rows.Close()
+
+	findings := []PackageFinding{}
+	for rows.Next() {
+		var f PackageFinding
+		var r versionRange
+		if err := rows.Scan(&f.CVEID, &f.CPEURI, &r.start, &r.startExcluding, &r.end, &r.endIncluding, &f.BaseScore, &f.BaseSeverity); err != nil {
+			return nil, err
+		}
+		if len(findings) > 0 && findings[len(findings)-1].CVEID == f.CVEID {
+			continue
+		}
+		if cpeCoversVersion(f.CPEURI, r, pkg.Version) {
+			if !r.endIncluding {
+				f.FixedVersion = r.end
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings, rows.Err()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// ScoreChange is one revision of a CVE's CVSS score or severity.
+type ScoreChange struct {
+	ChangedAt       time.Time  `json:"changed_at"`
+	NVDLastModified *time.Time `json:"nvd_last_modified,omitempty"`
+	Old             ScoreValue `json:"old"`
+	New             ScoreValue `json:"new"`
+}
+
+// ScoreValue is a CVSS assessment before or after a revision.
+type ScoreValue struct {
+	Version      string   `json:"version,omitempty"`
+	VectorString string   `json:"vector_string,omitempty"`
+	BaseScore    *float64 `json:"base_score,omitempty"`
+	BaseSeverity string   `json:"base_severity,omitempty"`
+}
+
+// recordScoreChange appends the stored and the new CVSS values of a CVE to
+// score_history if the score or severity differs, before impact_data is
+// overwritten. A CVE without a stored score records nothing, whether it has
+// no impact data or one stored while it awaited analysis (no score and no
+// severity): its first score is not a revision. score_history is staged and rolled back with the
+// other CVE tables, so a change is recorded once, when it is stored.
+func recordScoreChange(tx *sql.Tx, cveID, version, vector string, score float64, severity string, lastModified time.Time) error {
+	_, err := tx.Exec(`INSERT INTO score_history (cve_id, nvd_last_modified, old_version, old_vector_string, old_base_score, old_base_severity,
+												   new_version, new_vector_string, new_base_score, new_base_severity)
+					   SELECT i.cve_id, $2::timestamptz, i.cvss_version, i.cvss_vector_string, i.cvss_base_score, i.cvss_base_severity,
+							  $3::text, $4::text, $5::numeric, $6::text
+					   FROM impact_data i
+					   WHERE i.cve_id = $1
+					   AND (COALESCE(i.cvss_base_score, 0) <> 0 OR COALESCE(i.cvss_base_severity, '') <> '')
+					   AND (i.cvss_base_score IS DISTINCT FROM $5 OR i.cvss_base_severity IS DISTINCT FROM $6)`,
+		cveID, lastModified, version, vector, score, severity)
+	if err != nil {
+		return fmt.Errorf("failed to record the score change of CVE ID %s: %v", cveID, err)
+	}
+	return nil
+}
+
+// getScoreHistory returns the score revisions of a CVE, oldest first.
+func getScoreHistory(db *sql.DB, cveID string) ([]ScoreChange, error) {
+	rows, err := db.Query(`SELECT changed_at, nvd_last_modified,
+								  COALESCE(old_version, ''), COALESCE(old_vector_string, ''), old_base_score, COALESCE(old_base_severity, ''),
+								  COALESCE(new_version, ''), COALESCE(new_vector_string, ''), new_base_score, COALESCE(new_base_severity, '')
+						   FROM score_history WHERE cve_id = $1 ORDER BY changed_at, id`, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load score history: %v", err)
+	}
+	defer rows.Close()
+
+	changes := []ScoreChange{}
+	for rows.Next() {
+		var c ScoreChange
+		if err := rows.Scan(&c.ChangedAt, &c.NVDLastModified,
+			&c.Old.Version, &c.Old.VectorString, &c.Old.BaseScore, &c.Old.BaseSeverity,
+			&c.New.Version, &c.New.VectorString, &c.New.BaseScore, &c.New.BaseSeverity); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+)
+
+// seedData is a fixed sample of 300 CVEs in the NVD 2.0 API format, for new
+// environments and demos. The records are illustrative, not real advisories:
+// their IDs are in the unassigned CVE-YYYY-89xxxxx range. They span 2008 to
+// 2025 and cover CVSS v2-only, v3.1 and v4.0 scoring, NVD and CNA scores,
+// AND configurations with a platform node, rejected, disputed and unanalyzed
+// CVEs, and vendor comments.
+//
+//go:embed seed/nvd-cves.json
+var seedData []byte
+
+// runSeed implements the seed subcommand, which loads seedData through the
+// regular insert path.
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	force := fs.Bool("force", false, "load the sample even if the database already holds CVEs")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrate(db); err != nil {
+		return err
+	}
+	var existing int
+	if err := db.QueryRow(`SELECT count(*) FROM cve_data1`).Scan(&existing); err != nil {
+		return fmt.Errorf("failed to count CVEs: %v", err)
+	}
+	if existing > 0 && !*force {
+		return fmt.Errorf("the database already holds %d CVEs; seed is meant for empty databases (use -force to add the sample anyway)", existing)
+	}
+
+	var page nvdCVEResponse
+	if err := json.Unmarshal(seedData, &page); err != nil {
+		return fmt.Errorf("failed to decode the seed data: %v", err)
+	}
+	vulns, parseErrs := decodeRecords("seed", 0, page.Vulnerabilities, func(v nvdVulnerability) string { return v.CVE.ID })
+	if err := recordParseErrors(db, parseErrs); err != nil {
+		return err
+	}
+	items := make([]CVEItem, 0, len(vulns))
+	for _, v := range vulns {
+		items = append(items, v.CVE.toCVEItem())
+	}
+	run := beginSyncRun(db, "seed", datasetNVD, sourceSeed)
+	err = insertBatch(db, items, 0)
+	run.finish(db, err)
+	if err != nil {
+		return fmt.Errorf("failed to insert the seed data: %v", err)
+	}
+	if err := refreshDerivedFields(db); err != nil {
+		return err
+	}
+	log.Printf("Seeded %d sample CVEs\n", len(items))
+	return nil
+}
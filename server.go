@@ -0,0 +1,990 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	statusAddr = flag.String("status-addr", "", "address to serve the HTTP status endpoint and query API on, e.g. :8080 (disabled if empty)")
+	readOnly   = flag.Bool("read-only", false, "with -role serve, reject API requests that change data, so the database role only needs read access")
+)
+
+// startServer serves the HTTP endpoints on addr in the background. With
+// -role sync only /status and the mirror are served.
+func startServer(addr string, db *sql.DB) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", handleStatus)
+	if *mirrorDir != "" {
+		mux.Handle("GET /mirror/", http.StripPrefix("/mirror/", http.FileServer(http.Dir(*mirrorDir))))
+	}
+	if *role != "sync" {
+		registerAPIRoutes(mux, db)
+	}
+
+	go func() {
+		log.Printf("Serving HTTP on %s\n", addr)
+		var h http.Handler = invalidateOnWrite(mux)
+		if *readOnly {
+			h = rejectWrites(h)
+		}
+		if err := http.ListenAndServe(addr, withTenant(db, h)); err != nil {
+			log.Printf("HTTP server stopped: %v\n", err)
+		}
+	}()
+}
+
+func registerAPIRoutes(mux *http.ServeMux, db *sql.DB) {
+	mux.HandleFunc("GET /cves", cached(handleSearchCVEs(db)))
+	mux.HandleFunc("GET /cves/{id}", handleGetCVE(db))
+	mux.HandleFunc("PUT /cves/{id}/tags/{tag}", handleAddTag(db))
+	mux.HandleFunc("DELETE /cves/{id}/tags/{tag}", handleRemoveTag(db))
+	mux.HandleFunc("GET /cves/{id}/annotations", handleGetAnnotations(db))
+	mux.HandleFunc("POST /cves/{id}/annotations", handleAddAnnotation(db))
+	mux.HandleFunc("PUT /cves/{id}/cvss/environmental", handleSetEnvironmentalMetrics(db))
+	mux.HandleFunc("DELETE /cves/{id}/cvss/environmental", handleDeleteEnvironmentalMetrics(db))
+	mux.HandleFunc("GET /cves/{id}/nvd-history", handleGetNVDChanges(db))
+	mux.HandleFunc("GET /cves/{id}/epss-history", handleGetEPSSHistory(db))
+	mux.HandleFunc("GET /cves/{id}/score-history", handleGetScoreHistory(db))
+	mux.HandleFunc("GET /cves/{id}/techniques", handleGetAttackTechniques(db))
+	mux.HandleFunc("GET /cves/{id}/attack-patterns", handleGetAttackPatterns(db))
+	mux.HandleFunc("GET /feeds/json/cve/1.1/{file}", handleNVDFeed(db))
+	mux.HandleFunc("GET /sync-runs", handleListSyncRuns(db))
+	mux.HandleFunc("GET /changes", handleGetChanges(db))
+	mux.HandleFunc("GET /changes/consumers/{name}", handleGetChangeConsumer(db))
+	mux.HandleFunc("PUT /changes/consumers/{name}", handleAckChangeConsumer(db))
+	mux.HandleFunc("POST /match", handleMatch(db))
+	mux.HandleFunc("POST /scan/packages", handleScanPackages(db))
+	mux.HandleFunc("GET /reports/cwe-categories", cached(handleCWECategoryReport(db)))
+	mux.HandleFunc("GET /reports/assigners", cached(handleAssignerReport(db)))
+	mux.HandleFunc("GET /reports/epss-rising", cached(handleRisingEPSSReport(db)))
+	mux.HandleFunc("GET /tags", handleListTags(db))
+	mux.HandleFunc("GET /watchlist", handleListWatchlist(db))
+	mux.HandleFunc("POST /watchlist", handleAddWatchlistEntry(db))
+	mux.HandleFunc("DELETE /watchlist/{id}", handleDeleteWatchlistEntry(db))
+	mux.HandleFunc("GET /internal-advisories", handleListInternalAdvisories(db))
+	mux.HandleFunc("GET /internal-advisories/{id}", handleGetInternalAdvisory(db))
+	mux.HandleFunc("PUT /internal-advisories/{id}", handlePutInternalAdvisory(db))
+	mux.HandleFunc("DELETE /internal-advisories/{id}", handleDeleteInternalAdvisory(db))
+	mux.HandleFunc("GET /suppressions", handleListSuppressions(db))
+	mux.HandleFunc("POST /suppressions", handleAddSuppression(db))
+	mux.HandleFunc("DELETE /suppressions/{id}", handleDeleteSuppression(db))
+	mux.HandleFunc("GET /alerts", handleListAlerts(db))
+	mux.HandleFunc("GET /alerts/{id}", handleGetAlert(db))
+	mux.HandleFunc("POST /alerts/{id}/transitions", handleTransitionAlert(db))
+	if *taxiiEnabled {
+		registerTAXIIRoutes(mux, db)
+	}
+}
+
+// rejectWrites answers every request that could change data with 405, for
+// -read-only replicas. Writes go to the instance running the syncs.
+func rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !slices.Contains(queryPOSTs, r.URL.Path) {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, "this server is read-only")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type statusResponse struct {
+	Healthy        bool                 `json:"healthy"`
+	Sync           ProgressStatus       `json:"sync"`
+	Reconciliation []YearReconciliation `json:"reconciliation"`
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, statusResponse{
+		Healthy:        schedulerHealthy(),
+		Sync:           syncProgress.snapshot(),
+		Reconciliation: reconciliationStatus(),
+	})
+}
+
+func handleGetCVE(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var record any
+		var err error
+		cveID := strings.ToUpper(r.PathValue("id"))
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "osv" {
+			writeError(w, http.StatusBadRequest, "invalid format: must be json or osv")
+			return
+		}
+		if format == "osv" && r.URL.Query().Has("asOf") {
+			writeError(w, http.StatusBadRequest, "format=osv does not support asOf")
+			return
+		}
+		if format == "osv" {
+			record, err = getOSVRecord(db, tenantOf(r), cveID)
+		} else if v := r.URL.Query().Get("asOf"); v != "" {
+			asOf, ok := asOfParam(w, v)
+			if !ok {
+				return
+			}
+			record, err = getCVEAsOf(db, tenantOf(r), cveID, asOf)
+		} else {
+			record, err = getCVE(db, tenantOf(r), cveID)
+			if err == sql.ErrNoRows {
+				record, err = getInternalAdvisory(db, tenantOf(r), cveID)
+			}
+		}
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "CVE not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to load CVE %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load CVE")
+			return
+		}
+		writeJSON(w, http.StatusOK, record)
+	}
+}
+
+// handleSearchCVEs lists CVEs, optionally filtered by repeated tag
+// parameters and the assigning CNA, e.g.
+// /cves?tag=affects-prod&tag=triaged&assigner=psirt@cisco.com&limit=50. With asOf it
+// lists the CVE versions that were current at that time.
+func handleSearchCVEs(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := CVEFilter{Tenant: tenantOf(r), Assigner: query.Get("assigner"), Limit: 100}
+		for _, t := range query["tag"] {
+			tag, err := normalizeTag(t)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if !slices.Contains(filter.Tags, tag) {
+				filter.Tags = append(filter.Tags, tag)
+			}
+		}
+		for name, dst := range map[string]*int{"limit": &filter.Limit, "offset": &filter.Offset} {
+			if v := query.Get(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 0 || (name == "limit" && n > 1000) {
+					writeError(w, http.StatusBadRequest, "invalid "+name)
+					return
+				}
+				*dst = n
+			}
+		}
+
+		var cves []CVESummary
+		var err error
+		if v := query.Get("asOf"); v != "" {
+			asOf, ok := asOfParam(w, v)
+			if !ok {
+				return
+			}
+			cves, err = searchCVEsAsOf(db, filter, asOf)
+		} else {
+			cves, err = searchCVEs(db, filter)
+		}
+		if err != nil {
+			log.Printf("Failed to search CVEs: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to search CVEs")
+			return
+		}
+		writeJSON(w, http.StatusOK, cves)
+	}
+}
+
+func handleAddTag(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tag, err := normalizeTag(r.PathValue("tag"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = addTag(db, tenantOf(r), strings.ToUpper(r.PathValue("id")), tag)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "CVE not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to tag %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to add tag")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleRemoveTag(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tag, err := normalizeTag(r.PathValue("tag"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := removeTag(db, tenantOf(r), strings.ToUpper(r.PathValue("id")), tag); err != nil {
+			log.Printf("Failed to untag %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to remove tag")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleGetAnnotations(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		annotations, err := getAnnotations(db, tenantOf(r), strings.ToUpper(r.PathValue("id")))
+		if err != nil {
+			log.Printf("Failed to load annotations for %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load annotations")
+			return
+		}
+		writeJSON(w, http.StatusOK, annotations)
+	}
+}
+
+type annotationRequest struct {
+	Author string `json:"author"`
+	Text   string `json:"text"`
+}
+
+func handleAddAnnotation(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req annotationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Author == "" || strings.TrimSpace(req.Text) == "" {
+			writeError(w, http.StatusBadRequest, "author and text are required")
+			return
+		}
+
+		annotation, err := addAnnotation(db, tenantOf(r), strings.ToUpper(r.PathValue("id")), req.Author, req.Text)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "CVE not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to annotate %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to add annotation")
+			return
+		}
+		writeJSON(w, http.StatusCreated, annotation)
+	}
+}
+
+type environmentalRequest struct {
+	Metrics string `json:"metrics"`
+}
+
+// handleSetEnvironmentalMetrics stores the tenant's environmental CVSS
+// overrides for a CVE, e.g. {"metrics": "CR:H/IR:H/MAV:L"}, which the
+// tenant's risk score then uses.
+func handleSetEnvironmentalMetrics(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req environmentalRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		err := setEnvironmentalMetrics(db, tenantOf(r), strings.ToUpper(r.PathValue("id")), req.Metrics)
+		if errors.Is(err, errInvalidEnvironmental) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "CVE has no CVSS v3 score")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to set environmental metrics of %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to set environmental metrics")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleDeleteEnvironmentalMetrics(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := deleteEnvironmentalMetrics(db, tenantOf(r), strings.ToUpper(r.PathValue("id"))); err != nil {
+			log.Printf("Failed to delete environmental metrics of %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to delete environmental metrics")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleListTags(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tags, err := listTags(db, tenantOf(r))
+		if err != nil {
+			log.Printf("Failed to list tags: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to list tags")
+			return
+		}
+		writeJSON(w, http.StatusOK, tags)
+	}
+}
+
+// handleListSyncRuns returns the most recent sync runs, e.g.
+// /sync-runs?limit=20. A CVE's provenance names the run that last wrote it.
+func handleListSyncRuns(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := intParam(w, r, "limit", 50, 1, 1000)
+		if !ok {
+			return
+		}
+		runs, err := listSyncRuns(db, limit)
+		if err != nil {
+			log.Printf("Failed to list sync runs: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to list sync runs")
+			return
+		}
+		writeJSON(w, http.StatusOK, runs)
+	}
+}
+
+func handleGetNVDChanges(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changes, err := getNVDChanges(db, strings.ToUpper(r.PathValue("id")))
+		if err != nil {
+			log.Printf("Failed to load NVD change history for %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load NVD change history")
+			return
+		}
+		writeJSON(w, http.StatusOK, changes)
+	}
+}
+
+func handleGetAttackTechniques(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		techniques, err := getAttackTechniques(db, strings.ToUpper(r.PathValue("id")))
+		if err != nil {
+			log.Printf("Failed to load attack techniques for %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load attack techniques")
+			return
+		}
+		writeJSON(w, http.StatusOK, techniques)
+	}
+}
+
+func handleGetAttackPatterns(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		patterns, err := getAttackPatterns(db, strings.ToUpper(r.PathValue("id")))
+		if err != nil {
+			log.Printf("Failed to load attack patterns for %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load attack patterns")
+			return
+		}
+		writeJSON(w, http.StatusOK, patterns)
+	}
+}
+
+type matchRequest struct {
+	Items []MatchItem `json:"items"`
+	// AnyPlatform treats the platforms a configuration requires as present,
+	// for inventories that do not list them.
+	AnyPlatform bool `json:"any_platform"`
+}
+
+// handleMatch matches a software inventory, e.g. exported from an asset
+// database, against the stored CPE rows in one request.
+func handleMatch(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req matchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if len(req.Items) == 0 || len(req.Items) > maxMatchItems {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("items must hold 1 to %d entries", maxMatchItems))
+			return
+		}
+		format, ok := scanFormat(w, r)
+		if !ok {
+			return
+		}
+		results := matchInventory(db, tenantOf(r), req.Items, req.AnyPlatform)
+		if format == "cyclonedx" {
+			writeCycloneDX(w, matchVDR(results))
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+type scanPackagesRequest struct {
+	Packages []PackageRef `json:"packages"`
+}
+
+// handleScanPackages scans the packages a CI pipeline resolved, e.g. from a
+// lock file, for known CVEs.
+func handleScanPackages(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req scanPackagesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if len(req.Packages) == 0 || len(req.Packages) > maxScanPackages {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("packages must hold 1 to %d entries", maxScanPackages))
+			return
+		}
+		format, ok := scanFormat(w, r)
+		if !ok {
+			return
+		}
+		results := scanPackages(db, tenantOf(r), req.Packages)
+		if format == "cyclonedx" {
+			writeCycloneDX(w, packageScanVDR(results))
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// scanFormat reads the format parameter of the scan endpoints: json (the
+// default) or cyclonedx for a CycloneDX Vulnerability Disclosure Report. It
+// writes a 400 response and returns false if the format is unknown.
+func scanFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json":
+		return "json", true
+	case "cyclonedx":
+		return format, true
+	}
+	writeError(w, http.StatusBadRequest, "invalid format: must be json or cyclonedx")
+	return "", false
+}
+
+func writeCycloneDX(w http.ResponseWriter, bom cdxBOM) {
+	w.Header().Set("Content-Type", "application/vnd.cyclonedx+json")
+	if err := json.NewEncoder(w).Encode(bom); err != nil {
+		log.Printf("Failed to write response: %v\n", err)
+	}
+}
+
+func handleCWECategoryReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		view := r.URL.Query().Get("view")
+		if view == "" {
+			view = cweCategoryView
+		}
+		var tag string
+		if t := r.URL.Query().Get("tag"); t != "" {
+			var err error
+			if tag, err = normalizeTag(t); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		report, err := cweCategoryReport(db, view, tenantOf(r), tag)
+		if err != nil {
+			log.Printf("Failed to build CWE category report: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to build report")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// handleGetChanges returns changed CVEs with their impact and CPE rows,
+// oldest first. With since, an RFC 3339 timestamp, it returns the CVEs NVD
+// modified after it, e.g. /changes?since=2024-05-01T00:00:00Z&limit=1000, and
+// the next page is requested with the next_since and next_after of the
+// response as since and after. With cursor, or with consumer to start from a
+// consumer's acknowledged position, it returns the CVEs whose content changed
+// after that position in the change feed, and the next page is requested with
+// the cursor of the response.
+func handleGetChanges(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		n := 0
+		for _, p := range []string{"since", "cursor", "consumer"} {
+			if query.Has(p) {
+				n++
+			}
+		}
+		if n != 1 {
+			writeError(w, http.StatusBadRequest, "exactly one of since, cursor and consumer is required")
+			return
+		}
+		limit, ok := intParam(w, r, "limit", 500, 1, maxChangesPage)
+		if !ok {
+			return
+		}
+		var page *ChangesPage
+		var err error
+		switch {
+		case query.Has("since"):
+			since, perr := time.Parse(time.RFC3339Nano, query.Get("since"))
+			if perr != nil {
+				writeError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+				return
+			}
+			page, err = getChanges(db, since, query.Get("after"), limit)
+		case query.Has("cursor"):
+			cursor, perr := strconv.ParseInt(query.Get("cursor"), 10, 64)
+			if perr != nil || cursor < 0 {
+				writeError(w, http.StatusBadRequest, "invalid cursor")
+				return
+			}
+			page, err = getChangesAfter(db, cursor, limit)
+		default:
+			var cursor int64
+			if cursor, err = consumerCursor(db, tenantOf(r), query.Get("consumer")); err == nil {
+				page, err = getChangesAfter(db, cursor, limit)
+			}
+		}
+		if err != nil {
+			log.Printf("Failed to load changes: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to load changes")
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+func handleGetChangeConsumer(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := getChangeConsumer(db, tenantOf(r), r.PathValue("name"))
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "consumer not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to load change consumer: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to load consumer")
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+// handleAckChangeConsumer stores the cursor up to which a consumer has
+// processed the change feed, e.g. {"cursor": "1234"}. Its next
+// /changes?consumer= request starts after it.
+func handleAckChangeConsumer(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Cursor string `json:"cursor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		cursor, err := strconv.ParseInt(req.Cursor, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		tenant, name := tenantOf(r), r.PathValue("name")
+		if err := ackChangeConsumer(db, tenant, name, cursor); err != nil {
+			if err == errCursorOutOfRange {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			log.Printf("Failed to store change consumer: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to store consumer")
+			return
+		}
+		c, err := getChangeConsumer(db, tenant, name)
+		if err != nil {
+			log.Printf("Failed to load change consumer: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to load consumer")
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+// handleGetEPSSHistory returns a CVE's daily EPSS scores, by default of the
+// last 90 days, e.g. /cves/CVE-2024-3400/epss-history?days=30.
+func handleGetEPSSHistory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days, ok := intParam(w, r, "days", 90, 1, 3650)
+		if !ok {
+			return
+		}
+		points, err := getEPSSHistory(db, strings.ToUpper(r.PathValue("id")), days)
+		if err != nil {
+			log.Printf("Failed to load EPSS history of %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load EPSS history")
+			return
+		}
+		writeJSON(w, http.StatusOK, points)
+	}
+}
+
+// handleGetScoreHistory returns the revisions of a CVE's CVSS score and
+// severity since it was first stored, e.g. /cves/CVE-2024-3400/score-history.
+func handleGetScoreHistory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		changes, err := getScoreHistory(db, strings.ToUpper(r.PathValue("id")))
+		if err != nil {
+			log.Printf("Failed to load score history of %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load score history")
+			return
+		}
+		writeJSON(w, http.StatusOK, changes)
+	}
+}
+
+// handleRisingEPSSReport lists the CVEs whose EPSS score rose most over the
+// last days (default 7), e.g. /reports/epss-rising?days=7&min_increase=0.1&limit=50.
+func handleRisingEPSSReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days, ok := intParam(w, r, "days", 7, 1, 3650)
+		if !ok {
+			return
+		}
+		limit, ok := intParam(w, r, "limit", 100, 1, 1000)
+		if !ok {
+			return
+		}
+		minIncrease := 0.05
+		if v := r.URL.Query().Get("min_increase"); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				writeError(w, http.StatusBadRequest, "invalid min_increase")
+				return
+			}
+			minIncrease = f
+		}
+		report, err := risingEPSS(db, days, minIncrease, limit)
+		if err != nil {
+			log.Printf("Failed to build EPSS report: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to build report")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// intParam reads an optional integer query parameter within [lo, hi]. It
+// writes a 400 response and returns false if the value is invalid.
+func intParam(w http.ResponseWriter, r *http.Request, name string, def, lo, hi int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < lo || n > hi {
+		writeError(w, http.StatusBadRequest, "invalid "+name)
+		return 0, false
+	}
+	return n, true
+}
+
+func handleAssignerReport(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := assignerReport(db)
+		if err != nil {
+			log.Printf("Failed to build assigner report: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to build report")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func handleListAlerts(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		alerts, err := listAlerts(db, tenantOf(r), r.URL.Query().Get("status"))
+		if err != nil {
+			log.Printf("Failed to list alerts: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to list alerts")
+			return
+		}
+		writeJSON(w, http.StatusOK, alerts)
+	}
+}
+
+func handleGetAlert(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		alert, err := getAlert(db, tenantOf(r), strings.ToUpper(r.PathValue("id")))
+		if err == errAlertNotFound {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to load alert for %s: %v\n", r.PathValue("id"), err)
+			writeError(w, http.StatusInternalServerError, "failed to load alert")
+			return
+		}
+		writeJSON(w, http.StatusOK, alert)
+	}
+}
+
+type transitionRequest struct {
+	Status string `json:"status"`
+	Actor  string `json:"actor"`
+	Note   string `json:"note"`
+}
+
+func handleTransitionAlert(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req transitionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.Actor == "" {
+			writeError(w, http.StatusBadRequest, "actor is required")
+			return
+		}
+
+		cveID := strings.ToUpper(r.PathValue("id"))
+		err := transitionAlert(db, tenantOf(r), cveID, req.Status, req.Actor, req.Note)
+		switch {
+		case err == errAlertNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		case errors.Is(err, errInvalidTransition):
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		case err != nil:
+			log.Printf("Failed to transition alert for %s: %v\n", cveID, err)
+			writeError(w, http.StatusInternalServerError, "failed to update alert")
+			return
+		}
+
+		alert, err := getAlert(db, tenantOf(r), cveID)
+		if err != nil {
+			log.Printf("Failed to load alert for %s: %v\n", cveID, err)
+			writeError(w, http.StatusInternalServerError, "failed to load alert")
+			return
+		}
+		writeJSON(w, http.StatusOK, alert)
+	}
+}
+
+func handleListWatchlist(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries, err := listWatchlist(db, tenantOf(r))
+		if err != nil {
+			log.Printf("Failed to list watchlist: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to list watchlist")
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+func handleAddWatchlistEntry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req WatchlistEntry
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if !strings.HasPrefix(req.CPEPrefix, "cpe:2.3:") {
+			writeError(w, http.StatusBadRequest, "cpe_prefix must start with cpe:2.3:")
+			return
+		}
+
+		entry, err := addWatchlistEntry(db, tenantOf(r), req)
+		if err != nil {
+			log.Printf("Failed to add watchlist entry: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to add watchlist entry")
+			return
+		}
+		writeJSON(w, http.StatusCreated, entry)
+	}
+}
+
+func handleDeleteWatchlistEntry(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid watchlist entry id")
+			return
+		}
+		err = deleteWatchlistEntry(db, tenantOf(r), id)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "watchlist entry not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete watchlist entry %d: %v\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed to delete watchlist entry")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleListInternalAdvisories(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		advisories, err := listInternalAdvisories(db, tenantOf(r))
+		if err != nil {
+			log.Printf("Failed to list internal advisories: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to list internal advisories")
+			return
+		}
+		writeJSON(w, http.StatusOK, advisories)
+	}
+}
+
+func handleGetInternalAdvisory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.ToUpper(r.PathValue("id"))
+		advisory, err := getInternalAdvisory(db, tenantOf(r), id)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "internal advisory not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to load internal advisory %s: %v\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed to load internal advisory")
+			return
+		}
+		writeJSON(w, http.StatusOK, advisory)
+	}
+}
+
+// handlePutInternalAdvisory creates or replaces an internal advisory, e.g.
+// PUT /internal-advisories/ACME-2025-0042 with
+// {"title": "...", "severity": "HIGH", "products": [{"cpe": "cpe:2.3:a:acme:portal:*:*:*:*:*:*:*:*", "version_end": "4.2"}]}.
+func handlePutInternalAdvisory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req InternalAdvisory
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		req.ID, req.Source = r.PathValue("id"), internalSourceAPI
+
+		advisory, created, err := putInternalAdvisory(db, tenantOf(r), req)
+		if err == errInvalidInternalAdvisory {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to store internal advisory %s: %v\n", req.ID, err)
+			writeError(w, http.StatusInternalServerError, "failed to store internal advisory")
+			return
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, advisory)
+	}
+}
+
+func handleDeleteInternalAdvisory(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.ToUpper(r.PathValue("id"))
+		err := deleteInternalAdvisory(db, tenantOf(r), id)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "internal advisory not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete internal advisory %s: %v\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed to delete internal advisory")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleListSuppressions(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		suppressions, err := listSuppressions(db, tenantOf(r))
+		if err != nil {
+			log.Printf("Failed to list suppressions: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to list suppressions")
+			return
+		}
+		writeJSON(w, http.StatusOK, suppressions)
+	}
+}
+
+func handleAddSuppression(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Suppression
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if req.CreatedBy == "" {
+			writeError(w, http.StatusBadRequest, "created_by is required")
+			return
+		}
+
+		suppression, err := addSuppression(db, tenantOf(r), req)
+		if err == errInvalidSuppression {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to add suppression: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to add suppression")
+			return
+		}
+		writeJSON(w, http.StatusCreated, suppression)
+	}
+}
+
+func handleDeleteSuppression(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("id"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid suppression id")
+			return
+		}
+		err = deleteSuppression(db, tenantOf(r), id)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusNotFound, "suppression not found")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to delete suppression %d: %v\n", id, err)
+			writeError(w, http.StatusInternalServerError, "failed to delete suppression")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// asOfParam parses an asOf query parameter, writing a 400 response if it is
+// invalid. Point-in-time queries need the versions kept by -history.
+func asOfParam(w http.ResponseWriter, v string) (time.Time, bool) {
+	if !*historyMode {
+		writeError(w, http.StatusBadRequest, "asOf requires -history")
+		return time.Time{}, false
+	}
+	asOf, err := parseAsOf(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return time.Time{}, false
+	}
+	return asOf, true
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v\n", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+var errNoServiceSupport = errors.New("service installation is only supported on Windows")
+
+func isWindowsService() bool { return false }
+
+func runService() error { return errNoServiceSupport }
+
+func installService() error { return errNoServiceSupport }
+
+func removeService() error { return errNoServiceSupport }
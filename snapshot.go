@@ -0,0 +1,540 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	snapshotFormat       = "cve-download-update-snapshot"
+	snapshotManifestFile = "manifest.json"
+)
+
+// snapshotTables are the downloaded datasets a snapshot distributes, parents
+// before children. Local state (see stateTables), the quarantine and the EPSS
+// history, which each instance keeps from its own syncs, are not part of it.
+var snapshotTables = []string{
+	"cve_data1", "cpe_data", "cve_configurations", "impact_data",
+	"match_criteria", "match_criteria_names", "cpe_name_lookup", "advisories",
+	"exploits", "metasploit_modules", "kev", "epss", "cve_cwe", "cve_tags", "cve_comments", "cvss_metrics",
+	"capec_patterns", "cwe_capec", "capec_attack", "cwe_entries", "cwe_relations", "cve_nvd_history",
+}
+
+// A snapshot is a gzipped tar archive holding manifest.json followed by one
+// file of row_to_json lines per table. The manifest records each file's row
+// count and SHA-256, so signing the manifest signs the whole dataset.
+type snapshotManifest struct {
+	Format        string          `json:"format"`
+	Version       int             `json:"version"`
+	CreatedAt     time.Time       `json:"created_at"`
+	SchemaVersion int             `json:"schema_version"`
+	Tables        []snapshotTable `json:"tables"`
+}
+
+type snapshotTable struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// writeSnapshot writes a snapshot of the tables to w and returns the encoded
+// manifest, which is what a detached signature covers.
+func writeSnapshot(db *sql.DB, w io.Writer, tables []string) ([]byte, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY`); err != nil {
+		return nil, fmt.Errorf("failed to start snapshot: %v", err)
+	}
+
+	manifest := snapshotManifest{Format: snapshotFormat, Version: 1, CreatedAt: time.Now().UTC()}
+	if err := tx.QueryRow(`SELECT COALESCE(max(version), 0) FROM schema_migrations`).Scan(&manifest.SchemaVersion); err != nil {
+		return nil, fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	// Tar entries need their size up front, so the tables are spooled to
+	// temporary files and hashed on the way.
+	var spooled []*os.File
+	defer func() {
+		for _, f := range spooled {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	for _, table := range tables {
+		f, err := os.CreateTemp("", "snapshot-"+table+"-*.jsonl")
+		if err != nil {
+			return nil, err
+		}
+		spooled = append(spooled, f)
+
+		h := sha256.New()
+		n, err := dumpTable(tx, table, io.MultiWriter(f, h))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Tables = append(manifest.Tables, snapshotTable{
+			Name:   table,
+			File:   "tables/" + table + ".jsonl",
+			Rows:   n,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+		log.Printf("Snapshotted %d rows from %s\n", n, table)
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	hdr := &tar.Header{Name: snapshotManifestFile, Mode: 0644, Size: int64(len(manifestData)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return nil, err
+	}
+	for i, f := range spooled {
+		size, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		hdr := &tar.Header{Name: manifest.Tables[i].File, Mode: 0644, Size: size, ModTime: manifest.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifestData, gz.Close()
+}
+
+// dumpTable writes one row_to_json line per row of table and returns the
+// number of rows.
+func dumpTable(tx *sql.Tx, table string, w io.Writer) (int, error) {
+	rows, err := tx.Query(`SELECT row_to_json(t)::text FROM ` + pq.QuoteIdentifier(table) + ` t`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", table, err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return 0, err
+		}
+		if _, err := io.WriteString(w, row+"\n"); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read %s: %v", table, err)
+	}
+	return n, nil
+}
+
+// loadSigningKey reads an Ed25519 private key in PKCS #8 PEM form, as written
+// by `openssl genpkey -algorithm ed25519`.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// loadVerifyKey reads an Ed25519 public key in PKIX PEM form, as written by
+// `openssl pkey -pubout`.
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse verification key %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("verification key %s is not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// readSnapshot checks a snapshot against its manifest and hands every row to
+// load, if set. With a key, the manifest's signature is checked before
+// anything else is read. Files missing from the archive or the manifest and
+// row counts or hashes that differ from the manifest are errors; since load
+// sees rows before their file's hash is checked, callers verify a snapshot
+// completely before loading it.
+func readSnapshot(r io.Reader, key ed25519.PublicKey, sig []byte, load func(table string, row []byte) error) (*snapshotManifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %v", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != snapshotManifestFile {
+		return nil, fmt.Errorf("not a %s archive: %s must come first", snapshotFormat, snapshotManifestFile)
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	if key != nil && !ed25519.Verify(key, data, sig) {
+		return nil, fmt.Errorf("signature does not match the manifest")
+	}
+	var manifest snapshotManifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Format != snapshotFormat {
+		return nil, fmt.Errorf("not a %s archive", snapshotFormat)
+	}
+	if manifest.Version != 1 {
+		return nil, fmt.Errorf("unsupported snapshot version %d", manifest.Version)
+	}
+
+	files := map[string]snapshotTable{}
+	for _, t := range manifest.Tables {
+		if !slices.Contains(snapshotTables, t.Name) {
+			return nil, fmt.Errorf("manifest lists unknown table %s", t.Name)
+		}
+		if _, dup := files[t.File]; dup {
+			return nil, fmt.Errorf("manifest lists %s twice", t.File)
+		}
+		files[t.File] = t
+	}
+
+	seen := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %v", err)
+		}
+		t, ok := files[hdr.Name]
+		if !ok || seen[hdr.Name] {
+			return nil, fmt.Errorf("snapshot contains %s, which the manifest does not list", hdr.Name)
+		}
+		seen[hdr.Name] = true
+
+		h := sha256.New()
+		br := bufio.NewReader(io.TeeReader(tr, h))
+		n := 0
+		for {
+			line, err := br.ReadBytes('\n')
+			if len(line) > 0 {
+				n++
+				if load != nil {
+					if err := load(t.Name, bytes.TrimSuffix(line, []byte("\n"))); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", hdr.Name, err)
+			}
+		}
+		if n != t.Rows {
+			return nil, fmt.Errorf("%s has %d rows, the manifest says %d", hdr.Name, n, t.Rows)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != t.SHA256 {
+			return nil, fmt.Errorf("%s does not match its hash in the manifest", hdr.Name)
+		}
+	}
+	for file := range files {
+		if !seen[file] {
+			return nil, fmt.Errorf("snapshot is missing %s", file)
+		}
+	}
+	return &manifest, nil
+}
+
+// importSnapshot verifies the snapshot at path, then loads it in a second pass.
+// Each table is staged in a temporary table and merged by primary key, so rows
+// referenced by local state (e.g. tagged CVEs) are updated in place rather
+// than deleted and reinserted.
+func importSnapshot(db *sql.DB, path string, key ed25519.PublicKey, sig []byte) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	manifest, err := readSnapshot(f, key, sig, nil)
+	if err != nil {
+		return err
+	}
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+	if manifest.SchemaVersion > version {
+		return fmt.Errorf("snapshot has schema version %d, this database %d: upgrade before importing", manifest.SchemaVersion, version)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var tables []string
+	for _, t := range manifest.Tables {
+		tables = append(tables, t.Name)
+		staged := pq.QuoteIdentifier("snapshot_" + t.Name)
+		if _, err := tx.Exec(`CREATE TEMP TABLE ` + staged + ` (LIKE ` + pq.QuoteIdentifier(t.Name) + `) ON COMMIT DROP`); err != nil {
+			return fmt.Errorf("failed to stage %s: %v", t.Name, err)
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = readSnapshot(f, key, sig, func(table string, row []byte) error {
+		staged := pq.QuoteIdentifier("snapshot_" + table)
+		if _, err := tx.Exec(`INSERT INTO `+staged+` SELECT * FROM json_populate_record(NULL::`+staged+`, $1)`, string(row)); err != nil {
+			return fmt.Errorf("failed to load row of %s: %v", table, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := stashChangeSeqs(tx); err != nil {
+		return err
+	}
+	for _, t := range manifest.Tables {
+		if err := mergeStagedTable(tx, t.Name, pq.QuoteIdentifier("snapshot_"+t.Name)); err != nil {
+			return err
+		}
+		log.Printf("Imported %d rows into %s\n", t.Rows, t.Name)
+	}
+	if err := resetIDSequences(tx, tables); err != nil {
+		return err
+	}
+	if err := restoreChangeSeqs(tx); err != nil {
+		return err
+	}
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	return nil
+}
+
+// mergeStagedTable makes table hold exactly the rows of its staged copy, the
+// quoted table name staged: rows missing from the copy are deleted and the
+// others upserted by primary key.
+func mergeStagedTable(tx *sql.Tx, table, staged string) error {
+	rows, err := tx.Query(`SELECT a.attname, a.attnum = ANY(i.indkey)
+						   FROM pg_attribute a
+						   JOIN pg_index i ON i.indrelid = a.attrelid AND i.indisprimary
+						   WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+						   ORDER BY a.attnum`, tableName(table))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of %s: %v", table, err)
+	}
+	var keys, match, updates []string
+	for rows.Next() {
+		var column string
+		var isKey bool
+		if err := rows.Scan(&column, &isKey); err != nil {
+			rows.Close()
+			return err
+		}
+		column = pq.QuoteIdentifier(column)
+		if isKey {
+			keys = append(keys, column)
+			match = append(match, "s."+column+" = t."+column)
+		} else {
+			updates = append(updates, column+" = EXCLUDED."+column)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("table %s has no primary key", table)
+	}
+
+	target := pq.QuoteIdentifier(table)
+	if _, err := tx.Exec(`DELETE FROM ` + target + ` t WHERE NOT EXISTS (SELECT 1 FROM ` + staged + ` s WHERE ` + strings.Join(match, " AND ") + `)`); err != nil {
+		return fmt.Errorf("failed to delete rows of %s missing from the staged copy: %v", table, err)
+	}
+	onConflict := `DO NOTHING`
+	if len(updates) > 0 {
+		onConflict = `DO UPDATE SET ` + strings.Join(updates, ", ")
+	}
+	_, err = tx.Exec(`INSERT INTO ` + target + ` SELECT * FROM ` + staged + ` ON CONFLICT (` + strings.Join(keys, ", ") + `) ` + onConflict)
+	if err != nil {
+		return fmt.Errorf("failed to merge %s: %v", table, err)
+	}
+	return nil
+}
+
+// createSnapshotFile writes a snapshot of the downloaded data to out and,
+// with a key, its signature to out.sig.
+func createSnapshotFile(db *sql.DB, out string, key ed25519.PrivateKey) error {
+	tmp := out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	manifest, err := writeSnapshot(db, f, snapshotTables)
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("snapshot failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, out); err != nil {
+		return err
+	}
+	log.Printf("Wrote snapshot to %s\n", out)
+
+	// A signature left over from an earlier snapshot would not match.
+	os.Remove(out + ".sig")
+	if key != nil {
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest))
+		if err := os.WriteFile(out+".sig", []byte(sig+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write signature: %v", err)
+		}
+		log.Printf("Wrote signature to %s.sig\n", out)
+	}
+	return nil
+}
+
+// decodeSignature decodes a .sig file written by createSnapshotFile.
+func decodeSignature(data []byte) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+}
+
+// runSnapshot implements the snapshot subcommand.
+func runSnapshot(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: snapshot create|import")
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("snapshot create", flag.ExitOnError)
+		out := fs.String("o", "cve-snapshot.tar.gz", "file to write the snapshot to")
+		signKey := fs.String("sign-key", "", "Ed25519 private key (PKCS #8 PEM) to write a detached signature of the manifest to <file>.sig with")
+		fs.Parse(args[1:])
+
+		var key ed25519.PrivateKey
+		if *signKey != "" {
+			var err error
+			if key, err = loadSigningKey(*signKey); err != nil {
+				return err
+			}
+		}
+
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return createSnapshotFile(db, *out, key)
+	case "import":
+		fs := flag.NewFlagSet("snapshot import", flag.ExitOnError)
+		in := fs.String("i", "cve-snapshot.tar.gz", "snapshot to import")
+		verifyKey := fs.String("verify-key", "", "Ed25519 public key (PKIX PEM) the snapshot's <file>.sig must verify against")
+		allowUnsigned := fs.Bool("allow-unsigned", false, "import without checking a signature; the hashes in the manifest are still verified")
+		fs.Parse(args[1:])
+
+		var key ed25519.PublicKey
+		var sig []byte
+		switch {
+		case *verifyKey != "":
+			var err error
+			if key, err = loadVerifyKey(*verifyKey); err != nil {
+				return err
+			}
+			data, err := os.ReadFile(*in + ".sig")
+			if err != nil {
+				return fmt.Errorf("failed to read signature: %v", err)
+			}
+			if sig, err = decodeSignature(data); err != nil {
+				return fmt.Errorf("invalid signature %s.sig: %v", *in, err)
+			}
+		case !*allowUnsigned:
+			return fmt.Errorf("snapshot import needs -verify-key, or -allow-unsigned to skip the signature check")
+		}
+
+		db, err := openDB()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		if err := migrate(db); err != nil {
+			return err
+		}
+		if err := importSnapshot(db, *in, key, sig); err != nil {
+			return fmt.Errorf("snapshot import failed: %v", err)
+		}
+		log.Printf("Imported snapshot from %s\n", *in)
+		return nil
+	}
+	return fmt.Errorf("unknown snapshot command %q", args[0])
+}
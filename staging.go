@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	"github.com/lib/pq"
+)
+
+// stagingSchema returns the schema holding the staged copies of the CVE
+// tables while a year feed is loaded, next to the -db-schema if one is set. A
+// year is loaded into the copies and merged into the real tables in one
+// transaction at the end, so queries never see a half-loaded year and a
+// failed load leaves the real tables as they were.
+func stagingSchema() string {
+	if *dbSchema != "" {
+		return *dbSchema + "_staging"
+	}
+	return "cve_staging"
+}
+
+// stagingActive is set while a year feed is loaded into the staging tables.
+// Year loads are serialized by syncLock.
+var stagingActive atomic.Bool
+
+// cveInsertTables returns the tables a CVE insert writes, which a year load
+// stages and a rollback restores: every table keyed by CVE, parent first. The
+// quarantine and parse errors are review queues and are written directly.
+func cveInsertTables() []string {
+	tables := []string{"cve_data1", "cpe_data", "impact_data", "cve_cwe", "advisories", "cvss_metrics", "cve_tags", "cve_comments", "cve_configurations", "score_history"}
+	if *historyMode {
+		tables = append(tables, "cve_history")
+	}
+	if *expandCPENames {
+		tables = append(tables, "cpe_name_lookup")
+	}
+	return tables
+}
+
+func stagedName(table string) string {
+	return stagingSchema() + "." + pq.QuoteIdentifier(table)
+}
+
+// useStaging makes the unqualified table names in tx resolve to the staging
+// tables while a year is staged.
+func useStaging(tx *sql.Tx) error {
+	if !stagingActive.Load() {
+		return nil
+	}
+	if _, err := tx.Exec(`SELECT set_config('search_path', $1 || ', ' || current_setting('search_path'), true)`, stagingSchema()); err != nil {
+		return fmt.Errorf("failed to switch to the staging tables: %v", err)
+	}
+	return nil
+}
+
+// stagingReady reports whether the staging tables of a load interrupted by a
+// crash are still there to resume it.
+func stagingReady(db *sql.DB) (bool, error) {
+	for _, table := range cveInsertTables() {
+		var exists bool
+		staged := stagingSchema() + "." + pq.QuoteIdentifier(tableName(table))
+		if err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, staged).Scan(&exists); err != nil {
+			return false, fmt.Errorf("failed to look for staging tables: %v", err)
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// prepareStaging creates empty staging tables shaped like the real ones and
+// copies the stored rows of the year into them, so the load sees the same
+// data and conflict strategies as it would on the real tables.
+func prepareStaging(db *sql.DB, year int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DROP SCHEMA IF EXISTS ` + stagingSchema() + ` CASCADE; CREATE SCHEMA ` + stagingSchema()); err != nil {
+		return fmt.Errorf("failed to create the staging schema: %v", err)
+	}
+	pattern := fmt.Sprintf("CVE-%d-%%", year)
+	for _, table := range cveInsertTables() {
+		if _, err := tx.Exec(`CREATE TABLE ` + stagedName(table) + ` (LIKE ` + pq.QuoteIdentifier(table) + ` INCLUDING ALL)`); err != nil {
+			return fmt.Errorf("failed to stage %s: %v", table, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO `+stagedName(table)+` SELECT * FROM `+pq.QuoteIdentifier(table)+` WHERE cve_id LIKE $1`, pattern); err != nil {
+			return fmt.Errorf("failed to copy %s into staging: %v", table, err)
+		}
+	}
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	return nil
+}
+
+// cveInsertColumns are the cve_data1 columns a CVE insert writes, next to the
+// content hash stored with them. Merging staged rows and rolling back a run
+// restore only these, so the enrichment columns (exploits, maturity, risk
+// score) other jobs updated in the meantime are kept.
+var cveInsertColumns = []string{"description", "published_date", "last_modified_date", "assigner",
+	"source", "source_record_id", "ingested_at", "run_id", "content_hash"}
+
+// upsertCVEColumns copies the cveInsertColumns of the given CVEs from the
+// quoted table from, shaped like cve_data1, into cve_data1. It is an upsert,
+// as tags and annotations reference cve_data1.
+func upsertCVEColumns(tx *sql.Tx, from string, ids []string) error {
+	updates := make([]string, len(cveInsertColumns))
+	for i, column := range cveInsertColumns {
+		updates[i] = column + " = EXCLUDED." + column
+	}
+	columns := strings.Join(cveInsertColumns, ", ")
+	_, err := tx.Exec(`INSERT INTO cve_data1 (cve_id, `+columns+`)
+					   SELECT cve_id, `+columns+` FROM `+from+` WHERE cve_id = ANY($1)
+					   ON CONFLICT (cve_id) DO UPDATE SET `+strings.Join(updates, ", "), pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("failed to merge cve_data1: %v", err)
+	}
+	return nil
+}
+
+// mergeStaging replaces the rows of the staged CVEs that the load changed
+// with their staged rows and drops the staging tables, in one transaction. A
+// CVE counts as changed when it is new or NVD modified it; the rows of the
+// others are left alone. CVEs whose content changed move to the end of the
+// change feed as they would have during the load.
+func mergeStaging(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT s.cve_id, c.cve_id IS NULL OR s.content_hash IS DISTINCT FROM c.content_hash
+						   FROM ` + stagedName("cve_data1") + ` s
+						   LEFT JOIN cve_data1 c ON c.cve_id = s.cve_id
+						   WHERE c.cve_id IS NULL OR s.content_hash IS DISTINCT FROM c.content_hash
+							  OR s.last_modified_date IS DISTINCT FROM c.last_modified_date
+						   ORDER BY s.cve_id`)
+	if err != nil {
+		return fmt.Errorf("failed to find changed CVEs: %v", err)
+	}
+	var modified, changed []string
+	for rows.Next() {
+		var id string
+		var contentChanged bool
+		if err := rows.Scan(&id, &contentChanged); err != nil {
+			rows.Close()
+			return err
+		}
+		modified = append(modified, id)
+		if contentChanged {
+			changed = append(changed, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to find changed CVEs: %v", err)
+	}
+
+	if err := upsertCVEColumns(tx, stagedName("cve_data1"), modified); err != nil {
+		return err
+	}
+	for _, table := range cveInsertTables()[1:] {
+		target := pq.QuoteIdentifier(table)
+		if _, err := tx.Exec(`DELETE FROM `+target+` WHERE cve_id = ANY($1)`, pq.Array(modified)); err != nil {
+			return fmt.Errorf("failed to replace %s: %v", table, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO `+target+` SELECT * FROM `+stagedName(table)+` WHERE cve_id = ANY($1)`, pq.Array(modified)); err != nil {
+			return fmt.Errorf("failed to merge %s: %v", table, err)
+		}
+	}
+	for _, id := range changed {
+		if err := advanceChangeSeq(tx, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DROP SCHEMA ` + stagingSchema() + ` CASCADE`); err != nil {
+		return fmt.Errorf("failed to drop the staging tables: %v", err)
+	}
+	if err := checkLeadership(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit error: %v", err)
+	}
+	log.Printf("Merged %d modified CVEs from staging, %d with changed content\n", len(modified), len(changed))
+	return nil
+}
+
+// loadYearStaged loads the year feed through the staging tables. A load that
+// was interrupted resumes from its checkpoint into the staging tables it
+// left; otherwise staging starts over from the stored rows of the year.
+func loadYearStaged(db *sql.DB, year int, skipUnchanged bool) (int, error) {
+	url := yearFeedURL(year)
+	cp, resume, err := readCheckpoint(db, sourceNVDFeeds)
+	if err != nil {
+		return 0, err
+	}
+	if resume = resume && cp.Position == url; resume {
+		if resume, err = stagingReady(db); err != nil {
+			return 0, err
+		}
+	}
+	if !resume {
+		if err := clearCheckpoint(db, sourceNVDFeeds); err != nil {
+			return 0, err
+		}
+		if err := prepareStaging(db, year); err != nil {
+			return 0, err
+		}
+	}
+
+	stagingActive.Store(true)
+	expected, err := downloadAndInsertData(url, db, skipUnchanged)
+	stagingActive.Store(false)
+	if err != nil {
+		return 0, err
+	}
+	if err := mergeStaging(db); err != nil {
+		return 0, err
+	}
+	return expected, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Suppression excludes matches from a tenant's alerts, Jira issues and scan
+// results without touching the CVE data. A rule applies to a vulnerable CPE of a CVE
+// when every condition it sets holds: the CVE ID, a CPE prefix, or the package
+// (the CPE product component). Expired rules are ignored.
+type Suppression struct {
+	ID            int        `json:"id"`
+	CVEID         string     `json:"cve_id,omitempty"`
+	CPEPrefix     string     `json:"cpe_prefix,omitempty"`
+	Package       string     `json:"package,omitempty"`
+	Justification string     `json:"justification"`
+	CreatedBy     string     `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+}
+
+// suppressedCPE returns an SQL condition that holds when an active
+// suppression of tenant tenantCol covers the vulnerable CPE cpeCol of CVE
+// cveCol.
+func suppressedCPE(tenantCol, cveCol, cpeCol string) string {
+	return fmt.Sprintf(`EXISTS (
+		SELECT 1 FROM suppressions s
+		WHERE s.tenant = %[1]s AND (s.expires_at IS NULL OR s.expires_at > now())
+		AND (s.cve_id IS NULL OR s.cve_id = %[2]s)
+		AND (s.cpe_prefix IS NULL OR starts_with(%[3]s, s.cpe_prefix))
+		AND (s.package IS NULL OR split_part(%[3]s, ':', 5) = s.package))`, tenantCol, cveCol, cpeCol)
+}
+
+// suppressedCVE returns an SQL condition that holds when tenant tenantCol
+// suppresses CVE cveCol as a whole: a rule names only the CVE, or every
+// vulnerable CPE of the CVE is suppressed.
+func suppressedCVE(tenantCol, cveCol string) string {
+	return fmt.Sprintf(`(EXISTS (
+		SELECT 1 FROM suppressions s
+		WHERE s.tenant = %[1]s AND (s.expires_at IS NULL OR s.expires_at > now())
+		AND s.cve_id = %[2]s AND s.cpe_prefix IS NULL AND s.package IS NULL)
+	OR (EXISTS (SELECT 1 FROM cpe_data sp WHERE sp.cve_id = %[2]s AND sp.vulnerable)
+		AND NOT EXISTS (
+			SELECT 1 FROM cpe_data sp WHERE sp.cve_id = %[2]s AND sp.vulnerable
+			AND NOT %[3]s)))`, tenantCol, cveCol, suppressedCPE(tenantCol, "sp.cve_id", "sp.cpe_uri"))
+}
+
+// suppressedInternalAdvisory is suppressedCVE for the internal advisory idCol
+// of tenant tenantCol. Only the tenant's own rules apply, so another tenant's
+// rule for an advisory of the same ID does not hide it.
+func suppressedInternalAdvisory(tenantCol, idCol string) string {
+	return fmt.Sprintf(`(EXISTS (
+		SELECT 1 FROM suppressions s
+		WHERE s.tenant = %[1]s AND (s.expires_at IS NULL OR s.expires_at > now())
+		AND s.cve_id = %[2]s AND s.cpe_prefix IS NULL AND s.package IS NULL)
+	OR (EXISTS (SELECT 1 FROM internal_advisory_products sp WHERE sp.tenant = %[1]s AND sp.advisory_id = %[2]s)
+		AND NOT EXISTS (
+			SELECT 1 FROM internal_advisory_products sp WHERE sp.tenant = %[1]s AND sp.advisory_id = %[2]s
+			AND NOT %[3]s)))`, tenantCol, idCol, suppressedCPE(tenantCol, "sp.advisory_id", "sp.cpe_uri"))
+}
+
+var errInvalidSuppression = errors.New("a suppression needs a justification and at least one of cve_id, cpe_prefix or package")
+
+func addSuppression(db *sql.DB, tenant string, s Suppression) (*Suppression, error) {
+	s.CVEID = strings.ToUpper(strings.TrimSpace(s.CVEID))
+	s.Package = strings.ToLower(strings.TrimSpace(s.Package))
+	if strings.TrimSpace(s.Justification) == "" || (s.CVEID == "" && s.CPEPrefix == "" && s.Package == "") {
+		return nil, errInvalidSuppression
+	}
+
+	err := db.QueryRow(`INSERT INTO suppressions (tenant, cve_id, cpe_prefix, package, justification, created_by, expires_at)
+						VALUES ($1, NULLIF($2, ''), NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7)
+						RETURNING id, created_at`,
+		tenant, s.CVEID, s.CPEPrefix, s.Package, s.Justification, s.CreatedBy, s.ExpiresAt).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add suppression: %v", err)
+	}
+	return &s, nil
+}
+
+// deleteSuppression removes a rule of the tenant. It returns sql.ErrNoRows if
+// the tenant has no such rule.
+func deleteSuppression(db *sql.DB, tenant string, id int) error {
+	res, err := db.Exec(`DELETE FROM suppressions WHERE tenant = $1 AND id = $2`, tenant, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete suppression %d: %v", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// listSuppressions returns all rules of the tenant, including expired ones.
+func listSuppressions(db *sql.DB, tenant string) ([]Suppression, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(cve_id, ''), COALESCE(cpe_prefix, ''), COALESCE(package, ''),
+							   justification, created_by, created_at, expires_at
+						   FROM suppressions WHERE tenant = $1 ORDER BY id`, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list suppressions: %v", err)
+	}
+	defer rows.Close()
+
+	suppressions := []Suppression{}
+	for rows.Next() {
+		var s Suppression
+		if err := rows.Scan(&s.ID, &s.CVEID, &s.CPEPrefix, &s.Package, &s.Justification, &s.CreatedBy, &s.CreatedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, s)
+	}
+	return suppressions, rows.Err()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var syncStallTimeout = flag.Duration("sync-stall-timeout", 10*time.Minute, "stop systemd watchdog pings when a running sync makes no progress for this long")
+
+// syncHealth tracks whether the scheduler is making progress. A sync that
+// stops reporting progress is considered wedged.
+var syncHealth struct {
+	running      atomic.Bool
+	lastProgress atomic.Int64 // unix nanoseconds
+}
+
+func markSyncStart() {
+	syncHealth.lastProgress.Store(time.Now().UnixNano())
+	syncHealth.running.Store(true)
+}
+
+func markSyncProgress() {
+	syncHealth.lastProgress.Store(time.Now().UnixNano())
+}
+
+func markSyncEnd() {
+	syncHealth.running.Store(false)
+}
+
+func schedulerHealthy() bool {
+	if !syncHealth.running.Load() {
+		return true
+	}
+	last := time.Unix(0, syncHealth.lastProgress.Load())
+	return time.Since(last) < *syncStallTimeout
+}
+
+// sdNotify sends a state string to systemd. It is a no-op when the process
+// was not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket.
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval systemd expects watchdog pings at, or
+// zero if the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog pings the systemd watchdog at half the configured interval for
+// as long as the scheduler is healthy. Once a sync wedges the pings stop and
+// systemd restarts the service.
+func runWatchdog() {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !schedulerHealthy() {
+			log.Printf("Sync has made no progress for %v, withholding watchdog ping\n", *syncStallTimeout)
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Failed to ping systemd watchdog: %v\n", err)
+		}
+	}
+}
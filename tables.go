@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// baseSchema is cvedb.sql, the schema the migrations apply on top of.
+//
+//go:embed cvedb.sql
+var baseSchema string
+
+// schemaObjectPattern finds the tables, indexes and sequences the base schema
+// and the migrations create.
+var schemaObjectPattern = regexp.MustCompile(`(?i)CREATE\s+(?:UNIQUE\s+)?(?:TABLE|INDEX|SEQUENCE)\s+(?:CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?([a-z_][a-z0-9_]*)`)
+
+// schemaObjects returns the names of the tables, indexes and sequences of the
+// schema, including the primary key constraints Postgres names after their
+// tables. These are the names -table-prefix applies to; the exploit_maturity
+// type keeps its name, as cve_data1 has a column of the same name.
+func schemaObjects() (map[string]bool, error) {
+	sources := []string{baseSchema, `CREATE TABLE schema_migrations`}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		sources = append(sources, m.sql)
+	}
+	objects := map[string]bool{}
+	for _, src := range sources {
+		for _, m := range schemaObjectPattern.FindAllStringSubmatch(src, -1) {
+			name := strings.ToLower(m[1])
+			if name == "on" {
+				continue
+			}
+			objects[name] = true
+			if strings.EqualFold(strings.Fields(m[0])[1], "TABLE") {
+				objects[name+"_pkey"] = true
+			}
+		}
+	}
+	return objects, nil
+}
+
+// prefixedObjects is loaded from the schema at startup when -table-prefix is
+// set.
+var prefixedObjects map[string]bool
+
+// checkTablePrefix validates -table-prefix and loads the names it applies to.
+func checkTablePrefix() error {
+	if *tablePrefix == "" {
+		return nil
+	}
+	if !schemaPattern.MatchString(*tablePrefix) {
+		return fmt.Errorf("invalid -table-prefix %q: must be lower-case letters, digits and underscores", *tablePrefix)
+	}
+	objects, err := schemaObjects()
+	if err != nil {
+		return fmt.Errorf("failed to load schema: %v", err)
+	}
+	for name := range objects {
+		if len(*tablePrefix+name) > 63 {
+			return fmt.Errorf("-table-prefix %q is too long: %s%s exceeds Postgres' 63-character names", *tablePrefix, *tablePrefix, name)
+		}
+		// The prefixed names must not be names of the schema themselves, or
+		// they would be prefixed again wherever they are read back.
+		if objects[*tablePrefix+name] {
+			return fmt.Errorf("-table-prefix %q turns %s into %s, which is another table's name", *tablePrefix, name, *tablePrefix+name)
+		}
+	}
+	prefixedObjects = objects
+	return nil
+}
+
+// tableName returns the name table has in the database, for the places that
+// pass it as a value rather than in the SQL text, such as regclass arguments.
+func tableName(table string) string {
+	return *tablePrefix + table
+}
+
+func tableNames(tables []string) []string {
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = tableName(t)
+	}
+	return names
+}
+
+// prefixTables returns query with -table-prefix applied to the schema's
+// tables, indexes and sequences, so the SQL throughout can name them as
+// cvedb.sql does. Identifiers are rewritten whether quoted or not, and so is a
+// string literal cast to regclass ('cve_change_seq'::regclass); other string
+// literals, comments and parameters are left alone. Dollar-quoted bodies are
+// SQL (DO blocks) and rewritten as well.
+func prefixTables(query string) string {
+	if prefixedObjects == nil {
+		return query
+	}
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i - 4
+			}
+			b.WriteString(query[i : i+end+4])
+			i += end + 4
+		case c == '\'':
+			end := quotedEnd(query, i, '\'')
+			literal := query[i+1 : end-1]
+			if prefixedObjects[literal] && strings.HasPrefix(strings.ToLower(query[end:]), "::regclass") {
+				b.WriteString("'" + *tablePrefix + literal + "'")
+			} else {
+				b.WriteString(query[i:end])
+			}
+			i = end
+		case c == '"':
+			end := quotedEnd(query, i, '"')
+			if name := query[i+1 : end-1]; prefixedObjects[name] {
+				b.WriteString(`"` + *tablePrefix + name + `"`)
+			} else {
+				b.WriteString(query[i:end])
+			}
+			i = end
+		case c == '$' && i+1 < len(query) && !isDigit(query[i+1]):
+			tag := dollarTag(query[i:])
+			if tag == "" {
+				b.WriteByte(c)
+				i++
+				continue
+			}
+			body := query[i+len(tag):]
+			end := strings.Index(body, tag)
+			if end < 0 {
+				end = len(body)
+			}
+			b.WriteString(tag + prefixTables(body[:end]))
+			i += len(tag) + end
+			if end < len(body) {
+				b.WriteString(tag)
+				i += len(tag)
+			}
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(query) && (isIdentStart(query[end]) || isDigit(query[end]) || query[end] == '$') {
+				end++
+			}
+			if name := strings.ToLower(query[i:end]); prefixedObjects[name] {
+				b.WriteString(*tablePrefix + name)
+			} else {
+				b.WriteString(query[i:end])
+			}
+			i = end
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// quotedEnd returns the index after the quote closing the literal or
+// identifier opened at start, where a doubled quote is an escaped one.
+func quotedEnd(query string, start int, quote byte) int {
+	for i := start + 1; i < len(query); i++ {
+		if query[i] != quote {
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == quote {
+			i++
+			continue
+		}
+		return i + 1
+	}
+	return len(query)
+}
+
+// dollarTag returns the dollar quote ($$ or $tag$) s starts with, if any.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1]
+		case !isIdentStart(s[i]) && !isDigit(s[i]):
+			return ""
+		}
+	}
+	return ""
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// prefixConnector opens connections that apply -table-prefix to every
+// statement they run.
+type prefixConnector struct {
+	driver.Connector
+}
+
+func (c prefixConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return prefixConn{conn}, nil
+}
+
+// prefixConn passes statements to the pq connection with -table-prefix
+// applied, and the optional driver interfaces through.
+type prefixConn struct {
+	driver.Conn
+}
+
+func (c prefixConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(prefixTables(query))
+}
+
+func (c prefixConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, prefixTables(query))
+	}
+	return c.Prepare(query)
+}
+
+func (c prefixConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, prefixTables(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c prefixConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, prefixTables(query), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c prefixConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c prefixConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c prefixConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c prefixConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// runSchema implements the schema subcommand, which prints cvedb.sql with
+// -table-prefix applied, for loading the base schema of a prefixed install.
+func runSchema() error {
+	fmt.Print(prefixTables(baseSchema))
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// tagPattern restricts user labels to short lowercase slugs such as
+// "affects-prod" or "team:payments".
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._:-]{0,63}$`)
+
+var errInvalidTag = errors.New("tags must be lowercase letters, digits, '.', '_', ':' or '-' and at most 64 characters")
+
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagPattern.MatchString(tag) {
+		return "", errInvalidTag
+	}
+	return tag, nil
+}
+
+// addTag labels a stored CVE for a tenant. It returns sql.ErrNoRows if the
+// CVE is unknown.
+func addTag(db *sql.DB, tenant, cveID, tag string) error {
+	res, err := db.Exec(`INSERT INTO tags (tenant, cve_id, tag)
+						 SELECT $1, cve_id, $3 FROM cve_data1 WHERE cve_id = $2
+						 ON CONFLICT DO NOTHING`, tenant, cveID, tag)
+	if err != nil {
+		return fmt.Errorf("failed to tag %s: %v", cveID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM cve_data1 WHERE cve_id = $1)`, cveID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return sql.ErrNoRows
+		}
+	}
+	return nil
+}
+
+func removeTag(db *sql.DB, tenant, cveID, tag string) error {
+	if _, err := db.Exec(`DELETE FROM tags WHERE tenant = $1 AND cve_id = $2 AND tag = $3`, tenant, cveID, tag); err != nil {
+		return fmt.Errorf("failed to untag %s: %v", cveID, err)
+	}
+	return nil
+}
+
+func getTags(db *sql.DB, tenant, cveID string) ([]string, error) {
+	rows, err := db.Query(`SELECT tag FROM tags WHERE tenant = $1 AND cve_id = $2 ORDER BY tag`, tenant, cveID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tags: %v", err)
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// TagCount is the number of CVEs carrying a tag.
+type TagCount struct {
+	Tag  string `json:"tag"`
+	CVEs int    `json:"cves"`
+}
+
+func listTags(db *sql.DB, tenant string) ([]TagCount, error) {
+	rows, err := db.Query(`SELECT tag, count(*) FROM tags WHERE tenant = $1 GROUP BY tag ORDER BY tag`, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tags: %v", err)
+	}
+	defer rows.Close()
+
+	counts := []TagCount{}
+	for rows.Next() {
+		var c TagCount
+		if err := rows.Scan(&c.Tag, &c.CVEs); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// insertCVETags replaces the NVD cveTags stored for a CVE. A tag applied by
+// several sources is stored once, with the first source.
+func insertCVETags(tx *sql.Tx, cveID string, cveTags []CVETag) error {
+	if _, err := tx.Exec(`DELETE FROM cve_tags WHERE cve_id = $1`, cveID); err != nil {
+		return fmt.Errorf("failed to delete cveTags for CVE ID %s: %v", cveID, err)
+	}
+	for _, t := range cveTags {
+		for _, tag := range t.Tags {
+			_, err := tx.Exec(`INSERT INTO cve_tags (cve_id, tag, source_identifier) VALUES ($1, $2, $3)
+							   ON CONFLICT (cve_id, tag) DO NOTHING`, cveID, tag, t.SourceIdentifier)
+			if err != nil {
+				return fmt.Errorf("failed to insert cveTag %s for CVE ID %s: %v", tag, cveID, err)
+			}
+		}
+	}
+	return nil
+}
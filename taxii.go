@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TAXII 2.1 (https://docs.oasis-open.org/cti/taxii/v2.1/) lets threat
+// intelligence platforms poll the stored CVEs as STIX 2.1 vulnerability
+// objects. One read-only collection holds every CVE; an object's date_added is
+// the time it was last stored, so a CVE updated upstream is served again, and
+// so is one that a backfill, reconciliation or snapshot import stored after
+// clients polled past its NVD last modified time.
+const (
+	taxiiMediaType       = "application/taxii+json;version=2.1"
+	taxiiCollectionID    = "2c8a5a08-6d0e-4c0f-9a5b-5b1c0d7e4f21"
+	taxiiMaxPageSize     = 1000
+	taxiiDefaultPageSize = 100
+)
+
+var taxiiEnabled = flag.Bool("taxii", false, "serve the stored CVEs as STIX 2.1 vulnerability objects from a TAXII 2.1 collection under /taxii2/")
+
+// stixNamespace is the UUIDv5 namespace STIX 2.1 defines for deterministic
+// identifiers, so a CVE keeps its STIX id across polls.
+var stixNamespace = [16]byte{0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c, 0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7}
+
+// STIXVulnerability is a STIX 2.1 vulnerability domain object.
+type STIXVulnerability struct {
+	Type               string                  `json:"type"`
+	SpecVersion        string                  `json:"spec_version"`
+	ID                 string                  `json:"id"`
+	Created            string                  `json:"created"`
+	Modified           string                  `json:"modified"`
+	Name               string                  `json:"name"`
+	Description        string                  `json:"description,omitempty"`
+	ExternalReferences []STIXExternalReference `json:"external_references"`
+}
+
+type STIXExternalReference struct {
+	SourceName string `json:"source_name"`
+	ExternalID string `json:"external_id,omitempty"`
+	URL        string `json:"url,omitempty"`
+}
+
+// stixID returns the deterministic vulnerability--<UUIDv5> id of a CVE.
+func stixID(cveID string) string {
+	h := sha1.New()
+	h.Write(stixNamespace[:])
+	h.Write([]byte(cveID))
+	id := h.Sum(nil)[:16]
+	id[6] = id[6]&0x0f | 0x50
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("vulnerability--%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+type taxiiCollection struct {
+	ID         string   `json:"id"`
+	Title      string   `json:"title"`
+	CanRead    bool     `json:"can_read"`
+	CanWrite   bool     `json:"can_write"`
+	MediaTypes []string `json:"media_types"`
+}
+
+var stixCollection = taxiiCollection{
+	ID:         taxiiCollectionID,
+	Title:      "CVE vulnerabilities",
+	CanRead:    true,
+	MediaTypes: []string{"application/stix+json;version=2.1"},
+}
+
+type taxiiEnvelope struct {
+	More    bool                `json:"more"`
+	Next    string              `json:"next,omitempty"`
+	Objects []STIXVulnerability `json:"objects"`
+}
+
+// stixObjectsQuery selects a page of the collection, which is ordered by
+// date_added and CVE ID. afterTime and afterID resume after the last object
+// of the previous page.
+type stixObjectsQuery struct {
+	addedAfter time.Time
+	afterTime  time.Time
+	afterID    string
+	limit      int
+}
+
+// getSTIXObjects returns up to q.limit vulnerability objects plus the
+// date_added of each, oldest first.
+func getSTIXObjects(db *sql.DB, q stixObjectsQuery) ([]STIXVulnerability, []time.Time, error) {
+	var addedAfter, afterTime any
+	if !q.addedAfter.IsZero() {
+		addedAfter = q.addedAfter
+	}
+	if !q.afterTime.IsZero() {
+		afterTime = q.afterTime
+	}
+	rows, err := db.Query(`SELECT cve_id, COALESCE(description, ''), `+utcTimestampSQL("COALESCE(published_date, last_modified_date, ingested_at)")+`,
+								  COALESCE(last_modified_date, ingested_at), ingested_at
+						   FROM cve_data1
+						   WHERE ingested_at IS NOT NULL
+							 AND ($1::timestamptz IS NULL OR ingested_at > $1)
+							 AND ($2::timestamptz IS NULL OR (ingested_at, cve_id) > ($2, $3))
+						   ORDER BY ingested_at, cve_id
+						   LIMIT $4`, addedAfter, afterTime, q.afterID, q.limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load STIX objects: %v", err)
+	}
+	defer rows.Close()
+
+	objects := []STIXVulnerability{}
+	var added []time.Time
+	for rows.Next() {
+		var cveID, description, published string
+		var modified, ingested time.Time
+		if err := rows.Scan(&cveID, &description, &published, &modified, &ingested); err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, STIXVulnerability{
+			Type:        "vulnerability",
+			SpecVersion: "2.1",
+			ID:          stixID(cveID),
+			Created:     published,
+			Modified:    modified.UTC().Format(time.RFC3339Nano),
+			Name:        cveID,
+			Description: description,
+			ExternalReferences: []STIXExternalReference{
+				{SourceName: "cve", ExternalID: cveID},
+				{SourceName: "nvd", URL: "https://nvd.nist.gov/vuln/detail/" + cveID},
+			},
+		})
+		added = append(added, ingested)
+	}
+	return objects, added, rows.Err()
+}
+
+func registerTAXIIRoutes(mux *http.ServeMux, db *sql.DB) {
+	mux.HandleFunc("GET /taxii2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/taxii2/" {
+			writeTAXIIError(w, http.StatusNotFound, "not found")
+			return
+		}
+		writeTAXII(w, http.StatusOK, map[string]any{
+			"title":     "CVE TAXII server",
+			"default":   "/taxii2/api/",
+			"api_roots": []string{"/taxii2/api/"},
+		})
+	})
+	mux.HandleFunc("GET /taxii2/api/{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeTAXII(w, http.StatusOK, map[string]any{
+			"title":              "CVE vulnerabilities",
+			"versions":           []string{taxiiMediaType},
+			"max_content_length": 0,
+		})
+	})
+	mux.HandleFunc("GET /taxii2/api/collections/{$}", func(w http.ResponseWriter, r *http.Request) {
+		writeTAXII(w, http.StatusOK, map[string]any{"collections": []taxiiCollection{stixCollection}})
+	})
+	mux.HandleFunc("GET /taxii2/api/collections/{id}/{$}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != taxiiCollectionID {
+			writeTAXIIError(w, http.StatusNotFound, "collection not found")
+			return
+		}
+		writeTAXII(w, http.StatusOK, stixCollection)
+	})
+	mux.HandleFunc("GET /taxii2/api/collections/{id}/objects/{$}", handleTAXIIObjects(db))
+}
+
+// handleTAXIIObjects serves a page of the collection's objects. It supports
+// the added_after, limit, next and match[type] parameters; the other TAXII
+// filters are ignored.
+func handleTAXIIObjects(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != taxiiCollectionID {
+			writeTAXIIError(w, http.StatusNotFound, "collection not found")
+			return
+		}
+		query := r.URL.Query()
+		q := stixObjectsQuery{limit: taxiiDefaultPageSize}
+		if v := query.Get("added_after"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeTAXIIError(w, http.StatusBadRequest, "invalid added_after: use an RFC 3339 timestamp")
+				return
+			}
+			q.addedAfter = t
+		}
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				writeTAXIIError(w, http.StatusBadRequest, "invalid limit")
+				return
+			}
+			q.limit = min(n, taxiiMaxPageSize)
+		}
+		if v := query.Get("next"); v != "" {
+			after, id, ok := strings.Cut(v, "|")
+			t, err := time.Parse(time.RFC3339Nano, after)
+			if !ok || err != nil {
+				writeTAXIIError(w, http.StatusBadRequest, "invalid next")
+				return
+			}
+			q.afterTime, q.afterID = t, id
+		}
+		if types := query.Get("match[type]"); types != "" && !strings.Contains(","+types+",", ",vulnerability,") {
+			writeTAXII(w, http.StatusOK, taxiiEnvelope{Objects: []STIXVulnerability{}})
+			return
+		}
+
+		objects, added, err := getSTIXObjects(db, q)
+		if err != nil {
+			log.Printf("Failed to load STIX objects: %v\n", err)
+			writeTAXIIError(w, http.StatusInternalServerError, "failed to load objects")
+			return
+		}
+		envelope := taxiiEnvelope{Objects: objects}
+		if len(objects) > 0 {
+			last := added[len(added)-1].UTC().Format(time.RFC3339Nano)
+			w.Header().Set("X-TAXII-Date-Added-First", added[0].UTC().Format(time.RFC3339Nano))
+			w.Header().Set("X-TAXII-Date-Added-Last", last)
+			if len(objects) == q.limit {
+				envelope.More = true
+				envelope.Next = last + "|" + objects[len(objects)-1].Name
+			}
+		}
+		writeTAXII(w, http.StatusOK, envelope)
+	}
+}
+
+func writeTAXII(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", taxiiMediaType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v\n", err)
+	}
+}
+
+func writeTAXIIError(w http.ResponseWriter, status int, message string) {
+	writeTAXII(w, status, map[string]string{"title": message})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultTenant owns everything created without API authentication.
+const defaultTenant = "default"
+
+var apiAuth = flag.Bool("api-auth", false, "require an API token on every endpoint except /status; the token selects the tenant")
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+type tenantKey struct{}
+
+// tenantOf returns the tenant a request acts for.
+func tenantOf(r *http.Request) string {
+	if tenant, ok := r.Context().Value(tenantKey{}).(string); ok {
+		return tenant
+	}
+	return defaultTenant
+}
+
+// withTenant resolves the request's tenant from its bearer token. Without
+// -api-auth every request acts for the default tenant.
+func withTenant(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*apiAuth || r.URL.Path == "/status" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeError(w, http.StatusUnauthorized, "missing API token")
+			return
+		}
+		var tenant string
+		err := db.QueryRow(`SELECT tenant FROM api_tokens WHERE token_hash = $1`, hashToken(token)).Scan(&tenant)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusUnauthorized, "invalid API token")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to look up API token: %v\n", err)
+			writeError(w, http.StatusInternalServerError, "failed to authenticate")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenant)))
+	})
+}
+
+// hashToken returns the stored form of an API token; tokens themselves are
+// only shown once, when created.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func createAPIToken(db *sql.DB, tenant, name string) (string, error) {
+	if !tenantPattern.MatchString(tenant) {
+		return "", fmt.Errorf("invalid tenant %q: use lowercase letters, digits, '_' or '-'", tenant)
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if _, err := db.Exec(`INSERT INTO api_tokens (token_hash, tenant, name) VALUES ($1, $2, $3)`, hashToken(token), tenant, name); err != nil {
+		return "", fmt.Errorf("failed to store API token: %v", err)
+	}
+	return token, nil
+}
+
+// runToken implements the token subcommand:
+//
+//	token create -tenant payments -name ci
+//	token revoke <token>
+func runToken(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: token create|revoke")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("token create", flag.ExitOnError)
+		tenant := fs.String("tenant", defaultTenant, "tenant the token acts for")
+		name := fs.String("name", "", "description of the token's holder")
+		fs.Parse(args[1:])
+
+		token, err := createAPIToken(db, *tenant, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: token revoke <token>")
+		}
+		res, err := db.Exec(`DELETE FROM api_tokens WHERE token_hash = $1`, hashToken(args[1]))
+		if err != nil {
+			return fmt.Errorf("failed to revoke API token: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("unknown API token")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown token command %q", args[0])
+}
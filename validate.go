@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var cveIDPattern = regexp.MustCompile(`^CVE-\d{4}-\d{4,}$`)
+
+// cveIDDashes maps the dash look-alikes found in hand-written CVE IDs to '-'.
+var cveIDDashes = strings.NewReplacer("\u2010", "-", "\u2011", "-", "\u2012", "-", "\u2013", "-", "\u2014", "-", "\u2212", "-", "_", "-")
+
+// normalizeCVEID returns the canonical form of a CVE ID, so the same CVE
+// joins across tables whatever source it came from: trimmed, upper case, with
+// ASCII dashes and no leading zeros in the sequence number beyond its four
+// digit minimum. ok is false if the result is not a well-formed CVE ID.
+func normalizeCVEID(id string) (string, bool) {
+	id = strings.ToUpper(cveIDDashes.Replace(strings.TrimSpace(id)))
+	if rest, ok := strings.CutPrefix(id, "CVE-"); ok {
+		if year, seq, found := strings.Cut(rest, "-"); found && len(seq) > 4 {
+			trimmed := strings.TrimLeft(seq, "0")
+			if len(trimmed) < 4 {
+				trimmed = strings.Repeat("0", 4-len(trimmed)) + trimmed
+			}
+			id = "CVE-" + year + "-" + trimmed
+		}
+	}
+	return id, cveIDPattern.MatchString(id)
+}
+
+// nvdTimeLayouts are the timestamp formats used by the NVD feeds and API.
+var nvdTimeLayouts = []string{
+	"2006-01-02T15:04Z",
+	time.RFC3339,
+	"2006-01-02T15:04:05.000",
+	"2006-01-02T15:04:05",
+}
+
+// parseNVDTime parses an NVD timestamp. Timestamps without a zone are UTC.
+func parseNVDTime(value string) (time.Time, error) {
+	for _, layout := range nvdTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized timestamp %q", value)
+}
+
+// utcTimestamp renders an NVD or stored timestamp as RFC 3339 in UTC, to the
+// second, or "" if it cannot be parsed.
+func utcTimestamp(value string) string {
+	t, err := parseNVDTime(value)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// utcTimestampSQL returns an SQL expression rendering the timestamptz col
+// like utcTimestamp, whatever the session's time zone.
+func utcTimestampSQL(col string) string {
+	return `to_char(` + col + ` AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS"Z"')`
+}
+
+// normalizeCVEItem canonicalizes the CVE ID of item. Malformed IDs are left
+// as they are for validateCVEItem to quarantine.
+func normalizeCVEItem(item *CVEItem) {
+	if id, ok := normalizeCVEID(item.CVE.CVEDataMeta.ID); ok {
+		item.CVE.CVEDataMeta.ID = id
+	}
+}
+
+// validateCVEItem returns the reasons item should not be inserted, or nil if
+// it is valid.
+func validateCVEItem(item CVEItem) []string {
+	var reasons []string
+
+	if !cveIDPattern.MatchString(item.CVE.CVEDataMeta.ID) {
+		reasons = append(reasons, fmt.Sprintf("malformed CVE ID %q", item.CVE.CVEDataMeta.ID))
+	}
+	if _, err := parseNVDTime(item.PublishedDate); err != nil {
+		reasons = append(reasons, "published date: "+err.Error())
+	}
+	if _, err := parseNVDTime(item.LastModifiedDate); err != nil {
+		reasons = append(reasons, "last modified date: "+err.Error())
+	}
+
+	cvss := item.Impact.BaseMetricV3.CVSSV3
+	if cvss.Version != "" && (cvss.BaseScore < 0 || cvss.BaseScore > 10) {
+		reasons = append(reasons, fmt.Sprintf("CVSS base score %v out of range 0-10", cvss.BaseScore))
+	}
+
+	for _, node := range item.Configurations.Nodes {
+		for _, cpe := range node.CPEMatch {
+			if cpe.CPE23URI == "" {
+				reasons = append(reasons, "empty CPE URI")
+			}
+		}
+		for _, child := range node.Children {
+			for _, cpe := range child.CPEMatch {
+				if cpe.CPE23URI == "" {
+					reasons = append(reasons, "empty CPE URI in child node")
+				}
+			}
+		}
+	}
+
+	return reasons
+}
+
+// quarantineCVEItem stores an invalid record with the reasons it was rejected
+// so it can be inspected instead of being inserted or aborting the run.
+func quarantineCVEItem(tx *sql.Tx, item CVEItem, reasons []string) error {
+	record, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("failed to encode quarantined record: %v", err)
+	}
+	_, err = tx.Exec(`INSERT INTO cve_quarantine (cve_id, reasons, record) VALUES ($1, $2, $3)`,
+		item.CVE.CVEDataMeta.ID, strings.Join(reasons, "; "), record)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine CVE ID %s: %v", item.CVE.CVEDataMeta.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+)
+
+// contentHashSQL returns an SQL expression hashing the NVD-derived rows
+// stored for the CVE in cveCol. Enrichment columns such as risk_score are
+// left out, since they change without the CVE being re-ingested.
+func contentHashSQL(cveCol string) string {
+	return `encode(sha256(convert_to(concat_ws('|',
+		COALESCE((SELECT json_build_array(description, ` + utcTimestampSQL("published_date") + `, ` + utcTimestampSQL("last_modified_date") + `)::text
+				  FROM cve_data1 WHERE cve_id = ` + cveCol + `), ''),
+		COALESCE((SELECT json_build_array(cvss_version, cvss_vector_string, cvss_base_score, cvss_base_severity)::text
+				  FROM impact_data WHERE cve_id = ` + cveCol + `), ''),
+		COALESCE((SELECT json_agg(json_build_array(cpe_uri, vulnerable, version_start, version_end, config, node_id, parent_node_id, match_criteria_id,
+												   version_start_raw, version_end_raw, version_start_excluding, version_end_including)
+						 ORDER BY cpe_uri, version_start, version_end, version_start_raw, version_end_raw, version_start_excluding, version_end_including)::text
+				  FROM cpe_data WHERE cve_id = ` + cveCol + `), ''),
+		COALESCE((SELECT json_agg(cwe_id ORDER BY cwe_id)::text FROM cve_cwe WHERE cve_id = ` + cveCol + `), ''),
+		COALESCE((SELECT json_agg(json_build_array(vendor, advisory_id, url) ORDER BY url)::text
+				  FROM advisories WHERE cve_id = ` + cveCol + `), '')
+	), 'UTF8')), 'hex')`
+}
+
+// storeContentHash records the hash of the CVE's rows as they were just
+// written, for the verify command to check against. A CVE whose hash changed
+// moves to the end of the change feed, or, while a year is staged, when the
+// year is merged.
+func storeContentHash(tx *sql.Tx, cveID string) error {
+	res, err := tx.Exec(`UPDATE cve_data1 c SET content_hash = h.hash
+						 FROM (SELECT `+contentHashSQL("$1")+` AS hash) h
+						 WHERE c.cve_id = $1 AND c.content_hash IS DISTINCT FROM h.hash`, cveID)
+	if err != nil {
+		return fmt.Errorf("failed to hash CVE ID %s: %v", cveID, err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 && !stagingActive.Load() {
+		return advanceChangeSeq(tx, cveID)
+	}
+	return nil
+}
+
+// tamperedCVEs returns the CVEs whose stored rows no longer match their
+// content hash, and the number of CVEs stored before hashes were recorded.
+func tamperedCVEs(db *sql.DB) ([]string, int, error) {
+	var unhashed int
+	if err := db.QueryRow(`SELECT count(*) FROM cve_data1 WHERE content_hash IS NULL`).Scan(&unhashed); err != nil {
+		return nil, 0, fmt.Errorf("failed to count unhashed CVEs: %v", err)
+	}
+	rows, err := db.Query(`SELECT c.cve_id FROM cve_data1 c
+						   WHERE c.content_hash IS NOT NULL AND c.content_hash <> ` + contentHashSQL("c.cve_id") + `
+						   ORDER BY c.cve_id`)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to hash stored CVEs: %v", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, 0, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, unhashed, rows.Err()
+}
+
+// recordHashSQL returns the SQL expression hashing a cve_history record in
+// its stored form, the text Postgres renders for the JSONB value. That form
+// does not depend on the CVEItem struct, so records written by older versions
+// stay verifiable.
+func recordHashSQL(recordCol string) string {
+	return `encode(sha256(convert_to(` + recordCol + `::text, 'UTF8')), 'hex')`
+}
+
+// tamperedVersions lists the cve_history rows whose record no longer
+// hashes to record_hash.
+func tamperedVersions(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT id, cve_id FROM cve_history
+						   WHERE record_hash IS DISTINCT FROM ` + recordHashSQL("record") + `
+						   ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CVE history: %v", err)
+	}
+	defer rows.Close()
+	var tampered []string
+	for rows.Next() {
+		var id int64
+		var cveID string
+		if err := rows.Scan(&id, &cveID); err != nil {
+			return nil, err
+		}
+		tampered = append(tampered, fmt.Sprintf("%s (cve_history id %d)", cveID, id))
+	}
+	return tampered, rows.Err()
+}
+
+// fetchCVEItem fetches the canonical record of a CVE from the NVD API.
+func fetchCVEItem(cveID string) (CVEItem, error) {
+	var page nvdCVEResponse
+	if err := nvdGet(nvdCVEAPIURL, url.Values{"cveId": {cveID}}, &page); err != nil {
+		return CVEItem{}, err
+	}
+	if len(page.Vulnerabilities) == 0 {
+		return CVEItem{}, fmt.Errorf("NVD no longer publishes %s", cveID)
+	}
+	var v nvdVulnerability
+	if err := json.Unmarshal(page.Vulnerabilities[0], &v); err != nil {
+		return CVEItem{}, fmt.Errorf("failed to decode %s: %v", cveID, err)
+	}
+	return v.CVE.toCVEItem(), nil
+}
+
+// repairCVE re-fetches the canonical record from the NVD API and ingests it
+// again, which rewrites the CVE's rows and their hash.
+func repairCVE(db *sql.DB, cveID string) error {
+	item, err := fetchCVEItem(cveID)
+	if err != nil {
+		return err
+	}
+	return insertBatch(db, []CVEItem{item}, 0)
+}
+
+// runVerify implements the verify subcommand. It reports CVEs whose stored
+// rows were corrupted or edited by hand since they were ingested, and with
+// -repair restores them from NVD.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "re-fetch mismatching CVEs from the NVD API and store them again")
+	fs.Parse(args)
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tampered, unhashed, err := tamperedCVEs(db)
+	if err != nil {
+		return err
+	}
+	for _, id := range tampered {
+		fmt.Printf("%s: stored rows do not match the content hash\n", id)
+	}
+	versions, err := tamperedVersions(db)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		fmt.Printf("%s: history record does not match the content hash\n", v)
+	}
+	if unhashed > 0 {
+		fmt.Printf("%d CVEs were stored before content hashes were recorded and were not checked\n", unhashed)
+	}
+
+	failed := len(versions)
+	var run *syncRun
+	var repairErr error
+	if *repair && len(tampered) > 0 {
+		run = beginSyncRun(db, "repair", datasetNVD, sourceNVDAPI)
+	}
+	for _, id := range tampered {
+		if !*repair {
+			failed++
+			continue
+		}
+		if err := repairCVE(db, id); err != nil {
+			log.Printf("Failed to repair %s: %v\n", id, err)
+			repairErr = err
+			failed++
+			continue
+		}
+		log.Printf("Repaired %s\n", id)
+	}
+	run.finish(db, repairErr)
+	if failed > 0 {
+		return fmt.Errorf("%d records failed verification", failed)
+	}
+	return nil
+}
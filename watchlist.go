@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// WatchlistEntry is a product prefix a tenant wants to be told about.
+type WatchlistEntry struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	CPEPrefix string `json:"cpe_prefix"`
+}
+
+func listWatchlist(db *sql.DB, tenant string) ([]WatchlistEntry, error) {
+	rows, err := db.Query(`SELECT id, COALESCE(name, ''), cpe_prefix FROM watchlist WHERE tenant = $1 ORDER BY id`, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list watchlist: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []WatchlistEntry{}
+	for rows.Next() {
+		var e WatchlistEntry
+		if err := rows.Scan(&e.ID, &e.Name, &e.CPEPrefix); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func addWatchlistEntry(db *sql.DB, tenant string, e WatchlistEntry) (*WatchlistEntry, error) {
+	err := db.QueryRow(`INSERT INTO watchlist (tenant, name, cpe_prefix) VALUES ($1, $2, $3) RETURNING id`,
+		tenant, e.Name, e.CPEPrefix).Scan(&e.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add watchlist entry: %v", err)
+	}
+	return &e, nil
+}
+
+// deleteWatchlistEntry removes one of a tenant's entries. It returns
+// sql.ErrNoRows if the tenant has no such entry.
+func deleteWatchlistEntry(db *sql.DB, tenant string, id int) error {
+	res, err := db.Exec(`DELETE FROM watchlist WHERE tenant = $1 AND id = $2`, tenant, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete watchlist entry %d: %v", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}